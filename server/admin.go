@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/isaackoz/tronline/identity"
+	"github.com/isaackoz/tronline/signaling"
+	"github.com/isaackoz/tronline/turnserver"
+)
+
+// adminStats is what GET /admin/stats answers
+type adminStats struct {
+	ICEProviders []signaling.ICEProviderStats `json:"iceProviders"`
+	// active allocations of the built-in TURN server, omitted when it's disabled
+	TurnAllocations *int `json:"turnAllocations,omitempty"`
+}
+
+// registers the operator endpoints, they need token as a bearer token:
+//
+//	GET /admin/stats    counters of the ice providers and the turn server, see adminStats
+func handleAdmin(mux *http.ServeMux, token string, iceProvider *signaling.ICEProviderChain, turnServer *turnserver.Server) {
+	mux.HandleFunc("GET /admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(identity.BearerToken(r)), []byte(token)) != 1 {
+			http.Error(w, "admin token required", http.StatusUnauthorized)
+			return
+		}
+		stats := adminStats{ICEProviders: iceProvider.Stats()}
+		if turnServer != nil {
+			allocations := turnServer.AllocationCount()
+			stats.TurnAllocations = &allocations
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			slog.Debug("encode admin stats", "error", err)
+		}
+	})
+}
@@ -0,0 +1,171 @@
+// Package arena loads the maps matches are played on. Arenas are JSON files describing the
+// size, walls, obstacles and spawns of a map and turn into game.Settings for a player count
+package arena
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+
+	"github.com/isaackoz/tronline/game"
+)
+
+// Segment is a horizontal or vertical line of wall cells, both ends included
+type Segment struct {
+	From game.Point `json:"from"`
+	To   game.Point `json:"to"`
+}
+
+// Rect is a filled block of wall cells
+type Rect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+type Arena struct {
+	// unique id, lowercase letters, digits and dashes
+	Name string `json:"name"`
+	// shown to players
+	Title  string `json:"title"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// cycles leaving the arena come back in on the opposite edge
+	Wrap      bool      `json:"wrap,omitempty"`
+	Walls     []Segment `json:"walls,omitempty"`
+	Obstacles []Rect    `json:"obstacles,omitempty"`
+	// spawns by player count. Counts without spawns use game.DefaultSpawns
+	Spawns map[int][]game.Spawn `json:"spawns,omitempty"`
+}
+
+var validName = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+
+// Parse decodes and validates an arena
+func Parse(data []byte) (*Arena, error) {
+	return Load(bytes.NewReader(data))
+}
+
+// Load decodes and validates an arena
+func Load(r io.Reader) (*Arena, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var a Arena
+	if err := dec.Decode(&a); err != nil {
+		return nil, fmt.Errorf("decode arena: %w", err)
+	}
+	if err := a.Validate(); err != nil {
+		return nil, fmt.Errorf("arena %q: %w", a.Name, err)
+	}
+	return &a, nil
+}
+
+func (a *Arena) Validate() error {
+	if !validName.MatchString(a.Name) {
+		return errors.New("name must be 1-32 lowercase letters, digits or dashes")
+	}
+	if a.Width < game.MinSize || a.Height < game.MinSize || a.Width > game.MaxSize || a.Height > game.MaxSize {
+		return fmt.Errorf("arena must be between %dx%d and %dx%d, got %dx%d", game.MinSize, game.MinSize, game.MaxSize, game.MaxSize, a.Width, a.Height)
+	}
+	for i, wall := range a.Walls {
+		if wall.From.X != wall.To.X && wall.From.Y != wall.To.Y {
+			return fmt.Errorf("wall %d is not horizontal or vertical", i)
+		}
+		if !a.inBounds(wall.From) || !a.inBounds(wall.To) {
+			return fmt.Errorf("wall %d is outside the arena", i)
+		}
+	}
+	for i, rect := range a.Obstacles {
+		if rect.Width <= 0 || rect.Height <= 0 {
+			return fmt.Errorf("obstacle %d is empty", i)
+		}
+		if !a.inBounds(game.Point{X: rect.X, Y: rect.Y}) || !a.inBounds(game.Point{X: rect.X + rect.Width - 1, Y: rect.Y + rect.Height - 1}) {
+			return fmt.Errorf("obstacle %d is outside the arena", i)
+		}
+	}
+	for players := range a.Spawns {
+		if _, err := a.Settings(players); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Arena) inBounds(p game.Point) bool {
+	return p.X >= 0 && p.Y >= 0 && p.X < a.Width && p.Y < a.Height
+}
+
+// Cells returns every wall cell of the arena, ordered by row then column
+func (a *Arena) Cells() []game.Point {
+	seen := make(map[game.Point]bool)
+	add := func(p game.Point) {
+		seen[p] = true
+	}
+	for _, wall := range a.Walls {
+		dx, dy := sign(wall.To.X-wall.From.X), sign(wall.To.Y-wall.From.Y)
+		for p := wall.From; ; p = (game.Point{X: p.X + dx, Y: p.Y + dy}) {
+			add(p)
+			if p == wall.To {
+				break
+			}
+		}
+	}
+	for _, rect := range a.Obstacles {
+		for y := rect.Y; y < rect.Y+rect.Height; y++ {
+			for x := rect.X; x < rect.X+rect.Width; x++ {
+				add(game.Point{X: x, Y: y})
+			}
+		}
+	}
+
+	cells := make([]game.Point, 0, len(seen))
+	for p := range seen {
+		cells = append(cells, p)
+	}
+	// settings must come out the same every time, map order isn't
+	slices.SortFunc(cells, func(a game.Point, b game.Point) int {
+		if a.Y != b.Y {
+			return a.Y - b.Y
+		}
+		return a.X - b.X
+	})
+	return cells
+}
+
+// Settings returns the settings of a match for players on the arena. Every cycle must be able
+// to make its first move
+func (a *Arena) Settings(players int) (game.Settings, error) {
+	settings := game.Settings{
+		Width:   a.Width,
+		Height:  a.Height,
+		Players: players,
+		Spawns:  a.Spawns[players],
+		Walls:   a.Cells(),
+		Wrap:    a.Wrap,
+	}
+	state, err := game.New(settings)
+	if err != nil {
+		return game.Settings{}, fmt.Errorf("%d players: %w", players, err)
+	}
+	for i, cycle := range state.Cycles {
+		if !state.Free(state.Next(cycle.Pos, cycle.Dir)) {
+			return game.Settings{}, fmt.Errorf("%d players: spawn %d crashes on its first move", players, i)
+		}
+	}
+	return settings, nil
+}
+
+func sign(n int) int {
+	switch {
+	case n > 0:
+		return 1
+	case n < 0:
+		return -1
+	default:
+		return 0
+	}
+}
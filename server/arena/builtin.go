@@ -0,0 +1,65 @@
+package arena
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+)
+
+// Default is the arena of rooms that don't pick one
+const Default = "classic"
+
+//go:embed arenas/*.json
+var builtinFS embed.FS
+
+var builtins = mustLoadBuiltins()
+
+// the arenas ship with the binary, a broken one is a bug
+func mustLoadBuiltins() map[string]*Arena {
+	arenas := make(map[string]*Arena)
+	err := fs.WalkDir(builtinFS, "arenas", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := builtinFS.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		a, err := Parse(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if a.Name+".json" != d.Name() {
+			return fmt.Errorf("%s: file name doesn't match arena name %q", path, a.Name)
+		}
+		arenas[a.Name] = a
+		return nil
+	})
+	if err != nil {
+		panic("load built-in arenas: " + err.Error())
+	}
+	return arenas
+}
+
+// Builtin returns the built-in arena with the name. Empty is the default arena
+func Builtin(name string) (*Arena, bool) {
+	if name == "" {
+		name = Default
+	}
+	a, ok := builtins[name]
+	return a, ok
+}
+
+// Builtins returns every built-in arena ordered by name
+func Builtins() []*Arena {
+	arenas := make([]*Arena, 0, len(builtins))
+	for _, a := range builtins {
+		arenas = append(arenas, a)
+	}
+	slices.SortFunc(arenas, func(a *Arena, b *Arena) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return arenas
+}
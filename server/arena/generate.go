@@ -0,0 +1,200 @@
+package arena
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/isaackoz/tronline/game"
+)
+
+// Generated is the arena name of rooms playing a procedurally generated arena. The arena is
+// created from the room's seed
+const Generated = "generated"
+
+const (
+	// attempts at placing obstacles before giving up on a seed and using fewer obstacles
+	generateAttempts = 8
+	// every spawn must reach at least this share of the free cells
+	minReachable = 0.5
+	// cells around a spawn and ahead of it that stay clear
+	spawnClearance = 4
+	spawnLane      = 8
+)
+
+// Generate creates a symmetric arena from a seed. Obstacles are placed in the top left quarter
+// and mirrored into the others, so every spawn sees the same arena. Every spawn is guaranteed
+// to reach the others and most of the free cells. The same seed and size always give the same arena
+//
+// Clients reproduce it with the same algorithm: random numbers come from mulberry32 seeded with
+// seed, and are drawn in exactly the order of this function
+func Generate(seed uint32, width int, height int) (*Arena, error) {
+	if width < game.MinSize || height < game.MinSize || width > game.MaxSize || height > game.MaxSize {
+		return nil, fmt.Errorf("arena must be between %dx%d and %dx%d, got %dx%d", game.MinSize, game.MinSize, game.MaxSize, game.MaxSize, width, height)
+	}
+	rng := &mulberry32{state: seed}
+	a := &Arena{
+		Name:   Generated + "-" + strconv.FormatUint(uint64(seed), 10),
+		Title:  "Generated #" + strconv.FormatUint(uint64(seed), 10),
+		Width:  width,
+		Height: height,
+		Wrap:   rng.intn(4) == 0,
+		Spawns: mirroredSpawns(width, height),
+	}
+
+	qw, qh := width/2, height/2
+	maxSize := max(2, min(qw, qh)/4)
+	for obstacles := 2 + rng.intn(4); obstacles > 0; obstacles-- {
+		for attempt := 0; attempt < generateAttempts; attempt++ {
+			w, h := 1+rng.intn(maxSize), 1+rng.intn(maxSize)
+			rect := Rect{X: rng.intn(qw - w + 1), Y: rng.intn(qh - h + 1), Width: w, Height: h}
+			if a.blocksSpawn(rect) {
+				continue
+			}
+			before := len(a.Obstacles)
+			a.Obstacles = append(a.Obstacles, mirror(rect, width, height)...)
+			if a.fair() {
+				break
+			}
+			a.Obstacles = a.Obstacles[:before]
+		}
+	}
+	if err := a.Validate(); err != nil {
+		return nil, fmt.Errorf("generated arena %d: %w", seed, err)
+	}
+	return a, nil
+}
+
+// Resolve returns the arena of a room: a built-in arena, or the generated arena of the seed
+func Resolve(name string, seed uint32) (*Arena, error) {
+	if name == Generated {
+		return Generate(seed, generatedSize, generatedSize)
+	}
+	a, ok := Builtin(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown arena %q", name)
+	}
+	return a, nil
+}
+
+// size of the generated arenas of rooms
+const generatedSize = 64
+
+// spawns for 2 and 4 players, mirrored like the obstacles
+func mirroredSpawns(width int, height int) map[int][]game.Spawn {
+	x, y := width/4, height/4
+	return map[int][]game.Spawn{
+		2: {
+			{Pos: game.Point{X: x, Y: height / 2}, Dir: game.Right},
+			{Pos: game.Point{X: width - 1 - x, Y: height / 2}, Dir: game.Left},
+		},
+		4: {
+			{Pos: game.Point{X: x, Y: y}, Dir: game.Right},
+			{Pos: game.Point{X: width - 1 - x, Y: y}, Dir: game.Left},
+			{Pos: game.Point{X: x, Y: height - 1 - y}, Dir: game.Right},
+			{Pos: game.Point{X: width - 1 - x, Y: height - 1 - y}, Dir: game.Left},
+		},
+	}
+}
+
+// the rect and its mirror images across the vertical and horizontal center lines
+func mirror(rect Rect, width int, height int) []Rect {
+	mx := width - rect.X - rect.Width
+	my := height - rect.Y - rect.Height
+	return []Rect{
+		rect,
+		{X: mx, Y: rect.Y, Width: rect.Width, Height: rect.Height},
+		{X: rect.X, Y: my, Width: rect.Width, Height: rect.Height},
+		{X: mx, Y: my, Width: rect.Width, Height: rect.Height},
+	}
+}
+
+// blocksSpawn reports whether a rect, or one of its mirror images, is too close to a spawn
+// or in the lane ahead of it
+func (a *Arena) blocksSpawn(rect Rect) bool {
+	for _, r := range mirror(rect, a.Width, a.Height) {
+		for _, spawns := range a.Spawns {
+			for _, spawn := range spawns {
+				dx, dy := spawn.Dir.Delta()
+				for i := -spawnClearance; i <= spawnLane; i++ {
+					lane := game.Point{X: spawn.Pos.X + i*dx, Y: spawn.Pos.Y + i*dy}
+					if r.near(lane, 0) {
+						return true
+					}
+				}
+				if r.near(spawn.Pos, spawnClearance) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// near reports whether p is within margin cells of the rect
+func (r Rect) near(p game.Point, margin int) bool {
+	return p.X >= r.X-margin && p.X < r.X+r.Width+margin && p.Y >= r.Y-margin && p.Y < r.Y+r.Height+margin
+}
+
+// fair reports whether, for every player count, each spawn can reach at least minReachable
+// of the free cells. More than half for everybody means they're all connected to each other too
+func (a *Arena) fair() bool {
+	for players := range a.Spawns {
+		settings, err := a.Settings(players)
+		if err != nil {
+			return false
+		}
+		state, err := game.New(settings)
+		if err != nil {
+			return false
+		}
+		free := state.Width*state.Height - len(settings.Walls) - players
+		for _, cycle := range state.Cycles {
+			if float64(reachable(state, cycle.Pos)) < minReachable*float64(free) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// reachable counts the free cells connected to p. Spawns are trails already, they're stepped
+// over so spawns count as connected to each other but not as free cells
+func reachable(state *game.State, from game.Point) int {
+	seen := map[game.Point]bool{from: true}
+	queue := []game.Point{from}
+	count := 0
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		for _, dir := range []game.Direction{game.Up, game.Right, game.Down, game.Left} {
+			next := state.Next(p, dir)
+			if seen[next] || !state.InBounds(next) || state.Cell(next) == game.CellWall {
+				continue
+			}
+			seen[next] = true
+			if state.Free(next) {
+				count++
+			}
+			queue = append(queue, next)
+		}
+	}
+	return count
+}
+
+// mulberry32 is a tiny PRNG that's easy to reproduce in the browser with Math.imul
+type mulberry32 struct {
+	state uint32
+}
+
+func (m *mulberry32) next() uint32 {
+	m.state += 0x6D2B79F5
+	z := m.state
+	z = (z ^ (z >> 15)) * (z | 1)
+	z ^= z + (z^(z>>7))*(z|61)
+	return z ^ (z >> 14)
+}
+
+// intn returns a number in [0, n)
+func (m *mulberry32) intn(n int) int {
+	return int(m.next() % uint32(n))
+}
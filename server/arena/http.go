@@ -0,0 +1,36 @@
+package arena
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// HandleArenas registers the endpoint listing the built-in arenas hosts can pick from
+func HandleArenas(mux *http.ServeMux) {
+	mux.HandleFunc("GET /arenas", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]any{"arenas": Builtins()}); err != nil {
+			slog.Debug("encode arenas", "error", err)
+		}
+	})
+
+	// generated arenas for clients that would rather not reproduce the generator
+	mux.HandleFunc("GET /arenas/generated/{seed}", func(w http.ResponseWriter, r *http.Request) {
+		seed, err := strconv.ParseUint(r.PathValue("seed"), 10, 32)
+		if err != nil {
+			http.Error(w, "seed must be a 32 bit unsigned integer", http.StatusBadRequest)
+			return
+		}
+		a, err := Generate(uint32(seed), generatedSize, generatedSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(a); err != nil {
+			slog.Debug("encode generated arena", "error", err)
+		}
+	})
+}
@@ -0,0 +1,195 @@
+// Package bot plays lightcycles. Bots only see a board of blocked cells and the cycles on it,
+// the same information a client gets from the state messages of a server hosted match
+package bot
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/isaackoz/tronline/game"
+)
+
+// Difficulty picks the strategy of a bot
+type Difficulty string
+
+const (
+	// turns randomly, only avoiding cells that crash it on the next tick
+	DifficultyEasy Difficulty = "easy"
+	// hugs walls and trails
+	DifficultyMedium Difficulty = "medium"
+	// flood fills the board and goes where it owns the most territory (voronoi)
+	DifficultyHard Difficulty = "hard"
+)
+
+// ParseDifficulty parses the difficulty a host asked for. Empty means medium
+func ParseDifficulty(s string) (Difficulty, error) {
+	switch Difficulty(s) {
+	case "", DifficultyMedium:
+		return DifficultyMedium, nil
+	case DifficultyEasy:
+		return DifficultyEasy, nil
+	case DifficultyHard:
+		return DifficultyHard, nil
+	default:
+		return "", fmt.Errorf("invalid bot difficulty %q", s)
+	}
+}
+
+// ThinkTime is how long a bot of the difficulty may take to pick a turn
+func (d Difficulty) ThinkTime() time.Duration {
+	switch d {
+	case DifficultyHard:
+		return 25 * time.Millisecond
+	case DifficultyMedium:
+		return 10 * time.Millisecond
+	default:
+		return 5 * time.Millisecond
+	}
+}
+
+// Bot picks the turns of a cycle
+type Bot interface {
+	Difficulty() Difficulty
+	// Think picks the turn of player me for the next tick. It returns its best guess
+	// so far once ctx is done
+	Think(ctx context.Context, board *Board, me int) game.Turn
+}
+
+// New creates a bot. seed makes the random choices of the bot repeatable
+func New(difficulty Difficulty, seed uint64) Bot {
+	switch difficulty {
+	case DifficultyHard:
+		return &territoryBot{}
+	case DifficultyMedium:
+		return &wallFollower{}
+	default:
+		return newRandomSafe(seed)
+	}
+}
+
+// Board is what a bot knows about the arena
+type Board struct {
+	Width  int
+	Height int
+	Wrap   bool
+	Cycles []game.Cycle
+	// pickups lying in the arena, empty when power-ups are off
+	PowerUps []game.PowerUp
+	blocked  []bool
+	// blocked cells that are trails, shielded cycles drive through them
+	trails []bool
+}
+
+func NewBoard(width int, height int) *Board {
+	return &Board{
+		Width:   width,
+		Height:  height,
+		blocked: make([]bool, width*height),
+		trails:  make([]bool, width*height),
+	}
+}
+
+// BoardFromState creates the board of a simulation the bot has full access to, i.e. a bot
+// the server runs inside a match
+func BoardFromState(state *game.State) *Board {
+	b := NewBoard(state.Width, state.Height)
+	b.Wrap = state.Wrap
+	b.Cycles = state.Cycles
+	b.PowerUps = state.PowerUps
+	for y := 0; y < state.Height; y++ {
+		for x := 0; x < state.Width; x++ {
+			p := game.Point{X: x, Y: y}
+			switch cell := state.Cell(p); {
+			case cell == game.CellWall:
+				b.Block(p)
+			case cell != game.CellEmpty:
+				b.BlockTrail(p)
+			}
+		}
+	}
+	return b
+}
+
+// Block marks a cell as a wall
+func (b *Board) Block(p game.Point) {
+	if b.inBounds(p) {
+		b.blocked[p.Y*b.Width+p.X] = true
+	}
+}
+
+// BlockTrail marks a cell as a trail
+func (b *Board) BlockTrail(p game.Point) {
+	if b.inBounds(p) {
+		b.blocked[p.Y*b.Width+p.X] = true
+		b.trails[p.Y*b.Width+p.X] = true
+	}
+}
+
+// PowerUpAt reports whether a pickup lies at p
+func (b *Board) PowerUpAt(p game.Point) bool {
+	for _, powerUp := range b.PowerUps {
+		if powerUp.Pos == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the cell a cycle at p heading in d moves into
+func (b *Board) Next(p game.Point, d game.Direction) game.Point {
+	next := p.Add(d)
+	if b.Wrap {
+		next.X = (next.X + b.Width) % b.Width
+		next.Y = (next.Y + b.Height) % b.Height
+	}
+	return next
+}
+
+// Free reports whether a cycle can move into p
+func (b *Board) Free(p game.Point) bool {
+	return b.inBounds(p) && !b.blocked[p.Y*b.Width+p.X]
+}
+
+func (b *Board) inBounds(p game.Point) bool {
+	return p.X >= 0 && p.Y >= 0 && p.X < b.Width && p.Y < b.Height
+}
+
+// a turn and where it takes the cycle
+type move struct {
+	turn game.Turn
+	to   game.Point
+}
+
+var turns = []game.Turn{game.TurnNone, game.TurnLeft, game.TurnRight}
+
+// moves returns the turns of player me that don't crash into a wall or trail on the next tick.
+// A shielded cycle can drive through trails
+func (b *Board) moves(me int) []move {
+	cycle := b.Cycles[me]
+	var moves []move
+	for _, turn := range turns {
+		to := b.Next(cycle.Pos, cycle.Dir.Apply(turn))
+		if b.Free(to) || cycle.Shield > 0 && b.inBounds(to) && b.trails[to.Y*b.Width+to.X] {
+			moves = append(moves, move{turn: turn, to: to})
+		}
+	}
+	return moves
+}
+
+// contested reports whether another living cycle can move into p on the next tick, risking a head-on
+func (b *Board) contested(p game.Point, me int) bool {
+	for i, cycle := range b.Cycles {
+		if i == me || !cycle.Alive {
+			continue
+		}
+		for _, turn := range turns {
+			if b.Next(cycle.Pos, cycle.Dir.Apply(turn)) == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var neighbours = []game.Direction{game.Up, game.Right, game.Down, game.Left}
@@ -0,0 +1,33 @@
+package bot
+
+import (
+	"context"
+	"math/rand/v2"
+
+	"github.com/isaackoz/tronline/game"
+)
+
+// randomSafe turns at random but never straight into a wall or trail
+type randomSafe struct {
+	rng *rand.Rand
+}
+
+func newRandomSafe(seed uint64) *randomSafe {
+	return &randomSafe{rng: rand.New(rand.NewPCG(seed, seed))}
+}
+
+func (b *randomSafe) Difficulty() Difficulty {
+	return DifficultyEasy
+}
+
+func (b *randomSafe) Think(ctx context.Context, board *Board, me int) game.Turn {
+	moves := board.moves(me)
+	if len(moves) == 0 {
+		return game.TurnNone
+	}
+	// mostly keep going straight, a bot that turns every tick just spirals
+	if moves[0].turn == game.TurnNone && b.rng.IntN(4) > 0 {
+		return game.TurnNone
+	}
+	return moves[b.rng.IntN(len(moves))].turn
+}
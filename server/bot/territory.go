@@ -0,0 +1,122 @@
+package bot
+
+import (
+	"context"
+	"math"
+
+	"github.com/isaackoz/tronline/game"
+)
+
+// territoryBot flood fills the board from every cycle at once and picks the move that leaves
+// it the most cells it reaches before anybody else (a voronoi partition of the board)
+type territoryBot struct {
+	dist  []int32
+	owner []int8
+	queue []game.Point
+}
+
+func (b *territoryBot) Difficulty() Difficulty {
+	return DifficultyHard
+}
+
+func (b *territoryBot) Think(ctx context.Context, board *Board, me int) game.Turn {
+	moves := board.moves(me)
+	if len(moves) == 0 {
+		return game.TurnNone
+	}
+	best, bestScore := moves[0].turn, math.MinInt
+	for _, m := range moves {
+		score, ok := b.score(ctx, board, me, m.to)
+		// a partial fill isn't comparable to complete ones, keep the best move scored so far
+		if !ok {
+			break
+		}
+		if board.PowerUpAt(m.to) {
+			score += pickupBonus
+		}
+		// a head-on is a draw at best
+		if board.contested(m.to, me) {
+			score -= board.Width * board.Height
+		}
+		if score > bestScore {
+			best, bestScore = m.turn, score
+		}
+	}
+	return best
+}
+
+// cells of territory a pickup is worth
+const pickupBonus = 8
+
+const (
+	unowned = -1
+	// reached by several cycles on the same tick
+	shared = -2
+)
+
+// score is the territory of player me after moving to from minus the largest territory
+// of anybody else. ok is false when ctx ran out before the board was filled
+func (b *territoryBot) score(ctx context.Context, board *Board, me int, from game.Point) (score int, ok bool) {
+	cells := board.Width * board.Height
+	if len(b.dist) != cells {
+		b.dist = make([]int32, cells)
+		b.owner = make([]int8, cells)
+	}
+	for i := range b.dist {
+		b.dist[i] = math.MaxInt32
+		b.owner[i] = unowned
+	}
+	b.queue = b.queue[:0]
+
+	index := func(p game.Point) int { return p.Y*board.Width + p.X }
+	// we're a tick ahead of the others, their heads are one step behind. They go in the
+	// queue first so it stays in distance order
+	for i, cycle := range board.Cycles {
+		if i == me || !cycle.Alive {
+			continue
+		}
+		b.queue = append(b.queue, cycle.Pos)
+		b.dist[index(cycle.Pos)] = 0
+		b.owner[index(cycle.Pos)] = int8(i)
+	}
+	b.queue = append(b.queue, from)
+	b.dist[index(from)] = 1
+	b.owner[index(from)] = int8(me)
+
+	territory := make([]int, len(board.Cycles))
+	for n := 0; n < len(b.queue); n++ {
+		// the board can be large, don't blow the think time
+		if n%1024 == 0 && ctx.Err() != nil {
+			return 0, false
+		}
+		p := b.queue[n]
+		i := index(p)
+		owner := b.owner[i]
+		if owner >= 0 {
+			territory[owner]++
+		}
+		for _, dir := range neighbours {
+			next := board.Next(p, dir)
+			if !board.Free(next) {
+				continue
+			}
+			j := index(next)
+			switch {
+			case b.dist[j] == math.MaxInt32:
+				b.dist[j] = b.dist[i] + 1
+				b.owner[j] = owner
+				b.queue = append(b.queue, next)
+			case b.dist[j] == b.dist[i]+1 && b.owner[j] != owner:
+				b.owner[j] = shared
+			}
+		}
+	}
+
+	others := 0
+	for i, cells := range territory {
+		if i != me {
+			others = max(others, cells)
+		}
+	}
+	return territory[me] - others, true
+}
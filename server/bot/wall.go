@@ -0,0 +1,43 @@
+package bot
+
+import (
+	"context"
+
+	"github.com/isaackoz/tronline/game"
+)
+
+// wallFollower keeps as close to walls and trails as it can, which packs its own trail
+// tightly and leaves it room for longer
+type wallFollower struct{}
+
+func (b *wallFollower) Difficulty() Difficulty {
+	return DifficultyMedium
+}
+
+func (b *wallFollower) Think(ctx context.Context, board *Board, me int) game.Turn {
+	best, bestScore := game.TurnNone, -1
+	for _, m := range board.moves(me) {
+		score := 0
+		for _, dir := range neighbours {
+			if !board.Free(board.Next(m.to, dir)) {
+				score++
+			}
+		}
+		// a dead end is never worth it
+		if score == len(neighbours) {
+			score = 0
+		}
+		// pickups break ties
+		if board.PowerUpAt(m.to) {
+			score++
+		}
+		if board.contested(m.to, me) {
+			score = 0
+		}
+		// moves come straight first, so ties keep going straight
+		if score > bestScore {
+			best, bestScore = m.turn, score
+		}
+	}
+	return best
+}
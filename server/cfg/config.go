@@ -4,7 +4,10 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/sethvargo/go-envconfig"
@@ -17,6 +20,92 @@ type envConfig struct {
 	Production string `env:"ENVIRONMENT"`
 	// Server address
 	Addr string `env:"SERVER_ADDR" default:":8080"`
+	// Cloudflare TURN key id. If empty, only STUN servers are handed out to clients
+	TurnKeyID string `env:"CLOUDFLARE_TURN_KEY_ID"`
+	// Cloudflare TURN API token for the key above
+	TurnAPIToken string `env:"CLOUDFLARE_TURN_API_TOKEN"`
+	// lifetime of generated TURN credentials in seconds. Defaults to 86400 (24h)
+	TurnTTL string `env:"TURN_TTL"`
+	// where ICE servers come from: cloudflare, coturn or static. A comma separated list is tried in order,
+	// i.e. "cloudflare,coturn,static". Defaults to cloudflare if the cloudflare keys are set, otherwise static
+	ICEProvider string `env:"ICE_PROVIDER"`
+	// how long a single provider may take before the next one is tried, i.e. "3s". Defaults to 3s
+	ICEProviderTimeout string `env:"ICE_PROVIDER_TIMEOUT"`
+	// consecutive failures before a provider is skipped for the cooldown. Defaults to 3
+	ICEBreakerThreshold string `env:"ICE_BREAKER_THRESHOLD"`
+	// how long a failing provider is skipped, i.e. "1m". Defaults to 1m
+	ICEBreakerCooldown string `env:"ICE_BREAKER_COOLDOWN"`
+	// comma separated ICE urls for the static provider. Defaults to public STUN servers
+	ICEStaticURLs string `env:"ICE_STATIC_URLS"`
+	// optional credentials for the static provider
+	ICEStaticUsername   string `env:"ICE_STATIC_USERNAME"`
+	ICEStaticCredential string `env:"ICE_STATIC_CREDENTIAL"`
+	// comma separated TURN urls of a coturn server, i.e. "turn:localhost:3478?transport=udp"
+	CoturnURLs string `env:"COTURN_URLS"`
+	// coturn static-auth-secret used for the TURN REST API credentials
+	CoturnSecret string `env:"COTURN_SECRET"`
+	// udp address of the built-in STUN server, i.e. ":3478". Disabled if empty
+	StunAddr string `env:"STUN_ADDR"`
+	// host advertised for the built-in STUN server. Defaults to the host clients connect to
+	StunPublicHost string `env:"STUN_PUBLIC_HOST"`
+	// udp/tcp addresses of the built-in TURN server, i.e. ":3479". The TURN server is disabled if both are empty.
+	// tcp is for clients that can't reach it over udp, the relayed traffic is udp either way
+	TurnUDPAddr string `env:"TURN_UDP_ADDR"`
+	TurnTCPAddr string `env:"TURN_TCP_ADDR"`
+	// TURN realm. Defaults to "tronline"
+	TurnRealm string `env:"TURN_REALM"`
+	// shared secret for the built-in TURN server credentials (coturn's static-auth-secret). Random if empty
+	TurnSecret string `env:"TURN_SECRET"`
+	// public ip of this machine, handed out as the relay address. Required when the TURN server is enabled
+	TurnPublicIP string `env:"TURN_PUBLIC_IP"`
+	// host advertised for the built-in TURN server. Defaults to the host clients connect to
+	TurnPublicHost string `env:"TURN_PUBLIC_HOST"`
+	// relay port range. Defaults to 49152-65535
+	TurnRelayPortMin string `env:"TURN_RELAY_PORT_MIN"`
+	TurnRelayPortMax string `env:"TURN_RELAY_PORT_MAX"`
+	// relayed bytes per second per user. Defaults to 262144 (256KB/s)
+	TurnUserBandwidth string `env:"TURN_USER_BANDWIDTH"`
+	// concurrent allocations per user. Defaults to 4
+	TurnUserAllocations string `env:"TURN_USER_ALLOCATIONS"`
+	// allow relaying game traffic over the websocket when WebRTC fails. Defaults to true
+	RelayEnabled string `env:"RELAY_ENABLED"`
+	// relayed bytes per second per room. Defaults to 65536 (64KB/s)
+	RelayBandwidth string `env:"RELAY_ROOM_BANDWIDTH"`
+	// ticks per second of server hosted matches. Defaults to 20
+	HostedTickRate string `env:"HOSTED_TICK_RATE"`
+	// how many ticks late an input may arrive in a server hosted match and still be
+	// applied by rolling back. Defaults to 4
+	HostedRollbackWindow string `env:"HOSTED_ROLLBACK_WINDOW"`
+	// file players, ratings, results, replays and bans are kept in. Everything is only kept
+	// in memory if empty
+	StorePath string `env:"STORE_PATH"`
+	// directories replays and match results were written to before STORE_PATH. Their files
+	// are imported into the store on start
+	ReplayDir string `env:"REPLAY_DIR"`
+	ResultDir string `env:"RESULT_DIR"`
+	// share of ranked P2P matches re-simulated from the players' input logs even when their
+	// reports agree, 0 to 1. Defaults to 0.1
+	AuditRate string `env:"AUDIT_RATE"`
+	// secret identity tokens are signed with, at least 32 characters. Required with
+	// STORE_PATH, random if everything is kept in memory anyway
+	IdentitySecret string `env:"IDENTITY_SECRET"`
+	// lifetime of identity tokens in seconds, renewed whenever the player asks for its identity.
+	// Defaults to 31536000 (365 days)
+	IdentityTTL string `env:"IDENTITY_TTL"`
+	// OpenID Connect provider players log in with, i.e. "https://accounts.google.com". Logging in
+	// is disabled if empty
+	OIDCIssuer       string `env:"OIDC_ISSUER"`
+	OIDCClientID     string `env:"OIDC_CLIENT_ID"`
+	OIDCClientSecret string `env:"OIDC_CLIENT_SECRET"`
+	// this server's callback as registered at the provider, i.e. "https://api.example.com/auth/callback"
+	OIDCRedirectURL string `env:"OIDC_REDIRECT_URL"`
+	// web app page players are sent back to after logging in. The session is answered as json if empty
+	OIDCAppURL string `env:"OIDC_APP_URL"`
+	// lifetime of the session tokens of logged in players in seconds. Defaults to 2592000 (30 days)
+	SessionTTL string `env:"SESSION_TTL"`
+	// bearer token operators read GET /admin/stats with, at least 32 characters. The endpoint
+	// is disabled if empty
+	AdminToken string `env:"ADMIN_TOKEN"`
 }
 
 type Config struct {
@@ -26,6 +115,105 @@ type Config struct {
 	Production bool
 	// Server address. Defaults to :8080
 	Addr string
+	// Cloudflare TURN key id. Empty means TURN is disabled
+	TurnKeyID string
+	// Cloudflare TURN API token
+	TurnAPIToken string
+	// lifetime of generated TURN credentials. Defaults to 24h
+	TurnTTL time.Duration
+	// ICE providers to try in order. Each one of the ICEProvider* constants
+	ICEProviders []string
+	// per provider timeout
+	ICEProviderTimeout time.Duration
+	// consecutive failures before a provider's circuit breaker opens
+	ICEBreakerThreshold int
+	// how long an open circuit breaker skips its provider
+	ICEBreakerCooldown time.Duration
+	// ICE urls for the static provider
+	ICEStaticURLs []string
+	// optional credentials for the static provider
+	ICEStaticUsername   string
+	ICEStaticCredential string
+	// TURN urls of a coturn server
+	CoturnURLs []string
+	// coturn static-auth-secret
+	CoturnSecret string
+	// udp address of the built-in STUN server. Empty means disabled
+	StunAddr string
+	// host advertised for the built-in STUN server. Empty means the host clients connect to
+	StunPublicHost string
+	// udp/tcp addresses of the built-in TURN server. Both empty means disabled
+	TurnUDPAddr string
+	TurnTCPAddr string
+	// TURN realm
+	TurnRealm string
+	// shared secret for the built-in TURN server credentials. Empty means a random one is generated
+	TurnSecret string
+	// public ip handed out as the relay address
+	TurnPublicIP net.IP
+	// host advertised for the built-in TURN server. Empty means the host clients connect to
+	TurnPublicHost string
+	// relay port range
+	TurnRelayPortMin uint16
+	TurnRelayPortMax uint16
+	// relayed bytes per second per user
+	TurnUserBandwidth int
+	// concurrent allocations per user
+	TurnUserAllocations int
+	// allow relaying game traffic over the websocket when WebRTC fails
+	RelayEnabled bool
+	// relayed bytes per second per room
+	RelayBandwidth int
+	// ticks per second of server hosted matches
+	HostedTickRate int
+	// rollback window of server hosted matches in ticks
+	HostedRollbackWindow int
+	// store file, empty for in memory
+	StorePath string
+	// legacy replay and result directories imported into the store, empty if there's none
+	ReplayDir string
+	ResultDir string
+	// share of ranked P2P matches verified even when the reports agree
+	AuditRate float64
+	// secret identity tokens are signed with. Empty means a random one is generated, only
+	// allowed without a store file
+	IdentitySecret string
+	// lifetime of identity tokens
+	IdentityTTL time.Duration
+	// OpenID Connect login, disabled if the issuer is empty
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCAppURL       string
+	// lifetime of session tokens
+	SessionTTL time.Duration
+	// bearer token of the admin endpoints, disabled if empty
+	AdminToken string
+}
+
+// shortest IDENTITY_SECRET and ADMIN_TOKEN accepted
+const minIdentitySecretLength = 32
+
+const (
+	ICEProviderCloudflare = "cloudflare"
+	ICEProviderCoturn     = "coturn"
+	ICEProviderStatic     = "static"
+)
+
+// TurnServerEnabled reports whether the built-in TURN server should be started
+func (c *Config) TurnServerEnabled() bool {
+	return c.TurnUDPAddr != "" || c.TurnTCPAddr != ""
+}
+
+// OIDCEnabled reports whether players can log in with an OpenID Connect provider
+func (c *Config) OIDCEnabled() bool {
+	return c.OIDCIssuer != ""
+}
+
+// TurnEnabled reports whether Cloudflare TURN credentials are configured
+func (c *Config) TurnEnabled() bool {
+	return c.TurnKeyID != "" && c.TurnAPIToken != ""
 }
 
 func LoadConfig(ctx context.Context) (*Config, error) {
@@ -66,5 +254,227 @@ func LoadConfig(ctx context.Context) (*Config, error) {
 		cfg.Addr = ":8080"
 	}
 
+	// turn
+	cfg.TurnKeyID = c.TurnKeyID
+	cfg.TurnAPIToken = c.TurnAPIToken
+	cfg.TurnTTL = 24 * time.Hour
+	if len(c.TurnTTL) > 0 {
+		ttl, err := strconv.Atoi(c.TurnTTL)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid TURN_TTL %q: must be a positive number of seconds", c.TurnTTL)
+		}
+		cfg.TurnTTL = time.Duration(ttl) * time.Second
+	}
+
+	// ice providers
+	cfg.ICEProviders = splitList(strings.ToLower(c.ICEProvider))
+	if len(cfg.ICEProviders) == 0 {
+		if cfg.TurnEnabled() {
+			cfg.ICEProviders = []string{ICEProviderCloudflare}
+		} else {
+			cfg.ICEProviders = []string{ICEProviderStatic}
+		}
+	}
+	cfg.ICEStaticURLs = splitList(c.ICEStaticURLs)
+	cfg.ICEStaticUsername = c.ICEStaticUsername
+	cfg.ICEStaticCredential = c.ICEStaticCredential
+	cfg.CoturnURLs = splitList(c.CoturnURLs)
+	cfg.CoturnSecret = c.CoturnSecret
+	for _, provider := range cfg.ICEProviders {
+		switch provider {
+		case ICEProviderCloudflare:
+			if !cfg.TurnEnabled() {
+				return nil, fmt.Errorf("ICE_PROVIDER=cloudflare requires CLOUDFLARE_TURN_KEY_ID and CLOUDFLARE_TURN_API_TOKEN")
+			}
+		case ICEProviderCoturn:
+			if len(cfg.CoturnURLs) == 0 || cfg.CoturnSecret == "" {
+				return nil, fmt.Errorf("ICE_PROVIDER=coturn requires COTURN_URLS and COTURN_SECRET")
+			}
+		case ICEProviderStatic:
+		default:
+			return nil, fmt.Errorf("invalid ICE_PROVIDER %q: must be cloudflare, coturn or static", provider)
+		}
+	}
+	cfg.ICEProviderTimeout, err = parseDuration("ICE_PROVIDER_TIMEOUT", c.ICEProviderTimeout, 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ICEBreakerCooldown, err = parseDuration("ICE_BREAKER_COOLDOWN", c.ICEBreakerCooldown, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ICEBreakerThreshold, err = parsePositiveInt("ICE_BREAKER_THRESHOLD", c.ICEBreakerThreshold, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	// stun
+	cfg.StunAddr = c.StunAddr
+	cfg.StunPublicHost = c.StunPublicHost
+	if len(cfg.StunAddr) > 0 {
+		if _, _, err := net.SplitHostPort(cfg.StunAddr); err != nil {
+			return nil, fmt.Errorf("invalid STUN_ADDR %q: %w", cfg.StunAddr, err)
+		}
+	}
+
+	// turn server
+	cfg.TurnUDPAddr = c.TurnUDPAddr
+	cfg.TurnTCPAddr = c.TurnTCPAddr
+	cfg.TurnSecret = c.TurnSecret
+	cfg.TurnPublicHost = c.TurnPublicHost
+	cfg.TurnRealm = c.TurnRealm
+	if cfg.TurnRealm == "" {
+		cfg.TurnRealm = "tronline"
+	}
+	if cfg.TurnServerEnabled() {
+		for name, addr := range map[string]string{"TURN_UDP_ADDR": cfg.TurnUDPAddr, "TURN_TCP_ADDR": cfg.TurnTCPAddr} {
+			if len(addr) == 0 {
+				continue
+			}
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %w", name, addr, err)
+			}
+		}
+		cfg.TurnPublicIP = net.ParseIP(c.TurnPublicIP).To4()
+		if cfg.TurnPublicIP == nil {
+			return nil, fmt.Errorf("invalid TURN_PUBLIC_IP %q: an ipv4 address is required when the TURN server is enabled", c.TurnPublicIP)
+		}
+	}
+	portMin, err := parsePositiveInt("TURN_RELAY_PORT_MIN", c.TurnRelayPortMin, 49152)
+	if err != nil {
+		return nil, err
+	}
+	portMax, err := parsePositiveInt("TURN_RELAY_PORT_MAX", c.TurnRelayPortMax, 65535)
+	if err != nil {
+		return nil, err
+	}
+	if portMin > portMax || portMax > 65535 {
+		return nil, fmt.Errorf("invalid TURN relay port range %d-%d", portMin, portMax)
+	}
+	cfg.TurnRelayPortMin, cfg.TurnRelayPortMax = uint16(portMin), uint16(portMax)
+	cfg.TurnUserBandwidth, err = parsePositiveInt("TURN_USER_BANDWIDTH", c.TurnUserBandwidth, 256*1024)
+	if err != nil {
+		return nil, err
+	}
+	cfg.TurnUserAllocations, err = parsePositiveInt("TURN_USER_ALLOCATIONS", c.TurnUserAllocations, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	// relay
+	cfg.RelayEnabled = true
+	if len(c.RelayEnabled) > 0 {
+		cfg.RelayEnabled, err = strconv.ParseBool(c.RelayEnabled)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RELAY_ENABLED %q: %w", c.RelayEnabled, err)
+		}
+	}
+	cfg.RelayBandwidth, err = parsePositiveInt("RELAY_ROOM_BANDWIDTH", c.RelayBandwidth, 64*1024)
+	if err != nil {
+		return nil, err
+	}
+
+	// hosted matches
+	cfg.HostedTickRate, err = parsePositiveInt("HOSTED_TICK_RATE", c.HostedTickRate, 20)
+	if err != nil {
+		return nil, err
+	}
+	cfg.HostedRollbackWindow, err = parsePositiveInt("HOSTED_ROLLBACK_WINDOW", c.HostedRollbackWindow, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	// persistence
+	cfg.StorePath = c.StorePath
+	cfg.ReplayDir = c.ReplayDir
+	cfg.ResultDir = c.ResultDir
+
+	// match results
+	cfg.AuditRate = 0.1
+	if len(c.AuditRate) > 0 {
+		cfg.AuditRate, err = strconv.ParseFloat(c.AuditRate, 64)
+		if err != nil || cfg.AuditRate < 0 || cfg.AuditRate > 1 {
+			return nil, fmt.Errorf("invalid AUDIT_RATE %q: must be between 0 and 1", c.AuditRate)
+		}
+	}
+
+	// identities
+	cfg.IdentitySecret = c.IdentitySecret
+	// players in the store file would lose their identities on every restart
+	if cfg.IdentitySecret == "" && cfg.StorePath != "" {
+		return nil, fmt.Errorf("IDENTITY_SECRET is required with STORE_PATH")
+	}
+	if cfg.IdentitySecret != "" && len(cfg.IdentitySecret) < minIdentitySecretLength {
+		return nil, fmt.Errorf("IDENTITY_SECRET must be at least %d characters", minIdentitySecretLength)
+	}
+	cfg.IdentityTTL = 365 * 24 * time.Hour
+	if len(c.IdentityTTL) > 0 {
+		ttl, err := strconv.Atoi(c.IdentityTTL)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid IDENTITY_TTL %q: must be a positive number of seconds", c.IdentityTTL)
+		}
+		cfg.IdentityTTL = time.Duration(ttl) * time.Second
+	}
+
+	// login
+	cfg.OIDCIssuer = c.OIDCIssuer
+	cfg.OIDCClientID = c.OIDCClientID
+	cfg.OIDCClientSecret = c.OIDCClientSecret
+	cfg.OIDCRedirectURL = c.OIDCRedirectURL
+	cfg.OIDCAppURL = c.OIDCAppURL
+	if cfg.OIDCEnabled() && (cfg.OIDCClientID == "" || cfg.OIDCRedirectURL == "") {
+		return nil, fmt.Errorf("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required when OIDC_ISSUER is set")
+	}
+	cfg.SessionTTL = 30 * 24 * time.Hour
+	if len(c.SessionTTL) > 0 {
+		ttl, err := strconv.Atoi(c.SessionTTL)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid SESSION_TTL %q: must be a positive number of seconds", c.SessionTTL)
+		}
+		cfg.SessionTTL = time.Duration(ttl) * time.Second
+	}
+
+	// admin
+	cfg.AdminToken = c.AdminToken
+	if cfg.AdminToken != "" && len(cfg.AdminToken) < minIdentitySecretLength {
+		return nil, fmt.Errorf("ADMIN_TOKEN must be at least %d characters", minIdentitySecretLength)
+	}
+
 	return &cfg, nil
 }
+
+// splits a comma separated env value, dropping empty entries
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// parses a go duration (i.e. "1m30s"), returning def if the value is empty
+func parseDuration(name string, value string, def time.Duration) (time.Duration, error) {
+	if len(value) == 0 {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive duration like \"30s\"", name, value)
+	}
+	return d, nil
+}
+
+// parses a positive integer, returning def if the value is empty
+func parsePositiveInt(name string, value string, def int) (int, error) {
+	if len(value) == 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive number", name, value)
+	}
+	return n, nil
+}
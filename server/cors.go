@@ -7,9 +7,12 @@ import (
 
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		slog.Info("request", "method", r.Method, "url", r.URL.String(), "remote_addr", r.RemoteAddr)
+		// the path only, queries can hold tokens (the websocket's) and login codes
+		slog.Info("request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		// identity tokens come as bearer tokens
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusNoContent)
 			return
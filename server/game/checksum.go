@@ -0,0 +1,67 @@
+package game
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+)
+
+// buffers the states are serialized into for hashing. Checksums are taken every tick, so
+// the grid-sized buffer is reused instead of allocated each time
+var checksumBuffers = sync.Pool{New: func() any { return new([]byte) }}
+
+// Checksum hashes everything that affects the rest of the match. Peers simulating the
+// same match compare checksums to detect a desync
+func (s *State) Checksum() uint32 {
+	h := fnv.New32a()
+	pooled := checksumBuffers.Get().(*[]byte)
+	buf := (*pooled)[:0]
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(s.Tick))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(s.Width))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(s.Height))
+	// settings added after the first rules version are only hashed when set, so checksums
+	// of matches not using them didn't change
+	if s.Wrap {
+		buf = append(buf, 1)
+	}
+	for _, team := range s.Teams {
+		buf = append(buf, byte(team))
+	}
+	if s.FriendlyPass {
+		buf = append(buf, 1)
+	}
+	if s.Rings > 0 {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(s.Rings))
+	}
+	for _, c := range s.Cycles {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(c.Pos.X))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(c.Pos.Y))
+		buf = append(buf, byte(c.Dir))
+		if c.Alive {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(c.DiedAt))
+	}
+	if s.powerUps != nil {
+		buf = binary.LittleEndian.AppendUint32(buf, s.rng.state)
+		for _, c := range s.Cycles {
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(c.Energy))
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(c.Jumps))
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(c.Shield))
+		}
+		for _, p := range s.PowerUps {
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(p.Pos.X))
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(p.Pos.Y))
+			buf = append(buf, byte(p.Kind))
+		}
+	}
+	for _, cell := range s.grid {
+		buf = append(buf, byte(cell))
+	}
+	h.Write(buf)
+	*pooled = buf
+	checksumBuffers.Put(pooled)
+	return h.Sum32()
+}
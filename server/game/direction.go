@@ -0,0 +1,133 @@
+package game
+
+import "fmt"
+
+// Direction a cycle is heading in. Ordered clockwise so turning is +/- 1
+type Direction uint8
+
+const (
+	Up Direction = iota
+	Right
+	Down
+	Left
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Up:
+		return "up"
+	case Right:
+		return "right"
+	case Down:
+		return "down"
+	case Left:
+		return "left"
+	default:
+		return fmt.Sprintf("direction(%d)", uint8(d))
+	}
+}
+
+func (d Direction) MarshalText() ([]byte, error) {
+	if d > Left {
+		return nil, fmt.Errorf("invalid direction %d", uint8(d))
+	}
+	return []byte(d.String()), nil
+}
+
+func (d *Direction) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "up":
+		*d = Up
+	case "right":
+		*d = Right
+	case "down":
+		*d = Down
+	case "left":
+		*d = Left
+	default:
+		return fmt.Errorf("invalid direction %q", text)
+	}
+	return nil
+}
+
+// Delta is the change in position of a single move. y grows downwards
+func (d Direction) Delta() (dx int, dy int) {
+	switch d {
+	case Up:
+		return 0, -1
+	case Right:
+		return 1, 0
+	case Down:
+		return 0, 1
+	default:
+		return -1, 0
+	}
+}
+
+// Apply returns the direction after taking the turn
+func (d Direction) Apply(t Turn) Direction {
+	switch t {
+	case TurnLeft:
+		return (d + 3) % 4
+	case TurnRight:
+		return (d + 1) % 4
+	default:
+		return d
+	}
+}
+
+// Turn is a relative turn. Cycles can't reverse, so left/right are the only choices
+type Turn int8
+
+const (
+	TurnNone Turn = iota
+	TurnLeft
+	TurnRight
+)
+
+func (t Turn) String() string {
+	switch t {
+	case TurnNone:
+		return "none"
+	case TurnLeft:
+		return "left"
+	case TurnRight:
+		return "right"
+	default:
+		return fmt.Sprintf("turn(%d)", int8(t))
+	}
+}
+
+func (t Turn) MarshalText() ([]byte, error) {
+	if t < TurnNone || t > TurnRight {
+		return nil, fmt.Errorf("invalid turn %d", int8(t))
+	}
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText accepts "left", "right" and "none" (or empty)
+func (t *Turn) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "", "none":
+		*t = TurnNone
+	case "left":
+		*t = TurnLeft
+	case "right":
+		*t = TurnRight
+	default:
+		return fmt.Errorf("invalid turn %q", text)
+	}
+	return nil
+}
+
+// Point is a cell on the grid
+type Point struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// Add returns the point one move in direction d
+func (p Point) Add(d Direction) Point {
+	dx, dy := d.Delta()
+	return Point{X: p.X + dx, Y: p.Y + dy}
+}
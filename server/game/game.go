@@ -0,0 +1,148 @@
+// Package game is the authoritative lightcycle simulation. It's deterministic: no maps are
+// iterated, no floats or wall clock are used, so the server, bots and tools stepping the
+// same settings with the same inputs always end up in the same state
+package game
+
+import "fmt"
+
+// RulesVersion changes whenever the simulation behaves differently for the same settings and
+// inputs. New rules are added behind settings that default to off, so replays recorded with
+// older rules keep simulating the same. Fixes that change existing rules go in ruleChanges
+const RulesVersion = 3
+
+// the rule changes since the first version, each with the matches it plays differently
+var ruleChanges = []struct {
+	version int
+	changes func(s Settings) bool
+	what    string
+}{
+	{2, func(s Settings) bool { return s.Wrap && s.PowerUps != nil }, "the eraser wraps around the edges"},
+	{3, func(s Settings) bool { return s.SuddenDeath != nil && s.SuddenDeath.MaxSpeed > speedLimit }, fmt.Sprintf("max speed is capped at %d", speedLimit)},
+}
+
+// CheckRules reports an error when a match with settings played with an older rules version
+// doesn't play the same with the current rules
+func CheckRules(version int, settings Settings) error {
+	if version < 1 || version > RulesVersion {
+		return fmt.Errorf("unknown rules version %d, this server knows 1 to %d", version, RulesVersion)
+	}
+	for _, change := range ruleChanges {
+		if change.version > version && change.changes(settings) {
+			return fmt.Errorf("rules version %d changed the match: %s", change.version, change.what)
+		}
+	}
+	return nil
+}
+
+// Cell is the content of a grid cell
+type Cell uint8
+
+const (
+	CellEmpty Cell = 0
+	CellWall  Cell = 255
+)
+
+// TrailCell is the cell value of player's trail
+func TrailCell(player int) Cell {
+	return Cell(player + 1)
+}
+
+// Player returns whose trail the cell is, or -1 if it isn't a trail
+func (c Cell) Player() int {
+	if c == CellEmpty || c == CellWall {
+		return -1
+	}
+	return int(c) - 1
+}
+
+// Cycle is a player's lightcycle. Its current position is also part of its trail
+type Cycle struct {
+	Pos   Point     `json:"pos"`
+	Dir   Direction `json:"dir"`
+	Alive bool      `json:"alive"`
+	// tick the cycle died on, 0 while alive
+	DiedAt int `json:"diedAt,omitempty"`
+	// power-ups only. boost energy left
+	Energy int `json:"energy,omitempty"`
+	// power-ups only. jumps picked up and not used yet
+	Jumps int `json:"jumps,omitempty"`
+	// power-ups only. ticks of shield left
+	Shield int `json:"shield,omitempty"`
+	// cells moved into on the last tick in order, ending at Pos, when the cycle moved more
+	// than one (boost, sudden death speed). Not part of the state, every step replaces it
+	Path []Point `json:"path,omitempty"`
+}
+
+// Input is what a player does on a tick
+type Input struct {
+	Turn Turn `json:"turn"`
+	// power-ups only. move twice this tick, costs energy
+	Boost bool `json:"boost,omitempty"`
+	// power-ups only. jump over the next cell, costs a picked up jump
+	Jump bool `json:"jump,omitempty"`
+}
+
+// DeathCause is why a cycle crashed
+type DeathCause uint8
+
+const (
+	// drove off the arena or into a wall
+	DeathWall DeathCause = iota + 1
+	// drove into a trail, including its own
+	DeathTrail
+	// moved into the same cell as another cycle on the same tick
+	DeathHeadOn
+	// caught by the walls closing in in sudden death
+	DeathClosedIn
+)
+
+func (c DeathCause) String() string {
+	switch c {
+	case DeathWall:
+		return "wall"
+	case DeathTrail:
+		return "trail"
+	case DeathHeadOn:
+		return "head-on"
+	case DeathClosedIn:
+		return "closed-in"
+	default:
+		return "unknown"
+	}
+}
+
+func (c DeathCause) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// Event is something that happened during a tick: a cycle died (Cause is set) or picked up
+// a power-up (Pickup is set)
+type Event struct {
+	Tick   int         `json:"tick"`
+	Player int         `json:"player"`
+	Cause  DeathCause  `json:"cause,omitempty"`
+	Pickup PowerUpKind `json:"pickup,omitempty"`
+	// the cell the cycle crashed into or picked the power-up up at
+	At Point `json:"at"`
+	// player whose trail was hit, or the other cycle in a head-on. -1 otherwise
+	Other int `json:"other"`
+	// trail cells an eraser cleared
+	Erased []Point `json:"erased,omitempty"`
+}
+
+// IsDeath reports whether the event is a cycle dying
+func (e Event) IsDeath() bool {
+	return e.Cause != 0
+}
+
+// SplitEvents separates the deaths from the pickups, which clients get apart
+func SplitEvents(events []Event) (deaths []Event, pickups []Event) {
+	for _, e := range events {
+		if e.IsDeath() {
+			deaths = append(deaths, e)
+		} else {
+			pickups = append(pickups, e)
+		}
+	}
+	return deaths, pickups
+}
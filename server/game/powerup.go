@@ -0,0 +1,202 @@
+package game
+
+import "fmt"
+
+// PowerUpKind is what a pickup does
+type PowerUpKind uint8
+
+const (
+	// refills the boost energy
+	PowerUpBoost PowerUpKind = iota + 1
+	// a jump over the next cell, trails and walls in it included
+	PowerUpJump
+	// erases the trails around the pickup
+	PowerUpEraser
+	// drive through trails for a while
+	PowerUpShield
+)
+
+// number of kinds, spawned kinds are picked from 1 to powerUpKinds
+const powerUpKinds = 4
+
+func (k PowerUpKind) String() string {
+	switch k {
+	case PowerUpBoost:
+		return "boost"
+	case PowerUpJump:
+		return "jump"
+	case PowerUpEraser:
+		return "eraser"
+	case PowerUpShield:
+		return "shield"
+	default:
+		return fmt.Sprintf("power-up(%d)", uint8(k))
+	}
+}
+
+func (k PowerUpKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *PowerUpKind) UnmarshalText(text []byte) error {
+	for kind := PowerUpBoost; kind <= powerUpKinds; kind++ {
+		if kind.String() == string(text) {
+			*k = kind
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid power-up %q", text)
+}
+
+// PowerUp is a pickup lying in the arena
+type PowerUp struct {
+	Pos  Point       `json:"pos"`
+	Kind PowerUpKind `json:"kind"`
+}
+
+// PowerUpSettings turn on pickups and boost. Pickups spawn from Settings.Seed, so every
+// simulation of the same settings spawns the same pickups in the same places
+type PowerUpSettings struct {
+	// ticks between pickups spawning
+	Interval int `json:"interval"`
+	// most pickups in the arena at once
+	Max int `json:"max"`
+	// boost energy a cycle can hold, every boosted tick costs 1. Cycles start full
+	MaxEnergy int `json:"maxEnergy"`
+	// ticks without boosting to get 1 energy back
+	EnergyRegen int `json:"energyRegen"`
+	// ticks a shield lasts
+	ShieldTicks int `json:"shieldTicks"`
+	// trails up to this many cells away from an eraser are erased
+	EraseRadius int `json:"eraseRadius"`
+}
+
+// DefaultPowerUps are the power-up settings of rooms with power-ups on
+func DefaultPowerUps() *PowerUpSettings {
+	return &PowerUpSettings{
+		Interval:    60,
+		Max:         3,
+		MaxEnergy:   40,
+		EnergyRegen: 5,
+		ShieldTicks: 40,
+		EraseRadius: 4,
+	}
+}
+
+func (p *PowerUpSettings) Validate() error {
+	if p.Interval < 1 || p.Max < 1 || p.MaxEnergy < 0 || p.EnergyRegen < 1 || p.ShieldTicks < 0 || p.EraseRadius < 0 {
+		return fmt.Errorf("invalid power-up settings %+v", *p)
+	}
+	return nil
+}
+
+// how many random cells are tried when spawning a pickup before giving up until the next interval
+const spawnAttempts = 16
+
+// spawns a pickup every interval on a random free cell
+func (s *State) spawnPowerUp() {
+	if s.Tick%s.powerUps.Interval != 0 || len(s.PowerUps) >= s.powerUps.Max {
+		return
+	}
+	kind := PowerUpKind(1 + s.rng.intn(powerUpKinds))
+	for attempt := 0; attempt < spawnAttempts; attempt++ {
+		p := Point{X: s.rng.intn(s.Width), Y: s.rng.intn(s.Height)}
+		if s.Free(p) && s.powerUpAt(p) < 0 {
+			s.PowerUps = append(s.PowerUps, PowerUp{Pos: p, Kind: kind})
+			return
+		}
+	}
+}
+
+// index of the pickup at p, -1 if there's none
+func (s *State) powerUpAt(p Point) int {
+	for i, powerUp := range s.PowerUps {
+		if powerUp.Pos == p {
+			return i
+		}
+	}
+	return -1
+}
+
+// player's cycle drove onto the pickup at index i
+func (s *State) pickUp(player int, i int) Event {
+	powerUp := s.PowerUps[i]
+	s.PowerUps = append(s.PowerUps[:i:i], s.PowerUps[i+1:]...)
+	event := Event{Tick: s.Tick, Player: player, Pickup: powerUp.Kind, At: powerUp.Pos, Other: -1}
+
+	c := &s.Cycles[player]
+	switch powerUp.Kind {
+	case PowerUpBoost:
+		c.Energy = s.powerUps.MaxEnergy
+	case PowerUpJump:
+		c.Jumps++
+	case PowerUpShield:
+		c.Shield = s.powerUps.ShieldTicks
+	case PowerUpEraser:
+		r := s.powerUps.EraseRadius
+		for _, y := range s.span(powerUp.Pos.Y, r, s.Height) {
+			for _, x := range s.span(powerUp.Pos.X, r, s.Width) {
+				p := Point{X: x, Y: y}
+				if s.Cell(p).Player() < 0 || s.isHead(p) {
+					continue
+				}
+				s.grid[s.index(p)] = CellEmpty
+				event.Erased = append(event.Erased, p)
+			}
+		}
+	}
+	return event
+}
+
+// the coordinates up to r away from c on an axis of size n. They wrap around the edges in
+// wrap-around arenas, every coordinate once, and stop at them otherwise
+func (s *State) span(c int, r int, n int) []int {
+	if !s.Wrap {
+		lo, hi := max(c-r, 0), min(c+r, n-1)
+		coords := make([]int, 0, max(hi-lo+1, 0))
+		for i := lo; i <= hi; i++ {
+			coords = append(coords, i)
+		}
+		return coords
+	}
+	if 2*r+1 >= n {
+		coords := make([]int, n)
+		for i := range coords {
+			coords[i] = i
+		}
+		return coords
+	}
+	coords := make([]int, 0, 2*r+1)
+	for i := c - r; i <= c+r; i++ {
+		coords = append(coords, (i%n+n)%n)
+	}
+	return coords
+}
+
+// reports whether a living cycle is at p
+func (s *State) isHead(p Point) bool {
+	for _, c := range s.Cycles {
+		if c.Alive && c.Pos == p {
+			return true
+		}
+	}
+	return false
+}
+
+// mulberry32, the same generator as the arena generator so clients only need one
+type rng struct {
+	state uint32
+}
+
+func (r *rng) next() uint32 {
+	r.state += 0x6D2B79F5
+	z := r.state
+	z = (z ^ (z >> 15)) * (z | 1)
+	z ^= z + (z^(z>>7))*(z|61)
+	return z ^ (z >> 14)
+}
+
+// intn returns a number in [0, n)
+func (r *rng) intn(n int) int {
+	return int(r.next() % uint32(n))
+}
@@ -0,0 +1,131 @@
+package game
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+const (
+	MaxPlayers = 8
+	MinSize    = 8
+	MaxSize    = 512
+)
+
+// Spawn is where and in which direction a cycle starts
+type Spawn struct {
+	Pos Point     `json:"pos"`
+	Dir Direction `json:"dir"`
+}
+
+// Settings are everything needed to create a match. Two states created from the same
+// settings and stepped with the same inputs are always identical
+type Settings struct {
+	Width   int `json:"width"`
+	Height  int `json:"height"`
+	Players int `json:"players"`
+	// optional, one per player. Defaults to DefaultSpawns
+	Spawns []Spawn `json:"spawns,omitempty"`
+	// wall cells inside the arena
+	Walls []Point `json:"walls,omitempty"`
+	// cycles leaving the arena come back in on the opposite edge instead of crashing
+	Wrap bool `json:"wrap,omitempty"`
+	// optional team of every player. Players without teams are all on their own
+	Teams []int `json:"teams,omitempty"`
+	// teammates can drive through each other's trails
+	FriendlyPass bool `json:"friendlyPass,omitempty"`
+	// randomness of the match, i.e. where power-ups spawn
+	Seed uint32 `json:"seed,omitempty"`
+	// nil turns power-ups and boost off
+	PowerUps *PowerUpSettings `json:"powerUps,omitempty"`
+	// nil turns sudden death off
+	SuddenDeath *SuddenDeath `json:"suddenDeath,omitempty"`
+}
+
+// Equal reports whether two settings create the same match
+func (s Settings) Equal(o Settings) bool {
+	return s.Width == o.Width && s.Height == o.Height && s.Players == o.Players && s.Wrap == o.Wrap &&
+		s.FriendlyPass == o.FriendlyPass && slices.Equal(s.Spawns, o.Spawns) && slices.Equal(s.Walls, o.Walls) &&
+		slices.Equal(s.Teams, o.Teams) && s.Seed == o.Seed &&
+		(s.PowerUps == o.PowerUps || s.PowerUps != nil && o.PowerUps != nil && *s.PowerUps == *o.PowerUps) &&
+		(s.SuddenDeath == o.SuddenDeath || s.SuddenDeath != nil && o.SuddenDeath != nil && *s.SuddenDeath == *o.SuddenDeath)
+}
+
+func (s Settings) Validate() error {
+	if s.Width < MinSize || s.Height < MinSize || s.Width > MaxSize || s.Height > MaxSize {
+		return fmt.Errorf("arena must be between %dx%d and %dx%d, got %dx%d", MinSize, MinSize, MaxSize, MaxSize, s.Width, s.Height)
+	}
+	if s.Players < 1 || s.Players > MaxPlayers {
+		return fmt.Errorf("players must be between 1 and %d, got %d", MaxPlayers, s.Players)
+	}
+	if s.Spawns != nil && len(s.Spawns) != s.Players {
+		return fmt.Errorf("got %d spawns for %d players", len(s.Spawns), s.Players)
+	}
+	if s.Teams != nil && len(s.Teams) != s.Players {
+		return fmt.Errorf("got %d teams for %d players", len(s.Teams), s.Players)
+	}
+	for i, team := range s.Teams {
+		if team < 0 || team >= MaxPlayers {
+			return fmt.Errorf("player %d has an invalid team %d", i, team)
+		}
+	}
+	if s.PowerUps != nil {
+		if err := s.PowerUps.Validate(); err != nil {
+			return err
+		}
+	}
+	if s.SuddenDeath != nil {
+		if err := s.SuddenDeath.Validate(); err != nil {
+			return err
+		}
+	}
+	walls := make(map[Point]bool, len(s.Walls))
+	for _, wall := range s.Walls {
+		if wall.X < 0 || wall.Y < 0 || wall.X >= s.Width || wall.Y >= s.Height {
+			return fmt.Errorf("wall at %d,%d is outside the arena", wall.X, wall.Y)
+		}
+		walls[wall] = true
+	}
+	spawns := s.Spawns
+	if spawns == nil {
+		spawns = DefaultSpawns(s.Width, s.Height, s.Players)
+	}
+	seen := make(map[Point]bool, len(spawns))
+	for i, spawn := range spawns {
+		if spawn.Pos.X < 0 || spawn.Pos.Y < 0 || spawn.Pos.X >= s.Width || spawn.Pos.Y >= s.Height {
+			return fmt.Errorf("spawn %d at %d,%d is outside the arena", i, spawn.Pos.X, spawn.Pos.Y)
+		}
+		if spawn.Dir > Left {
+			return fmt.Errorf("spawn %d has an invalid direction %d", i, spawn.Dir)
+		}
+		if walls[spawn.Pos] {
+			return fmt.Errorf("spawn %d at %d,%d is on a wall", i, spawn.Pos.X, spawn.Pos.Y)
+		}
+		if seen[spawn.Pos] {
+			return errors.New("two spawns share the same cell")
+		}
+		seen[spawn.Pos] = true
+	}
+	return nil
+}
+
+// DefaultSpawns spreads players out in an empty arena. Two players face off from the left
+// and right, more players start in columns alternating between the top and bottom
+func DefaultSpawns(width int, height int, players int) []Spawn {
+	if players == 2 {
+		return []Spawn{
+			{Pos: Point{X: width / 4, Y: height / 2}, Dir: Right},
+			{Pos: Point{X: width - 1 - width/4, Y: height / 2}, Dir: Left},
+		}
+	}
+	spawns := make([]Spawn, players)
+	for i := range spawns {
+		x := width * (2*i + 1) / (2 * players)
+		if i%2 == 0 {
+			spawns[i] = Spawn{Pos: Point{X: x, Y: height / 4}, Dir: Down}
+		} else {
+			spawns[i] = Spawn{Pos: Point{X: x, Y: height - 1 - height/4}, Dir: Up}
+		}
+	}
+	return spawns
+}
@@ -0,0 +1,33 @@
+package game
+
+import "slices"
+
+// Snapshot is a frozen copy of a state that can be restored later, i.e. to re-simulate
+// from a confirmed tick
+type Snapshot struct {
+	state State
+}
+
+// Snapshot copies the state
+func (s *State) Snapshot() Snapshot {
+	return Snapshot{state: *s.Clone()}
+}
+
+// Restore puts the state back to the snapshot. The snapshot can be restored again later
+func (s *State) Restore(snap Snapshot) {
+	*s = *snap.state.Clone()
+}
+
+// Tick returns the tick the snapshot was taken at
+func (snap Snapshot) Tick() int {
+	return snap.state.Tick
+}
+
+// Clone returns a deep copy of the state
+func (s *State) Clone() *State {
+	c := *s
+	c.Cycles = slices.Clone(s.Cycles)
+	c.grid = slices.Clone(s.grid)
+	c.PowerUps = slices.Clone(s.PowerUps)
+	return &c
+}
@@ -0,0 +1,318 @@
+package game
+
+import "slices"
+
+// State is a match in progress
+type State struct {
+	Width  int
+	Height int
+	// cycles wrap around the edges of the arena
+	Wrap bool
+	// team of every player, nil when everybody is on their own
+	Teams []int
+	// teammates can drive through each other's trails
+	FriendlyPass bool
+	// ticks stepped so far
+	Tick   int
+	Cycles []Cycle
+	// pickups lying in the arena, ordered by when they spawned
+	PowerUps []PowerUp
+	// rings of walls closed in by sudden death
+	Rings int
+
+	grid []Cell
+	// nil when power-ups are off
+	powerUps *PowerUpSettings
+	rng      rng
+	// nil when sudden death is off
+	suddenDeath *SuddenDeath
+}
+
+// New creates the state at tick 0 with every cycle on its spawn
+func New(settings Settings) (*State, error) {
+	if err := settings.Validate(); err != nil {
+		return nil, err
+	}
+	spawns := settings.Spawns
+	if spawns == nil {
+		spawns = DefaultSpawns(settings.Width, settings.Height, settings.Players)
+	}
+
+	s := &State{
+		Width:  settings.Width,
+		Height: settings.Height,
+		Wrap:   settings.Wrap,
+		Teams:  settings.Teams,
+		// passing through teammates only means something with teams
+		FriendlyPass: settings.FriendlyPass && settings.Teams != nil,
+		Cycles:       make([]Cycle, settings.Players),
+		grid:         make([]Cell, settings.Width*settings.Height),
+	}
+	for _, wall := range settings.Walls {
+		s.grid[s.index(wall)] = CellWall
+	}
+	for i, spawn := range spawns {
+		s.Cycles[i] = Cycle{Pos: spawn.Pos, Dir: spawn.Dir, Alive: true}
+		s.grid[s.index(spawn.Pos)] = TrailCell(i)
+	}
+	if settings.PowerUps != nil {
+		powerUps := *settings.PowerUps
+		s.powerUps = &powerUps
+		s.rng = rng{state: settings.Seed}
+		for i := range s.Cycles {
+			s.Cycles[i].Energy = powerUps.MaxEnergy
+		}
+	}
+	if settings.SuddenDeath != nil {
+		suddenDeath := *settings.SuddenDeath
+		s.suddenDeath = &suddenDeath
+	}
+	return s, nil
+}
+
+func (s *State) index(p Point) int {
+	return p.Y*s.Width + p.X
+}
+
+// InBounds reports whether p is inside the arena
+func (s *State) InBounds(p Point) bool {
+	return p.X >= 0 && p.Y >= 0 && p.X < s.Width && p.Y < s.Height
+}
+
+// Next returns the cell a cycle at p heading in d moves into, wrapping around the edges
+// in wrap-around arenas
+func (s *State) Next(p Point, d Direction) Point {
+	next := p.Add(d)
+	if s.Wrap {
+		next.X = (next.X + s.Width) % s.Width
+		next.Y = (next.Y + s.Height) % s.Height
+	}
+	return next
+}
+
+// Cell returns the content of the cell at p. Cells outside the arena are walls
+func (s *State) Cell(p Point) Cell {
+	if !s.InBounds(p) {
+		return CellWall
+	}
+	return s.grid[s.index(p)]
+}
+
+// Free reports whether a cycle can move into p
+func (s *State) Free(p Point) bool {
+	return s.Cell(p) == CellEmpty
+}
+
+// Step advances the match by one tick. inputs[i] is player i's input, missing inputs mean
+// no turn. All cycles move simultaneously: a cycle dies if it moves into a wall or trail,
+// and cycles moving into the same cell all die (head-on tie). Cycles moving more than one cell
+// per tick, because of boost or sudden death speed-ups, move again after everybody moved
+// once. Returns the deaths and pickups of this tick
+func (s *State) Step(inputs []Input) []Event {
+	s.Tick++
+
+	// how many cells each cycle moves this tick, and whether it jumps on its first move
+	moves := make([]int, len(s.Cycles))
+	jumps := make([]bool, len(s.Cycles))
+	speed := s.suddenDeath.Speed(s.Tick)
+	for i := range s.Cycles {
+		c := &s.Cycles[i]
+		// a fresh path every tick, clones of the state share the last one
+		c.Path = nil
+		if !c.Alive {
+			continue
+		}
+		moves[i] = speed
+		var input Input
+		if i < len(inputs) {
+			input = inputs[i]
+		}
+		c.Dir = c.Dir.Apply(input.Turn)
+		if s.powerUps == nil {
+			continue
+		}
+		if input.Boost && c.Energy > 0 {
+			c.Energy--
+			moves[i]++
+		} else if s.Tick%s.powerUps.EnergyRegen == 0 && c.Energy < s.powerUps.MaxEnergy {
+			c.Energy++
+		}
+		if input.Jump && c.Jumps > 0 {
+			c.Jumps--
+			jumps[i] = true
+		}
+	}
+
+	var events []Event
+	movers := make([]bool, len(s.Cycles))
+	for sub := 0; ; sub++ {
+		moving := false
+		for i := range s.Cycles {
+			movers[i] = s.Cycles[i].Alive && moves[i] > sub
+			moving = moving || movers[i]
+		}
+		if !moving {
+			break
+		}
+		events = append(events, s.move(movers, jumps)...)
+		clear(jumps)
+		for i := range s.Cycles {
+			if c := &s.Cycles[i]; movers[i] && c.Alive && moves[i] > 1 {
+				c.Path = append(c.Path, c.Pos)
+			}
+		}
+	}
+
+	if s.suddenDeath != nil {
+		events = append(events, s.shrink()...)
+	}
+	if s.powerUps != nil {
+		for i := range s.Cycles {
+			if s.Cycles[i].Shield > 0 {
+				s.Cycles[i].Shield--
+			}
+		}
+		s.spawnPowerUp()
+	}
+	return events
+}
+
+// move moves the movers one cell ahead at the same time, or two for jumpers, who skip the
+// cell in between
+func (s *State) move(movers []bool, jumps []bool) []Event {
+	next := make([]Point, len(s.Cycles))
+	for i, c := range s.Cycles {
+		if !movers[i] {
+			continue
+		}
+		next[i] = s.Next(c.Pos, c.Dir)
+		if jumps[i] {
+			next[i] = s.Next(next[i], c.Dir)
+		}
+	}
+
+	var events []Event
+	dead := make([]bool, len(s.Cycles))
+	for i := range s.Cycles {
+		if !movers[i] {
+			continue
+		}
+		cell := s.Cell(next[i])
+		switch {
+		case cell == CellWall:
+			dead[i] = true
+			events = append(events, Event{Tick: s.Tick, Player: i, Cause: DeathWall, At: next[i], Other: -1})
+		case cell != CellEmpty && !s.canPass(i, cell):
+			dead[i] = true
+			events = append(events, Event{Tick: s.Tick, Player: i, Cause: DeathTrail, At: next[i], Other: cell.Player()})
+		default:
+			// head-on, anybody else moving into the same empty cell
+			for j := range s.Cycles {
+				if j != i && movers[j] && next[j] == next[i] {
+					dead[i] = true
+					events = append(events, Event{Tick: s.Tick, Player: i, Cause: DeathHeadOn, At: next[i], Other: j})
+					break
+				}
+			}
+		}
+	}
+
+	for i := range s.Cycles {
+		c := &s.Cycles[i]
+		if !movers[i] {
+			continue
+		}
+		if dead[i] {
+			c.Alive = false
+			c.DiedAt = s.Tick
+			continue
+		}
+		c.Pos = next[i]
+		s.grid[s.index(c.Pos)] = TrailCell(i)
+	}
+
+	if s.powerUps != nil {
+		for i, c := range s.Cycles {
+			if !movers[i] || !c.Alive {
+				continue
+			}
+			if p := s.powerUpAt(c.Pos); p >= 0 {
+				events = append(events, s.pickUp(i, p))
+			}
+		}
+	}
+	return events
+}
+
+// Team returns the team of a player. Without teams every player is their own team
+func (s *State) Team(player int) int {
+	if s.Teams == nil {
+		return player
+	}
+	return s.Teams[player]
+}
+
+// reports whether player can drive into a trail cell without crashing
+func (s *State) canPass(player int, cell Cell) bool {
+	other := cell.Player()
+	if other < 0 {
+		return false
+	}
+	if s.Cycles[player].Shield > 0 {
+		return true
+	}
+	return s.FriendlyPass && other != player && s.Team(other) == s.Team(player)
+}
+
+// AliveTeams returns the teams with a cycle still alive, ordered by team
+func (s *State) AliveTeams() []int {
+	var teams []int
+	for _, player := range s.Alive() {
+		if team := s.Team(player); !slices.Contains(teams, team) {
+			teams = append(teams, team)
+		}
+	}
+	slices.Sort(teams)
+	return teams
+}
+
+// Alive returns the players still alive
+func (s *State) Alive() []int {
+	var alive []int
+	for i, c := range s.Cycles {
+		if c.Alive {
+			alive = append(alive, i)
+		}
+	}
+	return alive
+}
+
+// Over reports whether the match is decided: at most one cycle is left, the only cycle of
+// a single player match crashed or the sudden death tick cap was hit
+func (s *State) Over() bool {
+	if s.TimeUp() {
+		return true
+	}
+	alive := len(s.Alive())
+	if len(s.Cycles) == 1 {
+		return alive == 0
+	}
+	return alive <= 1
+}
+
+// Winner returns the last cycle standing, or the tie break winner when the tick cap was
+// hit. ok is false while the match is running or when it's a draw
+func (s *State) Winner() (player int, ok bool) {
+	if !s.Over() {
+		return -1, false
+	}
+	alive := s.Alive()
+	if len(alive) == 1 {
+		return alive[0], true
+	}
+	if len(alive) > 1 {
+		player = s.TieBreak(func(player int) int { return player })
+		return player, player >= 0
+	}
+	return -1, false
+}
@@ -0,0 +1,155 @@
+package game
+
+import (
+	"errors"
+	"fmt"
+)
+
+// TieBreak decides a round that hit SuddenDeath.MaxTicks with more than one cycle alive
+type TieBreak string
+
+const (
+	// the round is a draw
+	TieBreakDraw TieBreak = "draw"
+	// the cycle still alive with the most trail cells wins, equal lengths are a draw
+	TieBreakLength TieBreak = "length"
+)
+
+// SuddenDeath settings end stalemates: the walls close in, cycles speed up and rounds have a
+// hard length cap. Every part is off while its tick is 0
+type SuddenDeath struct {
+	// tick the first ring of walls closes in on, 0 never
+	ShrinkAfter int `json:"shrinkAfter,omitempty"`
+	// ticks between two rings closing in
+	ShrinkEvery int `json:"shrinkEvery,omitempty"`
+	// tick cycles start moving 2 cells per tick, 0 never
+	SpeedAfter int `json:"speedAfter,omitempty"`
+	// ticks between speed-ups of 1 cell per tick after that
+	SpeedEvery int `json:"speedEvery,omitempty"`
+	// fastest cycles get in cells per tick, not counting boost
+	MaxSpeed int `json:"maxSpeed,omitempty"`
+	// the round is over after this many ticks, 0 never
+	MaxTicks int `json:"maxTicks,omitempty"`
+	// who wins a round that hit MaxTicks. Empty is a draw
+	TieBreak TieBreak `json:"tieBreak,omitempty"`
+}
+
+// the walls stop closing in once the open area would be narrower than this
+const minOpen = 4
+
+// fastest cycles can be made, every cell moved per tick is another pass over the cycles
+const speedLimit = 8
+
+func (d *SuddenDeath) Validate() error {
+	if d.ShrinkAfter < 0 || d.SpeedAfter < 0 || d.MaxTicks < 0 {
+		return errors.New("sudden death ticks can't be negative")
+	}
+	if d.ShrinkAfter > 0 && d.ShrinkEvery < 1 {
+		return errors.New("closing walls need a shrink interval")
+	}
+	if d.SpeedAfter > 0 && (d.SpeedEvery < 1 || d.MaxSpeed < 2) {
+		return errors.New("speeding up needs a speed interval and a max speed of at least 2")
+	}
+	if d.MaxSpeed > speedLimit {
+		return fmt.Errorf("max speed can't be more than %d", speedLimit)
+	}
+	switch d.TieBreak {
+	case "", TieBreakDraw, TieBreakLength:
+	default:
+		return fmt.Errorf("invalid tie break %q", d.TieBreak)
+	}
+	return nil
+}
+
+// Speed returns how many cells cycles move on a tick, not counting boost. Every one of them
+// is trail, the step leaves them in Cycle.Path
+func (d *SuddenDeath) Speed(tick int) int {
+	if d == nil || d.SpeedAfter == 0 || tick < d.SpeedAfter {
+		return 1
+	}
+	return min(d.MaxSpeed, 2+(tick-d.SpeedAfter)/d.SpeedEvery)
+}
+
+// Ring returns the cells of the kth ring from the edge of a width x height arena, ring 0
+// being the outermost cells
+func Ring(width int, height int, k int) []Point {
+	var cells []Point
+	for y := k; y < height-k; y++ {
+		for x := k; x < width-k; x++ {
+			if x == k || y == k || x == width-1-k || y == height-1-k {
+				cells = append(cells, Point{X: x, Y: y})
+			}
+		}
+	}
+	return cells
+}
+
+// closes the next ring of walls in when it's due. Cycles caught in it crash
+func (s *State) shrink() []Event {
+	d := s.suddenDeath
+	if d.ShrinkAfter == 0 || s.Tick < d.ShrinkAfter || (s.Tick-d.ShrinkAfter)%d.ShrinkEvery != 0 {
+		return nil
+	}
+	if min(s.Width, s.Height)-2*(s.Rings+1) < minOpen {
+		return nil
+	}
+
+	var events []Event
+	for _, p := range Ring(s.Width, s.Height, s.Rings) {
+		s.grid[s.index(p)] = CellWall
+		if i := s.powerUpAt(p); i >= 0 {
+			s.PowerUps = append(s.PowerUps[:i:i], s.PowerUps[i+1:]...)
+		}
+	}
+	for i := range s.Cycles {
+		c := &s.Cycles[i]
+		if c.Alive && s.grid[s.index(c.Pos)] == CellWall {
+			c.Alive = false
+			c.DiedAt = s.Tick
+			events = append(events, Event{Tick: s.Tick, Player: i, Cause: DeathClosedIn, At: c.Pos, Other: -1})
+		}
+	}
+	s.Rings++
+	return events
+}
+
+// TimeUp reports whether the round hit the sudden death tick cap
+func (s *State) TimeUp() bool {
+	return s.suddenDeath != nil && s.suddenDeath.MaxTicks > 0 && s.Tick >= s.suddenDeath.MaxTicks
+}
+
+// TieBreak returns the side that wins a round that hit the tick cap by the tie break rule, or
+// -1 for a draw. side maps a player to the side it's on
+func (s *State) TieBreak(side func(player int) int) int {
+	if s.suddenDeath == nil || s.suddenDeath.TieBreak != TieBreakLength {
+		return -1
+	}
+	lengths := make([]int, len(s.Cycles))
+	for _, cell := range s.grid {
+		if player := cell.Player(); player >= 0 {
+			lengths[player]++
+		}
+	}
+	// trails of the sides still alive, dead teammates count towards their side
+	alive := make(map[int]bool)
+	for _, player := range s.Alive() {
+		alive[side(player)] = true
+	}
+	totals := make(map[int]int)
+	for player, length := range lengths {
+		if alive[side(player)] {
+			totals[side(player)] += length
+		}
+	}
+
+	best, bestLength := -1, -1
+	for _, player := range s.Alive() {
+		switch length := totals[side(player)]; {
+		case length > bestLength:
+			best, bestLength = side(player), length
+		case length == bestLength && side(player) != best:
+			best = -1
+		}
+	}
+	return best
+}
@@ -0,0 +1,264 @@
+// Package history serves a player's recent matches and the statistics computed from them,
+// both straight from the stored match results
+package history
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/isaackoz/tronline/bot"
+	"github.com/isaackoz/tronline/mode"
+	"github.com/isaackoz/tronline/result"
+	"github.com/isaackoz/tronline/store"
+)
+
+// how many of a player's most recent matches statistics cover
+const statsMatches = 500
+
+// Outcome is how a match went for a player
+type Outcome string
+
+const (
+	OutcomeWin  Outcome = "win"
+	OutcomeLoss Outcome = "loss"
+	OutcomeDraw Outcome = "draw"
+	// only one player reported it or it's still being verified, it may be decided later
+	OutcomePending Outcome = "pending"
+	// the reports disagreed and the logs couldn't settle it
+	OutcomeUndecided Outcome = "undecided"
+)
+
+// Player is somebody in a match
+type Player struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Match is a match from a player's point of view
+type Match struct {
+	ID     string        `json:"id"`
+	Mode   mode.Kind     `json:"mode"`
+	Arena  string        `json:"arena,omitempty"`
+	Ranked bool          `json:"ranked,omitempty"`
+	Source result.Source `json:"source"`
+	Status result.Status `json:"status"`
+	// the player's index in the match
+	Player  int     `json:"player"`
+	Outcome Outcome `json:"outcome"`
+	Reason  string  `json:"reason,omitempty"`
+	Scores  []int   `json:"scores,omitempty"`
+	// players on other sides, bots included
+	Opponents []Player `json:"opponents"`
+	Teammates []Player `json:"teammates,omitempty"`
+	// seconds from setting the match up to its end, 0 when unknown
+	Duration float64 `json:"duration,omitempty"`
+	// seconds the player survived in the last round, 0 when unknown
+	Survived float64 `json:"survived,omitempty"`
+	// path of the replay of the last round, empty when there's none
+	Replay     string    `json:"replay,omitempty"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// Stats are aggregates over a player's recent matches
+type Stats struct {
+	PlayerID string `json:"playerId"`
+	Name     string `json:"name"`
+	// matches with a confirmed outcome
+	Matches int `json:"matches"`
+	Wins    int `json:"wins"`
+	Losses  int `json:"losses"`
+	Draws   int `json:"draws"`
+	// wins out of Matches, 0 to 1
+	WinRate float64 `json:"winRate"`
+	// seconds survived in the last round, over the matches that recorded it
+	AverageSurvival float64 `json:"averageSurvival"`
+	// most played arena, empty without matches
+	FavouriteArena string `json:"favouriteArena,omitempty"`
+	// matches played by mode, decided or not
+	Modes map[mode.Kind]int `json:"modes"`
+}
+
+// History reads match history and statistics from the store
+type History struct {
+	results result.Store
+	players store.PlayerStore
+}
+
+func New(results result.Store, players store.PlayerStore) *History {
+	return &History{results: results, players: players}
+}
+
+// Matches returns a page of the player's matches, newest first
+func (h *History) Matches(ctx context.Context, playerID string, offset int, limit int) ([]Match, error) {
+	results, err := h.results.ListByPlayer(ctx, playerID, offset, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list results: %w", err)
+	}
+	names := make(map[string]string)
+	matches := make([]Match, 0, len(results))
+	for _, r := range results {
+		if m, ok := h.match(ctx, r, playerID, names); ok {
+			matches = append(matches, m)
+		}
+	}
+	return matches, nil
+}
+
+// Stats computes the player's statistics over its most recent matches
+func (h *History) Stats(ctx context.Context, playerID string) (*Stats, error) {
+	results, err := h.results.ListByPlayer(ctx, playerID, 0, statsMatches)
+	if err != nil {
+		return nil, fmt.Errorf("list results: %w", err)
+	}
+	stats := &Stats{PlayerID: playerID, Name: h.name(ctx, playerID, nil), Modes: make(map[mode.Kind]int)}
+	arenas := make(map[string]int)
+	survived, survivedMatches := 0.0, 0
+	for _, r := range results {
+		player := slices.Index(r.Players, playerID)
+		if player < 0 {
+			continue
+		}
+		stats.Modes[r.Mode]++
+		if r.Arena != "" {
+			arenas[r.Arena]++
+		}
+		if s := survival(r, player); s > 0 {
+			survived += s
+			survivedMatches++
+		}
+		switch outcome(r, player) {
+		case OutcomeWin:
+			stats.Wins++
+		case OutcomeLoss:
+			stats.Losses++
+		case OutcomeDraw:
+			stats.Draws++
+		default:
+			continue
+		}
+		stats.Matches++
+	}
+	if stats.Matches > 0 {
+		stats.WinRate = float64(stats.Wins) / float64(stats.Matches)
+	}
+	if survivedMatches > 0 {
+		stats.AverageSurvival = survived / float64(survivedMatches)
+	}
+	// most played, ties by name so it doesn't flip between requests
+	favourite := 0
+	for arena, played := range arenas {
+		if played > favourite || played == favourite && arena < stats.FavouriteArena {
+			stats.FavouriteArena, favourite = arena, played
+		}
+	}
+	return stats, nil
+}
+
+// Known reports whether the player ever connected with an identity or played a match
+func (h *History) Known(ctx context.Context, playerID string) (bool, error) {
+	_, err := h.players.Load(ctx, playerID)
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		return false, fmt.Errorf("load player: %w", err)
+	}
+	results, err := h.results.ListByPlayer(ctx, playerID, 0, 1)
+	if err != nil {
+		return false, fmt.Errorf("list results: %w", err)
+	}
+	return len(results) > 0, nil
+}
+
+func (h *History) match(ctx context.Context, r *result.Result, playerID string, names map[string]string) (Match, bool) {
+	player := slices.Index(r.Players, playerID)
+	if player < 0 {
+		return Match{}, false
+	}
+	m := Match{
+		ID:         r.ID,
+		Mode:       r.Mode,
+		Arena:      r.Arena,
+		Ranked:     r.Ranked,
+		Source:     r.Source,
+		Status:     r.Status,
+		Player:     player,
+		Outcome:    outcome(r, player),
+		Reason:     r.Reason,
+		Scores:     r.Scores,
+		Opponents:  []Player{},
+		Survived:   survival(r, player),
+		FinishedAt: r.FinishedAt,
+	}
+	if !r.StartedAt.IsZero() {
+		m.Duration = r.FinishedAt.Sub(r.StartedAt).Seconds()
+	}
+	if len(r.Replays) > 0 {
+		m.Replay = "/replays/" + r.Replays[len(r.Replays)-1]
+	}
+	sides := mode.Mode{Kind: r.Mode}
+	for i, id := range r.Players {
+		if i == player {
+			continue
+		}
+		other := Player{ID: id, Name: h.name(ctx, id, names)}
+		if sides.Side(i) == sides.Side(player) {
+			m.Teammates = append(m.Teammates, other)
+		} else {
+			m.Opponents = append(m.Opponents, other)
+		}
+	}
+	return m, true
+}
+
+// looks up a player's display name, remembering it in names if it isn't nil
+func (h *History) name(ctx context.Context, id string, names map[string]string) string {
+	if name, ok := names[id]; ok {
+		return name
+	}
+	name := ""
+	if suffix, ok := strings.CutPrefix(id, "bot-"); ok {
+		// hosted matches fill empty slots with "bot-<difficulty>", bots added to a room keep
+		// their client id
+		name = "Bot"
+		if difficulty, err := bot.ParseDifficulty(suffix); err == nil {
+			name += " (" + string(difficulty) + ")"
+		}
+	} else if player, err := h.players.Load(ctx, id); err == nil {
+		name = player.Name
+	}
+	if names != nil {
+		names[id] = name
+	}
+	return name
+}
+
+// only confirmed results, verified ones included, have an outcome that counts
+func outcome(r *result.Result, player int) Outcome {
+	switch r.Status {
+	case result.StatusConfirmed:
+	case result.StatusUnconfirmed, result.StatusVerifying:
+		return OutcomePending
+	default:
+		return OutcomeUndecided
+	}
+	if r.Winner < 0 {
+		return OutcomeDraw
+	}
+	if (mode.Mode{Kind: r.Mode}).Side(player) == r.Winner {
+		return OutcomeWin
+	}
+	return OutcomeLoss
+}
+
+// seconds the player survived in the last round, 0 when the result doesn't say
+func survival(r *result.Result, player int) float64 {
+	if r.TickRate <= 0 || player >= len(r.Survived) {
+		return 0
+	}
+	return float64(r.Survived[player]) / float64(r.TickRate)
+}
@@ -0,0 +1,62 @@
+package history
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/isaackoz/tronline/internal/httpx"
+)
+
+// HandleHistory registers the player history endpoints:
+//
+//	GET /players/{id}/matches?offset=&limit=  recent matches, newest first
+//	GET /players/{id}/stats                   aggregates over the recent matches
+func HandleHistory(mux *http.ServeMux, history *History) {
+	mux.HandleFunc("GET /players/{id}/matches", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !known(w, r, history, id) {
+			return
+		}
+		offset, limit := httpx.Pagination(r)
+		matches, err := history.Matches(r.Context(), id, offset, limit)
+		if err != nil {
+			slog.Error("list matches", "error", err, "player_id", id)
+			http.Error(w, "could not list matches", http.StatusInternalServerError)
+			return
+		}
+		httpx.WriteJSON(w, map[string]any{
+			"matches": matches,
+			"offset":  offset,
+			"limit":   limit,
+		})
+	})
+
+	mux.HandleFunc("GET /players/{id}/stats", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !known(w, r, history, id) {
+			return
+		}
+		stats, err := history.Stats(r.Context(), id)
+		if err != nil {
+			slog.Error("compute stats", "error", err, "player_id", id)
+			http.Error(w, "could not compute stats", http.StatusInternalServerError)
+			return
+		}
+		httpx.WriteJSON(w, stats)
+	})
+}
+
+// answers 404 for players nobody has heard of
+func known(w http.ResponseWriter, r *http.Request, history *History, id string) bool {
+	ok, err := history.Known(r.Context(), id)
+	if err != nil {
+		slog.Error("look up player", "error", err, "player_id", id)
+		http.Error(w, "could not look up player", http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		http.Error(w, "player not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+
+	"github.com/isaackoz/tronline/cfg"
+	"github.com/isaackoz/tronline/signaling"
+	"github.com/isaackoz/tronline/turnserver"
+)
+
+// creates the chain of ICE providers selected in the config
+func newICEProvider(config *cfg.Config) (*signaling.ICEProviderChain, error) {
+	var links []signaling.ICEChainLink
+	for _, name := range config.ICEProviders {
+		provider, err := newSingleICEProvider(config, name)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, signaling.ICEChainLink{
+			Provider: provider,
+			Timeout:  config.ICEProviderTimeout,
+		})
+	}
+	return signaling.NewICEProviderChain(config.ICEBreakerThreshold, config.ICEBreakerCooldown, links...), nil
+}
+
+func newSingleICEProvider(config *cfg.Config, name string) (signaling.ICEProvider, error) {
+	switch name {
+	case cfg.ICEProviderCloudflare:
+		return &signaling.CloudflareProvider{
+			TurnKeyID: config.TurnKeyID,
+			APIToken:  config.TurnAPIToken,
+			TTL:       config.TurnTTL,
+		}, nil
+	case cfg.ICEProviderCoturn:
+		return &signaling.CoturnProvider{
+			URLs:   config.CoturnURLs,
+			Secret: config.CoturnSecret,
+			TTL:    config.TurnTTL,
+			User:   "tronline",
+		}, nil
+	case cfg.ICEProviderStatic:
+		if len(config.ICEStaticURLs) == 0 {
+			return &signaling.StaticProvider{Servers: signaling.FallbackICEServers}, nil
+		}
+		return &signaling.StaticProvider{
+			Servers: []signaling.ICEServer{
+				{
+					URLs:       config.ICEStaticURLs,
+					Username:   config.ICEStaticUsername,
+					Credential: config.ICEStaticCredential,
+				},
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown ice provider %q", name)
+	}
+}
+
+// starts the built-in turn server and advertises it with per client credentials
+func newTurnServer(ctx context.Context, config *cfg.Config, ice *signaling.ICEServerCache) (*turnserver.Server, error) {
+	secret := config.TurnSecret
+	if secret == "" {
+		// nobody else needs to know the secret, we hand out the credentials ourselves
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("generate turn secret: %w", err)
+		}
+		secret = base64.StdEncoding.EncodeToString(b)
+		slog.Warn("TURN_SECRET is empty, using a random secret")
+	}
+
+	server, err := turnserver.NewServer(turnserver.Config{
+		UDPAddr:         config.TurnUDPAddr,
+		TCPAddr:         config.TurnTCPAddr,
+		Realm:           config.TurnRealm,
+		Secret:          secret,
+		PublicIP:        config.TurnPublicIP,
+		RelayPortMin:    config.TurnRelayPortMin,
+		RelayPortMax:    config.TurnRelayPortMax,
+		UserBandwidth:   config.TurnUserBandwidth,
+		UserAllocations: config.TurnUserAllocations,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := server.Start(ctx); err != nil {
+		return nil, err
+	}
+
+	// the bound ports, the configured ones may be :0
+	udpPort, tcpPort := server.Ports()
+	ice.AddLocal(signaling.LocalTURNServer(config.TurnPublicHost, udpPort, tcpPort, secret, config.TurnTTL))
+	return server, nil
+}
@@ -0,0 +1,258 @@
+package identity
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/isaackoz/tronline/ratelimit"
+)
+
+// largest identity request accepted
+const maxRequestBody = 4 * 1024
+
+// new guest identities an ip can ask for per hour, renewing one isn't limited
+const newGuestsPerHour = 10
+
+// login requests an ip can make per minute, starting a login takes two of them for a guest
+const loginsPerMinute = 10
+
+// LoginCode is a guest's one time code to start a login with
+type LoginCode struct {
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// GuestRequest asks for a guest identity. Sending the current token keeps the player's id
+type GuestRequest struct {
+	Name  string `json:"name"`
+	Token string `json:"token,omitempty"`
+}
+
+// HandleIdentity registers the guest identity endpoint. The token can also come as a bearer
+// token in the Authorization header
+func HandleIdentity(mux *http.ServeMux, service *Service) {
+	limit := ratelimit.NewKeyed(newGuestsPerHour, time.Hour)
+	mux.HandleFunc("POST /identity", func(w http.ResponseWriter, r *http.Request) {
+		var req GuestRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Token == "" {
+			req.Token = BearerToken(r)
+		}
+		if req.Token == "" && !limit.Allow(ratelimit.ClientIP(r)) {
+			http.Error(w, "too many new identities, try again later", http.StatusTooManyRequests)
+			return
+		}
+		issued, err := service.Guest(r.Context(), req.Token, req.Name)
+		switch {
+		case errors.Is(err, ErrInvalidName), errors.Is(err, ErrNotGuest):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, ErrInvalidToken), errors.Is(err, ErrExpiredToken), errors.Is(err, ErrUpgraded):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case errors.Is(err, ErrBanned):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			slog.Error("issue identity", "error", err)
+			http.Error(w, "could not issue identity", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(issued); err != nil {
+			slog.Debug("encode identity", "error", err)
+		}
+	})
+}
+
+// Require returns the identity of the request's bearer token. Without a usable one it answers
+// the request with 401 or 403 and returns false
+func (s *Service) Require(w http.ResponseWriter, r *http.Request) (*Identity, bool) {
+	token := BearerToken(r)
+	if token == "" {
+		http.Error(w, "identity token required", http.StatusUnauthorized)
+		return nil, false
+	}
+	id, err := s.Authenticate(r.Context(), token)
+	switch {
+	case errors.Is(err, ErrInvalidToken), errors.Is(err, ErrExpiredToken), errors.Is(err, ErrUpgraded):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	case errors.Is(err, ErrBanned):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil, false
+	case err != nil:
+		slog.Error("authenticate player", "error", err)
+		http.Error(w, "could not authenticate", http.StatusInternalServerError)
+		return nil, false
+	}
+	return id, true
+}
+
+// BearerToken returns the bearer token of the Authorization header, empty if there's none
+func BearerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// HandleOIDC registers the login endpoints:
+//
+//	POST /auth/login                    a guest's login code, for its bearer token
+//	GET  /auth/login?code=<login code>  sends the player to the provider, without a code
+//	                                    it logs in as a new player
+//	GET  /auth/callback                 where the provider sends it back
+//
+// Guests don't put their token in the login url, urls end up in logs and Referer headers. The
+// login's state is also kept in a cookie, so only the browser that started a login can
+// finish it.
+//
+// With an app url the player ends up at <app url>#token=<session>&expiresAt=<unix>, or
+// #error=<message> when the login failed. Without one the callback answers the session as json
+func HandleOIDC(mux *http.ServeMux, oidc *OIDC) {
+	limit := ratelimit.NewKeyed(loginsPerMinute, time.Minute)
+	mux.HandleFunc("POST /auth/login", func(w http.ResponseWriter, r *http.Request) {
+		if !limit.Allow(ratelimit.ClientIP(r)) {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		token := BearerToken(r)
+		if token == "" {
+			http.Error(w, "identity token required", http.StatusUnauthorized)
+			return
+		}
+		code, expires, err := oidc.Code(token)
+		switch {
+		case errors.Is(err, ErrNotGuest):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, ErrInvalidToken), errors.Is(err, ErrExpiredToken):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case errors.Is(err, ErrTooManyLogins):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		case err != nil:
+			slog.Error("create login code", "error", err)
+			http.Error(w, "could not create login code", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(LoginCode{Code: code, ExpiresAt: expires}); err != nil {
+			slog.Debug("encode login code", "error", err)
+		}
+	})
+
+	mux.HandleFunc("GET /auth/login", func(w http.ResponseWriter, r *http.Request) {
+		if !limit.Allow(ratelimit.ClientIP(r)) {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		redirect, state, err := oidc.Begin(r.Context(), r.URL.Query().Get("code"))
+		switch {
+		case errors.Is(err, ErrUnknownLogin):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, ErrTooManyLogins):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		case err != nil:
+			slog.Error("begin login", "error", err)
+			http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+			return
+		}
+		http.SetCookie(w, oidc.loginCookie(state, int(loginTimeout.Seconds())))
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, redirect, http.StatusFound)
+	})
+
+	mux.HandleFunc("GET /auth/callback", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		// the login is over either way
+		http.SetCookie(w, oidc.loginCookie("", -1))
+		fail := func(status int, message string) {
+			if oidc.AppURL() == "" {
+				http.Error(w, message, status)
+				return
+			}
+			fragment := url.Values{"error": {message}}
+			http.Redirect(w, r, oidc.AppURL()+"#"+fragment.Encode(), http.StatusFound)
+		}
+		if providerErr := query.Get("error"); providerErr != "" {
+			// the player declined or the provider couldn't log it in
+			fail(http.StatusUnauthorized, strings.TrimSpace(providerErr+" "+query.Get("error_description")))
+			return
+		}
+		// a login started in another browser, i.e. an attacker's sent to the player to log it
+		// into the attacker's account
+		cookie, err := r.Cookie(loginCookieName)
+		if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+			fail(http.StatusBadRequest, ErrUnknownLogin.Error())
+			return
+		}
+		issued, err := oidc.Finish(r.Context(), query.Get("state"), query.Get("code"))
+		switch {
+		case errors.Is(err, ErrUnknownLogin):
+			fail(http.StatusBadRequest, err.Error())
+			return
+		case errors.Is(err, ErrBanned):
+			fail(http.StatusForbidden, err.Error())
+			return
+		case err != nil:
+			slog.Error("finish login", "error", err)
+			fail(http.StatusBadGateway, "login failed")
+			return
+		}
+		slog.Info("player logged in", "player_id", issued.ID)
+
+		w.Header().Set("Cache-Control", "no-store")
+		if oidc.AppURL() == "" {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(issued); err != nil {
+				slog.Debug("encode session", "error", err)
+			}
+			return
+		}
+		fragment := url.Values{
+			"token":     {issued.Token},
+			"expiresAt": {strconv.FormatInt(issued.ExpiresAt.Unix(), 10)},
+		}
+		http.Redirect(w, r, oidc.AppURL()+"#"+fragment.Encode(), http.StatusFound)
+	})
+}
+
+// cookie binding a login to the browser that started it
+const loginCookieName = "tronline_login"
+
+// the login cookie holding state, removed with a negative maxAge
+func (o *OIDC) loginCookie(state string, maxAge int) *http.Cookie {
+	// only sent to the callback, at the path the browser sees it at
+	path := "/auth/callback"
+	if u, err := url.Parse(o.config.RedirectURL); err == nil && u.Path != "" {
+		path = u.Path
+	}
+	return &http.Cookie{
+		Name:     loginCookieName,
+		Value:    state,
+		Path:     path,
+		MaxAge:   maxAge,
+		Secure:   strings.HasPrefix(o.config.RedirectURL, "https://"),
+		HttpOnly: true,
+		// sent along when the provider redirects back
+		SameSite: http.SameSiteLaxMode,
+	}
+}
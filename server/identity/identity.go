@@ -0,0 +1,124 @@
+// Package identity issues and checks the signed tokens players identify themselves with, so
+// a player keeps the same id across connections. Guests get theirs on request, players with
+// an account by logging in with an OpenID Connect provider. Tokens are signed by the server
+// and carry everything needed to check them, only bans and upgraded guests are looked up
+package identity
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Kind is how a player got its identity
+type Kind string
+
+const (
+	// issued on request to anybody, see HandleIdentity
+	KindGuest Kind = "guest"
+	// a session of a player who logged in with an OpenID Connect provider, see OIDC
+	KindAccount Kind = "account"
+)
+
+// Identity is who a player is
+type Identity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Kind Kind   `json:"kind"`
+}
+
+var (
+	ErrInvalidToken = errors.New("invalid identity token")
+	ErrExpiredToken = errors.New("identity token expired")
+)
+
+// token layout version, signed with the rest of the token
+const tokenVersion = "v1"
+
+// what a token carries
+type claims struct {
+	ID       string `json:"sub"`
+	Name     string `json:"name"`
+	Kind     Kind   `json:"kind"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+}
+
+// Issuer signs and checks identity tokens:
+//
+//	v1.<base64url claims json>.<base64url HMAC-SHA256 of "v1.<claims>">
+type Issuer struct {
+	key []byte
+	ttl time.Duration
+}
+
+// NewIssuer creates an issuer signing with secret. Tokens it issues are valid for ttl
+func NewIssuer(secret string, ttl time.Duration) *Issuer {
+	return &Issuer{key: []byte(secret), ttl: ttl}
+}
+
+// Issue returns a token for id and when it expires
+func (i *Issuer) Issue(id Identity) (string, time.Time) {
+	now := time.Now()
+	expires := now.Add(i.ttl)
+	payload, _ := json.Marshal(claims{
+		ID:       id.ID,
+		Name:     id.Name,
+		Kind:     id.Kind,
+		IssuedAt: now.Unix(),
+		Expires:  expires.Unix(),
+	})
+	signed := tokenVersion + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(i.sign(signed)), expires
+}
+
+// Verify returns the identity in token. ErrInvalidToken if it isn't one of ours,
+// ErrExpiredToken if it's too old
+func (i *Issuer) Verify(token string) (*Identity, error) {
+	signed, signature, ok := cutLast(token, ".")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	version, payload, ok := strings.Cut(signed, ".")
+	if !ok || version != tokenVersion {
+		return nil, ErrInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, i.sign(signed)) {
+		return nil, ErrInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var c claims
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	if c.ID == "" {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Unix() >= c.Expires {
+		return nil, ErrExpiredToken
+	}
+	return &Identity{ID: c.ID, Name: c.Name, Kind: c.Kind}, nil
+}
+
+func (i *Issuer) sign(signed string) []byte {
+	mac := hmac.New(sha256.New, i.key)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+func cutLast(s string, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
@@ -0,0 +1,492 @@
+package identity
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/isaackoz/tronline/store"
+	"github.com/lithammer/shortuuid/v4"
+)
+
+const (
+	// how long a player has to log in at the provider
+	loginTimeout = 10 * time.Minute
+	// requests to the provider
+	providerTimeout = 10 * time.Second
+	// largest provider response read
+	maxProviderResponse = 1024 * 1024
+	// how long a login code is good for, the browser is sent to the login with it right away
+	loginCodeTimeout = time.Minute
+	// logins in progress, and login codes, kept at most. New ones are refused past it
+	maxLogins = 10000
+	// how often expired logins and login codes are dropped
+	loginSweepInterval = time.Minute
+)
+
+var (
+	// the login was never started here, already finished or took too long
+	ErrUnknownLogin = errors.New("unknown or expired login")
+	// the provider refused the login or answered something we can't trust
+	ErrProvider = errors.New("identity provider error")
+	// maxLogins logins are in progress already
+	ErrTooManyLogins = errors.New("too many logins in progress, try again later")
+)
+
+// OIDCConfig is the OpenID Connect provider players log in with
+type OIDCConfig struct {
+	// issuer url, the discovery document is at <issuer>/.well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// the server's callback url, as registered at the provider
+	RedirectURL string
+	// where players are sent back to after logging in, with the session token in the fragment.
+	// The session is answered as json if empty
+	AppURL string
+}
+
+// OIDC logs players in with an OpenID Connect provider using the authorization code flow
+// with PKCE. A guest logging in keeps its id, so its ratings and history carry over to the
+// account.
+//
+// The id token comes straight from the provider's token endpoint over TLS, so as the spec
+// allows, it's trusted without checking its signature
+type OIDC struct {
+	config   OIDCConfig
+	service  *Service
+	sessions *Issuer
+	client   *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+	// logins in progress by state
+	logins map[string]*login
+	// login codes handed out to guests by code
+	codes     map[string]*loginCode
+	lastSweep time.Time
+}
+
+// the parts of the discovery document we use
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// a login in progress
+type login struct {
+	// the guest logging in, empty for a new player
+	guestID  string
+	nonce    string
+	verifier string
+	expires  time.Time
+}
+
+// a guest's one time code to start a login with, so its token isn't put in the login url
+type loginCode struct {
+	guestID string
+	expires time.Time
+}
+
+// NewOIDC creates the login flow. Sessions are signed by sessions, which must share its secret
+// with the service's issuer so the signaling server accepts them
+func NewOIDC(config OIDCConfig, service *Service, sessions *Issuer) *OIDC {
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	return &OIDC{
+		config:   config,
+		service:  service,
+		sessions: sessions,
+		client:   &http.Client{Timeout: providerTimeout},
+		logins:   make(map[string]*login),
+		codes:    make(map[string]*loginCode),
+	}
+}
+
+// Code hands the guest in guestToken a one time code to start its login with, good for
+// loginCodeTimeout
+func (o *OIDC) Code(guestToken string) (code string, expires time.Time, err error) {
+	guest, err := o.service.issuer.Verify(guestToken)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if guest.Kind != KindGuest {
+		return "", time.Time{}, ErrNotGuest
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	o.sweep(now)
+	if len(o.codes) >= maxLogins {
+		return "", time.Time{}, ErrTooManyLogins
+	}
+	code, expires = randomString(), now.Add(loginCodeTimeout)
+	o.codes[code] = &loginCode{guestID: guest.ID, expires: expires}
+	return code, expires, nil
+}
+
+// Begin starts a login and returns the provider url to send the player to and the state the
+// provider sends back. code is a guest's login code from Code, empty for a new player
+func (o *OIDC) Begin(ctx context.Context, code string) (redirect string, state string, err error) {
+	var guestID string
+	if code != "" {
+		o.mu.Lock()
+		c, ok := o.codes[code]
+		delete(o.codes, code)
+		o.mu.Unlock()
+		if !ok || time.Now().After(c.expires) {
+			return "", "", ErrUnknownLogin
+		}
+		guestID = c.guestID
+	}
+	d, err := o.discover(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, nonce, verifier := randomString(), randomString(), randomString()
+	challenge := sha256.Sum256([]byte(verifier))
+	o.mu.Lock()
+	now := time.Now()
+	o.sweep(now)
+	if len(o.logins) >= maxLogins {
+		o.mu.Unlock()
+		return "", "", ErrTooManyLogins
+	}
+	o.logins[state] = &login{guestID: guestID, nonce: nonce, verifier: verifier, expires: now.Add(loginTimeout)}
+	o.mu.Unlock()
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.config.ClientID},
+		"redirect_uri":          {o.config.RedirectURL},
+		"scope":                 {"openid profile email"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + query.Encode(), state, nil
+}
+
+// Finish completes the login the provider sent the player back from and returns its session
+func (o *OIDC) Finish(ctx context.Context, state string, code string) (*Issued, error) {
+	o.mu.Lock()
+	l, ok := o.logins[state]
+	delete(o.logins, state)
+	o.mu.Unlock()
+	if !ok || time.Now().After(l.expires) {
+		return nil, ErrUnknownLogin
+	}
+	d, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	idToken, accessToken, err := o.exchange(ctx, d, code, l.verifier)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := o.checkIDToken(d, idToken, l.nonce)
+	if err != nil {
+		return nil, err
+	}
+	if d.UserinfoEndpoint != "" {
+		info, err := o.userinfo(ctx, d, accessToken)
+		if err != nil {
+			return nil, err
+		}
+		if info.Subject != claims.Subject {
+			return nil, fmt.Errorf("%w: userinfo is about another user", ErrProvider)
+		}
+		claims.merge(info)
+	}
+
+	id, err := o.link(ctx, d.Issuer, claims, l.guestID)
+	if err != nil {
+		return nil, err
+	}
+	signed, expires := o.sessions.Issue(*id)
+	return &Issued{Identity: *id, Token: signed, ExpiresAt: expires}, nil
+}
+
+// drops the expired logins and login codes, at most every loginSweepInterval unless one of
+// them is full. must hold o.mu
+func (o *OIDC) sweep(now time.Time) {
+	if now.Sub(o.lastSweep) < loginSweepInterval && len(o.logins) < maxLogins && len(o.codes) < maxLogins {
+		return
+	}
+	o.lastSweep = now
+	for state, l := range o.logins {
+		if now.After(l.expires) {
+			delete(o.logins, state)
+		}
+	}
+	for code, c := range o.codes {
+		if now.After(c.expires) {
+			delete(o.codes, code)
+		}
+	}
+}
+
+// AppURL is where players are sent back to after logging in, empty if they aren't
+func (o *OIDC) AppURL() string {
+	return o.config.AppURL
+}
+
+// fetches the discovery document once it's needed, again after a failure
+func (o *OIDC) discover(ctx context.Context) (*discovery, error) {
+	o.mu.Lock()
+	d := o.discovery
+	o.mu.Unlock()
+	if d != nil {
+		return d, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.config.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, fmt.Errorf("create discovery request: %w", err)
+	}
+	d = &discovery{}
+	if err := o.do(req, d); err != nil {
+		return nil, fmt.Errorf("discover provider: %w", err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != o.config.Issuer {
+		return nil, fmt.Errorf("%w: discovery document is for issuer %q", ErrProvider, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" {
+		return nil, fmt.Errorf("%w: discovery document without authorization or token endpoint", ErrProvider)
+	}
+	o.mu.Lock()
+	o.discovery = d
+	o.mu.Unlock()
+	return d, nil
+}
+
+// trades the authorization code for the id and access tokens
+func (o *OIDC) exchange(ctx context.Context, d *discovery, code string, verifier string) (string, string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.config.RedirectURL},
+		"client_id":     {o.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", fmt.Errorf("create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if o.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.config.ClientID), url.QueryEscape(o.config.ClientSecret))
+	}
+	var tokens struct {
+		IDToken     string `json:"id_token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := o.do(req, &tokens); err != nil {
+		return "", "", fmt.Errorf("exchange code: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return "", "", fmt.Errorf("%w: no id token", ErrProvider)
+	}
+	return tokens.IDToken, tokens.AccessToken, nil
+}
+
+// the standard claims we use, from the id token and userinfo
+type userinfo struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// fills in what info has from userinfo, the id token's claims stay where it doesn't say
+func (claims *idTokenClaims) merge(info *userinfo) {
+	for _, field := range []struct{ claim, info *string }{
+		{&claims.Email, &info.Email},
+		{&claims.Name, &info.Name},
+		{&claims.PreferredUsername, &info.PreferredUsername},
+	} {
+		if *field.info != "" {
+			*field.claim = *field.info
+		}
+	}
+}
+
+type idTokenClaims struct {
+	userinfo
+	Issuer   string   `json:"iss"`
+	Audience audience `json:"aud"`
+	Expires  int64    `json:"exp"`
+	Nonce    string   `json:"nonce"`
+}
+
+// aud is a string or a list of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (o *OIDC) checkIDToken(d *discovery, token string, nonce string) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed id token", ErrProvider)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed id token", ErrProvider)
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed id token: %w", ErrProvider, err)
+	}
+	switch {
+	case claims.Issuer != d.Issuer:
+		return nil, fmt.Errorf("%w: id token from issuer %q", ErrProvider, claims.Issuer)
+	case !slices.Contains(claims.Audience, o.config.ClientID):
+		return nil, fmt.Errorf("%w: id token is for another client", ErrProvider)
+	case time.Now().Unix() >= claims.Expires:
+		return nil, fmt.Errorf("%w: id token expired", ErrProvider)
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("%w: id token nonce mismatch", ErrProvider)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: id token without subject", ErrProvider)
+	}
+	return &claims, nil
+}
+
+func (o *OIDC) userinfo(ctx context.Context, d *discovery, accessToken string) (*userinfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create userinfo request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	var info userinfo
+	if err := o.do(req, &info); err != nil {
+		return nil, fmt.Errorf("fetch userinfo: %w", err)
+	}
+	return &info, nil
+}
+
+// sends a request to the provider and decodes its json answer into v
+func (o *OIDC) do(req *http.Request, v any) error {
+	req.Header.Set("Accept", "application/json")
+	res, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxProviderResponse))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		var oauthErr struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		json.Unmarshal(body, &oauthErr)
+		if oauthErr.Error != "" {
+			return fmt.Errorf("%w: %s %s", ErrProvider, oauthErr.Error, oauthErr.Description)
+		}
+		return fmt.Errorf("%w: status %d", ErrProvider, res.StatusCode)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("%w: %w", ErrProvider, err)
+	}
+	return nil
+}
+
+// finds the provider user's account, or creates it for the guest logging in or a new player
+func (o *OIDC) link(ctx context.Context, issuer string, claims *idTokenClaims, guestID string) (*Identity, error) {
+	now := time.Now()
+	account, err := o.service.accounts.LoadBySubject(ctx, issuer, claims.Subject)
+	if errors.Is(err, store.ErrNotFound) {
+		id := guestID
+		if id != "" {
+			// a guest is upgraded once, logging in with another provider user makes a new player
+			_, err := o.service.accounts.Load(ctx, id)
+			if err == nil {
+				id = ""
+			} else if !errors.Is(err, store.ErrNotFound) {
+				return nil, fmt.Errorf("load account: %w", err)
+			}
+		}
+		if id == "" {
+			id = shortuuid.New()
+		}
+		account = &store.Account{ID: id, Issuer: issuer, Subject: claims.Subject, CreatedAt: now}
+	} else if err != nil {
+		return nil, fmt.Errorf("load account: %w", err)
+	}
+	if err := o.service.checkBan(ctx, account.ID); err != nil {
+		return nil, err
+	}
+
+	account.Email, account.Name, account.LoginAt = claims.Email, claims.Name, now
+	if err := o.service.accounts.Save(ctx, account); err != nil {
+		return nil, fmt.Errorf("save account: %w", err)
+	}
+
+	// players keep the name they play under, new ones start with the provider's
+	id := &Identity{ID: account.ID, Kind: KindAccount}
+	player, err := o.service.players.Load(ctx, account.ID)
+	switch {
+	case err == nil:
+		id.Name = player.Name
+	case errors.Is(err, store.ErrNotFound):
+		id.Name = providerName(claims, account.ID)
+	default:
+		return nil, fmt.Errorf("load player: %w", err)
+	}
+	if err := o.service.seen(ctx, id); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// a display name from the provider's, cut to fit
+func providerName(claims *idTokenClaims, id string) string {
+	for _, name := range []string{claims.PreferredUsername, claims.Name} {
+		name = strings.TrimSpace(name)
+		for utf8.RuneCountInString(name) > maxNameLength {
+			_, size := utf8.DecodeLastRuneInString(name)
+			name = name[:len(name)-size]
+		}
+		if name != "" && validName(name) {
+			return name
+		}
+	}
+	return "Player " + strings.ToUpper(id[:4])
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
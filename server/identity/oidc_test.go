@@ -0,0 +1,315 @@
+package identity
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/isaackoz/tronline/store"
+)
+
+const (
+	testClientID = "tronline"
+	testSecret   = "0123456789abcdef0123456789abcdef"
+)
+
+// mockProvider is an OpenID Connect provider that logs in whoever the test says. Codes are
+// handed out with grant and can be exchanged once, with the verifier matching the login's
+// challenge
+type mockProvider struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	grants map[string]grant
+}
+
+// what a code is exchanged for
+type grant struct {
+	subject   string
+	name      string
+	nonce     string
+	challenge string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	p := &mockProvider{grants: make(map[string]grant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"userinfo_endpoint":      p.URL + "/userinfo",
+		})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		g, ok := p.grants[r.FormValue("code")]
+		delete(p.grants, r.FormValue("code"))
+		p.mu.Unlock()
+		challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != g.challenge || r.FormValue("client_id") != testClientID {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims, _ := json.Marshal(map[string]any{
+			"iss":   p.URL,
+			"aud":   testClientID,
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"sub":   g.subject,
+			"name":  g.name,
+			"nonce": g.nonce,
+		})
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token":     "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".c2ln",
+			"access_token": "access-" + g.subject,
+		})
+	})
+	mux.HandleFunc("GET /userinfo", func(w http.ResponseWriter, r *http.Request) {
+		subject, ok := accessTokenSubject(r)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"sub": subject, "email": subject + "@example.com"})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// the subject of a mock access token
+func accessTokenSubject(r *http.Request) (string, bool) {
+	token := BearerToken(r)
+	if len(token) <= len("access-") {
+		return "", false
+	}
+	return token[len("access-"):], true
+}
+
+// authorize plays the player logging in at the provider: it grants a code for the login the
+// redirect starts, with the login's nonce unless nonce is set
+func (p *mockProvider) authorize(t *testing.T, redirect string, subject string, nonce string) (state string, code string) {
+	t.Helper()
+	u, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if nonce == "" {
+		nonce = query.Get("nonce")
+	}
+	code = randomString()
+	p.mu.Lock()
+	p.grants[code] = grant{subject: subject, name: "Player " + subject, nonce: nonce, challenge: query.Get("code_challenge")}
+	p.mu.Unlock()
+	return query.Get("state"), code
+}
+
+type oidcTest struct {
+	provider *mockProvider
+	service  *Service
+	store    store.Store
+	mux      *http.ServeMux
+}
+
+func newOIDCTest(t *testing.T) *oidcTest {
+	provider := newMockProvider(t)
+	st := store.NewMemory()
+	service := NewService(NewIssuer(testSecret, time.Hour), st)
+	oidc := NewOIDC(OIDCConfig{
+		Issuer:      provider.URL,
+		ClientID:    testClientID,
+		RedirectURL: "http://tronline.test/auth/callback",
+	}, service, NewIssuer(testSecret, time.Hour))
+	mux := http.NewServeMux()
+	HandleOIDC(mux, oidc)
+	return &oidcTest{provider: provider, service: service, store: st, mux: mux}
+}
+
+// code asks for the login code of the guest in guestToken
+func (o *oidcTest) code(t *testing.T, guestToken string) string {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/auth/login", nil)
+	r.Header.Set("Authorization", "Bearer "+guestToken)
+	w := httptest.NewRecorder()
+	o.mux.ServeHTTP(w, r)
+	var code LoginCode
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&code) != nil || code.Code == "" {
+		t.Fatalf("login code: got status %d: %s", w.Code, w.Body)
+	}
+	return code.Code
+}
+
+// begin starts a login with a guest's login code, empty for a new player
+func (o *oidcTest) begin(code string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	o.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/login?code="+url.QueryEscape(code), nil))
+	return w
+}
+
+// login starts a login for the guest in guestToken (or a new player) and returns the
+// provider redirect and the login cookie
+func (o *oidcTest) login(t *testing.T, guestToken string) (string, *http.Cookie) {
+	t.Helper()
+	var code string
+	if guestToken != "" {
+		code = o.code(t, guestToken)
+	}
+	w := o.begin(code)
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: got status %d: %s", w.Code, w.Body)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != loginCookieName || !cookies[0].HttpOnly {
+		t.Fatalf("login cookie: got %+v", cookies)
+	}
+	return w.Header().Get("Location"), cookies[0]
+}
+
+// callback finishes a login the way the provider sends the player back, with cookie if set
+func (o *oidcTest) callback(state string, code string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/auth/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	o.mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestOIDCCodeExchange(t *testing.T) {
+	o := newOIDCTest(t)
+	redirect, cookie := o.login(t, "")
+	state, code := o.provider.authorize(t, redirect, "user-1", "")
+	w := o.callback(state, code, cookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback: got status %d: %s", w.Code, w.Body)
+	}
+	var issued Issued
+	if err := json.NewDecoder(w.Body).Decode(&issued); err != nil {
+		t.Fatal(err)
+	}
+	if issued.Kind != KindAccount || issued.Name != "Player user-1" {
+		t.Fatalf("issued identity: got %+v", issued.Identity)
+	}
+	if _, err := o.service.Authenticate(context.Background(), issued.Token); err != nil {
+		t.Fatalf("authenticate session: %v", err)
+	}
+	account, err := o.store.Accounts().LoadBySubject(context.Background(), o.provider.URL, "user-1")
+	if err != nil || account.ID != issued.ID || account.Email != "user-1@example.com" {
+		t.Fatalf("account: got %+v, %v", account, err)
+	}
+
+	// the code and state were used up
+	if w := o.callback(state, code, cookie); w.Code != http.StatusBadRequest {
+		t.Fatalf("finish twice: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestOIDCNonceMismatch(t *testing.T) {
+	o := newOIDCTest(t)
+	redirect, cookie := o.login(t, "")
+	state, code := o.provider.authorize(t, redirect, "user-1", "another nonce")
+	if w := o.callback(state, code, cookie); w.Code != http.StatusBadGateway {
+		t.Fatalf("callback: got status %d, want %d", w.Code, http.StatusBadGateway)
+	}
+	if _, err := o.store.Accounts().LoadBySubject(context.Background(), o.provider.URL, "user-1"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("account after a nonce mismatch: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestOIDCStateCookie(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+	}{
+		{"no cookie", nil},
+		{"another login's cookie", &http.Cookie{Name: loginCookieName, Value: randomString()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOIDCTest(t)
+			// the attacker's login, finished in the player's browser
+			redirect, _ := o.login(t, "")
+			state, code := o.provider.authorize(t, redirect, "attacker", "")
+			if w := o.callback(state, code, tt.cookie); w.Code != http.StatusBadRequest {
+				t.Fatalf("callback: got status %d, want %d", w.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestOIDCGuestUpgrade(t *testing.T) {
+	o := newOIDCTest(t)
+	ctx := context.Background()
+	guest, err := o.service.Guest(ctx, "", "flynn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redirect, cookie := o.login(t, guest.Token)
+	state, code := o.provider.authorize(t, redirect, "user-1", "")
+	w := o.callback(state, code, cookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback: got status %d: %s", w.Code, w.Body)
+	}
+	var issued Issued
+	if err := json.NewDecoder(w.Body).Decode(&issued); err != nil {
+		t.Fatal(err)
+	}
+	// the guest keeps its id and name
+	if issued.ID != guest.ID || issued.Name != "flynn" || issued.Kind != KindAccount {
+		t.Fatalf("upgraded identity: got %+v, want the guest's %+v", issued.Identity, guest.Identity)
+	}
+	if _, err := o.service.Authenticate(ctx, guest.Token); !errors.Is(err, ErrUpgraded) {
+		t.Fatalf("guest token after the upgrade: got %v, want ErrUpgraded", err)
+	}
+
+	// a guest is upgraded once, another provider user logging in with it is a new player
+	redirect, cookie = o.login(t, guest.Token)
+	state, code = o.provider.authorize(t, redirect, "user-2", "")
+	w = o.callback(state, code, cookie)
+	var other Issued
+	if err := json.NewDecoder(w.Body).Decode(&other); err != nil {
+		t.Fatal(err)
+	}
+	if other.ID == "" || other.ID == guest.ID {
+		t.Fatalf("second upgrade of guest %s: got id %q", guest.ID, other.ID)
+	}
+}
+
+func TestOIDCLoginCode(t *testing.T) {
+	o := newOIDCTest(t)
+	guest, err := o.service.Guest(context.Background(), "", "flynn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := o.code(t, guest.Token)
+	if w := o.begin(code); w.Code != http.StatusFound {
+		t.Fatalf("login: got status %d: %s", w.Code, w.Body)
+	}
+	// codes are good for one login
+	if w := o.begin(code); w.Code != http.StatusBadRequest {
+		t.Fatalf("login with a used code: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := o.begin(randomString()); w.Code != http.StatusBadRequest {
+		t.Fatalf("login with an unknown code: got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// no token, no code
+	w := httptest.NewRecorder()
+	o.mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth/login", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("login code without a token: got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
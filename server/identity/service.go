@@ -0,0 +1,160 @@
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/isaackoz/tronline/store"
+	"github.com/lithammer/shortuuid/v4"
+)
+
+var (
+	ErrBanned      = errors.New("banned")
+	ErrInvalidName = errors.New("name must be 1 to 24 printable characters")
+	// the guest logged in with an account since, its guest token is no good anymore
+	ErrUpgraded = errors.New("guest identity was upgraded to an account, log in instead")
+	// account sessions are renewed by logging in again
+	ErrNotGuest = errors.New("not a guest identity")
+)
+
+const maxNameLength = 24
+
+// how often a returning player's SeenAt is written, connecting more often doesn't touch the
+// store
+const seenInterval = time.Hour
+
+// Service hands out identities and checks the ones players come back with against the bans
+type Service struct {
+	issuer   *Issuer
+	players  store.PlayerStore
+	accounts store.AccountStore
+	bans     store.BanStore
+}
+
+func NewService(issuer *Issuer, st store.Store) *Service {
+	return &Service{issuer: issuer, players: st.Players(), accounts: st.Accounts(), bans: st.Bans()}
+}
+
+// Issued is an identity and the token proving it
+type Issued struct {
+	Identity
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Guest issues a new guest identity, or renews the one in token so the player keeps its id.
+// An empty name keeps the current one, or picks one for a new guest
+func (s *Service) Guest(ctx context.Context, token string, name string) (*Issued, error) {
+	name = strings.TrimSpace(name)
+	if name != "" && !validName(name) {
+		return nil, ErrInvalidName
+	}
+
+	var id *Identity
+	if token != "" {
+		var err error
+		id, err = s.issuer.Verify(token)
+		if err != nil {
+			return nil, err
+		}
+		if id.Kind != KindGuest {
+			return nil, ErrNotGuest
+		}
+	} else {
+		id = &Identity{ID: shortuuid.New(), Kind: KindGuest}
+		id.Name = "Guest " + strings.ToUpper(id.ID[:4])
+	}
+	if name != "" {
+		id.Name = name
+	}
+	if err := s.check(ctx, id); err != nil {
+		return nil, err
+	}
+	if err := s.seen(ctx, id); err != nil {
+		return nil, err
+	}
+	signed, expires := s.issuer.Issue(*id)
+	return &Issued{Identity: *id, Token: signed, ExpiresAt: expires}, nil
+}
+
+// Authenticate returns the identity in token if it's valid and the player isn't banned
+func (s *Service) Authenticate(ctx context.Context, token string) (*Identity, error) {
+	id, err := s.issuer.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.check(ctx, id); err != nil {
+		return nil, err
+	}
+	if err := s.seen(ctx, id); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// checks an identity may still be used: not banned and not a guest that was upgraded
+func (s *Service) check(ctx context.Context, id *Identity) error {
+	if id.Kind == KindGuest {
+		_, err := s.accounts.Load(ctx, id.ID)
+		if err == nil {
+			return ErrUpgraded
+		}
+		if !errors.Is(err, store.ErrNotFound) {
+			return fmt.Errorf("load account: %w", err)
+		}
+	}
+	return s.checkBan(ctx, id.ID)
+}
+
+func (s *Service) checkBan(ctx context.Context, playerID string) error {
+	ban, err := s.bans.Load(ctx, playerID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("load ban: %w", err)
+	}
+	if !ban.Active(time.Now()) {
+		return nil
+	}
+	if ban.ExpiresAt.IsZero() {
+		return fmt.Errorf("%w: %s", ErrBanned, ban.Reason)
+	}
+	return fmt.Errorf("%w until %s: %s", ErrBanned, ban.ExpiresAt.UTC().Format(time.RFC3339), ban.Reason)
+}
+
+// records the player as seen now, creating it the first time. Only saves when the name
+// changed or the player wasn't seen for seenInterval
+func (s *Service) seen(ctx context.Context, id *Identity) error {
+	now := time.Now()
+	player, err := s.players.Load(ctx, id.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		player = &store.Player{ID: id.ID, CreatedAt: now}
+	} else if err != nil {
+		return fmt.Errorf("load player: %w", err)
+	} else if player.Name == id.Name && now.Sub(player.SeenAt) < seenInterval {
+		return nil
+	}
+	player.Name, player.SeenAt = id.Name, now
+	if err := s.players.Save(ctx, player); err != nil {
+		return fmt.Errorf("save player: %w", err)
+	}
+	return nil
+}
+
+func validName(name string) bool {
+	if utf8.RuneCountInString(name) > maxNameLength {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
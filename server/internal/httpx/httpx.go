@@ -0,0 +1,32 @@
+// Package httpx has the helpers the json endpoints of every package share
+package httpx
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+const (
+	DefaultListLimit = 20
+	MaxListLimit     = 100
+)
+
+// Pagination reads ?offset= and ?limit= with sane bounds
+func Pagination(r *http.Request) (offset int, limit int) {
+	offset, _ = strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = DefaultListLimit
+	}
+	return max(offset, 0), min(limit, MaxListLimit)
+}
+
+// WriteJSON answers v as json
+func WriteJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("encode response", "error", err)
+	}
+}
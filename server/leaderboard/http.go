@@ -0,0 +1,53 @@
+package leaderboard
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/isaackoz/tronline/internal/httpx"
+	"github.com/isaackoz/tronline/store"
+)
+
+// HandleLeaderboard registers the leaderboard endpoint:
+//
+//	GET /leaderboard?window=all-time|season|weekly&offset=&limit=&player=<id>
+//
+// player adds where that player is on the board, i.e. the player's own rank for the menu
+func HandleLeaderboard(mux *http.ServeMux, leaderboard *Leaderboard) {
+	mux.HandleFunc("GET /leaderboard", func(w http.ResponseWriter, r *http.Request) {
+		window, err := ParseWindow(r.URL.Query().Get("window"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		offset, limit := httpx.Pagination(r)
+		entries, err := leaderboard.Top(r.Context(), window, offset, limit)
+		if err != nil {
+			slog.Error("list leaderboard", "error", err, "window", window)
+			http.Error(w, "could not list leaderboard", http.StatusInternalServerError)
+			return
+		}
+
+		var player *Entry
+		if id := r.URL.Query().Get("player"); id != "" {
+			player, err = leaderboard.Rank(r.Context(), window, id)
+			if err != nil && !errors.Is(err, store.ErrNotFound) {
+				slog.Error("rank player", "error", err, "window", window, "player_id", id)
+				http.Error(w, "could not rank player", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		httpx.WriteJSON(w, map[string]any{
+			"window":  window,
+			"period":  PeriodAt(window, time.Now()),
+			"entries": entries,
+			"offset":  offset,
+			"limit":   limit,
+			// null when the player isn't on the board
+			"player": player,
+		})
+	})
+}
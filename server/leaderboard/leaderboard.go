@@ -0,0 +1,353 @@
+// Package leaderboard rates players with Elo after every ranked match and ranks them on an
+// all-time board and on boards that start over every season and every week
+package leaderboard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isaackoz/tronline/result"
+	"github.com/isaackoz/tronline/store"
+)
+
+// Window is how far back a leaderboard goes
+type Window string
+
+const (
+	WindowAllTime Window = "all-time"
+	// seasons are calendar quarters
+	WindowSeason Window = "season"
+	// weeks start on monday, UTC
+	WindowWeekly Window = "weekly"
+)
+
+var Windows = []Window{WindowAllTime, WindowSeason, WindowWeekly}
+
+var ErrInvalidWindow = errors.New("window must be all-time, season or weekly")
+
+func ParseWindow(s string) (Window, error) {
+	switch w := Window(s); w {
+	case "":
+		return WindowAllTime, nil
+	case WindowAllTime, WindowSeason, WindowWeekly:
+		return w, nil
+	default:
+		return "", ErrInvalidWindow
+	}
+}
+
+// Period is the stretch of a window a board covers
+type Period struct {
+	// the board's name in the store, i.e. "season-2026-q4"
+	Board string `json:"board"`
+	// zero for all-time
+	StartsAt time.Time `json:"startsAt,omitzero"`
+	EndsAt   time.Time `json:"endsAt,omitzero"`
+}
+
+// PeriodAt returns the period of w that t falls in
+func PeriodAt(w Window, t time.Time) Period {
+	t = t.UTC()
+	switch w {
+	case WindowSeason:
+		start := time.Date(t.Year(), (t.Month()-1)/3*3+1, 1, 0, 0, 0, 0, time.UTC)
+		return Period{
+			Board:    fmt.Sprintf("season-%d-q%d", start.Year(), (start.Month()-1)/3+1),
+			StartsAt: start,
+			EndsAt:   start.AddDate(0, 3, 0),
+		}
+	case WindowWeekly:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		start := day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		year, week := start.ISOWeek()
+		return Period{
+			Board:    fmt.Sprintf("week-%d-w%02d", year, week),
+			StartsAt: start,
+			EndsAt:   start.AddDate(0, 0, 7),
+		}
+	default:
+		return Period{Board: string(WindowAllTime)}
+	}
+}
+
+const (
+	// rating of a player's first match on a board
+	startRating = 1000
+	// most a rating moves in one match
+	kFactor = 32
+	// how long a board is served from memory. Recording a match drops its boards right away,
+	// this only bounds how stale names get
+	cacheTTL = time.Minute
+	// how many of a board's top entries are kept in memory, pages past them come from the store
+	cachedEntries = 1000
+)
+
+// Entry is a player's place on a leaderboard
+type Entry struct {
+	Rank     int    `json:"rank"`
+	PlayerID string `json:"playerId"`
+	Name     string `json:"name"`
+	Rating   int    `json:"rating"`
+	Matches  int    `json:"matches"`
+	Wins     int    `json:"wins"`
+	Losses   int    `json:"losses"`
+	Draws    int    `json:"draws"`
+}
+
+// Leaderboard keeps the ratings in the store up to date and serves the boards
+type Leaderboard struct {
+	ratings store.RatingStore
+	players store.PlayerStore
+
+	// ratings are read, updated and written back, one match at a time
+	recordMu sync.Mutex
+
+	mu sync.Mutex
+	// the top entries by board
+	cache map[string]*cached
+}
+
+type cached struct {
+	entries []Entry
+	expires time.Time
+}
+
+func New(ratings store.RatingStore, players store.PlayerStore) *Leaderboard {
+	return &Leaderboard{
+		ratings: ratings,
+		players: players,
+		cache:   make(map[string]*cached),
+	}
+}
+
+// Record updates the ratings of the players of a confirmed ranked match between two people,
+// or of one only a player reported. Other results are ignored. Meant for result.Config.Recorded
+func (l *Leaderboard) Record(ctx context.Context, r *result.Result) {
+	winner, ok := ratedWinner(r)
+	if !ok {
+		return
+	}
+	l.recordMu.Lock()
+	defer l.recordMu.Unlock()
+	for _, w := range Windows {
+		board := PeriodAt(w, r.FinishedAt).Board
+		if err := l.rate(ctx, board, r, winner); err != nil {
+			slog.Error("update ratings", "error", err, "match_id", r.ID, "board", board)
+			continue
+		}
+		l.invalidate(board)
+	}
+	slog.Debug("updated ratings", "match_id", r.ID, "players", r.Players, "winner", winner)
+}
+
+// ratedWinner returns the side the ratings count as the winner of r, -1 for a draw. Ratings
+// only count matches between two people that everybody agrees on, and ones a player didn't
+// report before the reporting window closed: not reporting a loss doesn't keep a rating up,
+// the player who didn't report loses. ok is false for matches that aren't rated
+func ratedWinner(r *result.Result) (winner int, ok bool) {
+	if !r.Ranked || len(r.Players) != 2 || r.Players[0] == r.Players[1] {
+		return -1, false
+	}
+	for _, id := range r.Players {
+		if strings.HasPrefix(id, "bot-") {
+			return -1, false
+		}
+	}
+	switch r.Status {
+	case result.StatusConfirmed:
+		return r.Winner, true
+	case result.StatusUnconfirmed:
+		if len(r.Reports) != 2 || (r.Reports[0] == nil) == (r.Reports[1] == nil) {
+			return -1, false
+		}
+		if r.Reports[0] != nil {
+			return 0, true
+		}
+		return 1, true
+	}
+	return -1, false
+}
+
+// applies the result, won by winner, to both players' ratings on board
+func (l *Leaderboard) rate(ctx context.Context, board string, r *result.Result, winner int) error {
+	ratings := make([]*store.Rating, 2)
+	for i, id := range r.Players {
+		rating, err := l.ratings.Load(ctx, board, id)
+		if errors.Is(err, store.ErrNotFound) {
+			rating = &store.Rating{Board: board, PlayerID: id, Rating: startRating}
+		} else if err != nil {
+			return fmt.Errorf("load rating: %w", err)
+		}
+		ratings[i] = rating
+	}
+
+	// score of player 0: 1 for a win, 0.5 for a draw
+	score := 0.5
+	switch winner {
+	case 0:
+		score = 1
+	case 1:
+		score = 0
+	}
+	delta := eloDelta(ratings[0].Rating, ratings[1].Rating, score)
+	now := time.Now()
+	for i, rating := range ratings {
+		rating.Matches++
+		switch {
+		case winner < 0 || winner > 1:
+			rating.Draws++
+		case winner == i:
+			rating.Wins++
+		default:
+			rating.Losses++
+		}
+		rating.UpdatedAt = now
+	}
+	ratings[0].Rating += delta
+	ratings[1].Rating -= delta
+	for _, rating := range ratings {
+		if err := l.ratings.Save(ctx, rating); err != nil {
+			return fmt.Errorf("save rating: %w", err)
+		}
+	}
+	return nil
+}
+
+// how many points a player rated a gains from one rated b with score (1 win, 0.5 draw,
+// 0 loss). b loses as many
+func eloDelta(a int, b int, score float64) int {
+	expected := 1 / (1 + math.Pow(10, float64(b-a)/400))
+	return int(math.Round(kFactor * (score - expected)))
+}
+
+// Top returns a page of the board of w's current period
+func (l *Leaderboard) Top(ctx context.Context, w Window, offset int, limit int) ([]Entry, error) {
+	board := PeriodAt(w, time.Now()).Board
+	entries, err := l.top(ctx, board)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) < cachedEntries || offset+limit <= len(entries) {
+		return page(entries, offset, limit), nil
+	}
+
+	// past the cached part of a big board
+	ratings, err := l.ratings.Top(ctx, board, offset, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list ratings: %w", err)
+	}
+	entries = make([]Entry, len(ratings))
+	for i, rating := range ratings {
+		entries[i] = l.entry(ctx, offset+i+1, rating)
+	}
+	return entries, nil
+}
+
+// Rank returns where the player is on the board of w's current period, store.ErrNotFound if
+// it didn't play a ranked match in it
+func (l *Leaderboard) Rank(ctx context.Context, w Window, playerID string) (*Entry, error) {
+	board := PeriodAt(w, time.Now()).Board
+	entries, err := l.top(ctx, board)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.PlayerID == playerID {
+			return &entry, nil
+		}
+	}
+	if len(entries) < cachedEntries {
+		return nil, store.ErrNotFound
+	}
+
+	rating, err := l.ratings.Load(ctx, board, playerID)
+	if err != nil {
+		return nil, err
+	}
+	rank, err := l.ratings.Rank(ctx, board, playerID)
+	if err != nil {
+		return nil, err
+	}
+	entry := l.entry(ctx, rank, rating)
+	return &entry, nil
+}
+
+// the first cachedEntries entries of board, from the cache while they're fresh
+func (l *Leaderboard) top(ctx context.Context, board string) ([]Entry, error) {
+	if entries, ok := l.cached(board); ok {
+		return entries, nil
+	}
+	ratings, err := l.ratings.Top(ctx, board, 0, cachedEntries)
+	if err != nil {
+		return nil, fmt.Errorf("list ratings: %w", err)
+	}
+	entries := make([]Entry, len(ratings))
+	for i, rating := range ratings {
+		entries[i] = l.entry(ctx, i+1, rating)
+	}
+	l.put(board, entries)
+	return entries, nil
+}
+
+func (l *Leaderboard) entry(ctx context.Context, rank int, rating *store.Rating) Entry {
+	entry := Entry{
+		Rank:     rank,
+		PlayerID: rating.PlayerID,
+		Rating:   rating.Rating,
+		Matches:  rating.Matches,
+		Wins:     rating.Wins,
+		Losses:   rating.Losses,
+		Draws:    rating.Draws,
+	}
+	if player, err := l.players.Load(ctx, rating.PlayerID); err == nil {
+		entry.Name = player.Name
+	}
+	return entry
+}
+
+func (l *Leaderboard) cached(board string) ([]Entry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.cache[board]
+	if !ok || time.Now().After(c.expires) {
+		return nil, false
+	}
+	return c.entries, true
+}
+
+func (l *Leaderboard) put(board string, entries []Entry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	// boards of past periods aren't asked for anymore
+	for board, c := range l.cache {
+		if now.After(c.expires) {
+			delete(l.cache, board)
+		}
+	}
+	l.cache[board] = &cached{entries: entries, expires: now.Add(cacheTTL)}
+}
+
+// drops the cached entries of board
+func (l *Leaderboard) invalidate(board string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.cache, board)
+}
+
+func page[T any](items []T, offset int, limit int) []T {
+	if offset >= len(items) {
+		return []T{}
+	}
+	items = items[offset:]
+	if limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
@@ -0,0 +1,21 @@
+// Package lockstep is the reference implementation of the P2P lockstep protocol. Every peer
+// sends its input for each tick ahead of time (input delay), a tick is only simulated once
+// the inputs of every player are in, and peers periodically exchange state checksums to
+// detect a desync. The verifier replays uploaded input logs to find where peers diverged
+package lockstep
+
+import "github.com/isaackoz/tronline/game"
+
+// InputFrame is a player's input for a tick. Seq increases by one with every frame a peer
+// sends, so missing or reordered frames are noticed
+type InputFrame struct {
+	Seq   uint32     `json:"seq"`
+	Tick  int        `json:"tick"`
+	Input game.Input `json:"input"`
+}
+
+// ChecksumFrame is a peer's state checksum after simulating a tick
+type ChecksumFrame struct {
+	Tick     int    `json:"tick"`
+	Checksum uint32 `json:"checksum"`
+}
@@ -0,0 +1,85 @@
+package lockstep
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/isaackoz/tronline/ratelimit"
+)
+
+const (
+	// largest upload accepted by the verifier
+	maxVerifyBody = 4 * 1024 * 1024
+	// verifications a player can ask for per minute, every one replays whole matches
+	verifiesPerMinute = 5
+	// longest log accepted, the grid is hashed on every tick of both logs so the work a
+	// request costs grows with ticks times cells
+	maxVerifyTicks = 20000
+	// largest arena accepted, in cells
+	maxVerifyCells = 128 * 128
+)
+
+type verifyRequest struct {
+	Logs []*InputLog `json:"logs"`
+}
+
+// HandleVerifier registers the endpoint that replays two peers' uploaded input logs
+// and reports where they diverged. It's a check for the peers only, nothing ties the logs to
+// a match so nothing is recorded. authenticate tells which player sent the request, answering
+// it itself when nobody did
+func HandleVerifier(mux *http.ServeMux, authenticate func(w http.ResponseWriter, r *http.Request) (string, bool)) {
+	limit := ratelimit.NewKeyed(verifiesPerMinute, time.Minute)
+	mux.HandleFunc("POST /lockstep/verify", func(w http.ResponseWriter, r *http.Request) {
+		playerID, ok := authenticate(w, r)
+		if !ok {
+			return
+		}
+		if !limit.Allow(playerID) || !limit.Allow(ratelimit.ClientIP(r)) {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		var req verifyRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxVerifyBody)).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		if len(req.Logs) != 2 {
+			http.Error(w, "exactly two logs are required", http.StatusBadRequest)
+			return
+		}
+		for _, log := range req.Logs {
+			if err := checkVerifyLimits(log); err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		report, err := Verify(req.Logs[0], req.Logs[1])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		slog.Debug("verified lockstep logs", "ticks", report.Ticks, "diverged", report.Diverged, "tick", report.Tick, "reason", report.Reason)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			slog.Debug("encode verify report", "error", err)
+		}
+	})
+}
+
+// rejects logs too long or for arenas too large to be replayed on request
+func checkVerifyLimits(log *InputLog) error {
+	if log == nil {
+		return nil
+	}
+	if len(log.Inputs) > maxVerifyTicks {
+		return fmt.Errorf("log has %d ticks, at most %d are verified", len(log.Inputs), maxVerifyTicks)
+	}
+	if cells := log.Settings.Width * log.Settings.Height; cells > maxVerifyCells {
+		return fmt.Errorf("arena has %d cells, at most %d are verified", cells, maxVerifyCells)
+	}
+	return nil
+}
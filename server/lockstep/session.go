@@ -0,0 +1,213 @@
+package lockstep
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/isaackoz/tronline/game"
+)
+
+var (
+	ErrSequence = errors.New("input frame out of sequence")
+	ErrTick     = errors.New("input frame for the wrong tick")
+)
+
+// DesyncError is returned when a remote checksum doesn't match ours
+type DesyncError struct {
+	Tick   int
+	Player int
+	Local  uint32
+	Remote uint32
+}
+
+func (e *DesyncError) Error() string {
+	return fmt.Sprintf("desync with player %d at tick %d: local checksum %08x, remote %08x", e.Player, e.Tick, e.Local, e.Remote)
+}
+
+type Config struct {
+	// ticks between a local input and the tick it's applied on. Hides the latency
+	// to the other peers. Defaults to 3
+	InputDelay int
+	// ticks between checksum exchanges. Defaults to 10
+	ChecksumInterval int
+}
+
+// Session is one peer's side of a lockstep match
+type Session struct {
+	local  int
+	config Config
+	state  *game.State
+	log    *InputLog
+
+	// inputs by tick, then player. nil until received
+	inputs map[int][]*game.Input
+	// last sequence sent by us and received from each player
+	sentSeq uint32
+	recvSeq []uint32
+	// tick the next local input is scheduled for
+	nextLocalTick int
+	// remote checksums for ticks we haven't simulated yet
+	pending []remoteChecksum
+}
+
+type remoteChecksum struct {
+	player int
+	frame  ChecksumFrame
+}
+
+// NewSession creates a session for the local player. Ticks up to the input delay have
+// no inputs, everybody drives straight
+func NewSession(settings game.Settings, local int, config Config) (*Session, error) {
+	if config.InputDelay <= 0 {
+		config.InputDelay = 3
+	}
+	if config.ChecksumInterval <= 0 {
+		config.ChecksumInterval = 10
+	}
+	state, err := game.New(settings)
+	if err != nil {
+		return nil, err
+	}
+	if local < 0 || local >= settings.Players {
+		return nil, fmt.Errorf("local player %d out of range", local)
+	}
+
+	s := &Session{
+		local:         local,
+		config:        config,
+		state:         state,
+		log:           &InputLog{Settings: settings, Player: local},
+		inputs:        make(map[int][]*game.Input),
+		recvSeq:       make([]uint32, settings.Players),
+		nextLocalTick: config.InputDelay + 1,
+	}
+	for tick := 1; tick <= config.InputDelay; tick++ {
+		inputs := make([]*game.Input, settings.Players)
+		for i := range inputs {
+			inputs[i] = &game.Input{}
+		}
+		s.inputs[tick] = inputs
+	}
+	return s, nil
+}
+
+// State is the simulation. It must not be modified
+func (s *Session) State() *game.State {
+	return s.state
+}
+
+// Log is everything simulated so far, for upload to the verifier
+func (s *Session) Log() *InputLog {
+	return s.log
+}
+
+// AddLocalInput schedules the local input for the next free tick and returns the frame to send
+// to the other peers. Call it once per tick, with a zero input if nothing was pressed
+func (s *Session) AddLocalInput(input game.Input) InputFrame {
+	s.sentSeq++
+	frame := InputFrame{Seq: s.sentSeq, Tick: s.nextLocalTick, Input: input}
+	s.set(s.local, frame.Tick, input)
+	s.nextLocalTick++
+	return frame
+}
+
+// AddRemoteInput stores a frame received from another player. Frames must arrive in order,
+// each one for the tick after the previous
+func (s *Session) AddRemoteInput(player int, frame InputFrame) error {
+	if player < 0 || player >= len(s.recvSeq) || player == s.local {
+		return fmt.Errorf("invalid remote player %d", player)
+	}
+	if frame.Seq <= s.recvSeq[player] {
+		// duplicate, i.e. resent over an unreliable channel
+		return nil
+	}
+	if frame.Seq != s.recvSeq[player]+1 {
+		return fmt.Errorf("%w: player %d expected %d, got %d", ErrSequence, player, s.recvSeq[player]+1, frame.Seq)
+	}
+	if want := s.config.InputDelay + int(frame.Seq); frame.Tick != want {
+		return fmt.Errorf("%w: player %d seq %d should be tick %d, got %d", ErrTick, player, frame.Seq, want, frame.Tick)
+	}
+	s.recvSeq[player] = frame.Seq
+	s.set(player, frame.Tick, frame.Input)
+	return nil
+}
+
+func (s *Session) set(player int, tick int, input game.Input) {
+	inputs := s.inputs[tick]
+	if inputs == nil {
+		inputs = make([]*game.Input, len(s.recvSeq))
+		s.inputs[tick] = inputs
+	}
+	inputs[player] = &input
+}
+
+// Ready reports whether the inputs of every player for the next tick are in
+func (s *Session) Ready() bool {
+	inputs := s.inputs[s.state.Tick+1]
+	if inputs == nil {
+		return false
+	}
+	for _, input := range inputs {
+		if input == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Advance simulates the next tick if every input is in. Every checksum interval it
+// returns the checksum frame to send to the other peers. Returns a *DesyncError if a remote
+// checksum received earlier for this tick doesn't match
+func (s *Session) Advance() (stepped bool, checksum *ChecksumFrame, err error) {
+	if !s.Ready() {
+		return false, nil, nil
+	}
+	tick := s.state.Tick + 1
+	inputs := make([]game.Input, len(s.recvSeq))
+	for i, input := range s.inputs[tick] {
+		inputs[i] = *input
+	}
+	delete(s.inputs, tick)
+	s.state.Step(inputs)
+
+	sum := s.state.Checksum()
+	s.log.Inputs = append(s.log.Inputs, inputs)
+	s.log.Checksums = append(s.log.Checksums, sum)
+	if tick%s.config.ChecksumInterval == 0 {
+		checksum = &ChecksumFrame{Tick: tick, Checksum: sum}
+	}
+
+	remaining := s.pending[:0]
+	for _, remote := range s.pending {
+		if remote.frame.Tick != tick {
+			remaining = append(remaining, remote)
+			continue
+		}
+		if err == nil {
+			err = s.compare(remote.player, remote.frame)
+		}
+	}
+	s.pending = remaining
+	return true, checksum, err
+}
+
+// AddRemoteChecksum compares another player's checksum with ours. Returns a *DesyncError
+// if they differ. Checksums for ticks we haven't simulated yet are compared once we have
+func (s *Session) AddRemoteChecksum(player int, frame ChecksumFrame) error {
+	if frame.Tick < 1 {
+		return fmt.Errorf("invalid checksum tick %d", frame.Tick)
+	}
+	if frame.Tick > s.state.Tick {
+		s.pending = append(s.pending, remoteChecksum{player: player, frame: frame})
+		return nil
+	}
+	return s.compare(player, frame)
+}
+
+func (s *Session) compare(player int, frame ChecksumFrame) error {
+	local := s.log.Checksums[frame.Tick-1]
+	if local != frame.Checksum {
+		return &DesyncError{Tick: frame.Tick, Player: player, Local: local, Remote: frame.Checksum}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package lockstep
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/isaackoz/tronline/game"
+)
+
+// InputLog is everything a peer simulated: the inputs of every player for each tick and
+// the checksum of its state after each tick
+type InputLog struct {
+	Settings game.Settings `json:"settings"`
+	// the uploading peer
+	Player int `json:"player"`
+	// Inputs[i] are the inputs of tick i+1, one per player
+	Inputs [][]game.Input `json:"inputs"`
+	// Checksums[i] is the checksum after tick i+1
+	Checksums []uint32 `json:"checksums"`
+}
+
+// DivergenceReason is what differed first between two peers
+type DivergenceReason string
+
+const (
+	// the peers applied different inputs on the tick
+	DivergenceInputs DivergenceReason = "inputs"
+	// same inputs, but a peer's state is different from the replay
+	DivergenceState DivergenceReason = "state"
+)
+
+// Report is the verifier's verdict
+type Report struct {
+	// ticks both logs cover
+	Ticks    int  `json:"ticks"`
+	Diverged bool `json:"diverged"`
+	// first tick the peers differ on, 0 if they never did
+	Tick   int              `json:"tick,omitempty"`
+	Reason DivergenceReason `json:"reason,omitempty"`
+	// peers whose reported checksums don't match the replay of their own inputs,
+	// i.e. a modified or broken client
+	Faulty []int `json:"faulty,omitempty"`
+	// outcome of replaying the first log. -1 for a draw or unfinished match
+	Winner int  `json:"winner"`
+	Over   bool `json:"over"`
+}
+
+// Verify replays both peers' logs through the simulation and finds the first tick they
+// diverged on. Peers with a checksum that doesn't match the replay of their own inputs are
+// reported as faulty
+func Verify(a *InputLog, b *InputLog) (*Report, error) {
+	if a == nil || b == nil {
+		return nil, errors.New("two input logs are required")
+	}
+	if !a.Settings.Equal(b.Settings) {
+		return nil, errors.New("the logs are for different match settings")
+	}
+	if a.Player == b.Player {
+		return nil, errors.New("the logs are from the same player")
+	}
+
+	replayA, err := Replay(a)
+	if err != nil {
+		return nil, fmt.Errorf("replay player %d: %w", a.Player, err)
+	}
+	replayB, err := Replay(b)
+	if err != nil {
+		return nil, fmt.Errorf("replay player %d: %w", b.Player, err)
+	}
+
+	report := &Report{
+		Ticks:  min(len(a.Inputs), len(b.Inputs)),
+		Winner: -1,
+	}
+	for i := 0; i < report.Ticks; i++ {
+		if !slices.Equal(a.Inputs[i], b.Inputs[i]) {
+			report.Diverged, report.Tick, report.Reason = true, i+1, DivergenceInputs
+			break
+		}
+		if a.Checksums[i] != b.Checksums[i] {
+			report.Diverged, report.Tick, report.Reason = true, i+1, DivergenceState
+			break
+		}
+	}
+
+	// a peer is faulty if it reported a state its own inputs don't produce
+	for _, replay := range []*ReplayResult{replayA, replayB} {
+		if replay.FirstMismatch > 0 {
+			report.Faulty = append(report.Faulty, replay.Player)
+		}
+	}
+
+	report.Over = replayA.Final.Over()
+	if winner, ok := replayA.Final.Winner(); ok {
+		report.Winner = winner
+	}
+	return report, nil
+}
+
+// ReplayResult is a single log replayed through the simulation
+type ReplayResult struct {
+	Player int
+	Final  *game.State
+	// first tick where the log's checksum differs from the replay, 0 if none did
+	FirstMismatch int
+}
+
+// Replay simulates a log's inputs and compares the state with the log's checksums
+func Replay(log *InputLog) (*ReplayResult, error) {
+	if len(log.Checksums) != len(log.Inputs) {
+		return nil, fmt.Errorf("log has %d ticks of inputs but %d checksums", len(log.Inputs), len(log.Checksums))
+	}
+	state, err := game.New(log.Settings)
+	if err != nil {
+		return nil, err
+	}
+	result := &ReplayResult{Player: log.Player}
+	for i, inputs := range log.Inputs {
+		if len(inputs) != log.Settings.Players {
+			return nil, fmt.Errorf("tick %d has %d inputs for %d players", i+1, len(inputs), log.Settings.Players)
+		}
+		state.Step(inputs)
+		if result.FirstMismatch == 0 && state.Checksum() != log.Checksums[i] {
+			result.FirstMismatch = i + 1
+		}
+	}
+	result.Final = state
+	return result, nil
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"log/slog"
@@ -12,8 +14,19 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/isaackoz/tronline/arena"
 	"github.com/isaackoz/tronline/cfg"
+	"github.com/isaackoz/tronline/history"
+	"github.com/isaackoz/tronline/identity"
+	"github.com/isaackoz/tronline/leaderboard"
+	"github.com/isaackoz/tronline/lockstep"
+	"github.com/isaackoz/tronline/replay"
+	"github.com/isaackoz/tronline/result"
 	"github.com/isaackoz/tronline/signaling"
+	"github.com/isaackoz/tronline/store"
+	"github.com/isaackoz/tronline/stun"
+	"github.com/isaackoz/tronline/tournament"
+	"github.com/isaackoz/tronline/turnserver"
 )
 
 // ref: https://victoriametrics.com/blog/go-graceful-shutdown/#summary
@@ -23,6 +36,15 @@ const (
 	_readinessDrainDelay = 5 * time.Second
 )
 
+const (
+	// how long P2P players have to report the outcome of their match
+	resultReportWindow = 15 * time.Minute
+	// how long P2P players have to upload their input logs when their result is verified
+	resultLogWindow = 5 * time.Minute
+	// how long players caught cheating in a re-simulated P2P match are banned
+	cheaterBanDuration = 7 * 24 * time.Hour
+)
+
 var isShuttingDown atomic.Bool
 
 func main() {
@@ -55,8 +77,102 @@ func main() {
 		fmt.Fprintln(w, "OK")
 	})
 
+	// ice servers. TURN credentials are cached and shared between clients
+	iceProvider, err := newICEProvider(config)
+	if err != nil {
+		log.Fatal("create ice provider", err)
+	}
+	slog.Info("using ice provider", "provider", iceProvider.Name())
+	ice := signaling.NewICEServerCache(iceProvider)
+
+	// built-in stun server, only advertised once its port is bound
+	if config.StunAddr != "" {
+		stunServer := stun.NewServer(config.StunAddr)
+		stunConn, err := stunServer.Listen()
+		if err != nil {
+			log.Fatal("start stun server", err)
+		}
+		_, stunPort, _ := net.SplitHostPort(stunConn.LocalAddr().String())
+		go func() {
+			if err := stunServer.Serve(ctx, stunConn); err != nil {
+				slog.Error("stun server", "error", err)
+			}
+		}()
+		ice.AddLocal(signaling.LocalSTUNServer(config.StunPublicHost, stunPort))
+	}
+
+	// built-in turn server
+	var turnServer *turnserver.Server
+	if config.TurnServerEnabled() {
+		turnServer, err = newTurnServer(ctx, config, ice)
+		if err != nil {
+			log.Fatal("start turn server", err)
+		}
+	}
+
+	// persistence
+	st, err := store.Open(config.StorePath)
+	if err != nil {
+		log.Fatal("open store", err)
+	}
+	if config.ReplayDir != "" || config.ResultDir != "" {
+		if config.StorePath == "" {
+			slog.Warn("REPLAY_DIR and RESULT_DIR are only imported, set STORE_PATH to keep new records")
+		}
+		if err := store.ImportDirs(ctx, st, config.ReplayDir, config.ResultDir); err != nil {
+			log.Fatal("import replay and result dirs", err)
+		}
+	}
+	replays := st.Replays()
+
+	// player identities
+	ids, oidc, err := newIdentityService(config, st)
+	if err != nil {
+		log.Fatal("create identity service", err)
+	}
+
+	// ratings, updated with every ranked result
+	leaderboards := leaderboard.New(st.Ratings(), st.Players())
+
+	// match results. Tournaments need the hub, which needs the results, so they're set below,
+	// before anything records a result
+	var tournaments *tournament.Service
+	results := result.NewReconciler(st.Results(), result.Config{
+		ReportWindow: resultReportWindow,
+		LogWindow:    resultLogWindow,
+		AuditRate:    config.AuditRate,
+		Recorded: func(ctx context.Context, r *result.Result) {
+			leaderboards.Record(ctx, r)
+			tournaments.Record(ctx, r)
+		},
+		Caught: func(ctx context.Context, r *result.Result, cheater result.Cheater) {
+			now := time.Now()
+			ban := &store.Ban{
+				PlayerID:  cheater.ID,
+				Reason:    fmt.Sprintf("caught cheating (%s) in match %s", cheater.Reason, r.ID),
+				CreatedAt: now,
+				ExpiresAt: now.Add(cheaterBanDuration),
+			}
+			if err := st.Bans().Save(ctx, ban); err != nil {
+				slog.Error("ban cheater", "error", err, "player_id", cheater.ID, "match_id", r.ID)
+			}
+		},
+	})
+
 	// hub
-	hub := signaling.NewHub()
+	hub := signaling.NewHub(signaling.RoomConfig{
+		RelayEnabled:         config.RelayEnabled,
+		RelayBandwidth:       config.RelayBandwidth,
+		HostedTickRate:       config.HostedTickRate,
+		HostedRollbackWindow: config.HostedRollbackWindow,
+		Replays:              replays,
+		Results:              results,
+	})
+
+	// tournaments, their matches are played in rooms of the hub
+	tournaments = tournament.New(ctx, hub, st.Tournaments(), st.Ratings())
+	go tournaments.Run(ctx)
+	go results.Run(ctx)
 
 	if !config.Production {
 		// log the hub stats every 10 seconds
@@ -69,6 +185,22 @@ func main() {
 					slog.Debug("hub stats",
 						"rooms", len(hub.Rooms),
 					)
+					if turnServer != nil {
+						slog.Debug("turn server stats",
+							"allocations", turnServer.AllocationCount(),
+						)
+					}
+					for _, stats := range iceProvider.Stats() {
+						slog.Debug("ice provider stats",
+							"provider", stats.Name,
+							"requests", stats.Requests,
+							"errors", stats.Errors,
+							"timeouts", stats.Timeouts,
+							"skipped", stats.Skipped,
+							"stale_served", stats.StaleServed,
+							"breaker_open", stats.BreakerOpen,
+						)
+					}
 				case <-ctx.Done():
 					slog.Info("stopping hub stats logging")
 					return
@@ -78,7 +210,45 @@ func main() {
 	}
 
 	// signaling server
-	signaling.HandleSignalServer(ctx, mux, hub)
+	signaling.HandleSignalServer(ctx, mux, hub, ice, ids)
+
+	// guest identities and logging in
+	identity.HandleIdentity(mux, ids)
+	if oidc != nil {
+		identity.HandleOIDC(mux, oidc)
+	}
+
+	// lockstep input log verifier, for players only
+	lockstep.HandleVerifier(mux, func(w http.ResponseWriter, r *http.Request) (string, bool) {
+		id, ok := ids.Require(w, r)
+		if !ok {
+			return "", false
+		}
+		return id.ID, true
+	})
+
+	// replay listing and downloads
+	replay.HandleReplays(mux, replays)
+
+	// P2P match reports and the result listing
+	result.HandleResults(mux, results)
+
+	// top players
+	leaderboard.HandleLeaderboard(mux, leaderboards)
+
+	// players' match history and stats
+	history.HandleHistory(mux, history.New(st.Results(), st.Players()))
+
+	// tournament brackets and their events
+	tournament.HandleTournaments(mux, tournaments, ids)
+
+	// built-in arenas hosts can pick from
+	arena.HandleArenas(mux)
+
+	// provider and relay counters for operators
+	if config.AdminToken != "" {
+		handleAdmin(mux, config.AdminToken, iceProvider, turnServer)
+	}
 
 	handler := corsMiddleware(mux)
 
@@ -115,5 +285,35 @@ func main() {
 		slog.Error("graceful shutdown did not complete in time", "err", err)
 		time.Sleep(_shutdownPeriodHard)
 	}
+	if err := st.Close(); err != nil {
+		slog.Error("close store", "error", err)
+	}
 	slog.Info("shutdown complete. goodbye")
 }
+
+// creates the identity service, with a random secret if none is configured, and the login flow
+// if a provider is configured
+func newIdentityService(config *cfg.Config, st store.Store) (*identity.Service, *identity.OIDC, error) {
+	secret := config.IdentitySecret
+	if secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, fmt.Errorf("generate identity secret: %w", err)
+		}
+		secret = base64.StdEncoding.EncodeToString(b)
+		slog.Warn("IDENTITY_SECRET is empty, using a random secret. identities won't survive a restart")
+	}
+	service := identity.NewService(identity.NewIssuer(secret, config.IdentityTTL), st)
+	if !config.OIDCEnabled() {
+		return service, nil, nil
+	}
+	oidc := identity.NewOIDC(identity.OIDCConfig{
+		Issuer:       config.OIDCIssuer,
+		ClientID:     config.OIDCClientID,
+		ClientSecret: config.OIDCClientSecret,
+		RedirectURL:  config.OIDCRedirectURL,
+		AppURL:       config.OIDCAppURL,
+	}, service, identity.NewIssuer(secret, config.SessionTTL))
+	slog.Info("player login enabled", "issuer", config.OIDCIssuer)
+	return service, oidc, nil
+}
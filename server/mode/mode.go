@@ -0,0 +1,168 @@
+// Package mode is the rules layer on top of the simulation: who plays, on which side, when a
+// round is over, who won it and how rounds add up to a match
+package mode
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/isaackoz/tronline/game"
+)
+
+type Kind string
+
+const (
+	// one on one
+	KindDuel Kind = "duel"
+	// everybody for themselves, last cycle standing. Empty slots are filled with bots
+	KindFFA Kind = "ffa"
+	// two teams of two, the host and the guest are on different teams with a bot each
+	KindTeams Kind = "teams"
+	// the host survives against bots until the time runs out
+	KindSurvival Kind = "survival"
+)
+
+const (
+	ffaPlayers      = 4
+	teamsPlayers    = 4
+	survivalPlayers = 4
+	// longest survival time a host can ask for
+	maxTimeLimit = 10 * 60
+	// most rounds a match can have
+	maxBestOf = 9
+)
+
+// Mode is how a match is played
+type Mode struct {
+	Kind Kind `json:"kind"`
+	// rounds of the match. The first side to win more than half of them wins
+	BestOf int `json:"bestOf"`
+	// teams only, teammates can drive through each other's trails
+	FriendlyPass bool `json:"friendlyPass,omitempty"`
+	// survival only, seconds to survive
+	TimeLimit int `json:"timeLimit,omitempty"`
+}
+
+// Default is a single round duel
+var Default = Mode{Kind: KindDuel, BestOf: 1}
+
+func (m Mode) Validate() error {
+	switch m.Kind {
+	case KindDuel, KindFFA, KindTeams:
+		if m.TimeLimit != 0 {
+			return errors.New("only survival has a time limit")
+		}
+	case KindSurvival:
+		if m.TimeLimit <= 0 || m.TimeLimit > maxTimeLimit {
+			return fmt.Errorf("survival time limit must be between 1 and %d seconds", maxTimeLimit)
+		}
+	default:
+		return fmt.Errorf("invalid game mode %q", m.Kind)
+	}
+	if m.BestOf < 1 || m.BestOf > maxBestOf || m.BestOf%2 == 0 {
+		return fmt.Errorf("best of must be an odd number between 1 and %d", maxBestOf)
+	}
+	if m.FriendlyPass && m.Kind != KindTeams {
+		return errors.New("friendly pass needs teams")
+	}
+	return nil
+}
+
+// Players is how many cycles are in a round
+func (m Mode) Players() int {
+	switch m.Kind {
+	case KindFFA:
+		return ffaPlayers
+	case KindTeams:
+		return teamsPlayers
+	case KindSurvival:
+		return survivalPlayers
+	default:
+		return 2
+	}
+}
+
+// Humans is how many of the players are people, the host is player 0 and the guest player 1.
+// The other players are bots
+func (m Mode) Humans() int {
+	if m.Kind == KindSurvival {
+		return 1
+	}
+	return 2
+}
+
+// Sides is how many sides can win a round. Scores are kept per side
+func (m Mode) Sides() int {
+	switch m.Kind {
+	case KindTeams, KindSurvival:
+		return 2
+	default:
+		return m.Players()
+	}
+}
+
+// Side returns the side a player is on: the team in teams, the survivors (0) or the bots (1)
+// in survival, and the player themselves otherwise
+func (m Mode) Side(player int) int {
+	switch m.Kind {
+	case KindTeams:
+		return player % 2
+	case KindSurvival:
+		if player < m.Humans() {
+			return 0
+		}
+		return 1
+	default:
+		return player
+	}
+}
+
+// Apply adds the mode's rules to the arena settings of a round
+func (m Mode) Apply(settings game.Settings) game.Settings {
+	settings.Players = m.Players()
+	if m.Kind == KindTeams {
+		settings.Teams = make([]int, settings.Players)
+		for i := range settings.Teams {
+			settings.Teams[i] = m.Side(i)
+		}
+		settings.FriendlyPass = m.FriendlyPass
+	}
+	return settings
+}
+
+// RoundResult reports whether the round is over and which side won it, -1 for a draw.
+// timeLimit is the survival time limit in ticks. Rounds hitting the sudden death tick cap
+// are decided by its tie break, survivors win them in survival
+func (m Mode) RoundResult(state *game.State, timeLimit int) (over bool, side int) {
+	alive := make([]bool, m.Sides())
+	for _, player := range state.Alive() {
+		alive[m.Side(player)] = true
+	}
+
+	if m.Kind == KindSurvival {
+		switch {
+		case !alive[0]:
+			return true, 1
+		case !alive[1] || state.Tick >= timeLimit || state.TimeUp():
+			return true, 0
+		}
+		return false, -1
+	}
+
+	side, left := -1, 0
+	for i, ok := range alive {
+		if ok {
+			side = i
+			left++
+		}
+	}
+	switch {
+	case left == 0:
+		return true, -1
+	case left == 1:
+		return true, side
+	case state.TimeUp():
+		return true, state.TieBreak(m.Side)
+	}
+	return false, -1
+}
@@ -0,0 +1,57 @@
+package mode
+
+// Series keeps the score over the rounds of a match
+type Series struct {
+	mode   Mode
+	scores []int
+	rounds int
+}
+
+func NewSeries(mode Mode) *Series {
+	return &Series{mode: mode, scores: make([]int, mode.Sides())}
+}
+
+// Record adds the result of a round, side is -1 for a draw
+func (s *Series) Record(side int) {
+	s.rounds++
+	if side >= 0 && side < len(s.scores) {
+		s.scores[side]++
+	}
+}
+
+// Round is the number of the next round, starting at 1
+func (s *Series) Round() int {
+	return s.rounds + 1
+}
+
+// Scores returns rounds won per side
+func (s *Series) Scores() []int {
+	return append([]int(nil), s.scores...)
+}
+
+// Over reports whether a side won more than half the rounds or every round was played
+func (s *Series) Over() bool {
+	if s.rounds >= s.mode.BestOf {
+		return true
+	}
+	for _, score := range s.scores {
+		if score > s.mode.BestOf/2 {
+			return true
+		}
+	}
+	return false
+}
+
+// Winner returns the side with the most rounds won, -1 on a tie
+func (s *Series) Winner() int {
+	winner, best := -1, -1
+	for side, score := range s.scores {
+		switch {
+		case score > best:
+			winner, best = side, score
+		case score == best:
+			winner = -1
+		}
+	}
+	return winner
+}
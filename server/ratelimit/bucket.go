@@ -0,0 +1,81 @@
+// Package ratelimit has a small token bucket used to cap relayed bandwidth and request rates
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket that refills at rate tokens (bytes) per second, up to burst
+type Bucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket creates a full bucket. A rate <= 0 means unlimited
+func NewBucket(rate int, burst int) *Bucket {
+	if burst < rate {
+		burst = rate
+	}
+	return &Bucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes n tokens from the bucket, returning false (and taking nothing) if there aren't enough
+func (b *Bucket) Allow(n int) bool {
+	if b == nil || b.rate <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Wait blocks until n tokens are available and takes them, or until ctx is done
+func (b *Bucket) Wait(ctx context.Context, n int) error {
+	if b == nil || b.rate <= 0 {
+		return nil
+	}
+	if float64(n) > b.burst {
+		return fmt.Errorf("%d tokens exceeds the bucket burst of %d", n, int(b.burst))
+	}
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		if b.tokens >= float64(n) {
+			b.tokens -= float64(n)
+			b.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((float64(n) - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Keyed keeps a bucket per key, i.e. per client ip, so one client can't use up the requests
+// of everybody else
+type Keyed struct {
+	rate  float64
+	burst float64
+	per   time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+}
+
+// NewKeyed allows n requests per key every per, all of them at once if the key was idle
+func NewKeyed(n int, per time.Duration) *Keyed {
+	return &Keyed{
+		rate:      float64(n) / per.Seconds(),
+		burst:     float64(n),
+		per:       per,
+		buckets:   make(map[string]*Bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a request from key's bucket, returning false if it has none left
+func (k *Keyed) Allow(key string) bool {
+	if k == nil || k.rate <= 0 {
+		return true
+	}
+	k.mu.Lock()
+	now := time.Now()
+	if now.Sub(k.lastSweep) > k.per {
+		k.sweep(now)
+	}
+	bucket, ok := k.buckets[key]
+	if !ok {
+		bucket = &Bucket{rate: k.rate, burst: k.burst, tokens: k.burst, last: now}
+		k.buckets[key] = bucket
+	}
+	k.mu.Unlock()
+	return bucket.Allow(1)
+}
+
+// drops the buckets idle long enough to be full again, they'd start full anyway
+func (k *Keyed) sweep(now time.Time) {
+	k.lastSweep = now
+	for key, bucket := range k.buckets {
+		bucket.mu.Lock()
+		idle := now.Sub(bucket.last)
+		bucket.mu.Unlock()
+		if idle > k.per {
+			delete(k.buckets, key)
+		}
+	}
+}
+
+// ClientIP is the ip r came from, to key the buckets of anonymous clients
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,201 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/isaackoz/tronline/game"
+)
+
+// FormatVersion is the version of the binary layout, not of the game rules
+const FormatVersion = 2
+
+var magic = [4]byte{'T', 'R', 'R', 'P'}
+
+// extension of replay files
+const fileExt = ".trr"
+
+// largest header accepted when decoding
+const maxHeaderSize = 64 * 1024
+
+var ErrNotReplay = errors.New("not a replay file")
+
+/*
+	Binary format, all integers are unsigned varints unless noted
+	magic        "TRRP"
+	version      uint16 big endian (FormatVersion)
+	header len   + header as json
+	input count  + per input: tick delta since the previous input, player, input flags
+
+	input flags are the turn in the low 2 bits, then boost and jump. Version 1 only stored
+	the turn
+*/
+
+const (
+	flagBoost = 1 << 2
+	flagJump  = 1 << 3
+)
+
+// Encode writes the replay in the compact binary format
+func Encode(w io.Writer, r *Replay) error {
+	header, err := json.Marshal(r.Header)
+	if err != nil {
+		return fmt.Errorf("marshal header: %w", err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(magic[:])
+	buf.Write(binary.BigEndian.AppendUint16(nil, FormatVersion))
+	buf.Write(binary.AppendUvarint(nil, uint64(len(header))))
+	buf.Write(header)
+	buf.Write(binary.AppendUvarint(nil, uint64(len(r.Inputs))))
+	prevTick := 0
+	for _, event := range r.Inputs {
+		if event.Tick < prevTick {
+			return errors.New("inputs are not ordered by tick")
+		}
+		buf.Write(binary.AppendUvarint(nil, uint64(event.Tick-prevTick)))
+		buf.Write(binary.AppendUvarint(nil, uint64(event.Player)))
+		buf.Write(binary.AppendUvarint(nil, inputFlags(event.Input)))
+		prevTick = event.Tick
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// Decode reads a replay of any known format version
+func Decode(r io.Reader) (*Replay, error) {
+	br := bufio.NewReader(r)
+	version, err := readVersion(br)
+	if err != nil {
+		return nil, err
+	}
+	replay := &Replay{}
+	if replay.Header, err = readHeader(br); err != nil {
+		return nil, err
+	}
+	switch version {
+	case 1:
+		err = decodeInputs(br, replay, func(flags uint64) (game.Input, bool) {
+			return game.Input{Turn: game.Turn(flags)}, flags <= uint64(game.TurnRight)
+		})
+	default:
+		err = decodeInputs(br, replay, flagsInput)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return replay, nil
+}
+
+// DecodeHeader reads only the header of a replay, for listings that don't need the inputs
+func DecodeHeader(r io.Reader) (Header, error) {
+	br := bufio.NewReader(r)
+	if _, err := readVersion(br); err != nil {
+		return Header{}, err
+	}
+	return readHeader(br)
+}
+
+// reads the magic and the format version, which has to be a known one
+func readVersion(br *bufio.Reader) (uint16, error) {
+	var head [6]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return 0, ErrNotReplay
+	}
+	if [4]byte(head[:4]) != magic {
+		return 0, ErrNotReplay
+	}
+	version := binary.BigEndian.Uint16(head[4:])
+	if version < 1 || version > FormatVersion {
+		return 0, fmt.Errorf("unsupported replay format version %d", version)
+	}
+	return version, nil
+}
+
+func inputFlags(input game.Input) uint64 {
+	flags := uint64(input.Turn)
+	if input.Boost {
+		flags |= flagBoost
+	}
+	if input.Jump {
+		flags |= flagJump
+	}
+	return flags
+}
+
+func flagsInput(flags uint64) (game.Input, bool) {
+	input := game.Input{
+		Turn:  game.Turn(flags & 3),
+		Boost: flags&flagBoost != 0,
+		Jump:  flags&flagJump != 0,
+	}
+	return input, input.Turn <= game.TurnRight && flags&^(3|flagBoost|flagJump) == 0
+}
+
+// reads the header after the version
+func readHeader(br *bufio.Reader) (Header, error) {
+	var header Header
+	headerLen, err := binary.ReadUvarint(br)
+	if err != nil {
+		return header, fmt.Errorf("read header length: %w", err)
+	}
+	if headerLen > maxHeaderSize {
+		return header, fmt.Errorf("header of %d bytes is too large", headerLen)
+	}
+	data := make([]byte, headerLen)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return header, fmt.Errorf("read header: %w", err)
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return header, fmt.Errorf("unmarshal header: %w", err)
+	}
+	return header, nil
+}
+
+// decodeInputs reads the inputs after the header into replay. input converts the stored input
+// value, ok is false when it's invalid
+func decodeInputs(br *bufio.Reader, replay *Replay, input func(uint64) (game.Input, bool)) error {
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return fmt.Errorf("read input count: %w", err)
+	}
+	// every input is at least 3 bytes, don't trust the count for the allocation
+	replay.Inputs = make([]InputEvent, 0, min(count, 1<<16))
+	tick := 0
+	for i := uint64(0); i < count; i++ {
+		var values [3]uint64
+		for j := range values {
+			if values[j], err = binary.ReadUvarint(br); err != nil {
+				return fmt.Errorf("read input %d: %w", i, err)
+			}
+		}
+		tick += int(values[0])
+		in, ok := input(values[2])
+		if values[1] >= game.MaxPlayers || !ok {
+			return fmt.Errorf("input %d is invalid", i)
+		}
+		replay.Inputs = append(replay.Inputs, InputEvent{
+			Tick:   tick,
+			Player: int(values[1]),
+			Input:  in,
+		})
+	}
+	return nil
+}
+
+func sortInputs(inputs []InputEvent) {
+	slices.SortStableFunc(inputs, func(a InputEvent, b InputEvent) int {
+		if a.Tick != b.Tick {
+			return cmp.Compare(a.Tick, b.Tick)
+		}
+		return cmp.Compare(a.Player, b.Player)
+	})
+}
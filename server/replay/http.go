@@ -0,0 +1,50 @@
+package replay
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/isaackoz/tronline/internal/httpx"
+)
+
+// HandleReplays registers the replay listing and download endpoints
+func HandleReplays(mux *http.ServeMux, store Store) {
+	mux.HandleFunc("GET /replays", func(w http.ResponseWriter, r *http.Request) {
+		offset, limit := httpx.Pagination(r)
+		headers, err := store.List(r.Context(), offset, limit)
+		if err != nil {
+			slog.Error("list replays", "error", err)
+			http.Error(w, "could not list replays", http.StatusInternalServerError)
+			return
+		}
+		httpx.WriteJSON(w, map[string]any{
+			"replays": headers,
+			"offset":  offset,
+			"limit":   limit,
+		})
+	})
+
+	// the compact binary format by default, ?format=json for the decoded replay
+	mux.HandleFunc("GET /replays/{id}", func(w http.ResponseWriter, r *http.Request) {
+		replay, err := store.Load(r.Context(), r.PathValue("id"))
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "replay not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("load replay", "error", err, "replay_id", r.PathValue("id"))
+			http.Error(w, "could not load replay", http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Query().Get("format") == "json" {
+			httpx.WriteJSON(w, replay)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+replay.Header.ID+fileExt+`"`)
+		if err := Encode(w, replay); err != nil {
+			slog.Debug("encode replay", "error", err)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+// Package replay records matches as their settings plus the inputs of every tick, which is
+// all that's needed to simulate them again
+package replay
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/isaackoz/tronline/game"
+	"github.com/isaackoz/tronline/mode"
+	"github.com/lithammer/shortuuid/v4"
+)
+
+// Player is a participant of a recorded match
+type Player struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// Header is everything about a match except its inputs
+type Header struct {
+	ID string `json:"id"`
+	// game.RulesVersion the match was played with
+	RulesVersion int           `json:"rulesVersion"`
+	Settings     game.Settings `json:"settings"`
+	Seed         int64         `json:"seed"`
+	Players      []Player      `json:"players"`
+	// "hosted" or "verified"
+	Source string `json:"source"`
+	// rounds of the same match share the match id
+	Match      string    `json:"match,omitempty"`
+	Round      int       `json:"round,omitempty"`
+	Mode       mode.Mode `json:"mode"`
+	RecordedAt time.Time `json:"recordedAt"`
+	// ticks simulated
+	Ticks int `json:"ticks"`
+	// winning side of the round (see mode.Mode.Side), -1 for a draw
+	Winner int `json:"winner"`
+}
+
+// InputEvent is a player's input on a tick. Ticks without one are no turn
+type InputEvent struct {
+	Tick   int        `json:"tick"`
+	Player int        `json:"player"`
+	Input  game.Input `json:"input"`
+}
+
+type Replay struct {
+	Header Header `json:"header"`
+	// ordered by tick, then player
+	Inputs []InputEvent `json:"inputs"`
+}
+
+// Simulate plays the replay back and returns the final state. Replays recorded with older
+// rules the current ones would play differently are refused
+func (r *Replay) Simulate() (*game.State, error) {
+	if err := game.CheckRules(r.Header.RulesVersion, r.Header.Settings); err != nil {
+		return nil, fmt.Errorf("simulate replay: %w", err)
+	}
+	state, err := game.New(r.Header.Settings)
+	if err != nil {
+		return nil, err
+	}
+	next := 0
+	inputs := make([]game.Input, r.Header.Settings.Players)
+	for tick := 1; tick <= r.Header.Ticks; tick++ {
+		clear(inputs)
+		for next < len(r.Inputs) && r.Inputs[next].Tick == tick {
+			event := r.Inputs[next]
+			if event.Player < 0 || event.Player >= len(inputs) {
+				return nil, fmt.Errorf("input for invalid player %d on tick %d", event.Player, tick)
+			}
+			inputs[event.Player] = event.Input
+			next++
+		}
+		state.Step(inputs)
+	}
+	return state, nil
+}
+
+// Recorder collects the inputs of a match as it's played
+type Recorder struct {
+	header Header
+	inputs []InputEvent
+}
+
+func NewRecorder(settings game.Settings, seed int64, players []Player, source string) *Recorder {
+	return &Recorder{
+		header: Header{
+			ID:           shortuuid.New(),
+			RulesVersion: game.RulesVersion,
+			Settings:     settings,
+			Seed:         seed,
+			Players:      players,
+			Source:       source,
+			Mode:         mode.Default,
+			Winner:       -1,
+		},
+	}
+}
+
+// SetMatch marks the replay as a round of a match played in the mode
+func (r *Recorder) SetMatch(matchID string, round int, m mode.Mode) {
+	r.header.Match = matchID
+	r.header.Round = round
+	r.header.Mode = m
+}
+
+// Record adds the input a player's cycle was simulated with on a tick. No turn inputs are skipped
+func (r *Recorder) Record(tick int, player int, input game.Input) {
+	if input == (game.Input{}) {
+		return
+	}
+	r.inputs = append(r.inputs, InputEvent{Tick: tick, Player: player, Input: input})
+}
+
+// Finish returns the replay of the round that ended after ticks with the winning side (-1 for a draw)
+func (r *Recorder) Finish(ticks int, winner int) *Replay {
+	header := r.header
+	header.Ticks = ticks
+	header.Winner = winner
+	header.RecordedAt = time.Now().UTC()
+
+	// rollbacks can record inputs out of order
+	inputs := make([]InputEvent, 0, len(r.inputs))
+	for _, event := range r.inputs {
+		if event.Tick <= ticks {
+			inputs = append(inputs, event)
+		}
+	}
+	sortInputs(inputs)
+	return &Replay{Header: header, Inputs: inputs}
+}
@@ -0,0 +1,85 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+)
+
+var ErrNotFound = errors.New("replay not found")
+
+// Store persists replays
+type Store interface {
+	Save(ctx context.Context, r *Replay) error
+	Load(ctx context.Context, id string) (*Replay, error)
+	// newest first
+	List(ctx context.Context, offset int, limit int) ([]Header, error)
+}
+
+// replays a MemoryStore keeps before it drops the oldest
+const maxMemoryReplays = 1000
+
+// MemoryStore keeps the latest replays in memory, they're gone on restart
+type MemoryStore struct {
+	mu      sync.RWMutex
+	replays map[string][]byte
+	headers []Header
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{replays: make(map[string][]byte)}
+}
+
+func (s *MemoryStore) Save(ctx context.Context, r *Replay) error {
+	var buf bytes.Buffer
+	if err := Encode(&buf, r); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.replays[r.Header.ID]; exists {
+		i := slices.IndexFunc(s.headers, func(h Header) bool { return h.ID == r.Header.ID })
+		s.headers[i] = r.Header
+	} else {
+		s.headers = append(s.headers, r.Header)
+	}
+	s.replays[r.Header.ID] = buf.Bytes()
+	if len(s.headers) > maxMemoryReplays {
+		for _, h := range s.headers[:len(s.headers)-maxMemoryReplays] {
+			delete(s.replays, h.ID)
+		}
+		s.headers = slices.Clone(s.headers[len(s.headers)-maxMemoryReplays:])
+	}
+	return nil
+}
+
+func (s *MemoryStore) Load(ctx context.Context, id string) (*Replay, error) {
+	s.mu.RLock()
+	data, ok := s.replays[id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return Decode(bytes.NewReader(data))
+}
+
+func (s *MemoryStore) List(ctx context.Context, offset int, limit int) ([]Header, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	headers := slices.Clone(s.headers)
+	slices.Reverse(headers)
+	return page(headers, offset, limit), nil
+}
+
+func page[T any](items []T, offset int, limit int) []T {
+	if offset >= len(items) {
+		return []T{}
+	}
+	items = items[offset:]
+	if limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
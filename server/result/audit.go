@@ -0,0 +1,211 @@
+package result
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/isaackoz/tronline/lockstep"
+)
+
+// Outcome is what re-simulating the players' input logs found
+type Outcome string
+
+const (
+	// every report matches the re-simulation
+	OutcomeClean Outcome = "clean"
+	// at least one player cheated, see Verdict.Cheaters
+	OutcomeCheated Outcome = "cheated"
+	// the logs weren't enough to re-simulate the match: missing, invalid, cut short or the
+	// players claim different inputs
+	OutcomeInconclusive Outcome = "inconclusive"
+)
+
+// CheatReason is how a player cheated
+type CheatReason string
+
+const (
+	// the player's checksums don't match the simulation of its own inputs, i.e. a modified client
+	CheatModifiedState CheatReason = "modified-state"
+	// the reported outcome, i.e. the winner, isn't the one the re-simulation ends with
+	CheatFalseReport CheatReason = "false-report"
+)
+
+// Cheater is a player caught cheating
+type Cheater struct {
+	Player int `json:"player"`
+	// the player's id
+	ID     string      `json:"id"`
+	Reason CheatReason `json:"reason"`
+}
+
+// Verdict is the outcome of re-simulating a P2P match from the players' input logs with the
+// authoritative engine. Logs cover the last round, so reports are checked against its final
+// state
+type Verdict struct {
+	Outcome Outcome `json:"outcome"`
+	// winner of the re-simulated round, -1 for a draw, an unfinished round or when inconclusive.
+	// The last round decides the match, so it's the match's winner too
+	Winner int `json:"winner"`
+	// single round matches only. rounds won per side, earlier rounds aren't in the logs
+	Scores []int `json:"scores,omitempty"`
+	// last tick and final state checksum of the re-simulation
+	Ticks    int       `json:"ticks"`
+	Checksum uint32    `json:"checksum"`
+	Cheaters []Cheater `json:"cheaters,omitempty"`
+	// players who didn't upload a valid log
+	MissingLogs []int `json:"missingLogs,omitempty"`
+	// first tick the logs differ on, 0 if they don't
+	Divergence int       `json:"divergence,omitempty"`
+	VerifiedAt time.Time `json:"verifiedAt"`
+}
+
+// SignLog returns the signature a player puts on its input log upload: the hex HMAC-SHA256,
+// keyed with the player's report key, of
+//
+//	matchID|player|<log json>
+func SignLog(key string, matchID string, player int, log []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(matchID + "|" + strconv.Itoa(player) + "|"))
+	mac.Write(log)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify re-simulates the uploaded logs (by player, nil if missing) of a match of bestOf rounds
+// and checks every report against it. The logs were checked against the settings of the room
+// on upload. It takes both players' logs to decide anything: a single log, i.e. a cheater's
+// made up one, or logs of a round that isn't over leave the match inconclusive, only players
+// whose own log doesn't add up are caught then. So does a last round that was a draw in a
+// longer match, the earlier rounds decided it
+func verify(result *Result, logs []*lockstep.InputLog, bestOf int) *Verdict {
+	verdict := &Verdict{Winner: -1, VerifiedAt: time.Now()}
+	cheated := make([]bool, len(result.Players))
+	cheat := func(player int, reason CheatReason) {
+		cheated[player] = true
+		verdict.Cheaters = append(verdict.Cheaters, Cheater{Player: player, ID: result.Players[player], Reason: reason})
+	}
+	inconclusive := func() *Verdict {
+		verdict.Outcome = OutcomeInconclusive
+		if len(verdict.Cheaters) > 0 {
+			verdict.Outcome = OutcomeCheated
+		}
+		return verdict
+	}
+
+	// logs matching their own checksums and their re-simulations
+	var consistent []*lockstep.InputLog
+	var replays []*lockstep.ReplayResult
+	for player, log := range logs {
+		if log == nil {
+			verdict.MissingLogs = append(verdict.MissingLogs, player)
+			continue
+		}
+		replay, err := lockstep.Replay(log)
+		if err != nil {
+			verdict.MissingLogs = append(verdict.MissingLogs, player)
+			continue
+		}
+		if replay.FirstMismatch > 0 {
+			cheat(player, CheatModifiedState)
+			continue
+		}
+		consistent = append(consistent, log)
+		replays = append(replays, replay)
+	}
+	if len(consistent) != len(result.Players) {
+		return inconclusive()
+	}
+	report, err := lockstep.Verify(consistent[0], consistent[1])
+	if err != nil || report.Diverged && report.Reason == lockstep.DivergenceInputs {
+		// both logs are sound but the players claim different inputs, there's no telling
+		// who's lying without signed inputs
+		if report != nil {
+			verdict.Divergence = report.Tick
+		}
+		return inconclusive()
+	}
+	// the logs agree on the ticks they share, the longer one goes the furthest
+	authoritative := replays[0]
+	if replays[1].Final.Tick > authoritative.Final.Tick {
+		authoritative = replays[1]
+	}
+	final := authoritative.Final
+	if !final.Over() {
+		// both logs stop before the round is over
+		return inconclusive()
+	}
+
+	verdict.Ticks, verdict.Checksum = final.Tick, final.Checksum()
+	if winner, ok := final.Winner(); ok {
+		verdict.Winner = winner
+	}
+	if bestOf <= 1 {
+		verdict.Scores = make([]int, len(result.Players))
+		if verdict.Winner >= 0 {
+			verdict.Scores[verdict.Winner]++
+		}
+	} else if verdict.Winner < 0 {
+		return inconclusive()
+	}
+	for player, report := range result.Reports {
+		if report == nil || cheated[player] {
+			continue
+		}
+		if verdict.Scores == nil && report.Winner < 0 && tiedFirst(report.Scores, verdict.Winner) {
+			// every round was played and the last one only drew the scores level, it takes the
+			// earlier rounds to tell
+			verdict.Winner = -1
+			return inconclusive()
+		}
+		if report.Ticks != verdict.Ticks || report.Checksum != verdict.Checksum || report.Winner != verdict.Winner ||
+			verdict.Scores != nil && !slices.Equal(report.Scores, verdict.Scores) {
+			cheat(player, CheatFalseReport)
+		}
+	}
+	verdict.Outcome = OutcomeClean
+	if len(verdict.Cheaters) > 0 {
+		verdict.Outcome = OutcomeCheated
+	}
+	return verdict
+}
+
+// reports whether side is one of the sides with the most rounds won in scores
+func tiedFirst(scores []int, side int) bool {
+	return side < len(scores) && scores[side] == slices.Max(scores)
+}
+
+// applies a verdict to a result that was being verified. agreed is whether the reports
+// agreed before the verification
+func applyVerdict(result *Result, verdict *Verdict, agreed bool) {
+	result.Verdict = verdict
+	if verdict.Outcome == OutcomeInconclusive {
+		result.Status = StatusDisputed
+		if agreed {
+			// sampled and nobody uploaded anything useful, the reports still agree
+			result.Status = StatusConfirmed
+		}
+		return
+	}
+
+	// the outcome of the re-simulation. P2P rounds have no time limit, they end in a crash.
+	// The scores of the earlier rounds of a longer match come from an honest report, which
+	// agrees with the re-simulation on the last one
+	result.Status = StatusConfirmed
+	result.Winner, result.Ticks, result.Reason, result.Scores = verdict.Winner, verdict.Ticks, "crash", verdict.Scores
+	if verdict.Scores != nil {
+		return
+	}
+	for player, report := range result.Reports {
+		honest := report != nil
+		for _, cheater := range verdict.Cheaters {
+			honest = honest && cheater.Player != player
+		}
+		if honest {
+			result.Scores = report.Scores
+			break
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package result
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/isaackoz/tronline/game"
+	"github.com/isaackoz/tronline/lockstep"
+)
+
+// a duel player 1 wins: player 0 turns into player 1's trail
+var duel = game.Settings{
+	Width:   16,
+	Height:  16,
+	Players: 2,
+	Spawns: []game.Spawn{
+		{Pos: game.Point{X: 2, Y: 2}, Dir: game.Right},
+		{Pos: game.Point{X: 2, Y: 10}, Dir: game.Right},
+	},
+}
+
+// plays the duel to the end, returns both players' logs and the report of what happened
+func playDuel(t *testing.T) ([]*lockstep.InputLog, *Report) {
+	t.Helper()
+	state, err := game.New(duel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inputs [][]game.Input
+	var checksums []uint32
+	for !state.Over() {
+		tick := make([]game.Input, 2)
+		if state.Tick == 0 {
+			tick[0].Turn = game.TurnRight
+		}
+		state.Step(tick)
+		inputs = append(inputs, tick)
+		checksums = append(checksums, state.Checksum())
+	}
+	winner, ok := state.Winner()
+	if !ok || winner != 1 {
+		t.Fatalf("duel: got winner %d, want 1", winner)
+	}
+	logs := make([]*lockstep.InputLog, 2)
+	for player := range logs {
+		logs[player] = &lockstep.InputLog{Settings: duel, Player: player, Inputs: inputs, Checksums: slices.Clone(checksums)}
+	}
+	return logs, &Report{Winner: 1, Ticks: state.Tick, Reason: "crash", Scores: []int{0, 1}, Checksum: state.Checksum()}
+}
+
+// a p2p result both players reported, the reports are changed by lie
+func reported(honest *Report, lie func(reports []*Report)) *Result {
+	reports := make([]*Report, 2)
+	for i := range reports {
+		report := *honest
+		report.Scores = slices.Clone(honest.Scores)
+		reports[i] = &report
+	}
+	if lie != nil {
+		lie(reports)
+	}
+	return &Result{ID: "m1", Source: SourceP2P, Players: []string{"p0", "p1"}, Winner: -1, Reports: reports}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		bestOf int
+		lie    func(reports []*Report)
+		// changes the uploaded logs
+		tamper  func(logs []*lockstep.InputLog)
+		outcome Outcome
+		// cheaters by player
+		cheaters map[int]CheatReason
+	}{
+		{name: "honest", bestOf: 1, outcome: OutcomeClean},
+		{
+			name:   "loser claims the win",
+			bestOf: 1,
+			lie: func(reports []*Report) {
+				reports[0].Winner, reports[0].Scores = 0, []int{1, 0}
+			},
+			outcome:  OutcomeCheated,
+			cheaters: map[int]CheatReason{0: CheatFalseReport},
+		},
+		{
+			name:   "loser claims a draw",
+			bestOf: 1,
+			lie: func(reports []*Report) {
+				reports[0].Winner, reports[0].Scores = -1, []int{0, 0}
+			},
+			outcome:  OutcomeCheated,
+			cheaters: map[int]CheatReason{0: CheatFalseReport},
+		},
+		{
+			name:   "loser only changes the scores",
+			bestOf: 1,
+			lie: func(reports []*Report) {
+				reports[0].Scores = []int{1, 1}
+			},
+			outcome:  OutcomeCheated,
+			cheaters: map[int]CheatReason{0: CheatFalseReport},
+		},
+		{
+			name:   "loser claims the win of a longer match",
+			bestOf: 3,
+			lie: func(reports []*Report) {
+				reports[0].Winner, reports[0].Scores = 0, []int{2, 1}
+				reports[1].Scores = []int{1, 2}
+			},
+			outcome:  OutcomeCheated,
+			cheaters: map[int]CheatReason{0: CheatFalseReport},
+		},
+		{
+			name:   "longer match drawn level on the last round",
+			bestOf: 3,
+			lie: func(reports []*Report) {
+				for _, report := range reports {
+					report.Winner, report.Scores = -1, []int{1, 1}
+				}
+			},
+			outcome: OutcomeInconclusive,
+		},
+		{
+			name:   "modified client",
+			bestOf: 1,
+			tamper: func(logs []*lockstep.InputLog) {
+				logs[1].Checksums[2]++
+			},
+			outcome:  OutcomeCheated,
+			cheaters: map[int]CheatReason{1: CheatModifiedState},
+		},
+		{
+			name:   "missing log",
+			bestOf: 1,
+			tamper: func(logs []*lockstep.InputLog) {
+				logs[1] = nil
+			},
+			outcome: OutcomeInconclusive,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs, honest := playDuel(t)
+			if tt.tamper != nil {
+				tt.tamper(logs)
+			}
+			result := reported(honest, tt.lie)
+			verdict := verify(result, logs, tt.bestOf)
+			if verdict.Outcome != tt.outcome {
+				t.Fatalf("outcome: got %s, want %s", verdict.Outcome, tt.outcome)
+			}
+			cheaters := make(map[int]CheatReason)
+			for _, cheater := range verdict.Cheaters {
+				cheaters[cheater.Player] = cheater.Reason
+			}
+			if len(cheaters) != len(tt.cheaters) {
+				t.Fatalf("cheaters: got %v, want %v", cheaters, tt.cheaters)
+			}
+			for player, reason := range tt.cheaters {
+				if cheaters[player] != reason {
+					t.Fatalf("cheaters: got %v, want %v", cheaters, tt.cheaters)
+				}
+			}
+			// a single sound log leaves the winner open
+			if tt.tamper == nil && tt.outcome != OutcomeInconclusive && verdict.Winner != honest.Winner {
+				t.Fatalf("winner: got %d, want %d", verdict.Winner, honest.Winner)
+			}
+		})
+	}
+}
+
+func TestApplyVerdict(t *testing.T) {
+	tests := []struct {
+		name   string
+		bestOf int
+		lie    func(reports []*Report)
+		// whether the reports agreed before the verification
+		agreed bool
+		status Status
+		winner int
+		scores []int
+	}{
+		{
+			name:   "lying winner",
+			bestOf: 1,
+			// the liar copies the real ticks and checksum but claims the win
+			lie: func(reports []*Report) {
+				reports[0].Winner, reports[0].Scores = 0, []int{1, 0}
+			},
+			status: StatusConfirmed,
+			winner: 1,
+			scores: []int{0, 1},
+		},
+		{
+			name:   "lying winner first in a longer match",
+			bestOf: 3,
+			lie: func(reports []*Report) {
+				reports[0].Winner, reports[0].Scores = 0, []int{2, 1}
+				reports[1].Scores = []int{1, 2}
+			},
+			status: StatusConfirmed,
+			winner: 1,
+			scores: []int{1, 2},
+		},
+		{
+			name:   "sampled and inconclusive",
+			bestOf: 3,
+			lie: func(reports []*Report) {
+				for _, report := range reports {
+					report.Winner, report.Scores = -1, []int{1, 1}
+				}
+			},
+			agreed: true,
+			status: StatusConfirmed,
+			winner: -1,
+			scores: nil,
+		},
+		{
+			name:   "disputed and inconclusive",
+			bestOf: 3,
+			lie: func(reports []*Report) {
+				reports[0].Winner, reports[0].Scores = -1, []int{1, 1}
+			},
+			status: StatusDisputed,
+			winner: -1,
+			scores: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs, honest := playDuel(t)
+			result := reported(honest, tt.lie)
+			applyVerdict(result, verify(result, logs, tt.bestOf), tt.agreed)
+			if result.Status != tt.status || result.Winner != tt.winner || !slices.Equal(result.Scores, tt.scores) {
+				t.Fatalf("got %s winner %d scores %v, want %s winner %d scores %v",
+					result.Status, result.Winner, result.Scores, tt.status, tt.winner, tt.scores)
+			}
+			if result.Status == StatusConfirmed && tt.winner >= 0 && result.Ticks != honest.Ticks {
+				t.Fatalf("ticks: got %d, want %d", result.Ticks, honest.Ticks)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package result
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/isaackoz/tronline/internal/httpx"
+)
+
+const (
+	// largest report accepted
+	maxReportBody = 16 * 1024
+	// largest input log upload accepted
+	maxLogBody = 4 * 1024 * 1024
+)
+
+// SubmitRequest is a player's signed report of a P2P match
+type SubmitRequest struct {
+	MatchID string `json:"matchId"`
+	Player  int    `json:"player"`
+	// see Sign
+	Signature string `json:"signature"`
+	Report
+}
+
+// LogRequest is a player's signed input log upload of a P2P match being verified
+type LogRequest struct {
+	Player int `json:"player"`
+	// see SignLog, the log is signed exactly as it's sent
+	Signature string `json:"signature"`
+	// lockstep.InputLog
+	Log json.RawMessage `json:"log"`
+}
+
+// HandleResults registers the P2P report and input log endpoints and the result listing.
+// Results can be filtered with ?status=, i.e. ?status=disputed for the ones needing review
+func HandleResults(mux *http.ServeMux, reconciler *Reconciler) {
+	mux.HandleFunc("POST /results", func(w http.ResponseWriter, r *http.Request) {
+		var req SubmitRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxReportBody)).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		result, err := reconciler.Submit(r.Context(), req.MatchID, req.Player, req.Report, req.Signature)
+		switch {
+		case errors.Is(err, ErrUnknownMatch):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, ErrInvalidPlayer):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, ErrBadSignature):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case errors.Is(err, ErrAlreadyReported):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			slog.Error("submit result", "error", err, "match_id", req.MatchID)
+			http.Error(w, "could not record result", http.StatusInternalServerError)
+			return
+		}
+		if result == nil {
+			// waiting for the other player
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			httpx.WriteJSON(w, map[string]any{"matchId": req.MatchID, "status": "pending"})
+			return
+		}
+		httpx.WriteJSON(w, result)
+	})
+
+	mux.HandleFunc("POST /results/{id}/logs", func(w http.ResponseWriter, r *http.Request) {
+		var req LogRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxLogBody)).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		matchID := r.PathValue("id")
+		result, err := reconciler.SubmitLog(r.Context(), matchID, req.Player, req.Log, req.Signature)
+		switch {
+		case errors.Is(err, ErrUnknownMatch):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, ErrInvalidPlayer), errors.Is(err, ErrInvalidLog):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, ErrBadSignature):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case errors.Is(err, ErrNotVerifying), errors.Is(err, ErrAlreadyUploaded):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			slog.Error("submit input log", "error", err, "match_id", matchID)
+			http.Error(w, "could not verify result", http.StatusInternalServerError)
+			return
+		}
+		if result == nil {
+			// waiting for the other player's log
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			httpx.WriteJSON(w, map[string]any{"matchId": matchID, "status": StatusVerifying})
+			return
+		}
+		httpx.WriteJSON(w, result)
+	})
+
+	mux.HandleFunc("GET /results", func(w http.ResponseWriter, r *http.Request) {
+		offset, limit := httpx.Pagination(r)
+		status := Status(r.URL.Query().Get("status"))
+		results, err := reconciler.Store().List(r.Context(), status, offset, limit)
+		if err != nil {
+			slog.Error("list results", "error", err)
+			http.Error(w, "could not list results", http.StatusInternalServerError)
+			return
+		}
+		httpx.WriteJSON(w, map[string]any{
+			"results": results,
+			"offset":  offset,
+			"limit":   limit,
+		})
+	})
+
+	mux.HandleFunc("GET /results/{id}", func(w http.ResponseWriter, r *http.Request) {
+		result, err := reconciler.Store().Load(r.Context(), r.PathValue("id"))
+		if errors.Is(err, ErrNotFound) {
+			http.Error(w, "result not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("load result", "error", err, "match_id", r.PathValue("id"))
+			http.Error(w, "could not load result", http.StatusInternalServerError)
+			return
+		}
+		httpx.WriteJSON(w, result)
+	})
+}
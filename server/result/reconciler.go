@@ -0,0 +1,392 @@
+package result
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	mrand "math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/isaackoz/tronline/game"
+	"github.com/isaackoz/tronline/lockstep"
+	"github.com/isaackoz/tronline/mode"
+	"github.com/lithammer/shortuuid/v4"
+)
+
+var (
+	ErrUnknownMatch    = errors.New("unknown match or its reporting window closed")
+	ErrInvalidPlayer   = errors.New("invalid player")
+	ErrBadSignature    = errors.New("invalid report signature")
+	ErrAlreadyReported = errors.New("player already reported")
+	ErrNotVerifying    = errors.New("match isn't waiting for input logs")
+	ErrAlreadyUploaded = errors.New("player already uploaded its input log")
+	ErrInvalidLog      = errors.New("invalid input log")
+)
+
+// how often expired reporting windows are closed
+const sweepInterval = 10 * time.Second
+
+// how long saving a result may take when a window closes
+const saveTimeout = 10 * time.Second
+
+// Config is how a Reconciler treats P2P matches
+type Config struct {
+	// how long players have to report a match
+	ReportWindow time.Duration
+	// how long players have to upload their input logs once they're asked for them
+	LogWindow time.Duration
+	// share of ranked matches with agreeing reports that are re-simulated anyway, 0 to 1
+	AuditRate float64
+	// called with every result once it's final and saved, i.e. to update ratings. Optional
+	Recorded func(ctx context.Context, result *Result)
+	// called with every cheater a re-simulation caught once the result is saved, i.e. to ban
+	// them. Optional
+	Caught func(ctx context.Context, result *Result, cheater Cheater)
+}
+
+// Reconciler collects the reports of P2P matches and records the outcome once every player
+// reported or the reporting window closed. Agreeing reports are confirmed. When they
+// disagree, or for a random share of ranked matches, the players are asked for their input
+// logs and the match is re-simulated to find the true winner and any cheater
+type Reconciler struct {
+	store  Store
+	config Config
+
+	mu      sync.Mutex
+	pending map[string]*pending
+}
+
+// a P2P match waiting for its reports, or its input logs while verifying
+type pending struct {
+	result *Result
+	// settings of the match as the room set it up, uploaded logs must be played with them
+	settings game.Settings
+	// rounds of the match, see mode.Mode
+	bestOf int
+	// report keys by player
+	keys     []string
+	deadline time.Time
+	// verifying only. uploaded logs by player and whether the reports agreed
+	logs   []*lockstep.InputLog
+	agreed bool
+}
+
+// NewReconciler records results to store
+func NewReconciler(store Store, config Config) *Reconciler {
+	return &Reconciler{
+		store:   store,
+		config:  config,
+		pending: make(map[string]*pending),
+	}
+}
+
+// Window returns how long players have to report a match
+func (r *Reconciler) Window() time.Duration {
+	return r.config.ReportWindow
+}
+
+// LogWindow returns how long players have to upload their input logs
+func (r *Reconciler) LogWindow() time.Duration {
+	return r.config.LogWindow
+}
+
+// Store returns where results are recorded
+func (r *Reconciler) Store() Store {
+	return r.store
+}
+
+// Expect opens the reporting window of a P2P match of rules between players (player ids by
+// player) played with settings. Returns the match id and every player's report key, players
+// sign their report with it
+func (r *Reconciler) Expect(roomID string, rules mode.Mode, arena string, settings game.Settings, ranked bool, players []string) (matchID string, keys []string) {
+	matchID = shortuuid.New()
+	keys = make([]string, len(players))
+	for i := range keys {
+		keys[i] = newKey()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending[matchID] = &pending{
+		result: &Result{
+			ID:        matchID,
+			RoomID:    roomID,
+			Source:    SourceP2P,
+			Mode:      rules.Kind,
+			Arena:     arena,
+			Ranked:    ranked,
+			Players:   players,
+			Winner:    -1,
+			Reports:   make([]*Report, len(players)),
+			StartedAt: time.Now(),
+		},
+		settings: settings,
+		bestOf:   rules.BestOf,
+		keys:     keys,
+		deadline: time.Now().Add(r.config.ReportWindow),
+	}
+	return matchID, keys
+}
+
+// Withdraw closes the reporting window of a match nobody reported yet, i.e. because a player
+// left before it was played and the room expects a new one
+func (r *Reconciler) Withdraw(matchID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.pending[matchID]
+	if !ok || p.logs != nil {
+		return
+	}
+	for _, report := range p.result.Reports {
+		if report != nil {
+			return
+		}
+	}
+	delete(r.pending, matchID)
+}
+
+func newKey() string {
+	key := make([]byte, 16)
+	rand.Read(key)
+	return hex.EncodeToString(key)
+}
+
+// Submit adds a player's signed report. Returns the result once it's recorded, nil while
+// other players still have to report. A result that is StatusVerifying waits for the players'
+// input logs, see SubmitLog
+func (r *Reconciler) Submit(ctx context.Context, matchID string, player int, report Report, signature string) (*Result, error) {
+	r.mu.Lock()
+	p, ok := r.pending[matchID]
+	if !ok || p.logs != nil {
+		r.mu.Unlock()
+		return nil, ErrUnknownMatch
+	}
+	if player < 0 || player >= len(p.keys) {
+		r.mu.Unlock()
+		return nil, ErrInvalidPlayer
+	}
+	if !hmac.Equal([]byte(Sign(p.keys[player], matchID, player, &report)), []byte(signature)) {
+		r.mu.Unlock()
+		return nil, ErrBadSignature
+	}
+	if p.result.Reports[player] != nil {
+		r.mu.Unlock()
+		return nil, ErrAlreadyReported
+	}
+	report.ReportedAt = time.Now()
+	p.result.Reports[player] = &report
+	for _, reported := range p.result.Reports {
+		if reported == nil {
+			r.mu.Unlock()
+			return nil, nil
+		}
+	}
+
+	result := reconcile(p.result)
+	if result.Status == StatusDisputed || result.Ranked && mrand.Float64() < r.config.AuditRate {
+		// keep it pending until the logs are in
+		p.agreed = result.Status == StatusConfirmed
+		p.logs = make([]*lockstep.InputLog, len(p.keys))
+		p.deadline = time.Now().Add(r.config.LogWindow)
+		result.Status = StatusVerifying
+		saved := *result
+		r.mu.Unlock()
+		slog.Debug("verifying match result", "match_id", matchID, "agreed", p.agreed)
+		return &saved, r.save(ctx, &saved)
+	}
+	delete(r.pending, matchID)
+	r.mu.Unlock()
+	return result, r.save(ctx, result)
+}
+
+// SubmitLog adds a player's signed input log (lockstep.InputLog as json) to a match being
+// verified. Returns the result with its verdict once every log is in, nil while others are
+// still missing
+func (r *Reconciler) SubmitLog(ctx context.Context, matchID string, player int, data []byte, signature string) (*Result, error) {
+	r.mu.Lock()
+	p, ok := r.pending[matchID]
+	if !ok {
+		r.mu.Unlock()
+		return nil, ErrUnknownMatch
+	}
+	if p.logs == nil {
+		r.mu.Unlock()
+		return nil, ErrNotVerifying
+	}
+	if player < 0 || player >= len(p.keys) {
+		r.mu.Unlock()
+		return nil, ErrInvalidPlayer
+	}
+	if !hmac.Equal([]byte(SignLog(p.keys[player], matchID, player, data)), []byte(signature)) {
+		r.mu.Unlock()
+		return nil, ErrBadSignature
+	}
+	if p.logs[player] != nil {
+		r.mu.Unlock()
+		return nil, ErrAlreadyUploaded
+	}
+	r.mu.Unlock()
+
+	// logs can be large, don't hold up every other match decoding one. The settings never
+	// change once the match is expected
+	var log lockstep.InputLog
+	if err := json.Unmarshal(data, &log); err != nil || log.Player != player || !log.Settings.Equal(p.settings) {
+		return nil, ErrInvalidLog
+	}
+
+	r.mu.Lock()
+	if r.pending[matchID] != p {
+		// the log window closed meanwhile
+		r.mu.Unlock()
+		return nil, ErrUnknownMatch
+	}
+	if p.logs[player] != nil {
+		r.mu.Unlock()
+		return nil, ErrAlreadyUploaded
+	}
+	p.logs[player] = &log
+	for _, uploaded := range p.logs {
+		if uploaded == nil {
+			r.mu.Unlock()
+			return nil, nil
+		}
+	}
+	delete(r.pending, matchID)
+	r.mu.Unlock()
+
+	return r.finishVerifying(ctx, p)
+}
+
+// re-simulates the match from the logs that were uploaded and records the result. p must
+// not be pending anymore, re-simulating takes a while so r.mu must not be held either
+func (r *Reconciler) finishVerifying(ctx context.Context, p *pending) (*Result, error) {
+	verdict := verify(p.result, p.logs, p.bestOf)
+	applyVerdict(p.result, verdict, p.agreed)
+	if err := r.save(ctx, p.result); err != nil {
+		return p.result, err
+	}
+	for _, cheater := range verdict.Cheaters {
+		slog.Warn("cheater caught", "match_id", p.result.ID, "room_id", p.result.RoomID, "player", cheater.Player, "client_id", cheater.ID, "reason", cheater.Reason)
+		if r.config.Caught != nil {
+			r.config.Caught(ctx, p.result, cheater)
+		}
+	}
+	return p.result, nil
+}
+
+// Record saves the result of a match the server ran itself
+func (r *Reconciler) Record(ctx context.Context, result *Result) error {
+	result.Source = SourceHosted
+	result.Status = StatusConfirmed
+	return r.save(ctx, result)
+}
+
+// Run closes expired reporting and log windows until ctx is done. Matches with some reports
+// are recorded unconfirmed, matches nobody reported are dropped. Matches being verified
+// are re-simulated with the logs that were uploaded
+func (r *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.expire(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *Reconciler) expire(now time.Time) {
+	var expired []*Result
+	var verifying []*pending
+	r.mu.Lock()
+	for id, p := range r.pending {
+		if !now.After(p.deadline) {
+			continue
+		}
+		delete(r.pending, id)
+		if p.logs != nil {
+			verifying = append(verifying, p)
+			continue
+		}
+		expired = append(expired, reconcile(p.result))
+	}
+	r.mu.Unlock()
+
+	// verify with the logs that made it in time
+	for _, p := range verifying {
+		ctx, cancel := context.WithTimeout(context.Background(), saveTimeout)
+		if _, err := r.finishVerifying(ctx, p); err != nil {
+			slog.Error("save verified result", "error", err, "match_id", p.result.ID)
+		}
+		cancel()
+	}
+
+	for _, result := range expired {
+		reported := false
+		for _, report := range result.Reports {
+			reported = reported || report != nil
+		}
+		if !reported {
+			slog.Debug("match never reported", "match_id", result.ID, "room_id", result.RoomID)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), saveTimeout)
+		if err := r.save(ctx, result); err != nil {
+			slog.Error("save expired result", "error", err, "match_id", result.ID)
+		}
+		cancel()
+	}
+}
+
+// decides the status and outcome of a P2P result from its reports
+func reconcile(result *Result) *Result {
+	var first *Report
+	missing := false
+	result.Status = StatusConfirmed
+	for _, report := range result.Reports {
+		switch {
+		case report == nil:
+			missing = true
+		case first == nil:
+			first = report
+		case !first.agrees(report):
+			result.Status = StatusDisputed
+		}
+	}
+	if result.Status == StatusDisputed {
+		result.Winner = -1
+		return result
+	}
+	if missing {
+		// a single side can't decide the match, the report stays for review
+		result.Status = StatusUnconfirmed
+		result.Winner = -1
+		return result
+	}
+	result.Winner, result.Ticks, result.Reason, result.Scores = first.Winner, first.Ticks, first.Reason, first.Scores
+	return result
+}
+
+func (r *Reconciler) save(ctx context.Context, result *Result) error {
+	if result.FinishedAt.IsZero() {
+		result.FinishedAt = time.Now()
+	}
+	if err := r.store.Save(ctx, result); err != nil {
+		return err
+	}
+	if result.Status == StatusDisputed {
+		slog.Warn("match result disputed", "match_id", result.ID, "room_id", result.RoomID, "players", result.Players)
+	} else {
+		slog.Debug("recorded match result", "match_id", result.ID, "room_id", result.RoomID, "status", result.Status, "winner", result.Winner)
+	}
+	if result.Status != StatusVerifying && r.config.Recorded != nil {
+		r.config.Recorded(ctx, result)
+	}
+	return nil
+}
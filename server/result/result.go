@@ -0,0 +1,123 @@
+// Package result records who won matches. Hosted matches are recorded as they finish, P2P
+// matches finish in the browsers so both players report the outcome and the reports are
+// reconciled before it counts
+package result
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/isaackoz/tronline/mode"
+)
+
+// Status is how much a result can be trusted
+type Status string
+
+const (
+	// the server ran the match, or both players reported the same outcome
+	StatusConfirmed Status = "confirmed"
+	// the players reported different outcomes, needs review
+	StatusDisputed Status = "disputed"
+	// only one player reported before the reporting window closed. The result has no winner,
+	// the report is kept in Reports. Ratings count ranked ones as lost by the other player
+	StatusUnconfirmed Status = "unconfirmed"
+	// the reports disagreed or the match was picked for a check, waiting for the players'
+	// input logs to re-simulate it
+	StatusVerifying Status = "verifying"
+)
+
+// Source is where the match was played
+type Source string
+
+const (
+	SourceHosted Source = "hosted"
+	SourceP2P    Source = "p2p"
+)
+
+// Report is the outcome of a match as one player saw it
+type Report struct {
+	// winning side, -1 for a draw
+	Winner int `json:"winner"`
+	// last tick of the last round
+	Ticks int `json:"ticks"`
+	// "crash", "time" or "forfeit"
+	Reason string `json:"reason"`
+	// rounds won per side
+	Scores []int `json:"scores,omitempty"`
+	// game.State checksum after the last tick. Peers simulating the same match end up with
+	// the same one
+	Checksum   uint32    `json:"checksum"`
+	ReportedAt time.Time `json:"reportedAt"`
+}
+
+// agrees reports whether two reports describe the same outcome
+func (r *Report) agrees(o *Report) bool {
+	return r.Winner == o.Winner && r.Ticks == o.Ticks && r.Reason == o.Reason &&
+		r.Checksum == o.Checksum && slices.Equal(r.Scores, o.Scores)
+}
+
+// Result is the recorded outcome of a match
+type Result struct {
+	// id of the match. Hosted matches share it with their replays (replay.Header.Match)
+	ID     string    `json:"id"`
+	RoomID string    `json:"roomId"`
+	Source Source    `json:"source"`
+	Mode   mode.Kind `json:"mode"`
+	// name of the arena played on
+	Arena string `json:"arena,omitempty"`
+	// ranked matches count towards ratings. Ranked P2P matches are randomly re-simulated
+	// even when the reports agree
+	Ranked bool `json:"ranked,omitempty"`
+	// player ids by player, bots are "bot-<difficulty>"
+	Players []string `json:"players"`
+	Status  Status   `json:"status"`
+	// winning side, -1 for a draw or while disputed
+	Winner int `json:"winner"`
+	// ticks of the last round
+	Ticks int `json:"ticks"`
+	// hosted only. ticks per second the match ran at
+	TickRate int `json:"tickRate,omitempty"`
+	// hosted only. ticks each player survived in the last round, by player
+	Survived []int  `json:"survived,omitempty"`
+	Reason   string `json:"reason"`
+	Scores   []int  `json:"scores,omitempty"`
+	// hosted only. replay ids by round, rounds without a replay are left out
+	Replays []string `json:"replays,omitempty"`
+	// P2P only. reports by player, nil for players who didn't report
+	Reports []*Report `json:"reports,omitempty"`
+	// P2P only. set once the players' input logs were re-simulated
+	Verdict *Verdict `json:"verdict,omitempty"`
+	// when the match was set up, zero for results recorded before it was kept
+	StartedAt  time.Time `json:"startedAt,omitzero"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// Sign returns the signature a player puts on their report: the hex HMAC-SHA256, keyed with
+// the player's report key, of
+//
+//	matchID|player|winner|ticks|reason|checksum|scores
+//
+// with the scores comma separated
+func Sign(key string, matchID string, player int, report *Report) string {
+	scores := make([]string, len(report.Scores))
+	for i, score := range report.Scores {
+		scores[i] = strconv.Itoa(score)
+	}
+	message := strings.Join([]string{
+		matchID,
+		strconv.Itoa(player),
+		strconv.Itoa(report.Winner),
+		strconv.Itoa(report.Ticks),
+		report.Reason,
+		strconv.FormatUint(uint64(report.Checksum), 10),
+		strings.Join(scores, ","),
+	}, "|")
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
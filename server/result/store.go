@@ -0,0 +1,94 @@
+package result
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+)
+
+var ErrNotFound = errors.New("result not found")
+
+// Store persists results
+type Store interface {
+	// saves a new result or replaces the one with the same id
+	Save(ctx context.Context, r *Result) error
+	Load(ctx context.Context, id string) (*Result, error)
+	// newest first, only results with the status unless it's empty
+	List(ctx context.Context, status Status, offset int, limit int) ([]*Result, error)
+	// the results the player played in, newest first
+	ListByPlayer(ctx context.Context, playerID string, offset int, limit int) ([]*Result, error)
+}
+
+// MemoryStore keeps results in memory, they're gone on restart
+type MemoryStore struct {
+	mu      sync.RWMutex
+	results map[string]*Result
+	// ids in the order they were first saved
+	order []string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{results: make(map[string]*Result)}
+}
+
+func (s *MemoryStore) Save(ctx context.Context, r *Result) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.results[r.ID]; !exists {
+		s.order = append(s.order, r.ID)
+	}
+	saved := *r
+	s.results[r.ID] = &saved
+	return nil
+}
+
+func (s *MemoryStore) Load(ctx context.Context, id string) (*Result, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.results[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	loaded := *r
+	return &loaded, nil
+}
+
+func (s *MemoryStore) List(ctx context.Context, status Status, offset int, limit int) ([]*Result, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var results []*Result
+	for i := len(s.order) - 1; i >= 0; i-- {
+		r := s.results[s.order[i]]
+		if status == "" || r.Status == status {
+			listed := *r
+			results = append(results, &listed)
+		}
+	}
+	return page(results, offset, limit), nil
+}
+
+func (s *MemoryStore) ListByPlayer(ctx context.Context, playerID string, offset int, limit int) ([]*Result, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var results []*Result
+	for i := len(s.order) - 1; i >= 0; i-- {
+		r := s.results[s.order[i]]
+		if slices.Contains(r.Players, playerID) {
+			listed := *r
+			results = append(results, &listed)
+		}
+	}
+	return page(results, offset, limit), nil
+}
+
+func page[T any](items []T, offset int, limit int) []T {
+	if offset >= len(items) {
+		return []T{}
+	}
+	items = items[offset:]
+	if limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
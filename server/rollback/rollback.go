@@ -0,0 +1,273 @@
+// Package rollback runs the simulation ahead of the confirmed inputs by predicting the
+// inputs that haven't arrived yet. When a real input differs from its prediction, the state
+// is restored to the tick before it and re-simulated up to the current tick
+package rollback
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/isaackoz/tronline/game"
+)
+
+// how far ahead of the current tick inputs are accepted
+const maxInputLead = 128
+
+var (
+	// the input is for a tick that's already confirmed
+	ErrTooLate = errors.New("input is older than the rollback window")
+	// the input is too far ahead of the current tick
+	ErrTooEarly = errors.New("input is too far ahead")
+	// the player already has a different input for the tick
+	ErrDuplicate = errors.New("player already has an input for the tick")
+	// the simulation can't run further ahead of the confirmed inputs
+	ErrStall = errors.New("waiting for inputs, rollback window is full")
+)
+
+type Config struct {
+	// how many ticks the simulation may run ahead of the confirmed inputs, and so how late an
+	// input may arrive. Defaults to 8
+	Window int
+	// an authoritative session (the server) never waits: ticks falling out of the window are
+	// confirmed with the inputs they were simulated with. Otherwise Advance stalls until the
+	// remote inputs arrive (a P2P peer or bot)
+	Authoritative bool
+	// predicts a player's input that hasn't arrived. last is the player's latest received input.
+	// Defaults to no turn, cycles mostly drive straight, and holding on to boost
+	Predict func(player int, last game.Input) game.Input
+}
+
+// TickResult is the outcome of a re-simulated tick
+type TickResult struct {
+	Tick     int            `json:"tick"`
+	Cycles   []game.Cycle   `json:"cycles"`
+	PowerUps []game.PowerUp `json:"powerUps,omitempty"`
+	Deaths   []game.Event   `json:"deaths,omitempty"`
+	Pickups  []game.Event   `json:"pickups,omitempty"`
+}
+
+// Rollback describes a correction: the state was rewound to From and Ticks were re-simulated
+type Rollback struct {
+	From  int
+	Ticks []TickResult
+}
+
+// Stats about the rollbacks of a session
+type Stats struct {
+	Rollbacks int `json:"rollbacks"`
+	// ticks simulated again because of rollbacks
+	Resimulated int `json:"resimulated"`
+	// deepest rollback in ticks
+	MaxDepth int `json:"maxDepth"`
+	// inputs that matched their prediction
+	CorrectPredictions int `json:"correctPredictions"`
+	// inputs rejected for being older than the window
+	LateInputs int `json:"lateInputs"`
+	// calls to Advance that had to wait for inputs
+	Stalls int `json:"stalls"`
+}
+
+// AvgDepth is the average rollback depth in ticks
+func (s Stats) AvgDepth() float64 {
+	if s.Rollbacks == 0 {
+		return 0
+	}
+	return float64(s.Resimulated) / float64(s.Rollbacks)
+}
+
+type frame struct {
+	// inputs the tick was (or will be) simulated with, received or predicted
+	inputs []game.Input
+	// which of them were received
+	known []bool
+	// state before the tick was simulated
+	before    game.Snapshot
+	simulated bool
+}
+
+type Session struct {
+	config  Config
+	players int
+	state   *game.State
+	frames  map[int]*frame
+	// every tick up to and including confirmed is final
+	confirmed int
+	// latest received input per player, for predictions
+	last      []game.Input
+	lastTicks []int
+	stats     Stats
+}
+
+func New(settings game.Settings, config Config) (*Session, error) {
+	if config.Window <= 0 {
+		config.Window = 8
+	}
+	if config.Predict == nil {
+		config.Predict = func(_ int, last game.Input) game.Input { return game.Input{Boost: last.Boost} }
+	}
+	state, err := game.New(settings)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{
+		config:    config,
+		players:   settings.Players,
+		state:     state,
+		frames:    make(map[int]*frame),
+		last:      make([]game.Input, settings.Players),
+		lastTicks: make([]int, settings.Players),
+	}, nil
+}
+
+// State is the current, possibly predicted, state. It must not be modified
+func (s *Session) State() *game.State {
+	return s.state
+}
+
+// Confirmed is the latest tick that can't change anymore
+func (s *Session) Confirmed() int {
+	return s.confirmed
+}
+
+func (s *Session) Stats() Stats {
+	return s.stats
+}
+
+func (s *Session) frame(tick int) *frame {
+	f, ok := s.frames[tick]
+	if !ok {
+		f = &frame{
+			inputs: make([]game.Input, s.players),
+			known:  make([]bool, s.players),
+		}
+		s.frames[tick] = f
+	}
+	return f
+}
+
+// SetInput adds a player's real input for a tick. If the tick was already simulated with a
+// different prediction, the session rolls back and the correction is returned
+func (s *Session) SetInput(player int, tick int, input game.Input) (*Rollback, error) {
+	if player < 0 || player >= s.players {
+		return nil, fmt.Errorf("invalid player %d", player)
+	}
+	if tick <= s.confirmed {
+		s.stats.LateInputs++
+		return nil, ErrTooLate
+	}
+	if tick > s.state.Tick+maxInputLead {
+		return nil, ErrTooEarly
+	}
+
+	f := s.frame(tick)
+	if f.known[player] {
+		if f.inputs[player] == input {
+			return nil, nil
+		}
+		return nil, ErrDuplicate
+	}
+	f.known[player] = true
+	if tick > s.lastTicks[player] {
+		s.last[player] = input
+		s.lastTicks[player] = tick
+	}
+
+	if !f.simulated {
+		f.inputs[player] = input
+		s.confirm()
+		return nil, nil
+	}
+	if f.inputs[player] == input {
+		s.stats.CorrectPredictions++
+		s.confirm()
+		return nil, nil
+	}
+
+	f.inputs[player] = input
+	rb := s.resimulate(tick)
+	s.confirm()
+	return rb, nil
+}
+
+// restores the state before tick and simulates up to the current tick again
+func (s *Session) resimulate(tick int) *Rollback {
+	current := s.state.Tick
+	s.state.Restore(s.frames[tick].before)
+
+	rb := &Rollback{From: tick - 1}
+	for t := tick; t <= current; t++ {
+		f := s.frames[t]
+		s.predict(f)
+		f.before = s.state.Snapshot()
+		deaths, pickups := game.SplitEvents(s.state.Step(f.inputs))
+		rb.Ticks = append(rb.Ticks, TickResult{
+			Tick:     t,
+			Cycles:   append([]game.Cycle(nil), s.state.Cycles...),
+			PowerUps: append([]game.PowerUp(nil), s.state.PowerUps...),
+			Deaths:   deaths,
+			Pickups:  pickups,
+		})
+	}
+
+	depth := current - tick + 1
+	s.stats.Rollbacks++
+	s.stats.Resimulated += depth
+	s.stats.MaxDepth = max(s.stats.MaxDepth, depth)
+	return rb
+}
+
+// fills the inputs that haven't arrived with predictions
+func (s *Session) predict(f *frame) {
+	for i := range f.inputs {
+		if !f.known[i] {
+			f.inputs[i] = s.config.Predict(i, s.last[i])
+		}
+	}
+}
+
+// Advance simulates the next tick with the inputs received so far and predictions for the rest.
+// A non authoritative session returns ErrStall once it's a full window ahead of the confirmed inputs
+func (s *Session) Advance() ([]game.Event, error) {
+	next := s.state.Tick + 1
+	if !s.config.Authoritative && next-s.confirmed > s.config.Window {
+		s.stats.Stalls++
+		return nil, ErrStall
+	}
+
+	f := s.frame(next)
+	s.predict(f)
+	f.before = s.state.Snapshot()
+	events := s.state.Step(f.inputs)
+	f.simulated = true
+	s.confirm()
+	return events, nil
+}
+
+// moves the confirmed tick forward and forgets everything before it
+func (s *Session) confirm() {
+	if s.config.Authoritative {
+		s.confirmed = max(s.confirmed, s.state.Tick-s.config.Window)
+	} else {
+		for {
+			f, ok := s.frames[s.confirmed+1]
+			if !ok || !f.simulated || !allKnown(f) {
+				break
+			}
+			s.confirmed++
+		}
+	}
+	for tick := range s.frames {
+		if tick <= s.confirmed {
+			delete(s.frames, tick)
+		}
+	}
+}
+
+func allKnown(f *frame) bool {
+	for _, known := range f.known {
+		if !known {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,222 @@
+package signaling
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/isaackoz/tronline/bot"
+	"github.com/isaackoz/tronline/game"
+	"github.com/lithammer/shortuuid/v4"
+)
+
+// AddBot fills the guest slot of a server hosted room with a bot, on the host's request.
+// The bot plays through the same messages as a person would
+func (r *Room) AddBot(msg *IncomingMessage, from *Client) {
+	var req BotRequestMessage
+	if err := msg.Decode(&req); err != nil {
+		slog.Debug("decode bot request", "error", err, "client_id", from.ID)
+		return
+	}
+	difficulty, err := bot.ParseDifficulty(req.Difficulty)
+	if err != nil {
+		from.SendMessage(&ErrorMessage{Type: MessageTypeError, Message: err.Error()})
+		return
+	}
+	if !from.IsHost || r.Settings.Mode != RoomModeHosted {
+		from.SendMessage(&ErrorMessage{
+			Type:    MessageTypeError,
+			Message: "only the host of a hosted room can add a bot",
+		})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &Client{
+		ID:     "bot-" + shortuuid.New(),
+		Room:   r,
+		Send:   make(chan []byte, 256),
+		Relay:  make(chan []byte, 256),
+		Bot:    difficulty,
+		Ctx:    ctx,
+		Cancel: cancel,
+	}
+	if err := r.AddClient(client); err != nil {
+		cancel()
+		from.SendMessage(&ErrorMessage{Type: MessageTypeError, Message: err.Error()})
+		return
+	}
+
+	guest := &botGuest{
+		client: client,
+		bot:    bot.New(difficulty, rand.Uint64()),
+		// leave half the tick for the input to reach the match
+		budget: min(difficulty.ThinkTime(), time.Second/time.Duration(2*r.config.HostedTickRate)),
+	}
+	go guest.run()
+	slog.Debug("bot joined room", "room_id", r.ID, "client_id", client.ID, "difficulty", difficulty)
+	r.StartMatch()
+}
+
+// botGuest plays a hosted match as the guest. It reads the messages sent to its client
+// and answers with input messages
+type botGuest struct {
+	client *Client
+	bot    bot.Bot
+	budget time.Duration
+
+	player int
+	width  int
+	height int
+	walls  []game.Point
+	wrap   bool
+	// sudden death rings closed in by the latest tick
+	rings int
+	// cycles after every tick, history[0] are the spawns
+	history [][]game.Cycle
+	// pickups lying in the arena after the latest tick
+	powerUps []game.PowerUp
+	// eraser pickups so far, the trails they cleared are free again
+	erasures []game.Event
+}
+
+func (g *botGuest) run() {
+	defer g.client.Cancel()
+	for {
+		select {
+		case data, ok := <-g.client.Send:
+			if !ok {
+				// the room closed
+				return
+			}
+			msg, err := DecodeMessage(data)
+			if err != nil {
+				slog.Error("bot decode message", "error", err, "client_id", g.client.ID)
+				continue
+			}
+			g.handle(msg)
+		case <-g.client.Ctx.Done():
+			// fell too far behind on its messages
+			g.client.Room.RemoveClient(g.client)
+			return
+		}
+	}
+}
+
+func (g *botGuest) handle(msg *IncomingMessage) {
+	switch msg.GetType() {
+	case MessageTypeMatchStart:
+		var start MatchStartMessage
+		if err := msg.Decode(&start); err != nil {
+			return
+		}
+		g.player, g.width, g.height = start.Player, start.Width, start.Height
+		g.walls, g.wrap, g.rings = start.Walls, start.Wrap, 0
+		g.history = [][]game.Cycle{start.Cycles}
+		g.powerUps, g.erasures = nil, nil
+		g.think()
+	case MessageTypeState:
+		var state StateMessage
+		if err := msg.Decode(&state); err != nil || state.Tick > len(g.history) {
+			return
+		}
+		g.history = append(g.history[:state.Tick], state.Cycles)
+		g.rings = state.Rings
+		g.powerUps = state.PowerUps
+		g.erased(state.Tick-1, state.Pickups)
+		g.think()
+	case MessageTypeRollback:
+		var rb RollbackMessage
+		if err := msg.Decode(&rb); err != nil || rb.From >= len(g.history) {
+			return
+		}
+		g.history = g.history[:rb.From+1]
+		g.erased(rb.From, nil)
+		for _, tick := range rb.Ticks {
+			g.history = append(g.history, tick.Cycles)
+			g.powerUps = tick.PowerUps
+			g.erased(tick.Tick-1, tick.Pickups)
+		}
+	}
+}
+
+// forgets the erasures after tick, which are being replaced, and keeps the ones of pickups
+func (g *botGuest) erased(tick int, pickups []game.Event) {
+	kept := g.erasures[:0]
+	for _, e := range g.erasures {
+		if e.Tick <= tick {
+			kept = append(kept, e)
+		}
+	}
+	g.erasures = kept
+	for _, e := range pickups {
+		if len(e.Erased) > 0 {
+			g.erasures = append(g.erasures, e)
+		}
+	}
+}
+
+// picks the turn for the tick after the latest one and sends it
+func (g *botGuest) think() {
+	cycles := g.history[len(g.history)-1]
+	if g.player >= len(cycles) || !cycles[g.player].Alive {
+		return
+	}
+	board := bot.NewBoard(g.width, g.height)
+	board.Wrap = g.wrap
+	for _, wall := range g.walls {
+		board.Block(wall)
+	}
+	for ring := 0; ring < g.rings; ring++ {
+		for _, wall := range game.Ring(g.width, g.height, ring) {
+			board.Block(wall)
+		}
+	}
+	// the tick every trail cell was last erased on
+	erasedAt := make(map[game.Point]int)
+	for _, e := range g.erasures {
+		for _, p := range e.Erased {
+			erasedAt[p] = e.Tick
+		}
+	}
+	for tick, positions := range g.history {
+		block := func(p game.Point) {
+			if at, ok := erasedAt[p]; !ok || tick > at {
+				board.BlockTrail(p)
+			}
+		}
+		for _, cycle := range positions {
+			block(cycle.Pos)
+			// fast cycles move through more cells than their position on a tick
+			for _, p := range cycle.Path {
+				block(p)
+			}
+		}
+	}
+	board.Cycles = cycles
+	board.PowerUps = g.powerUps
+
+	ctx, cancel := context.WithTimeout(g.client.Ctx, g.budget)
+	turn := g.bot.Think(ctx, board, g.player)
+	cancel()
+	if turn == game.TurnNone {
+		return
+	}
+
+	data, err := json.Marshal(&InputMessage{
+		Type: MessageTypeInput,
+		Tick: len(g.history),
+		Turn: turn,
+	})
+	if err != nil {
+		slog.Error("marshal bot input", "error", err)
+		return
+	}
+	msg, err := DecodeMessage(data)
+	if err != nil {
+		return
+	}
+	g.client.Room.HandleInput(msg, g.client)
+}
@@ -5,9 +5,13 @@ import (
 	"encoding/json"
 	"errors"
 	"log/slog"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coder/websocket"
+	"github.com/isaackoz/tronline/bot"
+	"github.com/isaackoz/tronline/identity"
 )
 
 const (
@@ -18,19 +22,57 @@ const (
 )
 
 type Client struct {
-	ID     string
-	Hub    *Hub
-	Room   *Room
-	Conn   *websocket.Conn
-	Send   chan []byte // for sending messages to the client. buffer of 256 messages
-	IsHost bool
+	// per connection
+	ID string
+	// who the player is, nil for anonymous players
+	Identity *identity.Identity
+	Hub      *Hub
+	Room     *Room
+	Conn     *websocket.Conn
+	Send     chan []byte // for sending messages to the client. buffer of 256 messages
+	Relay    chan []byte // binary game frames relayed from the other member. buffer of 256 frames
+	IsHost   bool
+	// difficulty of a bot guest, empty for people
+	Bot    bot.Difficulty
 	Ctx    context.Context
+	Cancel context.CancelFunc // cancels Ctx, disconnecting the client
+	// round trip of the last ping, in nanoseconds
+	rtt atomic.Int64
+
+	// guards sending on Send and Relay against the room closing them
+	sendMu sync.Mutex
+	closed bool
+}
+
+// Latency is the round trip to the client, measured by the keep-alive pings. Zero until the
+// first pong is back
+func (c *Client) Latency() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
+
+// pings the client, keeping track of the round trip
+func (c *Client) ping(ctx context.Context) error {
+	start := time.Now()
+	if err := c.Conn.Ping(ctx); err != nil {
+		return err
+	}
+	c.rtt.Store(int64(time.Since(start)))
+	return nil
+}
+
+// PlayerID is the id results and ratings are kept under: the identity's, or the connection's
+// for anonymous players
+func (c *Client) PlayerID() string {
+	if c.Identity != nil {
+		return c.Identity.ID
+	}
+	return c.ID
 }
 
 // read and write messages to/from the websocket connection. this is client<->server
 func (c *Client) ReadWriteWs(ctx context.Context) {
 	c.Conn.SetReadLimit(maxMessageSize)
-	readChan := make(chan Message, 10)
+	readChan := make(chan *IncomingMessage, 10)
 	pingTicker := time.NewTicker(pingPeriod)
 	defer func() {
 		slog.Debug("Closing client connection in readwritews", "client_id", c.ID)
@@ -45,7 +87,7 @@ func (c *Client) ReadWriteWs(ctx context.Context) {
 		}
 		defer close(readChan)
 		for {
-			_, data, err := conn.Read(ctx)
+			typ, data, err := conn.Read(ctx)
 			if err != nil {
 				var wsErr websocket.CloseError
 				if errors.As(err, &wsErr) {
@@ -58,8 +100,14 @@ func (c *Client) ReadWriteWs(ctx context.Context) {
 				// otherwise it was a normal closure
 				return
 			}
-			var msg Message
-			if err := json.Unmarshal(data, &msg); err != nil {
+			if typ == websocket.MessageBinary {
+				// game frames in relay mode. relayed straight from here so waiting on the
+				// room's bandwidth cap only slows down this client's reads
+				c.Room.RelayFrame(ctx, c, data)
+				continue
+			}
+			msg, err := DecodeMessage(data)
+			if err != nil {
 				slog.Error("unmarshal message", "error", err)
 				continue
 			}
@@ -77,6 +125,13 @@ func (c *Client) ReadWriteWs(ctx context.Context) {
 		}
 	}(c.Conn)
 
+	// measure the latency right away, hosted matches need it before the first keep-alive ping
+	go func() {
+		if err := c.ping(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			slog.Debug("pinging client", "error", err)
+		}
+	}()
+
 	for {
 		select {
 		case msg, ok := <-readChan:
@@ -89,7 +144,21 @@ func (c *Client) ReadWriteWs(ctx context.Context) {
 			switch msgType {
 			case MessageTypeOffer, MessageTypeAnswer, MessageTypeICECandidate:
 				c.Room.RouteMessage(msg, c)
+			case MessageTypeInput:
+				c.Room.HandleInput(msg, c)
+			case MessageTypeBotRequest:
+				c.Room.AddBot(msg, c)
+			case MessageTypeMatchResult:
+				c.Room.ReportResult(msg, c)
+			case MessageTypeRelayRequest:
+				// webrtc failed or timed out, the game traffic goes through us instead
+				c.Room.StartRelay(c)
 			case MessageTypeWebRTCConnected:
+				if c.Room.IsRelaying() {
+					// the websocket is the game connection now, keep it open
+					slog.Debug("ignoring webrtc connected in relay mode", "client_id", c.ID, "room_id", c.Room.ID)
+					continue
+				}
 				// when the client tells us that they connected to their peer, our work is done here
 				slog.Debug("webrtc connected", "client_id", c.ID, "room_id", c.Room.ID)
 				// TODO: close the websocket connection as we don't need it anymore
@@ -109,8 +178,19 @@ func (c *Client) ReadWriteWs(ctx context.Context) {
 				}
 				return
 			}
+		case frame, ok := <-c.Relay:
+			if !ok {
+				return
+			}
+			err := c.Conn.Write(ctx, websocket.MessageBinary, frame)
+			if err != nil {
+				if !errors.Is(err, context.Canceled) {
+					slog.Debug("relaying to client", "error", err)
+				}
+				return
+			}
 		case <-pingTicker.C:
-			if err := c.Conn.Ping(ctx); err != nil {
+			if err := c.ping(ctx); err != nil {
 				if !errors.Is(err, context.Canceled) {
 					slog.Debug("pinging client", "error", err)
 				}
@@ -123,6 +203,8 @@ func (c *Client) ReadWriteWs(ctx context.Context) {
 	}
 }
 
+// SendMessage queues a message for the client. Messages to a client whose room closed are
+// dropped
 func (c *Client) SendMessage(msg Message) {
 	data, err := json.Marshal(msg)
 	if err != nil {
@@ -130,11 +212,49 @@ func (c *Client) SendMessage(msg Message) {
 		return
 	}
 
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.closed {
+		slog.Debug("client closed, dropping message", "type", msg.GetType(), "client_id", c.ID)
+		return
+	}
 	select {
 	case c.Send <- data:
 		slog.Debug("sent message", "type", msg.GetType(), "client_id", c.ID)
 	default:
+		// the send channel is closed by the room on cleanup, closing it here too could
+		// panic a later send. disconnect instead
 		slog.Debug("send channel full, closing connection", "client_id", c.ID)
+		if c.Cancel != nil {
+			c.Cancel()
+		}
+	}
+}
+
+// SendFrame queues a relayed binary frame. Frames must stay in order, so a client that can't
+// keep up is disconnected instead of having frames dropped
+func (c *Client) SendFrame(frame []byte) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.Relay <- frame:
+	default:
+		slog.Debug("relay channel full, disconnecting client", "client_id", c.ID)
+		if c.Cancel != nil {
+			c.Cancel()
+		}
+	}
+}
+
+// closes Send so the connection ends once what's queued is written. Nothing is sent after
+func (c *Client) close() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if !c.closed {
+		c.closed = true
 		close(c.Send)
 	}
 }
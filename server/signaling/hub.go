@@ -3,17 +3,22 @@ package signaling
 import (
 	"context"
 	"log/slog"
+	"strings"
 	"sync"
+
+	"github.com/lithammer/shortuuid/v4"
 )
 
 type Hub struct {
-	Rooms map[string]*Room
-	mu    sync.RWMutex
+	Rooms      map[string]*Room
+	roomConfig RoomConfig
+	mu         sync.RWMutex
 }
 
-func NewHub() *Hub {
+func NewHub(roomConfig RoomConfig) *Hub {
 	return &Hub{
-		Rooms: make(map[string]*Room),
+		Rooms:      make(map[string]*Room),
+		roomConfig: roomConfig,
 	}
 }
 
@@ -61,16 +66,37 @@ func NewHub() *Hub {
 // }
 
 // creates a room
-func (h *Hub) CreateRoom(id string) *Room {
+func (h *Hub) CreateRoom(id string, settings RoomSettings) *Room {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	room := NewRoom(id)
+	room := NewRoom(id, h.roomConfig, settings)
 	h.Rooms[id] = room
 	slog.Debug("room created", "room_id", id)
 	return room
 }
 
+// OpenRoom creates a room the server sets up itself, i.e. for a tournament match, and runs it
+// until it closes or ctx is done. Players join it as clients with its id
+func (h *Hub) OpenRoom(ctx context.Context, settings RoomSettings) *Room {
+	h.mu.Lock()
+	id := newRoomID()
+	for h.Rooms[id] != nil {
+		id = newRoomID()
+	}
+	room := NewRoom(id, h.roomConfig, settings)
+	h.Rooms[id] = room
+	h.mu.Unlock()
+	slog.Debug("room opened", "room_id", id, "players", settings.Players)
+	go h.RunRoom(ctx, room)
+	return room
+}
+
+// 6 char room id i.e. "AB12CD"
+func newRoomID() string {
+	return strings.ToUpper(shortuuid.New()[0:6])
+}
+
 // runs a rooms logic and handles cleanup when the room is closed
 func (h *Hub) RunRoom(ctx context.Context, room *Room) {
 	err := room.Run(ctx) // blocking until the room is done
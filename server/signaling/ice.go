@@ -1,67 +1,181 @@
 package signaling
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
+	"log/slog"
+	"net"
+	"sync"
 	"time"
 )
 
 type ICEServer struct {
 	URLs       []string `json:"urls"`
-	Username   string   `json:"username"`
-	Credential string   `json:"credential"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
 }
 
 type ICEServersResponse struct {
 	ICEServers []ICEServer `json:"iceServers"`
+	// when the credentials stop working. zero means they never expire
+	ExpiresAt time.Time `json:"-"`
 }
 
-type GenerateICEServersRequest struct {
-	TTL int `json:"ttl"`
+// public STUN servers handed out when no provider is configured or the provider is unavailable
+var FallbackICEServers = []ICEServer{
+	{URLs: []string{"stun:stun.cloudflare.com:3478", "stun:stun.l.google.com:19302"}},
 }
 
-// GenerateICEServers calls the Cloudflare TURN API to generate ICE server credentials
-func GenerateICEServers(ctx context.Context, turnKeyID string, apiToken string, ttl int) (*ICEServersResponse, error) {
-	url := fmt.Sprintf("https://rtc.live.cloudflare.com/v1/turn/keys/%s/credentials/generate-ice-servers", turnKeyID)
+// ICEProvider is a source of ICE servers (and their credentials) for the WebRTC peer connection
+type ICEProvider interface {
+	// short name used in logs, i.e. "cloudflare"
+	Name() string
+	ICEServers(ctx context.Context) (*ICEServersResponse, error)
+}
+
+// LocalICEServer is an ICE server embedded in this binary (i.e. the built-in STUN server).
+// host is the public host the client reached us on, used when no public host is configured.
+// user identifies the client for servers that hand out per user credentials
+type LocalICEServer func(host string, user string) ICEServer
 
-	reqBody := GenerateICEServersRequest{
-		TTL: ttl,
+// LocalSTUNServer advertises the built-in STUN server at publicHost:port. If publicHost is empty,
+// the host the client connected to is used
+func LocalSTUNServer(publicHost string, port string) LocalICEServer {
+	return func(host string, user string) ICEServer {
+		if publicHost != "" {
+			host = publicHost
+		}
+		return ICEServer{URLs: []string{"stun:" + net.JoinHostPort(host, port)}}
 	}
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
+}
+
+// LocalTURNServer advertises the built-in TURN server with TURN REST API credentials for the user.
+// Either port may be empty if that transport is disabled
+func LocalTURNServer(publicHost string, udpPort string, tcpPort string, secret string, ttl time.Duration) LocalICEServer {
+	return func(host string, user string) ICEServer {
+		if publicHost != "" {
+			host = publicHost
+		}
+		var urls []string
+		if udpPort != "" {
+			urls = append(urls, "turn:"+net.JoinHostPort(host, udpPort)+"?transport=udp")
+		}
+		if tcpPort != "" {
+			urls = append(urls, "turn:"+net.JoinHostPort(host, tcpPort)+"?transport=tcp")
+		}
+		username, credential := CoturnCredentials(secret, user, time.Now().Add(ttl))
+		return ICEServer{
+			URLs:       urls,
+			Username:   username,
+			Credential: credential,
+		}
 	}
+}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+// ICEServerCache hands out ICE servers to clients. Credentials are generated once per
+// lifetime window and shared by every client, so we don't hit the provider per connection
+type ICEServerCache struct {
+	provider ICEProvider
+	local    []LocalICEServer
+
+	mu        sync.Mutex
+	servers   *ICEServersResponse
+	fetchedAt time.Time
+	// closed when the provider call running finishes, nil while there's none
+	refreshing chan struct{}
+}
+
+func NewICEServerCache(provider ICEProvider) *ICEServerCache {
+	return &ICEServerCache{
+		provider: provider,
 	}
+}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiToken))
-	req.Header.Set("Content-Type", "application/json")
+// AddLocal advertises a server embedded in this binary ahead of the provider's servers
+func (c *ICEServerCache) AddLocal(server LocalICEServer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.local = append(c.local, server)
+}
+
+// Get returns the ICE servers for a client that reached us on host (the Host header of its request),
+// with the local servers first. user identifies the client to the local servers
+func (c *ICEServerCache) Get(ctx context.Context, host string, user string) *ICEServersResponse {
+	servers := c.get(ctx)
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.local) == 0 {
+		return servers
 	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to execute request: %w", err)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
 	}
-	defer resp.Body.Close()
+	resp := &ICEServersResponse{ExpiresAt: servers.ExpiresAt}
+	for _, local := range c.local {
+		resp.ICEServers = append(resp.ICEServers, local(host, user))
+	}
+	resp.ICEServers = append(resp.ICEServers, servers.ICEServers...)
+	return resp
+}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+// get returns the cached ICE servers, asking the provider for new ones when the cached credentials are
+// past half their lifetime. This way a client always gets credentials that are valid for at least half of it.
+// One call asks the provider at a time, the others get the old credentials meanwhile or wait for it when
+// there are none. Falls back to STUN only if the provider fails and nothing valid is cached
+func (c *ICEServerCache) get(ctx context.Context) *ICEServersResponse {
+	c.mu.Lock()
+	now := time.Now()
+	if c.servers != nil {
+		halfLife := c.fetchedAt.Add(c.servers.ExpiresAt.Sub(c.fetchedAt) / 2)
+		if c.servers.ExpiresAt.IsZero() || now.Before(halfLife) {
+			defer c.mu.Unlock()
+			return c.servers
+		}
 	}
+	done := c.refresh(ctx)
+	// the old credentials are still usable until they fully expire
+	if c.servers != nil && now.Before(c.servers.ExpiresAt) {
+		defer c.mu.Unlock()
+		return c.servers
+	}
+	c.mu.Unlock()
 
-	var iceServers ICEServersResponse
-	if err := json.NewDecoder(resp.Body).Decode(&iceServers); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return &ICEServersResponse{ICEServers: FallbackICEServers}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.servers != nil && (c.servers.ExpiresAt.IsZero() || time.Now().Before(c.servers.ExpiresAt)) {
+		return c.servers
 	}
+	return &ICEServersResponse{ICEServers: FallbackICEServers}
+}
 
-	return &iceServers, nil
+// asks the provider for new servers in the background unless that's running already. The
+// returned channel is closed once it's done. must hold c.mu
+func (c *ICEServerCache) refresh(ctx context.Context) <-chan struct{} {
+	if c.refreshing != nil {
+		return c.refreshing
+	}
+	done := make(chan struct{})
+	c.refreshing = done
+	// the client that started it may leave, the others still wait for it
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer close(done)
+		servers, err := c.provider.ICEServers(ctx)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.refreshing = nil
+		if err != nil {
+			slog.Error("get ice servers", "provider", c.provider.Name(), "error", err)
+			return
+		}
+		c.servers = servers
+		c.fetchedAt = time.Now()
+		slog.Debug("got new ice servers", "provider", c.provider.Name(), "count", len(servers.ICEServers), "expires_at", servers.ExpiresAt)
+	}()
+	return done
 }
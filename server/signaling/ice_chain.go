@@ -0,0 +1,174 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ICEChainLink is a provider in an ICEProviderChain with its own timeout
+type ICEChainLink struct {
+	Provider ICEProvider
+	// how long the provider may take before the next one is tried. 0 means no timeout
+	Timeout time.Duration
+}
+
+// ICEProviderStats are the counters of a single provider in the chain
+type ICEProviderStats struct {
+	Name string `json:"name"`
+	// calls made to the provider
+	Requests int64 `json:"requests"`
+	// failed calls, including timeouts
+	Errors   int64 `json:"errors"`
+	Timeouts int64 `json:"timeouts"`
+	// calls skipped because the circuit breaker was open
+	Skipped int64 `json:"skipped"`
+	// times the last known good credentials were handed out instead
+	StaleServed int64     `json:"staleServed"`
+	BreakerOpen bool      `json:"breakerOpen"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastErrorAt time.Time `json:"lastErrorAt,omitempty"`
+}
+
+type chainLink struct {
+	ICEChainLink
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	// a call after the cooldown is running, the others still skip the provider
+	probing  bool
+	lastGood *ICEServersResponse
+	stats    ICEProviderStats
+}
+
+// ICEProviderChain tries its providers in order until one of them returns ICE servers.
+// A provider that fails threshold times in a row is skipped for the cooldown (circuit breaker),
+// after which it gets a single attempt again. If every provider fails, the last known good
+// credentials are reused as long as they're still valid
+type ICEProviderChain struct {
+	links     []*chainLink
+	threshold int
+	cooldown  time.Duration
+}
+
+func NewICEProviderChain(threshold int, cooldown time.Duration, links ...ICEChainLink) *ICEProviderChain {
+	chain := &ICEProviderChain{
+		threshold: max(threshold, 1),
+		cooldown:  cooldown,
+	}
+	for _, link := range links {
+		chain.links = append(chain.links, &chainLink{
+			ICEChainLink: link,
+			stats:        ICEProviderStats{Name: link.Provider.Name()},
+		})
+	}
+	return chain
+}
+
+func (c *ICEProviderChain) Name() string {
+	names := make([]string, len(c.links))
+	for i, link := range c.links {
+		names[i] = link.Provider.Name()
+	}
+	return "chain(" + strings.Join(names, ",") + ")"
+}
+
+func (c *ICEProviderChain) ICEServers(ctx context.Context) (*ICEServersResponse, error) {
+	var errs []error
+	for _, link := range c.links {
+		servers, err := link.get(ctx, c.threshold, c.cooldown)
+		if err == nil {
+			return servers, nil
+		}
+		errs = append(errs, err)
+	}
+
+	// everybody failed, reuse the first last known good credentials that haven't expired
+	now := time.Now()
+	for _, link := range c.links {
+		link.mu.Lock()
+		lastGood := link.lastGood
+		if lastGood != nil && (lastGood.ExpiresAt.IsZero() || now.Before(lastGood.ExpiresAt)) {
+			link.stats.StaleServed++
+			link.mu.Unlock()
+			slog.Warn("all ice providers failed, reusing last known good servers", "provider", link.Provider.Name(), "expires_at", lastGood.ExpiresAt)
+			return lastGood, nil
+		}
+		link.mu.Unlock()
+	}
+
+	return nil, fmt.Errorf("all ice providers failed: %w", errors.Join(errs...))
+}
+
+// Stats returns a copy of the counters of every provider in the chain
+func (c *ICEProviderChain) Stats() []ICEProviderStats {
+	now := time.Now()
+	stats := make([]ICEProviderStats, len(c.links))
+	for i, link := range c.links {
+		link.mu.Lock()
+		stats[i] = link.stats
+		stats[i].BreakerOpen = now.Before(link.openUntil) || link.probing
+		link.mu.Unlock()
+	}
+	return stats
+}
+
+var errBreakerOpen = errors.New("circuit breaker open")
+
+func (l *chainLink) get(ctx context.Context, threshold int, cooldown time.Duration) (*ICEServersResponse, error) {
+	name := l.Provider.Name()
+
+	l.mu.Lock()
+	if time.Now().Before(l.openUntil) || l.probing {
+		l.stats.Skipped++
+		l.mu.Unlock()
+		return nil, fmt.Errorf("%s: %w", name, errBreakerOpen)
+	}
+	// half open, this call is the single attempt
+	probing := l.failures >= threshold
+	l.probing = probing
+	l.stats.Requests++
+	l.mu.Unlock()
+
+	callCtx := ctx
+	if l.Timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, l.Timeout)
+		defer cancel()
+	}
+	servers, err := l.Provider.ICEServers(callCtx)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if probing {
+		l.probing = false
+	}
+	if err != nil {
+		l.failures++
+		l.stats.Errors++
+		if errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+			l.stats.Timeouts++
+		}
+		l.stats.LastError = err.Error()
+		l.stats.LastErrorAt = time.Now()
+		slog.Warn("ice provider failed", "provider", name, "error", err, "consecutive_failures", l.failures)
+		if l.failures >= threshold {
+			l.openUntil = time.Now().Add(cooldown)
+			slog.Error("ice provider circuit breaker opened", "provider", name, "cooldown", cooldown)
+		}
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	if l.failures >= threshold {
+		slog.Info("ice provider recovered", "provider", name)
+	}
+	l.failures = 0
+	l.openUntil = time.Time{}
+	l.lastGood = servers
+	return servers, nil
+}
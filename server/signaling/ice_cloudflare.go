@@ -0,0 +1,90 @@
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+type GenerateICEServersRequest struct {
+	TTL int `json:"ttl"`
+}
+
+// base url of the Cloudflare TURN keys API
+const CloudflareTurnAPI = "https://rtc.live.cloudflare.com/v1/turn/keys"
+
+// CloudflareProvider generates short lived TURN credentials with the Cloudflare TURN API
+type CloudflareProvider struct {
+	TurnKeyID string
+	APIToken  string
+	TTL       time.Duration
+	// optional, defaults to CloudflareTurnAPI. Useful to point at an httptest server
+	BaseURL string
+}
+
+func (p *CloudflareProvider) Name() string {
+	return "cloudflare"
+}
+
+func (p *CloudflareProvider) ICEServers(ctx context.Context) (*ICEServersResponse, error) {
+	baseURL := p.BaseURL
+	if baseURL == "" {
+		baseURL = CloudflareTurnAPI
+	}
+	servers, err := generateICEServers(ctx, baseURL, p.TurnKeyID, p.APIToken, int(p.TTL.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	servers.ExpiresAt = time.Now().Add(p.TTL)
+	return servers, nil
+}
+
+// GenerateICEServers calls the Cloudflare TURN API to generate ICE server credentials
+func GenerateICEServers(ctx context.Context, turnKeyID string, apiToken string, ttl int) (*ICEServersResponse, error) {
+	return generateICEServers(ctx, CloudflareTurnAPI, turnKeyID, apiToken, ttl)
+}
+
+func generateICEServers(ctx context.Context, baseURL string, turnKeyID string, apiToken string, ttl int) (*ICEServersResponse, error) {
+	url := fmt.Sprintf("%s/%s/credentials/generate-ice-servers", baseURL, turnKeyID)
+
+	reqBody := GenerateICEServersRequest{
+		TTL: ttl,
+	}
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiToken))
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var iceServers ICEServersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&iceServers); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &iceServers, nil
+}
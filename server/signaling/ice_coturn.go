@@ -0,0 +1,56 @@
+package signaling
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// CoturnProvider generates time limited credentials for a coturn server using the TURN REST API
+// scheme (static-auth-secret / use-auth-secret). No request is made, coturn validates the
+// credentials with the shared secret on its own
+// ref: https://datatracker.ietf.org/doc/html/draft-uberti-behave-turn-rest-00
+type CoturnProvider struct {
+	URLs   []string
+	Secret string
+	TTL    time.Duration
+	// optional user id appended to the username, i.e. "1700000000:tronline"
+	User string
+}
+
+func (p *CoturnProvider) Name() string {
+	return "coturn"
+}
+
+func (p *CoturnProvider) ICEServers(ctx context.Context) (*ICEServersResponse, error) {
+	if p.Secret == "" {
+		return nil, fmt.Errorf("coturn secret is empty")
+	}
+	expiresAt := time.Now().Add(p.TTL)
+	username, credential := CoturnCredentials(p.Secret, p.User, expiresAt)
+	return &ICEServersResponse{
+		ICEServers: []ICEServer{
+			{
+				URLs:       p.URLs,
+				Username:   username,
+				Credential: credential,
+			},
+		},
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// CoturnCredentials returns a TURN REST API username/password pair that is valid until expiresAt.
+// username = "<unix expiry>[:user]", password = base64(hmac-sha1(secret, username))
+func CoturnCredentials(secret string, user string, expiresAt time.Time) (string, string) {
+	username := fmt.Sprintf("%d", expiresAt.Unix())
+	if user != "" {
+		username += ":" + user
+	}
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
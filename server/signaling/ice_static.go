@@ -0,0 +1,17 @@
+package signaling
+
+import "context"
+
+// StaticProvider always hands out the same ICE servers, i.e. public STUN servers or a TURN server
+// with fixed credentials
+type StaticProvider struct {
+	Servers []ICEServer
+}
+
+func (p *StaticProvider) Name() string {
+	return "static"
+}
+
+func (p *StaticProvider) ICEServers(ctx context.Context) (*ICEServersResponse, error) {
+	return &ICEServersResponse{ICEServers: p.Servers}, nil
+}
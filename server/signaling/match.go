@@ -0,0 +1,519 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/isaackoz/tronline/bot"
+	"github.com/isaackoz/tronline/game"
+	"github.com/isaackoz/tronline/mode"
+	"github.com/isaackoz/tronline/replay"
+	"github.com/isaackoz/tronline/result"
+	"github.com/isaackoz/tronline/rollback"
+	"github.com/lithammer/shortuuid/v4"
+)
+
+const (
+	// time between match-start and the first tick of a round
+	matchCountdown = 3 * time.Second
+	// how long saving a replay may take
+	replaySaveTimeout = 10 * time.Second
+	// how long recording a match result may take
+	resultSaveTimeout = 10 * time.Second
+	// inputs a player can have waiting on the ticks after the one they were for
+	maxQueuedInputs = 4
+)
+
+// hostedMatch is a match the server runs itself. Members only send inputs and
+// get a state delta every tick. Inputs arriving up to rollbackWindow ticks late, and no
+// later than the member's round trip, roll the simulation back and the members get the
+// corrected ticks. Players without a member
+// are bots the server plays itself
+type hostedMatch struct {
+	id             string
+	roomID         string
+	tickRate       int
+	rollbackWindow int
+	mode           mode.Mode
+	// arena settings with the mode applied, every round starts from them
+	settings game.Settings
+	seed     uint32
+	// ticks a survival round lasts
+	timeLimit int
+	ranked    bool
+	// resolved arena name
+	arena     string
+	startedAt time.Time
+
+	mu     sync.Mutex
+	series *mode.Series
+	sim    *rollback.Session
+	// members by player, nil for bots and members who left
+	players   []*Client
+	playerIDs []string
+	bots      map[int]bot.Bot
+	botBudget time.Duration
+	// inputs of the current round as they were applied, nil when replays aren't stored
+	recorder *replay.Recorder
+	replays  replay.Store
+	// ids of the replays of the rounds played so far
+	replayIDs []string
+	// nil when results aren't recorded
+	results *result.Reconciler
+	// ticks the round has been over for. The result is final once no late input can change it
+	overFor int
+	done    bool
+	stop    chan struct{}
+}
+
+// hostedMatchConfig is everything a room decides about its match
+type hostedMatchConfig struct {
+	roomID         string
+	tickRate       int
+	rollbackWindow int
+	mode           mode.Mode
+	arena          string
+	settings       game.Settings
+	seed           uint32
+	botDifficulty  bot.Difficulty
+	ranked         bool
+	replays        replay.Store
+	results        *result.Reconciler
+}
+
+// newHostedMatch creates a match between members, indexed by player. Players past the
+// members, or nil members, are played by bots
+func newHostedMatch(cfg hostedMatchConfig, members []*Client) *hostedMatch {
+	m := &hostedMatch{
+		id:             shortuuid.New(),
+		roomID:         cfg.roomID,
+		tickRate:       cfg.tickRate,
+		rollbackWindow: cfg.rollbackWindow,
+		mode:           cfg.mode,
+		settings:       cfg.mode.Apply(cfg.settings),
+		seed:           cfg.seed,
+		ranked:         cfg.ranked,
+		arena:          cfg.arena,
+		startedAt:      time.Now(),
+		timeLimit:      cfg.mode.TimeLimit * cfg.tickRate,
+		series:         mode.NewSeries(cfg.mode),
+		players:        make([]*Client, cfg.mode.Players()),
+		playerIDs:      make([]string, cfg.mode.Players()),
+		bots:           make(map[int]bot.Bot),
+		replays:        cfg.replays,
+		results:        cfg.results,
+		stop:           make(chan struct{}),
+	}
+	copy(m.players, members)
+	for i, client := range m.players {
+		if client != nil {
+			m.playerIDs[i] = client.PlayerID()
+			continue
+		}
+		m.playerIDs[i] = "bot-" + string(cfg.botDifficulty)
+		m.bots[i] = bot.New(cfg.botDifficulty, uint64(cfg.seed)+uint64(i))
+	}
+	if len(m.bots) > 0 {
+		// the bots think while the match is locked, keep them to a quarter of the tick
+		m.botBudget = min(cfg.botDifficulty.ThinkTime(), time.Second/time.Duration(4*cfg.tickRate*len(m.bots)))
+	}
+	return m
+}
+
+// run plays the rounds of the match until it's decided or stopped
+func (m *hostedMatch) run() {
+	for {
+		if err := m.startRound(); err != nil {
+			slog.Error("start hosted round", "error", err, "room_id", m.roomID)
+			m.close()
+			return
+		}
+		select {
+		case <-time.After(matchCountdown):
+		case <-m.stop:
+			return
+		}
+		if m.playRound() {
+			return
+		}
+	}
+}
+
+// creates the simulation of the next round and tells the members it's about to start
+func (m *hostedMatch) startRound() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	settings := m.settings
+	if settings.PowerUps != nil {
+		// a different seed every round so power-ups don't spawn the same way again
+		settings.Seed = m.seed + uint32(m.series.Round()-1)
+	}
+	sim, err := rollback.New(settings, rollback.Config{
+		Window:        m.rollbackWindow,
+		Authoritative: true,
+	})
+	if err != nil {
+		return err
+	}
+	m.sim = sim
+	m.overFor = 0
+	m.recorder = nil
+	if m.replays != nil {
+		members := make([]replay.Player, len(m.playerIDs))
+		for i, id := range m.playerIDs {
+			members[i] = replay.Player{ID: id}
+			if client := m.players[i]; client != nil && client.Identity != nil {
+				members[i].Name = client.Identity.Name
+			}
+		}
+		m.recorder = replay.NewRecorder(settings, int64(m.seed), members, "hosted")
+		m.recorder.SetMatch(m.id, m.series.Round(), m.mode)
+	}
+
+	state := m.sim.State()
+	for i, client := range m.players {
+		if client == nil {
+			continue
+		}
+		client.SendMessage(&MatchStartMessage{
+			Type:           MessageTypeMatchStart,
+			Player:         i,
+			Game:           m.mode,
+			Round:          m.series.Round(),
+			Width:          state.Width,
+			Height:         state.Height,
+			Walls:          m.settings.Walls,
+			Wrap:           m.settings.Wrap,
+			Teams:          m.settings.Teams,
+			FriendlyPass:   m.settings.FriendlyPass,
+			PowerUps:       m.settings.PowerUps,
+			SuddenDeath:    m.settings.SuddenDeath,
+			TickRate:       m.tickRate,
+			RollbackWindow: m.rollbackWindow,
+			Cycles:         state.Cycles,
+			StartsIn:       int(matchCountdown.Milliseconds()),
+		})
+	}
+	slog.Debug("hosted round starting", "room_id", m.roomID, "round", m.series.Round(), "mode", m.mode.Kind, "tick_rate", m.tickRate, "rollback_window", m.rollbackWindow)
+	return nil
+}
+
+// ticks the round until it's over. returns true once the match is over or stopped
+func (m *hostedMatch) playRound() bool {
+	ticker := time.NewTicker(time.Second / time.Duration(m.tickRate))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.stop:
+			return true
+		}
+		if roundOver, matchOver := m.tick(); roundOver {
+			return matchOver
+		}
+	}
+}
+
+// steps the simulation once and broadcasts the delta
+func (m *hostedMatch) tick() (roundOver bool, matchOver bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done {
+		return true, true
+	}
+
+	state := m.sim.State()
+	if over, _ := m.mode.RoundResult(state, m.timeLimit); !over {
+		m.botInputs(state)
+		events, err := m.sim.Advance()
+		if err != nil {
+			// authoritative sessions never stall
+			slog.Error("advance hosted match", "error", err, "room_id", m.roomID)
+			return false, false
+		}
+		deaths, pickups := game.SplitEvents(events)
+		m.broadcast(&StateMessage{
+			Type:     MessageTypeState,
+			Tick:     state.Tick,
+			Cycles:   state.Cycles,
+			PowerUps: state.PowerUps,
+			Rings:    state.Rings,
+			Deaths:   deaths,
+			Pickups:  pickups,
+		})
+		m.overFor = 0
+		if over, _ = m.mode.RoundResult(state, m.timeLimit); !over {
+			return false, false
+		}
+	}
+
+	// a late input could still undo the crash, wait until it's out of the rollback window
+	if m.overFor < m.rollbackWindow {
+		m.overFor++
+		return false, false
+	}
+	_, side := m.mode.RoundResult(state, m.timeLimit)
+	reason := "crash"
+	if m.mode.Kind == mode.KindSurvival && state.Tick >= m.timeLimit || state.TimeUp() {
+		reason = "time"
+	}
+	m.endRound(side, reason)
+	return true, m.done
+}
+
+// must hold m.mu
+func (m *hostedMatch) botInputs(state *game.State) {
+	for player, b := range m.bots {
+		if !state.Cycles[player].Alive {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), m.botBudget)
+		turn := b.Think(ctx, bot.BoardFromState(state), player)
+		cancel()
+		if turn != game.TurnNone {
+			m.setInput(player, state.Tick+1, game.Input{Turn: turn})
+		}
+	}
+}
+
+// applies a member's input. Inputs too late for a rollback are applied on the next tick.
+// So are inputs for ticks the member had already seen the state of, which could dodge a
+// crash it watched happen: an input may only reach back as far as the member's round trip
+func (m *hostedMatch) handleInput(player int, input InputMessage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done || m.sim == nil || player >= len(m.players) || m.players[player] == nil {
+		return
+	}
+
+	latest := m.sim.State().Tick
+	lag := int((m.players[player].Latency()*time.Duration(m.tickRate) + time.Second - 1) / time.Second)
+	tick := input.Tick
+	if tick <= m.sim.Confirmed() || tick <= latest-lag {
+		tick = latest + 1
+	}
+	m.setInput(player, tick, game.Input{Turn: input.Turn, Boost: input.Boost, Jump: input.Jump})
+}
+
+// a second input for a tick that already has one goes to the tick after it so quick double
+// turns aren't lost, up to maxQueuedInputs of them. Inputs more than a second ahead of the
+// simulation are dropped. must hold m.mu
+func (m *hostedMatch) setInput(player int, tick int, input game.Input) {
+	latest := m.sim.State().Tick + m.tickRate
+	for queued := 0; ; queued++ {
+		if tick > latest || queued > maxQueuedInputs {
+			slog.Debug("dropping input, too many queued", "room_id", m.roomID, "player", player, "tick", tick)
+			return
+		}
+		rb, err := m.sim.SetInput(player, tick, input)
+		if errors.Is(err, rollback.ErrDuplicate) {
+			tick++
+			continue
+		}
+		if err != nil {
+			slog.Debug("dropping input", "error", err, "room_id", m.roomID, "player", player, "tick", tick)
+			return
+		}
+		if m.recorder != nil {
+			// an input is final once it's set, ticks without one were simulated with no turn
+			m.recorder.Record(tick, player, input)
+		}
+		if rb != nil {
+			m.broadcast(&RollbackMessage{
+				Type:  MessageTypeRollback,
+				From:  rb.From,
+				Ticks: rb.Ticks,
+			})
+			slog.Debug("hosted match rolled back", "room_id", m.roomID, "player", player, "from", rb.From, "depth", len(rb.Ticks))
+		}
+		return
+	}
+}
+
+// the member left, which ends the match. The side of a member still in it wins, the bots
+// win survival
+func (m *hostedMatch) forfeit(player int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done || player >= len(m.players) {
+		return
+	}
+	m.players[player] = nil
+	winner := -1
+	if m.mode.Kind == mode.KindSurvival {
+		winner = m.mode.Side(len(m.players) - 1)
+	}
+	for i, client := range m.players {
+		if client != nil {
+			winner = m.mode.Side(i)
+			break
+		}
+	}
+	slog.Debug("player forfeited hosted match", "room_id", m.roomID, "player", player)
+	if m.sim == nil {
+		// still counting down the first round
+		m.done = true
+		close(m.stop)
+		return
+	}
+	m.saveReplay(winner)
+	m.finish(winner, "forfeit")
+}
+
+// stops the match without a result, i.e. the room is closing. Nothing is sent after it returns
+func (m *hostedMatch) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.done {
+		m.done = true
+		close(m.stop)
+	}
+}
+
+// ends the match the room can't keep open any longer, the side ahead in rounds wins or it's
+// a draw. The result is sent and recorded as usual
+func (m *hostedMatch) expire() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done {
+		return
+	}
+	if m.sim == nil {
+		m.done = true
+		close(m.stop)
+		return
+	}
+	winner, best := -1, -1
+	for side, score := range m.series.Scores() {
+		if score > best {
+			winner, best = side, score
+		} else if score == best {
+			// tied for the lead
+			winner = -1
+		}
+	}
+	slog.Debug("hosted match expired", "room_id", m.roomID, "scores", m.series.Scores())
+	m.saveReplay(winner)
+	m.finish(winner, "time")
+}
+
+func (m *hostedMatch) isDone() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.done
+}
+
+// must hold m.mu
+func (m *hostedMatch) endRound(side int, reason string) {
+	m.series.Record(side)
+	round := m.series.Round() - 1
+	state := m.sim.State()
+	m.broadcast(&RoundResultMessage{
+		Type:   MessageTypeRoundResult,
+		Round:  round,
+		Winner: side,
+		Tick:   state.Tick,
+		Reason: reason,
+		Scores: m.series.Scores(),
+	})
+	stats := m.sim.Stats()
+	slog.Debug("hosted round finished",
+		"room_id", m.roomID,
+		"round", round,
+		"winner", side,
+		"reason", reason,
+		"tick", state.Tick,
+		"rollbacks", stats.Rollbacks,
+		"max_rollback_depth", stats.MaxDepth,
+		"late_inputs", stats.LateInputs,
+	)
+	m.saveReplay(side)
+	if m.series.Over() {
+		m.finish(m.series.Winner(), reason)
+	}
+}
+
+// must hold m.mu
+func (m *hostedMatch) finish(winner int, reason string) {
+	m.done = true
+	close(m.stop)
+	m.broadcast(&MatchResultMessage{
+		Type:   MessageTypeMatchResult,
+		Winner: winner,
+		Tick:   m.sim.State().Tick,
+		Reason: reason,
+		Mode:   m.mode.Kind,
+		Rounds: m.series.Round() - 1,
+		Scores: m.series.Scores(),
+	})
+	slog.Debug("hosted match finished", "room_id", m.roomID, "winner", winner, "reason", reason, "scores", m.series.Scores())
+	if m.results != nil {
+		state := m.sim.State()
+		survived := make([]int, len(m.playerIDs))
+		for i := range survived {
+			survived[i] = state.Tick
+			if i < len(state.Cycles) && state.Cycles[i].DiedAt > 0 {
+				survived[i] = state.Cycles[i].DiedAt
+			}
+		}
+		go recordResult(m.results, &result.Result{
+			ID:         m.id,
+			RoomID:     m.roomID,
+			Mode:       m.mode.Kind,
+			Arena:      m.arena,
+			Ranked:     m.ranked,
+			Players:    slices.Clone(m.playerIDs),
+			Winner:     winner,
+			Ticks:      state.Tick,
+			TickRate:   m.tickRate,
+			Survived:   survived,
+			Reason:     reason,
+			Scores:     m.series.Scores(),
+			Replays:    slices.Clone(m.replayIDs),
+			StartedAt:  m.startedAt,
+			FinishedAt: time.Now(),
+		})
+	}
+}
+
+func recordResult(results *result.Reconciler, r *result.Result) {
+	ctx, cancel := context.WithTimeout(context.Background(), resultSaveTimeout)
+	defer cancel()
+	if err := results.Record(ctx, r); err != nil {
+		slog.Error("record match result", "error", err, "match_id", r.ID, "room_id", r.RoomID)
+	}
+}
+
+// saves the replay of the current round, must hold m.mu
+func (m *hostedMatch) saveReplay(winner int) {
+	if m.recorder == nil || m.sim.State().Tick == 0 {
+		return
+	}
+	r := m.recorder.Finish(m.sim.State().Tick, winner)
+	m.replayIDs = append(m.replayIDs, r.Header.ID)
+	go saveReplay(m.replays, r, m.roomID)
+	m.recorder = nil
+}
+
+func saveReplay(store replay.Store, r *replay.Replay, roomID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), replaySaveTimeout)
+	defer cancel()
+	if err := store.Save(ctx, r); err != nil {
+		slog.Error("save replay", "error", err, "room_id", roomID)
+		return
+	}
+	slog.Debug("saved replay", "replay_id", r.Header.ID, "room_id", roomID, "ticks", r.Header.Ticks)
+}
+
+// must hold m.mu
+func (m *hostedMatch) broadcast(msg Message) {
+	for _, client := range m.players {
+		if client != nil {
+			client.SendMessage(msg)
+		}
+	}
+}
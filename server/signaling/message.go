@@ -1,5 +1,15 @@
 package signaling
 
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/isaackoz/tronline/game"
+	"github.com/isaackoz/tronline/mode"
+	"github.com/isaackoz/tronline/result"
+	"github.com/isaackoz/tronline/rollback"
+)
+
 type MessageType string
 
 const (
@@ -11,6 +21,25 @@ const (
 
 	MessageTypeRoomMeta MessageType = "room-meta"
 
+	// websocket relay fallback when WebRTC can't connect
+	MessageTypeRelayRequest MessageType = "relay-request"
+	MessageTypeRelayStart   MessageType = "relay-start"
+
+	// server hosted matches
+	MessageTypeInput       MessageType = "input"
+	MessageTypeMatchStart  MessageType = "match-start"
+	MessageTypeState       MessageType = "state"
+	MessageTypeMatchResult MessageType = "match-result"
+	MessageTypeRoundResult MessageType = "round-result"
+	MessageTypeRollback    MessageType = "rollback"
+	// host asks for a bot to join as the guest
+	MessageTypeBotRequest MessageType = "bot-request"
+
+	// P2P matches. Both members get a key to sign their match-result report with
+	MessageTypeResultKey MessageType = "result-key"
+	// the reports disagreed or the match was picked for a check, members upload their input logs
+	MessageTypeLogRequest MessageType = "log-request"
+
 	MessageEventTypeHostLeft    MessageType = "host-left"
 	MessageEventTypeGuestLeft   MessageType = "guest-left"
 	MessageEventTypeGuestJoined MessageType = "guest-joined"
@@ -22,6 +51,41 @@ type Message interface {
 	GetType() MessageType
 }
 
+// IncomingMessage is a message received from a client. Only the type is decoded up front,
+// the rest is kept raw so it can be forwarded as is or decoded into the concrete message type
+type IncomingMessage struct {
+	Type MessageType
+	Raw  json.RawMessage
+}
+
+func (m *IncomingMessage) GetType() MessageType {
+	return m.Type
+}
+
+// MarshalJSON forwards the message exactly as the client sent it
+func (m *IncomingMessage) MarshalJSON() ([]byte, error) {
+	return m.Raw, nil
+}
+
+// Decode decodes the message into its concrete type
+func (m *IncomingMessage) Decode(v any) error {
+	return json.Unmarshal(m.Raw, v)
+}
+
+// DecodeMessage decodes the type of a message received from a client
+func DecodeMessage(data []byte) (*IncomingMessage, error) {
+	var envelope struct {
+		Type MessageType `json:"type"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	if envelope.Type == "" {
+		return nil, errors.New("message has no type")
+	}
+	return &IncomingMessage{Type: envelope.Type, Raw: data}, nil
+}
+
 type EventMessage struct {
 	Type     MessageType `json:"type"`
 	Metadata any         `json:"metadata,omitempty"`
@@ -32,8 +96,17 @@ func (m EventMessage) GetType() MessageType {
 }
 
 type RoomMetaMessage struct {
-	Type   MessageType `json:"type"`
-	RoomId string      `json:"roomId"`
+	Type     MessageType `json:"type"`
+	RoomId   string      `json:"roomId"`
+	Mode     RoomMode    `json:"mode"`
+	Arena    string      `json:"arena"`
+	Seed     uint32      `json:"seed"`
+	Game     mode.Mode   `json:"game"`
+	PowerUps bool        `json:"powerUps,omitempty"`
+	// nil without sudden death
+	SuddenDeath *game.SuddenDeath `json:"suddenDeath,omitempty"`
+	Ranked      bool              `json:"ranked,omitempty"`
+	ICEServers  []ICEServer       `json:"iceServers,omitempty"`
 }
 
 func (m RoomMetaMessage) GetType() MessageType {
@@ -106,3 +179,185 @@ type WebRTCConnectedMessage struct {
 func (m WebRTCConnectedMessage) GetType() MessageType {
 	return MessageTypeWebRTCConnected
 }
+
+// RelayStartMessage tells both members that game traffic now goes through the server as binary
+// websocket frames instead of the WebRTC data channel
+type RelayStartMessage struct {
+	Type MessageType `json:"type"`
+	// relayed bytes per second for the whole room. 0 means unlimited
+	MaxBytesPerSecond int `json:"maxBytesPerSecond"`
+	// largest frame the server will relay
+	MaxFrameSize int `json:"maxFrameSize"`
+}
+
+func (m RelayStartMessage) GetType() MessageType {
+	return MessageTypeRelayStart
+}
+
+// InputMessage is a turn for a tick of a server hosted match (client -> server)
+type InputMessage struct {
+	Type MessageType `json:"type"`
+	Tick int         `json:"tick"`
+	Turn game.Turn   `json:"turn"`
+	// power-ups only
+	Boost bool `json:"boost,omitempty"`
+	Jump  bool `json:"jump,omitempty"`
+}
+
+func (m InputMessage) GetType() MessageType {
+	return MessageTypeInput
+}
+
+// MatchStartMessage tells the members of a server hosted room that the match is about to start
+type MatchStartMessage struct {
+	Type MessageType `json:"type"`
+	// index of the receiving player in cycles
+	Player int       `json:"player"`
+	Game   mode.Mode `json:"game"`
+	// round about to start, from 1
+	Round  int `json:"round"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// wall cells inside the arena
+	Walls []game.Point `json:"walls,omitempty"`
+	// cycles leaving the arena come back in on the opposite edge
+	Wrap bool `json:"wrap,omitempty"`
+	// team of every player in team modes
+	Teams []int `json:"teams,omitempty"`
+	// teammates can drive through each other's trails
+	FriendlyPass bool `json:"friendlyPass,omitempty"`
+	// nil when power-ups are off
+	PowerUps *game.PowerUpSettings `json:"powerUps,omitempty"`
+	// nil without sudden death
+	SuddenDeath *game.SuddenDeath `json:"suddenDeath,omitempty"`
+	TickRate    int               `json:"tickRate"`
+	// how many ticks late an input may arrive and still be applied on its tick
+	RollbackWindow int          `json:"rollbackWindow"`
+	Cycles         []game.Cycle `json:"cycles"`
+	// milliseconds until the first tick
+	StartsIn int `json:"startsIn"`
+}
+
+func (m MatchStartMessage) GetType() MessageType {
+	return MessageTypeMatchStart
+}
+
+// StateMessage is the delta of a tick of a server hosted match. Trails aren't sent,
+// they're every position a cycle has been at plus the paths of cycles that moved more than
+// one cell on a tick
+type StateMessage struct {
+	Type   MessageType  `json:"type"`
+	Tick   int          `json:"tick"`
+	Cycles []game.Cycle `json:"cycles"`
+	// pickups lying in the arena after the tick
+	PowerUps []game.PowerUp `json:"powerUps,omitempty"`
+	// sudden death rings of walls closed in so far, see game.Ring
+	Rings int `json:"rings,omitempty"`
+	// cycles that died on the tick
+	Deaths []game.Event `json:"deaths,omitempty"`
+	// power-ups picked up on the tick
+	Pickups []game.Event `json:"pickups,omitempty"`
+}
+
+func (m StateMessage) GetType() MessageType {
+	return MessageTypeState
+}
+
+// RollbackMessage corrects ticks of a server hosted match after a late input. Clients rewind
+// to tick From (dropping the trail cells of later ticks) and apply Ticks in order
+type RollbackMessage struct {
+	Type  MessageType           `json:"type"`
+	From  int                   `json:"from"`
+	Ticks []rollback.TickResult `json:"ticks"`
+}
+
+func (m RollbackMessage) GetType() MessageType {
+	return MessageTypeRollback
+}
+
+// BotRequestMessage asks for a bot to fill the guest slot of a server hosted room (host -> server)
+type BotRequestMessage struct {
+	Type MessageType `json:"type"`
+	// "easy", "medium" or "hard". Empty means medium
+	Difficulty string `json:"difficulty,omitempty"`
+}
+
+func (m BotRequestMessage) GetType() MessageType {
+	return MessageTypeBotRequest
+}
+
+// RoundResultMessage is the outcome of a round of a server hosted match
+type RoundResultMessage struct {
+	Type  MessageType `json:"type"`
+	Round int         `json:"round"`
+	// winning side (the player, the team in teams, survivors 0 or bots 1 in survival), -1 for a draw
+	Winner int `json:"winner"`
+	Tick   int `json:"tick"`
+	// "crash" or "time"
+	Reason string `json:"reason"`
+	// rounds won per side so far
+	Scores []int `json:"scores"`
+}
+
+func (m RoundResultMessage) GetType() MessageType {
+	return MessageTypeRoundResult
+}
+
+// MatchResultMessage is the outcome of a match
+type MatchResultMessage struct {
+	Type MessageType `json:"type"`
+	// winning side like in RoundResultMessage, -1 for a draw
+	Winner int `json:"winner"`
+	// last tick of the last round
+	Tick int `json:"tick"`
+	// "crash", "time" or "forfeit"
+	Reason string    `json:"reason"`
+	Mode   mode.Kind `json:"mode"`
+	Rounds int       `json:"rounds"`
+	// rounds won per side
+	Scores []int `json:"scores"`
+}
+
+func (m MatchResultMessage) GetType() MessageType {
+	return MessageTypeMatchResult
+}
+
+// ResultKeyMessage opens the reporting window of a P2P match once both members are in
+// the room. The member signs its report of the outcome with Key, see result.Sign
+type ResultKeyMessage struct {
+	Type    MessageType `json:"type"`
+	MatchID string      `json:"matchId"`
+	Player  int         `json:"player"`
+	Key     string      `json:"key"`
+	// seconds the members have to report
+	ReportWithin int `json:"reportWithin"`
+}
+
+func (m ResultKeyMessage) GetType() MessageType {
+	return MessageTypeResultKey
+}
+
+// MatchReportMessage is a member's signed report of a P2P match (client -> server). The
+// websocket closes once WebRTC connects unless the room is relaying, so members can also
+// POST the same report to /results
+type MatchReportMessage struct {
+	Type MessageType `json:"type"`
+	result.SubmitRequest
+}
+
+func (m MatchReportMessage) GetType() MessageType {
+	return MessageTypeMatchResult
+}
+
+// LogRequestMessage asks the members of a P2P match for their lockstep input logs. They're
+// too large for the websocket, members POST them to /results/{matchId}/logs
+type LogRequestMessage struct {
+	Type    MessageType `json:"type"`
+	MatchID string      `json:"matchId"`
+	// seconds the members have to upload
+	Within int `json:"within"`
+}
+
+func (m LogRequestMessage) GetType() MessageType {
+	return MessageTypeLogRequest
+}
@@ -3,22 +3,81 @@ package signaling
 import (
 	"context"
 	"log/slog"
+	"slices"
 	"sync"
 	"time"
+
+	"github.com/isaackoz/tronline/arena"
+	"github.com/isaackoz/tronline/game"
+	"github.com/isaackoz/tronline/ratelimit"
+	"github.com/isaackoz/tronline/replay"
+	"github.com/isaackoz/tronline/result"
+)
+
+// largest binary frame relayed in relay mode
+const maxRelayFrameSize = 16 * 1024
+
+const (
+	// rooms close once they weren't busy for this long
+	roomLifetime = 10 * time.Minute
+	// how often a busy room checks whether it's still busy
+	busyCheckInterval = time.Minute
+	// longest a busy room stays open. A hosted match still running then is ended with a
+	// result, a relayed one is cut off
+	maxRoomLifetime = 2 * time.Hour
 )
 
+// RoomConfig is the server wide configuration every room is created with
+type RoomConfig struct {
+	// allow the websocket relay fallback when WebRTC can't connect
+	RelayEnabled bool
+	// relayed bytes per second per room, both directions combined. 0 means unlimited
+	RelayBandwidth int
+	// ticks per second of server hosted matches
+	HostedTickRate int
+	// how many ticks late an input may arrive in a server hosted match
+	HostedRollbackWindow int
+	// where finished hosted matches are recorded. nil disables recording
+	Replays replay.Store
+	// records match results and reconciles the reports of P2P matches. nil disables results
+	Results *result.Reconciler
+}
+
 type Room struct {
-	ID     string
-	Host   *Client
-	Guest  *Client
-	mu     sync.RWMutex
-	ctx    context.Context
-	cancel context.CancelFunc
+	ID       string
+	Host     *Client
+	Guest    *Client
+	Settings RoomSettings
+	config   RoomConfig
+	mu       sync.RWMutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	// relay mode. game frames go through the websocket instead of the data channel
+	relaying    bool
+	relayBucket *ratelimit.Bucket
+
+	// the current match in hosted mode
+	match *hostedMatch
+	// the P2P match the members were handed report keys for
+	expected *expectedResult
+	// set by Cleanup, the members are gone
+	closed bool
 }
 
-func NewRoom(id string) *Room {
+// a P2P match whose reporting window is open
+type expectedResult struct {
+	matchID string
+	keys    []string
+	players []string
+	expires time.Time
+}
+
+func NewRoom(id string, config RoomConfig, settings RoomSettings) *Room {
 	return &Room{
-		ID: id,
+		ID:       id,
+		Settings: settings,
+		config:   config,
 	}
 }
 
@@ -30,16 +89,41 @@ func (e *RoomError) Error() string {
 	return e.Message
 }
 
-// runs a rooms logic/loop. rooms have a lifetime of 10 mins
+// runs a rooms logic/loop. rooms have a lifetime of 10 mins, longer while a hosted or relayed
+// match is running in them (see busy), up to maxRoomLifetime
 // the room is just to connect a host <-> guest. Once they're connected, the room will close
 // and the two clients will communicate P2P via WebRTC from thereon
 func (r *Room) Run(rootCtx context.Context) error {
-	// rooms will close automatically after 10 mins
-	r.ctx, r.cancel = context.WithTimeout(rootCtx, time.Minute*10)
+	r.mu.Lock()
+	r.ctx, r.cancel = context.WithCancel(rootCtx)
+	r.mu.Unlock()
 	defer r.cancel()
 	slog.Debug("room running", "room_id", r.ID)
 
-	<-r.ctx.Done()
+	opened := time.Now()
+	timer := time.NewTimer(roomLifetime)
+	defer timer.Stop()
+	for done := false; !done; {
+		select {
+		case <-r.ctx.Done():
+			done = true
+		case <-timer.C:
+			if r.busy() {
+				if time.Since(opened) < maxRoomLifetime {
+					timer.Reset(busyCheckInterval)
+					continue
+				}
+				// finish the match cleanly, its members get the result before the room closes
+				slog.Info("room open too long, ending its match", "room_id", r.ID, "open_for", time.Since(opened))
+				r.mu.RLock()
+				if r.match != nil {
+					r.match.expire()
+				}
+				r.mu.RUnlock()
+			}
+			done = true
+		}
+	}
 	slog.Debug("room context done, cleaning up", "room_id", r.ID)
 	if err := r.Cleanup(); err != nil {
 		slog.Error("cleanup room", "error", err, "room_id", r.ID)
@@ -47,6 +131,17 @@ func (r *Room) Run(rootCtx context.Context) error {
 	return nil
 }
 
+// whether the members are in the middle of something the room has to stay open for: a
+// hosted match that isn't over, or a P2P match relayed over the websockets
+func (r *Room) busy() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.relaying && r.Host != nil && r.Guest != nil {
+		return true
+	}
+	return r.match != nil && !r.match.isDone()
+}
+
 func (r *Room) AddClient(client *Client) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -56,16 +151,29 @@ func (r *Room) AddClient(client *Client) error {
 		}
 		r.Host = client
 		slog.Debug("host joined room", "room_id", r.ID, "client_id", client.ID)
+		// the host of a reserved room came back
+		if r.Guest != nil {
+			r.expectResult()
+		}
 	} else {
 		if r.Guest != nil {
 			return &RoomError{Message: "room already has a guest"}
 		}
+		if r.Settings.Game.Humans() < 2 {
+			return &RoomError{Message: "room is single player"}
+		}
 		r.Guest = client
 		slog.Debug("guest joined room", "room_id", r.ID, "client_id", client.ID)
 		if r.Host != nil {
+			var metadata any
+			if client.Bot != "" {
+				metadata = map[string]any{"bot": client.Bot}
+			}
 			r.Host.SendMessage(&EventMessage{
-				Type: MessageEventTypeGuestJoined,
+				Type:     MessageEventTypeGuestJoined,
+				Metadata: metadata,
 			})
+			r.expectResult()
 		}
 	}
 
@@ -73,9 +181,183 @@ func (r *Room) AddClient(client *Client) error {
 	return nil
 }
 
+// opens the reporting window of the P2P match the members are about to play and hands them
+// their report keys. Members rejoining get the keys of the match they're already playing
+// while its window is open, a new pairing withdraws the match of the old one. must hold r.mu
+func (r *Room) expectResult() {
+	if r.Settings.Mode != RoomModeP2P || r.config.Results == nil {
+		return
+	}
+	members := []*Client{r.Host, r.Guest}
+	ids := make([]string, len(members))
+	for i, client := range members {
+		ids[i] = client.PlayerID()
+	}
+	if r.expected == nil || !slices.Equal(r.expected.players, ids) || time.Now().After(r.expected.expires) {
+		if r.expected != nil {
+			r.config.Results.Withdraw(r.expected.matchID)
+		}
+		a, settings, err := r.gameSettings()
+		if err != nil {
+			slog.Error("p2p match settings", "error", err, "room_id", r.ID, "arena", r.Settings.Arena)
+			return
+		}
+		matchID, keys := r.config.Results.Expect(r.ID, r.Settings.Game, a.Name, r.Settings.Game.Apply(settings), r.Settings.Ranked, ids)
+		r.expected = &expectedResult{
+			matchID: matchID,
+			keys:    keys,
+			players: ids,
+			expires: time.Now().Add(r.config.Results.Window()),
+		}
+		slog.Debug("expecting p2p match result", "room_id", r.ID, "match_id", matchID)
+	}
+	for i, client := range members {
+		client.SendMessage(&ResultKeyMessage{
+			Type:         MessageTypeResultKey,
+			MatchID:      r.expected.matchID,
+			Player:       i,
+			Key:          r.expected.keys[i],
+			ReportWithin: int(time.Until(r.expected.expires).Seconds()),
+		})
+	}
+}
+
+// ReportResult submits a member's signed report of a P2P match
+func (r *Room) ReportResult(msg *IncomingMessage, from *Client) {
+	var report MatchReportMessage
+	if err := msg.Decode(&report); err != nil {
+		slog.Debug("decode match report", "error", err, "client_id", from.ID)
+		return
+	}
+	if r.config.Results == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(from.Ctx, resultSaveTimeout)
+	defer cancel()
+	// members can only report as themselves
+	res, err := r.config.Results.Submit(ctx, report.MatchID, playerIndex(from), report.Report, report.Signature)
+	if err != nil {
+		slog.Debug("submit match report", "error", err, "client_id", from.ID, "room_id", r.ID)
+		from.SendMessage(&ErrorMessage{
+			Type:    MessageTypeError,
+			Message: err.Error(),
+		})
+		return
+	}
+	if res == nil || res.Status != result.StatusVerifying {
+		return
+	}
+	// members still connected are asked right away, the others see the status when they
+	// report or look the result up
+	request := &LogRequestMessage{
+		Type:    MessageTypeLogRequest,
+		MatchID: res.ID,
+		Within:  int(r.config.Results.LogWindow().Seconds()),
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return
+	}
+	for _, client := range []*Client{r.Host, r.Guest} {
+		if client != nil {
+			client.SendMessage(request)
+		}
+	}
+}
+
+// StartMatch starts a server hosted match between the host (player 0) and the guest (player 1)
+// once every member the game mode needs is in a hosted room. Bots take the other players.
+// Does nothing otherwise or if a match is already running
+func (r *Room) StartMatch() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Settings.Mode != RoomModeHosted || r.Host == nil {
+		return
+	}
+	members := []*Client{r.Host}
+	if r.Settings.Game.Humans() > 1 {
+		if r.Guest == nil {
+			return
+		}
+		members = append(members, r.Guest)
+	}
+	if r.match != nil && !r.match.isDone() {
+		return
+	}
+	a, settings, err := r.gameSettings()
+	if err != nil {
+		slog.Error("hosted match settings", "error", err, "room_id", r.ID, "arena", r.Settings.Arena)
+		return
+	}
+	match := newHostedMatch(hostedMatchConfig{
+		roomID:         r.ID,
+		tickRate:       r.config.HostedTickRate,
+		rollbackWindow: r.config.HostedRollbackWindow,
+		mode:           r.Settings.Game,
+		arena:          a.Name,
+		settings:       settings,
+		seed:           r.Settings.Seed,
+		botDifficulty:  r.Settings.BotDifficulty,
+		ranked:         r.Settings.Ranked,
+		replays:        r.config.Replays,
+		results:        r.config.Results,
+	}, members)
+	r.match = match
+	go match.run()
+}
+
+// the arena of the room and the settings its matches are played with, before the game mode
+// is applied
+func (r *Room) gameSettings() (*arena.Arena, game.Settings, error) {
+	a, err := arena.Resolve(r.Settings.Arena, r.Settings.Seed)
+	if err != nil {
+		return nil, game.Settings{}, err
+	}
+	settings, err := a.Settings(r.Settings.Game.Players())
+	if err != nil {
+		return nil, game.Settings{}, err
+	}
+	if r.Settings.PowerUps {
+		settings.PowerUps = game.DefaultPowerUps()
+	}
+	settings.SuddenDeath = r.Settings.SuddenDeath
+	return a, settings, nil
+}
+
+// HandleInput queues a member's input for the hosted match
+func (r *Room) HandleInput(msg *IncomingMessage, from *Client) {
+	var input InputMessage
+	if err := msg.Decode(&input); err != nil {
+		slog.Debug("decode input", "error", err, "client_id", from.ID)
+		return
+	}
+	r.mu.RLock()
+	match := r.match
+	r.mu.RUnlock()
+	if match == nil {
+		slog.Debug("input without a hosted match, dropping", "client_id", from.ID, "room_id", r.ID)
+		return
+	}
+	match.handleInput(playerIndex(from), input)
+}
+
+// host is player 0, the guest player 1
+func playerIndex(c *Client) int {
+	if c.IsHost {
+		return 0
+	}
+	return 1
+}
+
 func (r *Room) RemoveClient(client *Client) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	// a new guest has to negotiate again
+	r.relaying = false
+	if r.match != nil {
+		r.match.forfeit(playerIndex(client))
+	}
 	if client.IsHost {
 		r.Host = nil
 
@@ -87,7 +369,8 @@ func (r *Room) RemoveClient(client *Client) {
 		}
 
 		slog.Debug("host left room", "room_id", r.ID, "client_id", client.ID)
-		if r.cancel != nil {
+		// reserved rooms stay open for the host to come back until they expire
+		if r.cancel != nil && len(r.Settings.Players) == 0 {
 			r.cancel() // cancel the room context to trigger cleanup
 		}
 
@@ -126,6 +409,81 @@ func (r *Room) RouteMessage(msg Message, from *Client) {
 	slog.Debug("routed message", "from", from.ID, "to", target.ID, "room_id", r.ID, "type", msg.GetType())
 }
 
+// StartRelay switches the room to relay mode after a member's WebRTC negotiation failed or timed out.
+// Both members are told to send their game frames as binary websocket frames from now on
+func (r *Room) StartRelay(from *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+
+	if !r.config.RelayEnabled || r.Settings.Mode == RoomModeHosted {
+		from.SendMessage(&ErrorMessage{
+			Type:    MessageTypeError,
+			Message: "relay is disabled on this server",
+		})
+		return
+	}
+	if r.Host == nil || r.Guest == nil {
+		from.SendMessage(&ErrorMessage{
+			Type:    MessageTypeError,
+			Message: "relay needs both players in the room",
+		})
+		return
+	}
+
+	msg := &RelayStartMessage{
+		Type:              MessageTypeRelayStart,
+		MaxBytesPerSecond: r.config.RelayBandwidth,
+		MaxFrameSize:      maxRelayFrameSize,
+	}
+	if r.relaying {
+		// the other member asked first, just confirm
+		from.SendMessage(msg)
+		return
+	}
+	r.relaying = true
+	r.relayBucket = ratelimit.NewBucket(r.config.RelayBandwidth, max(r.config.RelayBandwidth, maxRelayFrameSize))
+	r.Host.SendMessage(msg)
+	r.Guest.SendMessage(msg)
+	slog.Debug("room switched to relay mode", "room_id", r.ID, "requested_by", from.ID)
+}
+
+func (r *Room) IsRelaying() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.relaying
+}
+
+// RelayFrame forwards an opaque binary game frame to the other member. Frames are relayed in order,
+// waiting for the room's bandwidth cap instead of dropping
+func (r *Room) RelayFrame(ctx context.Context, from *Client, frame []byte) {
+	r.mu.RLock()
+	relaying, bucket := r.relaying, r.relayBucket
+	target := r.Guest
+	if !from.IsHost {
+		target = r.Host
+	}
+	r.mu.RUnlock()
+
+	if !relaying {
+		slog.Debug("binary frame outside relay mode, dropping", "client_id", from.ID, "room_id", r.ID)
+		return
+	}
+	if len(frame) > maxRelayFrameSize {
+		slog.Debug("relay frame too large, dropping", "size", len(frame), "client_id", from.ID, "room_id", r.ID)
+		return
+	}
+	if target == nil {
+		return
+	}
+	if err := bucket.Wait(ctx, len(frame)); err != nil {
+		return
+	}
+	target.SendFrame(frame)
+}
+
 func (r *Room) IsEmpty() bool {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -136,12 +494,18 @@ func (r *Room) IsEmpty() bool {
 func (r *Room) Cleanup() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.closed = true
+
+	// stop the match first, it must not send anything once the send channels are closed
+	if r.match != nil {
+		r.match.close()
+	}
 
 	if r.Host != nil {
 		r.Host.SendMessage(&EventMessage{
 			Type: MessageEventRoomClosed,
 		})
-		close(r.Host.Send)
+		r.Host.close()
 		r.Host = nil
 	}
 
@@ -149,7 +513,7 @@ func (r *Room) Cleanup() error {
 		r.Guest.SendMessage(&EventMessage{
 			Type: MessageEventRoomClosed,
 		})
-		close(r.Guest.Send)
+		r.Guest.close()
 		r.Guest = nil
 	}
 
@@ -2,17 +2,59 @@ package signaling
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"log/slog"
 	"net/http"
-	"strings"
+	"slices"
 	"time"
 
 	"github.com/coder/websocket"
+	"github.com/isaackoz/tronline/identity"
+	"github.com/isaackoz/tronline/ratelimit"
 	"github.com/lithammer/shortuuid/v4"
 )
 
-func HandleSignalServer(rootCtx context.Context, mux *http.ServeMux, hub *Hub) {
+// ice server requests a client can make per minute
+const iceServersPerMinute = 30
+
+// HandleSignalServer registers the websocket endpoint and the ice servers. Players identify
+// themselves with ?token=<identity token>, anonymous players are still let in unless the room
+// is ranked. ids may be nil, then everybody is anonymous
+func HandleSignalServer(rootCtx context.Context, mux *http.ServeMux, hub *Hub, ice *ICEServerCache, ids *identity.Service) {
+
+	// ice servers (stun/turn) for the WebRTC peer connection. The turn user is the player or
+	// its ip, so asking again doesn't hand out a fresh turn quota
+	iceLimit := ratelimit.NewKeyed(iceServersPerMinute, time.Minute)
+	mux.HandleFunc("GET /ice-servers", func(w http.ResponseWriter, r *http.Request) {
+		if !iceLimit.Allow(ratelimit.ClientIP(r)) {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		var id *identity.Identity
+		if token := identity.BearerToken(r); token != "" && ids != nil {
+			var err error
+			id, err = ids.Authenticate(r.Context(), token)
+			switch {
+			case errors.Is(err, identity.ErrBanned):
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			case errors.Is(err, identity.ErrInvalidToken), errors.Is(err, identity.ErrExpiredToken), errors.Is(err, identity.ErrUpgraded):
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			case err != nil:
+				slog.Error("authenticate player", "error", err)
+				http.Error(w, "could not authenticate", http.StatusInternalServerError)
+				return
+			}
+		}
+		servers := ice.Get(r.Context(), r.Host, turnUser(r, id))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(servers); err != nil {
+			slog.Debug("encode ice servers", "error", err)
+		}
+	})
 
 	/*
 		Error code reference
@@ -22,6 +64,11 @@ func HandleSignalServer(rootCtx context.Context, mux *http.ServeMux, hub *Hub) {
 		3003 = room id collision (host) or could not create room (host)
 		3004 = room does not exist (client)
 		3005 = could not add client to room (room full etc)
+		3006 = invalid room settings (host)
+		3007 = invalid, expired or upgraded identity token
+		3008 = player is banned
+		3009 = ranked rooms need an identity
+		3010 = room is reserved for other players
 
 	*/
 	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
@@ -38,7 +85,8 @@ func HandleSignalServer(rootCtx context.Context, mux *http.ServeMux, hub *Hub) {
 			return
 		}
 
-		clientCtx, cancel := context.WithTimeout(context.Background(), time.Minute*10)
+		// the connection lasts as long as the client's room, which closes it on cleanup
+		clientCtx, cancel := context.WithCancel(context.Background())
 
 		defer func() {
 			slog.Debug("closing connection inside server.go")
@@ -60,9 +108,36 @@ func HandleSignalServer(rootCtx context.Context, mux *http.ServeMux, hub *Hub) {
 
 		isHost := role == "host"
 
+		var id *identity.Identity
+		if token := r.URL.Query().Get("token"); token != "" && ids != nil {
+			id, err = ids.Authenticate(clientCtx, token)
+			switch {
+			case errors.Is(err, identity.ErrBanned):
+				c.Close(3008, err.Error())
+				return
+			case errors.Is(err, identity.ErrInvalidToken), errors.Is(err, identity.ErrExpiredToken), errors.Is(err, identity.ErrUpgraded):
+				c.Close(3007, err.Error())
+				return
+			case err != nil:
+				slog.Error("authenticate client", "error", err)
+				c.Close(3000, "internal server error")
+				return
+			}
+		}
+
 		if isHost {
+			settings, err := parseRoomSettings(r)
+			if err != nil {
+				c.Close(3006, err.Error())
+				return
+			}
+			if settings.Ranked && id == nil && ids != nil {
+				c.Close(3009, "ranked rooms need an identity token")
+				return
+			}
+
 			// create and set the room id
-			roomID = strings.ToUpper(shortuuid.New()[0:6]) // 6 char room id i.e. "AB12CD"
+			roomID = newRoomID()
 			_, roomExists := hub.GetRoom(roomID)
 			if roomExists {
 				// the odds are pretty damn low, but if it does exist, just close the connection and let them try again
@@ -70,7 +145,7 @@ func HandleSignalServer(rootCtx context.Context, mux *http.ServeMux, hub *Hub) {
 				c.Close(3003, "room id collision (rare!), please try again")
 				return
 			}
-			room := hub.CreateRoom(roomID)
+			room := hub.CreateRoom(roomID, settings)
 			if room == nil {
 				c.Close(3003, "could not create room, please try again")
 				return
@@ -84,16 +159,34 @@ func HandleSignalServer(rootCtx context.Context, mux *http.ServeMux, hub *Hub) {
 			c.Close(3004, "room does not exist")
 			return
 		}
+		if room.Settings.Ranked && id == nil && ids != nil {
+			c.Close(3009, "ranked rooms need an identity token")
+			return
+		}
+		if len(room.Settings.Players) > 0 {
+			// reserved rooms seat their players themselves, whatever role they asked for
+			seat := -1
+			if id != nil {
+				seat = slices.Index(room.Settings.Players, id.ID)
+			}
+			if seat < 0 {
+				c.Close(3010, "room is reserved for other players")
+				return
+			}
+			isHost = seat == 0
+		}
 
-		// max of 10 mins connection time
 		client := &Client{
-			ID:     shortuuid.New(),
-			Hub:    hub,
-			Room:   room,
-			Conn:   c,
-			Send:   make(chan []byte, 256),
-			IsHost: isHost,
-			Ctx:    clientCtx,
+			ID:       shortuuid.New(),
+			Identity: id,
+			Hub:      hub,
+			Room:     room,
+			Conn:     c,
+			Send:     make(chan []byte, 256),
+			Relay:    make(chan []byte, 256),
+			IsHost:   isHost,
+			Ctx:      clientCtx,
+			Cancel:   cancel,
 		}
 
 		if err := room.AddClient(client); err != nil {
@@ -108,13 +201,30 @@ func HandleSignalServer(rootCtx context.Context, mux *http.ServeMux, hub *Hub) {
 		}
 
 		client.SendMessage(&RoomMetaMessage{
-			Type:   MessageTypeRoomMeta,
-			RoomId: room.ID,
+			Type:        MessageTypeRoomMeta,
+			RoomId:      room.ID,
+			Mode:        room.Settings.Mode,
+			Arena:       room.Settings.Arena,
+			Seed:        room.Settings.Seed,
+			Game:        room.Settings.Game,
+			PowerUps:    room.Settings.PowerUps,
+			SuddenDeath: room.Settings.SuddenDeath,
+			Ranked:      room.Settings.Ranked,
+			ICEServers:  ice.Get(clientCtx, r.Host, turnUser(r, id)).ICEServers,
 		})
 
-		slog.Debug("client connected", "client_id", client.ID, "room_id", room.ID, "is_host", client.IsHost)
+		slog.Debug("client connected", "client_id", client.ID, "player_id", client.PlayerID(), "room_id", room.ID, "is_host", client.IsHost)
+		room.StartMatch()             // hosted mode only, once both members are in
 		client.ReadWriteWs(clientCtx) // blocking
 		slog.Debug("client disconnected", "client_id", client.ID, "room_id", room.ID)
 		room.RemoveClient(client)
 	})
 }
+
+// the turn user of a client, its player id or its ip for anonymous ones
+func turnUser(r *http.Request, id *identity.Identity) string {
+	if id != nil {
+		return id.ID
+	}
+	return "ip-" + ratelimit.ClientIP(r)
+}
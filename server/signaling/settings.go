@@ -0,0 +1,206 @@
+package signaling
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/isaackoz/tronline/arena"
+	"github.com/isaackoz/tronline/bot"
+	"github.com/isaackoz/tronline/game"
+	"github.com/isaackoz/tronline/mode"
+)
+
+// RoomMode is how the match of a room is played
+type RoomMode string
+
+const (
+	// the members play P2P over WebRTC (or the websocket relay), the server only does signaling
+	RoomModeP2P RoomMode = "p2p"
+	// the server runs the match, members only send inputs
+	RoomModeHosted RoomMode = "hosted"
+)
+
+// ParseRoomMode parses the mode a host asked for. Empty means p2p
+func ParseRoomMode(s string) (RoomMode, error) {
+	switch RoomMode(s) {
+	case "", RoomModeP2P:
+		return RoomModeP2P, nil
+	case RoomModeHosted:
+		return RoomModeHosted, nil
+	default:
+		return "", fmt.Errorf("invalid room mode %q", s)
+	}
+}
+
+// RoomSettings are chosen by the host when creating a room
+type RoomSettings struct {
+	Mode RoomMode
+	// name of a built-in arena or arena.Generated, hosted matches are played on it
+	Arena string
+	// picked by the server unless the host asks for one. Generated arenas are created from it,
+	// so P2P peers can reproduce them
+	Seed uint32
+	// game mode of the match
+	Game mode.Mode
+	// difficulty of the bots filling empty player slots
+	BotDifficulty bot.Difficulty
+	// pickups and boost
+	PowerUps bool
+	// nil when rounds are played without sudden death
+	SuddenDeath *game.SuddenDeath
+	// P2P results of ranked rooms are randomly verified from the players' input logs
+	Ranked bool
+	// player ids of the only players who may join, the host first. Set for rooms the server
+	// opens itself, i.e. for tournament matches. Empty lets anybody in
+	Players []string
+}
+
+// parseRoomSettings reads the settings a host asked for from the query of its websocket request
+func parseRoomSettings(r *http.Request) (RoomSettings, error) {
+	query := r.URL.Query()
+	roomMode, err := ParseRoomMode(query.Get("mode"))
+	if err != nil {
+		return RoomSettings{}, err
+	}
+	settings := RoomSettings{Mode: roomMode, Arena: query.Get("arena"), Seed: rand.Uint32()}
+	if s := query.Get("seed"); s != "" {
+		seed, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return RoomSettings{}, errors.New("seed must be a 32 bit unsigned integer")
+		}
+		settings.Seed = uint32(seed)
+	}
+	if settings.Arena == "" {
+		settings.Arena = arena.Default
+	}
+	if settings.Game, err = parseGameMode(query); err != nil {
+		return RoomSettings{}, err
+	}
+	if settings.Mode == RoomModeP2P && settings.Game.Players() != 2 {
+		return RoomSettings{}, fmt.Errorf("%s needs a hosted room", settings.Game.Kind)
+	}
+	if settings.BotDifficulty, err = bot.ParseDifficulty(query.Get("difficulty")); err != nil {
+		return RoomSettings{}, err
+	}
+	if s := query.Get("powerUps"); s != "" {
+		if settings.PowerUps, err = strconv.ParseBool(s); err != nil {
+			return RoomSettings{}, errors.New("powerUps must be true or false")
+		}
+	}
+	// P2P clients don't simulate power-ups
+	if settings.PowerUps && settings.Mode == RoomModeP2P {
+		return RoomSettings{}, errors.New("powerUps need a hosted room")
+	}
+	if settings.SuddenDeath, err = parseSuddenDeath(query); err != nil {
+		return RoomSettings{}, err
+	}
+	// P2P clients don't implement sudden death either
+	if settings.SuddenDeath != nil && settings.Mode == RoomModeP2P {
+		return RoomSettings{}, errors.New("sudden death needs a hosted room")
+	}
+	if s := query.Get("ranked"); s != "" {
+		if settings.Ranked, err = strconv.ParseBool(s); err != nil {
+			return RoomSettings{}, errors.New("ranked must be true or false")
+		}
+	}
+
+	a, err := arena.Resolve(settings.Arena, settings.Seed)
+	if err != nil {
+		return RoomSettings{}, err
+	}
+	if _, err := a.Settings(settings.Game.Players()); err != nil {
+		return RoomSettings{}, fmt.Errorf("arena %s can't be played in %s: %w", a.Name, settings.Game.Kind, err)
+	}
+	return settings, nil
+}
+
+// default seconds to survive in survival
+const defaultTimeLimit = 60
+
+// parseGameMode reads ?game=, ?bestOf=, ?friendlyPass= and ?timeLimit=
+func parseGameMode(query url.Values) (mode.Mode, error) {
+	m := mode.Default
+	if kind := query.Get("game"); kind != "" {
+		m.Kind = mode.Kind(kind)
+	}
+	if m.Kind == mode.KindSurvival {
+		m.TimeLimit = defaultTimeLimit
+	}
+	var err error
+	if s := query.Get("bestOf"); s != "" {
+		if m.BestOf, err = strconv.Atoi(s); err != nil {
+			return mode.Mode{}, errors.New("bestOf must be a number")
+		}
+	}
+	if s := query.Get("timeLimit"); s != "" {
+		if m.TimeLimit, err = strconv.Atoi(s); err != nil {
+			return mode.Mode{}, errors.New("timeLimit must be a number of seconds")
+		}
+	}
+	if s := query.Get("friendlyPass"); s != "" {
+		if m.FriendlyPass, err = strconv.ParseBool(s); err != nil {
+			return mode.Mode{}, errors.New("friendlyPass must be true or false")
+		}
+	}
+	return m, m.Validate()
+}
+
+// sudden death defaults for the intervals a host didn't ask for, in ticks
+const (
+	defaultShrinkEvery = 20
+	defaultSpeedEvery  = 300
+	defaultMaxSpeed    = 3
+)
+
+// parseSuddenDeath reads ?shrinkAfter=, ?shrinkEvery=, ?speedAfter=, ?speedEvery=, ?maxSpeed=,
+// ?maxTicks= and ?tieBreak=, all in ticks. Returns nil when none of them turn sudden death on
+func parseSuddenDeath(query url.Values) (*game.SuddenDeath, error) {
+	d := &game.SuddenDeath{
+		ShrinkEvery: defaultShrinkEvery,
+		SpeedEvery:  defaultSpeedEvery,
+		MaxSpeed:    defaultMaxSpeed,
+		TieBreak:    game.TieBreak(query.Get("tieBreak")),
+	}
+	params := []struct {
+		name  string
+		value *int
+	}{
+		{"shrinkAfter", &d.ShrinkAfter},
+		{"shrinkEvery", &d.ShrinkEvery},
+		{"speedAfter", &d.SpeedAfter},
+		{"speedEvery", &d.SpeedEvery},
+		{"maxSpeed", &d.MaxSpeed},
+		{"maxTicks", &d.MaxTicks},
+	}
+	for _, param := range params {
+		s := query.Get(param.name)
+		if s == "" {
+			continue
+		}
+		value, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a number of ticks", param.name)
+		}
+		*param.value = value
+	}
+
+	if d.ShrinkAfter == 0 {
+		d.ShrinkEvery = 0
+	}
+	if d.SpeedAfter == 0 {
+		d.SpeedEvery, d.MaxSpeed = 0, 0
+	}
+	if d.MaxTicks == 0 {
+		if d.TieBreak != "" {
+			return nil, errors.New("tieBreak needs maxTicks")
+		}
+		if d.ShrinkAfter == 0 && d.SpeedAfter == 0 {
+			return nil, nil
+		}
+	}
+	return d, d.Validate()
+}
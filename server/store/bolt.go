@@ -0,0 +1,542 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/isaackoz/tronline/replay"
+	"github.com/isaackoz/tronline/result"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt keeps everything in a single bbolt file. Records are json, replays their binary
+// format. Listings are served from index buckets ordered the way they're listed
+type Bolt struct {
+	db *bolt.DB
+}
+
+// how long opening waits for another process holding the file
+const openTimeout = 3 * time.Second
+
+// OpenBolt opens or creates the store file at path and migrates it to the latest schema
+func OpenBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("open store %s: %w", path, err)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Bolt{db: db}, nil
+}
+
+func (b *Bolt) Players() PlayerStore         { return boltPlayers{b.db} }
+func (b *Bolt) Accounts() AccountStore       { return boltAccounts{b.db} }
+func (b *Bolt) Ratings() RatingStore         { return boltRatings{b.db} }
+func (b *Bolt) Results() result.Store        { return boltResults{b.db} }
+func (b *Bolt) Replays() replay.Store        { return boltReplays{b.db} }
+func (b *Bolt) Tournaments() TournamentStore { return boltTournaments{b.db} }
+func (b *Bolt) Bans() BanStore               { return boltBans{b.db} }
+func (b *Bolt) Close() error                 { return b.db.Close() }
+
+var (
+	bucketMeta     = []byte("meta")
+	bucketPlayers  = []byte("players")
+	bucketAccounts = []byte("accounts")
+	// account index: issuer + "|" + subject -> account id
+	bucketAccountsBySubject = []byte("accounts_by_subject")
+	// board + 0 + player id -> rating
+	bucketRatings = []byte("ratings")
+	// rating index: board + 0 + inverted rating (highest first) + player id -> nil
+	bucketRatingsByValue = []byte("ratings_by_value")
+	bucketResults        = []byte("results")
+	// result index: finished at + id -> nil
+	bucketResultsByTime = []byte("results_by_time")
+	// result index: player id + 0 + finished at + id -> nil
+	bucketResultsByPlayer = []byte("results_by_player")
+	bucketReplays         = []byte("replays")
+	// replay index: recorded at + id -> header json, so listing doesn't decode every replay
+	bucketReplaysByTime = []byte("replays_by_time")
+	bucketTournaments   = []byte("tournaments")
+	// tournament index: created at + id -> nil
+	bucketTournamentsByTime = []byte("tournaments_by_time")
+	bucketBans              = []byte("bans")
+)
+
+// a key ordered by time, then id
+func timeKey(t time.Time, id string) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, uint64(t.UnixNano())), id...)
+}
+
+// prefix of a player's keys in the result index
+func playerPrefix(playerID string) []byte {
+	return append([]byte(playerID), 0)
+}
+
+// adds a result to the time and player indexes, or removes it with remove
+func indexResult(tx *bolt.Tx, r *result.Result, remove bool) error {
+	keys := [][2][]byte{{bucketResultsByTime, timeKey(r.FinishedAt, r.ID)}}
+	for _, playerID := range r.Players {
+		keys = append(keys, [2][]byte{bucketResultsByPlayer, append(playerPrefix(playerID), timeKey(r.FinishedAt, r.ID)...)})
+	}
+	for _, key := range keys {
+		var err error
+		if remove {
+			err = tx.Bucket(key[0]).Delete(key[1])
+		} else {
+			err = tx.Bucket(key[0]).Put(key[1], nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefix of a board's keys in both rating buckets
+func boardPrefix(board string) []byte {
+	return append([]byte(board), 0)
+}
+
+func ratingID(board string, playerID string) string {
+	return string(boardPrefix(board)) + playerID
+}
+
+// a key ordered by board, then rating, highest first, then player id
+func ratingKey(r *Rating) []byte {
+	key := binary.BigEndian.AppendUint64(boardPrefix(r.Board), math.MaxInt64-uint64(int64(r.Rating)+math.MaxInt32))
+	return append(key, r.PlayerID...)
+}
+
+// the player id of a ratingKey
+func ratingKeyPlayer(board string, key []byte) string {
+	return string(key[len(board)+1+8:])
+}
+
+// the first key after every key starting with prefix, nil if there's none
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func get[T any](tx *bolt.Tx, bucket []byte, id string) (*T, error) {
+	data := tx.Bucket(bucket).Get([]byte(id))
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	var record T
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("unmarshal %s %s: %w", bucket, id, err)
+	}
+	return &record, nil
+}
+
+func put(tx *bolt.Tx, bucket []byte, id string, record any) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshal %s %s: %w", bucket, id, err)
+	}
+	return tx.Bucket(bucket).Put([]byte(id), data)
+}
+
+// walks the keys of an index bucket starting with prefix until offset+limit keys matched.
+// visit reports whether a key matched, skipping the first offset is up to it
+func scan(tx *bolt.Tx, bucket []byte, prefix []byte, offset int, limit int, visit func(k []byte, v []byte) (bool, error)) error {
+	c := tx.Bucket(bucket).Cursor()
+	found := 0
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) && found < offset+limit; k, v = c.Next() {
+		matched, err := visit(k, v)
+		if err != nil {
+			return err
+		}
+		if matched {
+			found++
+		}
+	}
+	return nil
+}
+
+// like scan, but from the last key backwards
+func scanReverse(tx *bolt.Tx, bucket []byte, prefix []byte, offset int, limit int, visit func(k []byte, v []byte) (bool, error)) error {
+	c := tx.Bucket(bucket).Cursor()
+	var k, v []byte
+	if end := prefixEnd(prefix); end == nil {
+		k, v = c.Last()
+	} else if k, v = c.Seek(end); k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+	found := 0
+	for ; k != nil && bytes.HasPrefix(k, prefix) && found < offset+limit; k, v = c.Prev() {
+		matched, err := visit(k, v)
+		if err != nil {
+			return err
+		}
+		if matched {
+			found++
+		}
+	}
+	return nil
+}
+
+type boltPlayers struct {
+	db *bolt.DB
+}
+
+func (s boltPlayers) Save(ctx context.Context, p *Player) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return put(tx, bucketPlayers, p.ID, p)
+	})
+}
+
+func (s boltPlayers) Load(ctx context.Context, id string) (p *Player, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		p, err = get[Player](tx, bucketPlayers, id)
+		return err
+	})
+	return p, err
+}
+
+type boltAccounts struct {
+	db *bolt.DB
+}
+
+func subjectKey(issuer string, subject string) []byte {
+	return []byte(issuer + "|" + subject)
+}
+
+func (s boltAccounts) Save(ctx context.Context, a *Account) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		old, err := get[Account](tx, bucketAccounts, a.ID)
+		if err == nil {
+			if err := tx.Bucket(bucketAccountsBySubject).Delete(subjectKey(old.Issuer, old.Subject)); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err := tx.Bucket(bucketAccountsBySubject).Put(subjectKey(a.Issuer, a.Subject), []byte(a.ID)); err != nil {
+			return err
+		}
+		return put(tx, bucketAccounts, a.ID, a)
+	})
+}
+
+func (s boltAccounts) Load(ctx context.Context, id string) (a *Account, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		a, err = get[Account](tx, bucketAccounts, id)
+		return err
+	})
+	return a, err
+}
+
+func (s boltAccounts) LoadBySubject(ctx context.Context, issuer string, subject string) (a *Account, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(bucketAccountsBySubject).Get(subjectKey(issuer, subject))
+		if id == nil {
+			return ErrNotFound
+		}
+		a, err = get[Account](tx, bucketAccounts, string(id))
+		return err
+	})
+	return a, err
+}
+
+type boltRatings struct {
+	db *bolt.DB
+}
+
+func (s boltRatings) Save(ctx context.Context, r *Rating) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		id := ratingID(r.Board, r.PlayerID)
+		old, err := get[Rating](tx, bucketRatings, id)
+		if err == nil {
+			if err := tx.Bucket(bucketRatingsByValue).Delete(ratingKey(old)); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err := tx.Bucket(bucketRatingsByValue).Put(ratingKey(r), nil); err != nil {
+			return err
+		}
+		return put(tx, bucketRatings, id, r)
+	})
+}
+
+func (s boltRatings) Load(ctx context.Context, board string, playerID string) (r *Rating, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		r, err = get[Rating](tx, bucketRatings, ratingID(board, playerID))
+		return err
+	})
+	return r, err
+}
+
+func (s boltRatings) Top(ctx context.Context, board string, offset int, limit int) ([]*Rating, error) {
+	ratings := []*Rating{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found := 0
+		return scan(tx, bucketRatingsByValue, boardPrefix(board), offset, limit, func(k []byte, _ []byte) (bool, error) {
+			found++
+			if found <= offset {
+				return true, nil
+			}
+			r, err := get[Rating](tx, bucketRatings, ratingID(board, ratingKeyPlayer(board, k)))
+			if err != nil {
+				return false, err
+			}
+			ratings = append(ratings, r)
+			return true, nil
+		})
+	})
+	return ratings, err
+}
+
+// counts the keys ahead of the player's in the index, fine for the boards we have
+func (s boltRatings) Rank(ctx context.Context, board string, playerID string) (int, error) {
+	rank := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		r, err := get[Rating](tx, bucketRatings, ratingID(board, playerID))
+		if err != nil {
+			return err
+		}
+		key, prefix := ratingKey(r), boardPrefix(board)
+		c := tx.Bucket(bucketRatingsByValue).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.Compare(k, key) < 0; k, _ = c.Next() {
+			rank++
+		}
+		rank++
+		return nil
+	})
+	return rank, err
+}
+
+type boltResults struct {
+	db *bolt.DB
+}
+
+func (s boltResults) Save(ctx context.Context, r *result.Result) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		old, err := get[result.Result](tx, bucketResults, r.ID)
+		if err == nil {
+			if err := indexResult(tx, old, true); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err := indexResult(tx, r, false); err != nil {
+			return err
+		}
+		return put(tx, bucketResults, r.ID, r)
+	})
+}
+
+func (s boltResults) Load(ctx context.Context, id string) (*result.Result, error) {
+	var r *result.Result
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		r, err = get[result.Result](tx, bucketResults, id)
+		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil, result.ErrNotFound
+	}
+	return r, err
+}
+
+func (s boltResults) List(ctx context.Context, status result.Status, offset int, limit int) ([]*result.Result, error) {
+	results := []*result.Result{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found := 0
+		return scanReverse(tx, bucketResultsByTime, nil, offset, limit, func(k []byte, _ []byte) (bool, error) {
+			r, err := get[result.Result](tx, bucketResults, string(k[8:]))
+			if err != nil {
+				return false, err
+			}
+			if status != "" && r.Status != status {
+				return false, nil
+			}
+			found++
+			if found > offset {
+				results = append(results, r)
+			}
+			return true, nil
+		})
+	})
+	return results, err
+}
+
+func (s boltResults) ListByPlayer(ctx context.Context, playerID string, offset int, limit int) ([]*result.Result, error) {
+	results := []*result.Result{}
+	prefix := playerPrefix(playerID)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found := 0
+		return scanReverse(tx, bucketResultsByPlayer, prefix, offset, limit, func(k []byte, _ []byte) (bool, error) {
+			found++
+			if found <= offset {
+				return true, nil
+			}
+			r, err := get[result.Result](tx, bucketResults, string(k[len(prefix)+8:]))
+			if err != nil {
+				return false, err
+			}
+			results = append(results, r)
+			return true, nil
+		})
+	})
+	return results, err
+}
+
+type boltReplays struct {
+	db *bolt.DB
+}
+
+func (s boltReplays) Save(ctx context.Context, r *replay.Replay) error {
+	var buf bytes.Buffer
+	if err := replay.Encode(&buf, r); err != nil {
+		return err
+	}
+	header, err := json.Marshal(r.Header)
+	if err != nil {
+		return fmt.Errorf("marshal replay header: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if old := tx.Bucket(bucketReplays).Get([]byte(r.Header.ID)); old != nil {
+			oldHeader, err := replay.DecodeHeader(bytes.NewReader(old))
+			if err != nil {
+				return fmt.Errorf("decode replay header %s: %w", r.Header.ID, err)
+			}
+			if err := tx.Bucket(bucketReplaysByTime).Delete(timeKey(oldHeader.RecordedAt, r.Header.ID)); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(bucketReplaysByTime).Put(timeKey(r.Header.RecordedAt, r.Header.ID), header); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketReplays).Put([]byte(r.Header.ID), buf.Bytes())
+	})
+}
+
+func (s boltReplays) Load(ctx context.Context, id string) (*replay.Replay, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// only valid during the transaction
+		data = bytes.Clone(tx.Bucket(bucketReplays).Get([]byte(id)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, replay.ErrNotFound
+	}
+	return replay.Decode(bytes.NewReader(data))
+}
+
+func (s boltReplays) List(ctx context.Context, offset int, limit int) ([]replay.Header, error) {
+	headers := []replay.Header{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found := 0
+		return scanReverse(tx, bucketReplaysByTime, nil, offset, limit, func(_ []byte, v []byte) (bool, error) {
+			found++
+			if found <= offset {
+				return true, nil
+			}
+			var header replay.Header
+			if err := json.Unmarshal(v, &header); err != nil {
+				return false, fmt.Errorf("unmarshal replay header: %w", err)
+			}
+			headers = append(headers, header)
+			return true, nil
+		})
+	})
+	return headers, err
+}
+
+type boltTournaments struct {
+	db *bolt.DB
+}
+
+func (s boltTournaments) Save(ctx context.Context, t *Tournament) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		old, err := get[Tournament](tx, bucketTournaments, t.ID)
+		if err == nil {
+			if err := tx.Bucket(bucketTournamentsByTime).Delete(timeKey(old.CreatedAt, old.ID)); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err := tx.Bucket(bucketTournamentsByTime).Put(timeKey(t.CreatedAt, t.ID), nil); err != nil {
+			return err
+		}
+		return put(tx, bucketTournaments, t.ID, t)
+	})
+}
+
+func (s boltTournaments) Load(ctx context.Context, id string) (t *Tournament, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		t, err = get[Tournament](tx, bucketTournaments, id)
+		return err
+	})
+	return t, err
+}
+
+func (s boltTournaments) List(ctx context.Context, offset int, limit int) ([]*Tournament, error) {
+	tournaments := []*Tournament{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found := 0
+		return scanReverse(tx, bucketTournamentsByTime, nil, offset, limit, func(k []byte, _ []byte) (bool, error) {
+			found++
+			if found <= offset {
+				return true, nil
+			}
+			t, err := get[Tournament](tx, bucketTournaments, string(k[8:]))
+			if err != nil {
+				return false, err
+			}
+			tournaments = append(tournaments, t)
+			return true, nil
+		})
+	})
+	return tournaments, err
+}
+
+type boltBans struct {
+	db *bolt.DB
+}
+
+func (s boltBans) Save(ctx context.Context, b *Ban) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return put(tx, bucketBans, b.PlayerID, b)
+	})
+}
+
+func (s boltBans) Load(ctx context.Context, playerID string) (b *Ban, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b, err = get[Ban](tx, bucketBans, playerID)
+		return err
+	})
+	return b, err
+}
+
+func (s boltBans) Delete(ctx context.Context, playerID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBans).Delete([]byte(playerID))
+	})
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/isaackoz/tronline/replay"
+	"github.com/isaackoz/tronline/result"
+)
+
+// file extensions of the replay and result directories
+const (
+	replayFileExt = ".trr"
+	resultFileExt = ".json"
+)
+
+// ImportDirs copies the replays and results the server used to keep as files in replayDir and
+// resultDir (REPLAY_DIR and RESULT_DIR) into s. Records s already has are skipped, so it's
+// safe to run on every start. Empty dirs are skipped, the files are left alone
+func ImportDirs(ctx context.Context, s Store, replayDir string, resultDir string) error {
+	if replayDir != "" {
+		n, err := importDir(ctx, replayDir, replayFileExt, func(id string, data []byte) (bool, error) {
+			if _, err := s.Replays().Load(ctx, id); err == nil {
+				return false, nil
+			} else if !errors.Is(err, replay.ErrNotFound) {
+				return false, err
+			}
+			r, err := replay.Decode(bytes.NewReader(data))
+			if err != nil {
+				return false, err
+			}
+			return true, s.Replays().Save(ctx, r)
+		})
+		if err != nil {
+			return fmt.Errorf("import replays: %w", err)
+		}
+		slog.Info("imported replay dir", "dir", replayDir, "replays", n)
+	}
+	if resultDir != "" {
+		n, err := importDir(ctx, resultDir, resultFileExt, func(id string, data []byte) (bool, error) {
+			if _, err := s.Results().Load(ctx, id); err == nil {
+				return false, nil
+			} else if !errors.Is(err, result.ErrNotFound) {
+				return false, err
+			}
+			var r result.Result
+			if err := json.Unmarshal(data, &r); err != nil {
+				return false, err
+			}
+			return true, s.Results().Save(ctx, &r)
+		})
+		if err != nil {
+			return fmt.Errorf("import results: %w", err)
+		}
+		slog.Info("imported result dir", "dir", resultDir, "results", n)
+	}
+	return nil
+}
+
+// calls save with the id and content of every file in dir with the extension. Files that
+// can't be read or decoded are logged and skipped. Returns how many were saved
+func importDir(ctx context.Context, dir string, ext string, save func(id string, data []byte) (bool, error)) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	imported := 0
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return imported, err
+		}
+		id, ok := strings.CutSuffix(entry.Name(), ext)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			slog.Warn("read legacy record", "error", err, "file", entry.Name())
+			continue
+		}
+		saved, err := save(id, data)
+		if err != nil {
+			slog.Warn("import legacy record", "error", err, "file", entry.Name())
+			continue
+		}
+		if saved {
+			imported++
+		}
+	}
+	return imported, nil
+}
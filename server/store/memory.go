@@ -0,0 +1,181 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/isaackoz/tronline/replay"
+	"github.com/isaackoz/tronline/result"
+)
+
+// Memory keeps everything in memory, it's gone on restart
+type Memory struct {
+	players     *memoryRecords[Player]
+	accounts    *memoryAccounts
+	ratings     *memoryRatings
+	results     *result.MemoryStore
+	replays     *replay.MemoryStore
+	tournaments *memoryTournaments
+	bans        *memoryRecords[Ban]
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		players:     newMemoryRecords(func(p *Player) string { return p.ID }),
+		accounts:    &memoryAccounts{newMemoryRecords(func(a *Account) string { return a.ID })},
+		ratings:     &memoryRatings{newMemoryRecords(func(r *Rating) string { return ratingID(r.Board, r.PlayerID) })},
+		results:     result.NewMemoryStore(),
+		replays:     replay.NewMemoryStore(),
+		tournaments: &memoryTournaments{newMemoryRecords(func(t *Tournament) string { return t.ID })},
+		bans:        newMemoryRecords(func(b *Ban) string { return b.PlayerID }),
+	}
+}
+
+func (m *Memory) Players() PlayerStore         { return m.players }
+func (m *Memory) Accounts() AccountStore       { return m.accounts }
+func (m *Memory) Ratings() RatingStore         { return m.ratings }
+func (m *Memory) Results() result.Store        { return m.results }
+func (m *Memory) Replays() replay.Store        { return m.replays }
+func (m *Memory) Tournaments() TournamentStore { return m.tournaments }
+func (m *Memory) Bans() BanStore               { return m.bans }
+func (m *Memory) Close() error                 { return nil }
+
+// memoryRecords is a map of records by id. Records are copied in and out so callers can't
+// change what's stored
+type memoryRecords[T any] struct {
+	mu      sync.RWMutex
+	records map[string]T
+	id      func(*T) string
+}
+
+func newMemoryRecords[T any](id func(*T) string) *memoryRecords[T] {
+	return &memoryRecords[T]{records: make(map[string]T), id: id}
+}
+
+func (s *memoryRecords[T]) Save(ctx context.Context, record *T) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[s.id(record)] = *record
+	return nil
+}
+
+func (s *memoryRecords[T]) Load(ctx context.Context, id string) (*T, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, ok := s.records[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &record, nil
+}
+
+func (s *memoryRecords[T]) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, id)
+	return nil
+}
+
+type memoryAccounts struct {
+	*memoryRecords[Account]
+}
+
+func (s *memoryAccounts) LoadBySubject(ctx context.Context, issuer string, subject string) (*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, a := range s.records {
+		if a.Issuer == issuer && a.Subject == subject {
+			return &a, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+type memoryRatings struct {
+	*memoryRecords[Rating]
+}
+
+func (s *memoryRatings) Load(ctx context.Context, board string, playerID string) (*Rating, error) {
+	return s.memoryRecords.Load(ctx, ratingID(board, playerID))
+}
+
+func (s *memoryRatings) Top(ctx context.Context, board string, offset int, limit int) ([]*Rating, error) {
+	return page(s.sorted(board), offset, limit), nil
+}
+
+func (s *memoryRatings) Rank(ctx context.Context, board string, playerID string) (int, error) {
+	for i, r := range s.sorted(board) {
+		if r.PlayerID == playerID {
+			return i + 1, nil
+		}
+	}
+	return 0, ErrNotFound
+}
+
+// the board's ratings, highest first
+func (s *memoryRatings) sorted(board string) []*Rating {
+	s.mu.RLock()
+	var ratings []*Rating
+	for _, r := range s.records {
+		if r.Board == board {
+			ratings = append(ratings, &r)
+		}
+	}
+	s.mu.RUnlock()
+	slices.SortFunc(ratings, compareRatings)
+	return ratings
+}
+
+// highest rating first, equal ratings by player id
+func compareRatings(a *Rating, b *Rating) int {
+	if a.Rating != b.Rating {
+		return cmp.Compare(b.Rating, a.Rating)
+	}
+	return cmp.Compare(a.PlayerID, b.PlayerID)
+}
+
+// tournaments are cloned in and out, memoryRecords only copies the struct
+type memoryTournaments struct {
+	*memoryRecords[Tournament]
+}
+
+func (s *memoryTournaments) Save(ctx context.Context, t *Tournament) error {
+	return s.memoryRecords.Save(ctx, t.Clone())
+}
+
+func (s *memoryTournaments) Load(ctx context.Context, id string) (*Tournament, error) {
+	t, err := s.memoryRecords.Load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return t.Clone(), nil
+}
+
+func (s *memoryTournaments) List(ctx context.Context, offset int, limit int) ([]*Tournament, error) {
+	s.mu.RLock()
+	var tournaments []*Tournament
+	for _, t := range s.records {
+		tournaments = append(tournaments, t.Clone())
+	}
+	s.mu.RUnlock()
+	slices.SortFunc(tournaments, func(a *Tournament, b *Tournament) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.ID, a.ID)
+	})
+	return page(tournaments, offset, limit), nil
+}
+
+func page[T any](items []T, offset int, limit int) []T {
+	if offset >= len(items) {
+		return []T{}
+	}
+	items = items[offset:]
+	if limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
@@ -0,0 +1,180 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// a schema change. Migrations run in order, each in its own transaction, and the schema
+// version in the meta bucket records the last one applied. Never change a released one,
+// add a new one instead
+type migration struct {
+	version uint64
+	name    string
+	apply   func(tx *bolt.Tx) error
+}
+
+var migrations = []migration{
+	{version: 1, name: "create buckets", apply: func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{
+			bucketPlayers, bucketRatings, bucketRatingsByValue, bucketResults, bucketResultsByTime,
+			bucketReplays, bucketReplaysByTime, bucketBans,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{version: 2, name: "create account buckets", apply: func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{bucketAccounts, bucketAccountsBySubject} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{version: 3, name: "ratings by board", apply: func(tx *bolt.Tx) error {
+		// ratings used to be one board, they're the all-time board now. Keys are built the way
+		// they were at version 3, the live helpers may change with later versions
+		type ratingV3 struct {
+			PlayerID string `json:"playerId"`
+			Rating   int    `json:"rating"`
+		}
+		const board = "all-time"
+		prefix := append([]byte(board), 0)
+		type moved struct {
+			id   []byte
+			key  []byte
+			data []byte
+		}
+		var ratings []moved
+		err := tx.Bucket(bucketRatings).ForEach(func(k []byte, v []byte) error {
+			var fields map[string]json.RawMessage
+			var r ratingV3
+			if err := json.Unmarshal(v, &fields); err != nil {
+				return fmt.Errorf("unmarshal rating %s: %w", k, err)
+			}
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("unmarshal rating %s: %w", k, err)
+			}
+			fields["board"] = json.RawMessage(`"` + board + `"`)
+			data, err := json.Marshal(fields)
+			if err != nil {
+				return fmt.Errorf("marshal rating %s: %w", k, err)
+			}
+			key := binary.BigEndian.AppendUint64(bytes.Clone(prefix), math.MaxInt64-uint64(int64(r.Rating)+math.MaxInt32))
+			ratings = append(ratings, moved{
+				id:   append(bytes.Clone(prefix), r.PlayerID...),
+				key:  append(key, r.PlayerID...),
+				data: data,
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, bucket := range [][]byte{bucketRatings, bucketRatingsByValue} {
+			if err := tx.DeleteBucket(bucket); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(bucket); err != nil {
+				return err
+			}
+		}
+		for _, r := range ratings {
+			if err := tx.Bucket(bucketRatingsByValue).Put(r.key, nil); err != nil {
+				return err
+			}
+			if err := tx.Bucket(bucketRatings).Put(r.id, r.data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{version: 4, name: "index results by player", apply: func(tx *bolt.Tx) error {
+		// the index as it was at version 4: player id + 0 + finished at + result id
+		type resultV4 struct {
+			ID         string    `json:"id"`
+			Players    []string  `json:"players"`
+			FinishedAt time.Time `json:"finishedAt"`
+		}
+		index, err := tx.CreateBucket(bucketResultsByPlayer)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketResults).ForEach(func(k []byte, v []byte) error {
+			var r resultV4
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("unmarshal result %s: %w", k, err)
+			}
+			for _, playerID := range r.Players {
+				key := append([]byte(playerID), 0)
+				key = binary.BigEndian.AppendUint64(key, uint64(r.FinishedAt.UnixNano()))
+				if err := index.Put(append(key, r.ID...), nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}},
+	{version: 5, name: "create tournament buckets", apply: func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{bucketTournaments, bucketTournamentsByTime} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+}
+
+var keySchemaVersion = []byte("schema_version")
+
+func schemaVersion(tx *bolt.Tx) uint64 {
+	v := tx.Bucket(bucketMeta).Get(keySchemaVersion)
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func migrate(db *bolt.DB) error {
+	var current uint64
+	err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketMeta); err != nil {
+			return err
+		}
+		current = schemaVersion(tx)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	if latest := migrations[len(migrations)-1].version; current > latest {
+		return fmt.Errorf("store schema version %d is newer than this server's %d", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		err := db.Update(func(tx *bolt.Tx) error {
+			if err := m.apply(tx); err != nil {
+				return err
+			}
+			return tx.Bucket(bucketMeta).Put(keySchemaVersion, binary.BigEndian.AppendUint64(nil, m.version))
+		})
+		if err != nil {
+			return fmt.Errorf("migrate store to version %d (%s): %w", m.version, m.name, err)
+		}
+		slog.Info("migrated store", "version", m.version, "name", m.name)
+	}
+	return nil
+}
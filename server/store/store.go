@@ -0,0 +1,210 @@
+// Package store is where everything the server keeps across matches lives: players, their
+// ratings, match results, replays, tournaments and bans. Store has an in-memory implementation for tests
+// and development and a bbolt one that keeps everything in a single file
+package store
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/isaackoz/tronline/mode"
+	"github.com/isaackoz/tronline/replay"
+	"github.com/isaackoz/tronline/result"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Store is every kind of record the server persists
+type Store interface {
+	Players() PlayerStore
+	Accounts() AccountStore
+	Ratings() RatingStore
+	Results() result.Store
+	Replays() replay.Store
+	Tournaments() TournamentStore
+	Bans() BanStore
+	Close() error
+}
+
+// Open opens the single-file store at path, or an in-memory store if path is empty
+func Open(path string) (Store, error) {
+	if path == "" {
+		return NewMemory(), nil
+	}
+	return OpenBolt(path)
+}
+
+// Player is somebody who played on the server
+type Player struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	// last time the player connected, to the hour
+	SeenAt time.Time `json:"seenAt"`
+}
+
+type PlayerStore interface {
+	// saves a new player or replaces the one with the same id
+	Save(ctx context.Context, p *Player) error
+	Load(ctx context.Context, id string) (*Player, error)
+}
+
+// Account links a player to a login at an OpenID Connect provider
+type Account struct {
+	// the player's id
+	ID string `json:"id"`
+	// the provider's issuer url and its id for the user, unique together
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+	Email   string `json:"email,omitempty"`
+	// name at the provider
+	Name      string    `json:"name,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	// last login
+	LoginAt time.Time `json:"loginAt"`
+}
+
+type AccountStore interface {
+	// saves a new account or replaces the one with the same id
+	Save(ctx context.Context, a *Account) error
+	Load(ctx context.Context, id string) (*Account, error)
+	// the account of a provider's user
+	LoadBySubject(ctx context.Context, issuer string, subject string) (*Account, error)
+}
+
+// Rating is a player's skill rating and record on a leaderboard
+type Rating struct {
+	// the leaderboard, i.e. one per season
+	Board     string    `json:"board"`
+	PlayerID  string    `json:"playerId"`
+	Rating    int       `json:"rating"`
+	Matches   int       `json:"matches"`
+	Wins      int       `json:"wins"`
+	Losses    int       `json:"losses"`
+	Draws     int       `json:"draws"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type RatingStore interface {
+	// saves a new rating or replaces the player's on the same board
+	Save(ctx context.Context, r *Rating) error
+	Load(ctx context.Context, board string, playerID string) (*Rating, error)
+	// highest rating first, equal ratings by player id
+	Top(ctx context.Context, board string, offset int, limit int) ([]*Rating, error)
+	// the player's position in Top, from 1. ErrNotFound if the player isn't on the board
+	Rank(ctx context.Context, board string, playerID string) (int, error)
+}
+
+// Tournament is a bracket of matches players sign up for, see package tournament
+type Tournament struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// single-elimination, double-elimination or round-robin
+	Format string `json:"format"`
+	// player id of whoever created it
+	OrganizerID string `json:"organizerId"`
+	// open while players sign up, then running and finished
+	Status string `json:"status"`
+	// how every match is played
+	Game     mode.Mode `json:"game"`
+	Arena    string    `json:"arena"`
+	PowerUps bool      `json:"powerUps,omitempty"`
+	Ranked   bool      `json:"ranked,omitempty"`
+	// most players that can sign up
+	MaxPlayers int `json:"maxPlayers"`
+	// in sign up order, in seeding order once started
+	Players []TournamentPlayer `json:"players"`
+	// the bracket, empty until started
+	Matches []TournamentMatch `json:"matches"`
+	// player id of the champion once finished
+	Winner     string    `json:"winner,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	StartedAt  time.Time `json:"startedAt,omitzero"`
+	FinishedAt time.Time `json:"finishedAt,omitzero"`
+}
+
+type TournamentPlayer struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// from 1 once started
+	Seed     int       `json:"seed,omitempty"`
+	JoinedAt time.Time `json:"joinedAt"`
+}
+
+// TournamentMatch is a pairing of a tournament's bracket
+type TournamentMatch struct {
+	// i.e. "W1-2", the second match of the first winners round
+	ID string `json:"id"`
+	// winners, losers or final in elimination, round-robin otherwise
+	Bracket string `json:"bracket"`
+	Round   int    `json:"round"`
+	// player ids, the first one hosts. Empty while an earlier match decides the player, or
+	// for nobody when that match had no one to send
+	Players [2]string `json:"players"`
+	// how many of the players earlier matches still have to decide
+	Waiting int `json:"waiting"`
+	// matches the winner and the loser move on to and the slot they take there, empty when
+	// they're done
+	WinnerTo   string `json:"winnerTo,omitempty"`
+	WinnerSlot int    `json:"winnerSlot,omitempty"`
+	LoserTo    string `json:"loserTo,omitempty"`
+	LoserSlot  int    `json:"loserSlot,omitempty"`
+	// waiting, ready, playing, stalled, finished or skipped
+	Status string `json:"status"`
+	// room the players join while playing
+	RoomID string `json:"roomId,omitempty"`
+	// rooms opened for the match so far
+	Rooms int `json:"rooms,omitempty"`
+	// the match result, empty when the match wasn't played
+	ResultID string `json:"resultId,omitempty"`
+	// player id of the winner, empty for a draw
+	Winner string `json:"winner,omitempty"`
+	// won without playing: a bye, or settled by the organizer
+	Walkover   bool      `json:"walkover,omitempty"`
+	Scores     []int     `json:"scores,omitempty"`
+	StartedAt  time.Time `json:"startedAt,omitzero"`
+	FinishedAt time.Time `json:"finishedAt,omitzero"`
+}
+
+// Clone returns a copy of t that shares nothing with it
+func (t *Tournament) Clone() *Tournament {
+	c := *t
+	c.Players = slices.Clone(t.Players)
+	c.Matches = slices.Clone(t.Matches)
+	for i := range c.Matches {
+		c.Matches[i].Scores = slices.Clone(c.Matches[i].Scores)
+	}
+	return &c
+}
+
+type TournamentStore interface {
+	// saves a new tournament or replaces the one with the same id
+	Save(ctx context.Context, t *Tournament) error
+	Load(ctx context.Context, id string) (*Tournament, error)
+	// newest first
+	List(ctx context.Context, offset int, limit int) ([]*Tournament, error)
+}
+
+// Ban keeps a player out of the server
+type Ban struct {
+	PlayerID  string    `json:"playerId"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"createdAt"`
+	// zero for a permanent ban
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+}
+
+// Active reports whether the ban is still in effect at now
+func (b *Ban) Active(now time.Time) bool {
+	return b.ExpiresAt.IsZero() || now.Before(b.ExpiresAt)
+}
+
+type BanStore interface {
+	// saves a ban, replacing the player's previous one
+	Save(ctx context.Context, b *Ban) error
+	// the player's ban, active or not. ErrNotFound if the player was never banned
+	Load(ctx context.Context, playerID string) (*Ban, error)
+	Delete(ctx context.Context, playerID string) error
+}
@@ -0,0 +1,359 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/isaackoz/tronline/game"
+	"github.com/isaackoz/tronline/replay"
+	"github.com/isaackoz/tronline/result"
+	bolt "go.etcd.io/bbolt"
+)
+
+// runs test against every implementation
+func eachStore(t *testing.T, test func(t *testing.T, s Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemory())
+	})
+	t.Run("bolt", func(t *testing.T) {
+		s, err := OpenBolt(filepath.Join(t.TempDir(), "store.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		test(t, s)
+	})
+}
+
+var epoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestPlayersAndAccounts(t *testing.T) {
+	eachStore(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		if _, err := s.Players().Load(ctx, "p1"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("load missing player: got %v, want ErrNotFound", err)
+		}
+		if err := s.Players().Save(ctx, &Player{ID: "p1", Name: "flynn", CreatedAt: epoch}); err != nil {
+			t.Fatal(err)
+		}
+		p, err := s.Players().Load(ctx, "p1")
+		if err != nil || p.Name != "flynn" {
+			t.Fatalf("load player: got %+v, %v", p, err)
+		}
+
+		account := &Account{ID: "p1", Issuer: "https://id.example", Subject: "42", CreatedAt: epoch}
+		if err := s.Accounts().Save(ctx, account); err != nil {
+			t.Fatal(err)
+		}
+		a, err := s.Accounts().LoadBySubject(ctx, "https://id.example", "42")
+		if err != nil || a.ID != "p1" {
+			t.Fatalf("load account by subject: got %+v, %v", a, err)
+		}
+		if _, err := s.Accounts().LoadBySubject(ctx, "https://other.example", "42"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("load account of another issuer: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestRatings(t *testing.T) {
+	eachStore(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		for _, r := range []*Rating{
+			{Board: "all-time", PlayerID: "a", Rating: 1200},
+			{Board: "all-time", PlayerID: "b", Rating: 1350},
+			{Board: "all-time", PlayerID: "c", Rating: 1200},
+			{Board: "all-time", PlayerID: "d", Rating: 900},
+			{Board: "2026-01", PlayerID: "a", Rating: 1500},
+		} {
+			if err := s.Ratings().Save(ctx, r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// a rating that changes moves in the ranking
+		if err := s.Ratings().Save(ctx, &Rating{Board: "all-time", PlayerID: "d", Rating: 1400}); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name   string
+			board  string
+			offset int
+			limit  int
+			want   []string
+		}{
+			{"all", "all-time", 0, 10, []string{"d", "b", "a", "c"}},
+			{"page", "all-time", 1, 2, []string{"b", "a"}},
+			{"past the end", "all-time", 4, 10, []string{}},
+			{"other board", "2026-01", 0, 10, []string{"a"}},
+			{"empty board", "2025-12", 0, 10, []string{}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				top, err := s.Ratings().Top(ctx, tt.board, tt.offset, tt.limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := []string{}
+				for _, r := range top {
+					got = append(got, r.PlayerID)
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			})
+		}
+
+		if rank, err := s.Ratings().Rank(ctx, "all-time", "c"); err != nil || rank != 4 {
+			t.Fatalf("rank of c: got %d, %v, want 4", rank, err)
+		}
+		if _, err := s.Ratings().Rank(ctx, "2026-01", "b"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("rank off the board: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestResults(t *testing.T) {
+	eachStore(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		for i, r := range []*result.Result{
+			{ID: "r1", Players: []string{"a", "b"}, Status: result.StatusConfirmed},
+			{ID: "r2", Players: []string{"b", "c"}, Status: result.StatusDisputed},
+			{ID: "r3", Players: []string{"a", "c"}, Status: result.StatusConfirmed},
+		} {
+			r.FinishedAt = epoch.Add(time.Duration(i) * time.Minute)
+			if err := s.Results().Save(ctx, r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// saving again replaces the result and its index entries
+		if err := s.Results().Save(ctx, &result.Result{ID: "r2", Players: []string{"b", "c"}, Status: result.StatusConfirmed, FinishedAt: epoch.Add(time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+
+		ids := func(results []*result.Result) []string {
+			ids := []string{}
+			for _, r := range results {
+				ids = append(ids, r.ID)
+			}
+			return ids
+		}
+		tests := []struct {
+			name string
+			list func() ([]*result.Result, error)
+			want []string
+		}{
+			{"all", func() ([]*result.Result, error) { return s.Results().List(ctx, "", 0, 10) }, []string{"r3", "r2", "r1"}},
+			{"confirmed", func() ([]*result.Result, error) { return s.Results().List(ctx, result.StatusConfirmed, 0, 10) }, []string{"r3", "r2", "r1"}},
+			{"disputed", func() ([]*result.Result, error) { return s.Results().List(ctx, result.StatusDisputed, 0, 10) }, []string{}},
+			{"page", func() ([]*result.Result, error) { return s.Results().List(ctx, "", 1, 1) }, []string{"r2"}},
+			{"player", func() ([]*result.Result, error) { return s.Results().ListByPlayer(ctx, "a", 0, 10) }, []string{"r3", "r1"}},
+			{"player page", func() ([]*result.Result, error) { return s.Results().ListByPlayer(ctx, "c", 1, 10) }, []string{"r2"}},
+			// a prefix of player ids in the index
+			{"unknown player", func() ([]*result.Result, error) { return s.Results().ListByPlayer(ctx, "b\x00", 0, 10) }, []string{}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				results, err := tt.list()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := ids(results); !slices.Equal(got, tt.want) {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			})
+		}
+
+		if _, err := s.Results().Load(ctx, "r4"); !errors.Is(err, result.ErrNotFound) {
+			t.Fatalf("load missing result: got %v, want result.ErrNotFound", err)
+		}
+	})
+}
+
+func testReplay(id string, recordedAt time.Time) *replay.Replay {
+	return &replay.Replay{
+		Header: replay.Header{
+			ID:           id,
+			RulesVersion: game.RulesVersion,
+			Settings:     game.Settings{Width: 20, Height: 20, Players: 2},
+			Players:      []replay.Player{{ID: "a"}, {ID: "b"}},
+			Source:       "hosted",
+			Winner:       -1,
+			RecordedAt:   recordedAt,
+		},
+		Inputs: []replay.InputEvent{{Tick: 1, Player: 0, Input: game.Input{Turn: game.TurnLeft}}},
+	}
+}
+
+func TestReplays(t *testing.T) {
+	eachStore(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		for i, id := range []string{"x1", "x2", "x3"} {
+			if err := s.Replays().Save(ctx, testReplay(id, epoch.Add(time.Duration(i)*time.Minute))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r, err := s.Replays().Load(ctx, "x2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Header.ID != "x2" || len(r.Inputs) != 1 || r.Inputs[0].Input.Turn != game.TurnLeft {
+			t.Fatalf("load replay: got %+v", r)
+		}
+		headers, err := s.Replays().List(ctx, 0, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, h := range headers {
+			got = append(got, h.ID)
+		}
+		if want := []string{"x3", "x2"}; !slices.Equal(got, want) {
+			t.Fatalf("list replays: got %v, want %v", got, want)
+		}
+		if _, err := s.Replays().Load(ctx, "x4"); !errors.Is(err, replay.ErrNotFound) {
+			t.Fatalf("load missing replay: got %v, want replay.ErrNotFound", err)
+		}
+	})
+}
+
+func TestTournamentsAndBans(t *testing.T) {
+	eachStore(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		for i, id := range []string{"t1", "t2"} {
+			tournament := &Tournament{ID: id, Players: []TournamentPlayer{{ID: "a"}}, CreatedAt: epoch.Add(time.Duration(i) * time.Minute)}
+			if err := s.Tournaments().Save(ctx, tournament); err != nil {
+				t.Fatal(err)
+			}
+			// changing the saved tournament doesn't change the stored one
+			tournament.Players[0].ID = "changed"
+		}
+		tournaments, err := s.Tournaments().List(ctx, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tournaments) != 2 || tournaments[0].ID != "t2" || tournaments[1].Players[0].ID != "a" {
+			t.Fatalf("list tournaments: got %+v", tournaments)
+		}
+
+		if err := s.Bans().Save(ctx, &Ban{PlayerID: "a", Reason: "cheating", CreatedAt: epoch, ExpiresAt: epoch.Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+		ban, err := s.Bans().Load(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ban.Active(epoch) || ban.Active(epoch.Add(2*time.Hour)) {
+			t.Fatalf("ban active: got %+v", ban)
+		}
+		if err := s.Bans().Delete(ctx, "a"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Bans().Load(ctx, "a"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("load deleted ban: got %v, want ErrNotFound", err)
+		}
+	})
+}
+
+// a store file at schema version 2, before ratings had boards and results a player index
+func TestMigrateFromVersion2(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, m := range migrations[:2] {
+			if err := m.apply(tx); err != nil {
+				return err
+			}
+		}
+		meta, err := tx.CreateBucket(bucketMeta)
+		if err != nil {
+			return err
+		}
+		if err := meta.Put(keySchemaVersion, binary.BigEndian.AppendUint64(nil, 2)); err != nil {
+			return err
+		}
+		for id, r := range map[string]string{
+			"a": `{"playerId":"a","rating":1100,"matches":3}`,
+			"b": `{"playerId":"b","rating":1300,"matches":5}`,
+		} {
+			if err := tx.Bucket(bucketRatings).Put([]byte(id), []byte(r)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketResults).Put([]byte("r1"), []byte(`{"id":"r1","players":["a","b"],"status":"confirmed","finishedAt":"2026-01-01T00:00:00Z"}`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s, err := OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+	top, err := s.Ratings().Top(ctx, "all-time", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 2 || top[0].PlayerID != "b" || top[0].Matches != 5 || top[1].PlayerID != "a" {
+		t.Fatalf("migrated ratings: got %+v", top)
+	}
+	results, err := s.Results().ListByPlayer(ctx, "b", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].ID != "r1" {
+		t.Fatalf("migrated result index: got %+v", results)
+	}
+}
+
+func TestImportDirs(t *testing.T) {
+	replayDir, resultDir := t.TempDir(), t.TempDir()
+	f, err := os.Create(filepath.Join(replayDir, "x1.trr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replay.Encode(f, testReplay("x1", epoch)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	data, _ := json.Marshal(&result.Result{ID: "r1", Players: []string{"a", "b"}, FinishedAt: epoch})
+	if err := os.WriteFile(filepath.Join(resultDir, "r1.json"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// broken files are skipped
+	if err := os.WriteFile(filepath.Join(resultDir, "r2.json"), []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	eachStore(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		// twice, records imported before are skipped
+		for range 2 {
+			if err := ImportDirs(ctx, s, replayDir, resultDir); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := s.Replays().Load(ctx, "x1"); err != nil {
+			t.Fatalf("load imported replay: %v", err)
+		}
+		results, err := s.Results().ListByPlayer(ctx, "a", 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].ID != "r1" {
+			t.Fatalf("imported results: got %+v", results)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+// Package stun is a minimal STUN server that answers binding requests (RFC 5389) so clients
+// can discover their server reflexive address without depending on a public STUN server
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"net"
+)
+
+const (
+	headerSize  = 20
+	magicCookie = 0x2112A442
+
+	typeBindingRequest = 0x0001
+	typeBindingSuccess = 0x0101
+
+	attrXORMappedAddress = 0x0020
+	attrSoftware         = 0x8022
+	attrFingerprint      = 0x8028
+
+	familyIPv4 = 0x01
+	familyIPv6 = 0x02
+
+	fingerprintXOR = 0x5354554e
+
+	software = "tronline"
+)
+
+var errNotBindingRequest = errors.New("not a stun binding request")
+
+type Server struct {
+	Addr string
+}
+
+func NewServer(addr string) *Server {
+	return &Server{Addr: addr}
+}
+
+// ListenAndServe answers binding requests on the udp address until ctx is done
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	conn, err := s.Listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, conn)
+}
+
+// Listen binds the udp address, so callers know the server is reachable before they hand
+// the connection to Serve
+func (s *Server) Listen() (net.PacketConn, error) {
+	conn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen udp: %w", err)
+	}
+	return conn, nil
+}
+
+// Serve answers binding requests on conn until ctx is done. conn is closed when Serve returns
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	slog.Info("stun server listening", "addr", conn.LocalAddr().String())
+
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			slog.Debug("stun read", "error", err)
+			continue
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		resp, err := handleBindingRequest(buf[:n], udpAddr)
+		if err != nil {
+			// anything that isn't a binding request is silently dropped
+			slog.Debug("stun drop packet", "error", err, "remote_addr", addr.String())
+			continue
+		}
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			slog.Debug("stun write", "error", err, "remote_addr", addr.String())
+		}
+	}
+}
+
+// parses a binding request and builds the success response with the XOR-MAPPED-ADDRESS of from
+func handleBindingRequest(req []byte, from *net.UDPAddr) ([]byte, error) {
+	if len(req) < headerSize {
+		return nil, errNotBindingRequest
+	}
+	// the top two bits of every stun message are zero
+	if req[0]&0xC0 != 0 {
+		return nil, errNotBindingRequest
+	}
+	msgType := binary.BigEndian.Uint16(req[0:2])
+	msgLen := binary.BigEndian.Uint16(req[2:4])
+	if msgType != typeBindingRequest || binary.BigEndian.Uint32(req[4:8]) != magicCookie {
+		return nil, errNotBindingRequest
+	}
+	if int(msgLen)+headerSize != len(req) || msgLen%4 != 0 {
+		return nil, fmt.Errorf("bad stun message length %d", msgLen)
+	}
+	transactionID := req[8:20]
+
+	resp := make([]byte, headerSize, 96)
+	binary.BigEndian.PutUint16(resp[0:2], typeBindingSuccess)
+	binary.BigEndian.PutUint32(resp[4:8], magicCookie)
+	copy(resp[8:20], transactionID)
+
+	resp = appendAttr(resp, attrXORMappedAddress, xorAddress(from, transactionID))
+	resp = appendAttr(resp, attrSoftware, []byte(software))
+
+	// the fingerprint covers the message with its length already including the fingerprint
+	binary.BigEndian.PutUint16(resp[2:4], uint16(len(resp)-headerSize+8))
+	crc := crc32.ChecksumIEEE(resp) ^ fingerprintXOR
+	value := binary.BigEndian.AppendUint32(nil, crc)
+	resp = appendAttr(resp, attrFingerprint, value)
+
+	binary.BigEndian.PutUint16(resp[2:4], uint16(len(resp)-headerSize))
+	return resp, nil
+}
+
+// XOR-MAPPED-ADDRESS value. The port is xor'd with the top of the magic cookie, the ip with
+// the magic cookie (ipv4) or the magic cookie followed by the transaction id (ipv6)
+func xorAddress(addr *net.UDPAddr, transactionID []byte) []byte {
+	key := binary.BigEndian.AppendUint32(nil, magicCookie)
+	key = append(key, transactionID...)
+
+	ip := addr.IP.To4()
+	family := byte(familyIPv4)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = familyIPv6
+	}
+
+	value := []byte{0, family}
+	value = binary.BigEndian.AppendUint16(value, uint16(addr.Port)^uint16(magicCookie>>16))
+	for i, b := range ip {
+		value = append(value, b^key[i])
+	}
+	return value
+}
+
+// appends a type-length-value attribute, padded to a multiple of 4 bytes
+func appendAttr(msg []byte, attrType uint16, value []byte) []byte {
+	msg = binary.BigEndian.AppendUint16(msg, attrType)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(value)))
+	msg = append(msg, value...)
+	for len(msg)%4 != 0 {
+		msg = append(msg, 0)
+	}
+	return msg
+}
@@ -0,0 +1,343 @@
+package tournament
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/isaackoz/tronline/store"
+)
+
+// brackets of a match
+const (
+	bracketWinners    = "winners"
+	bracketLosers     = "losers"
+	bracketFinal      = "final"
+	bracketRoundRobin = "round-robin"
+)
+
+// ids of the grand final and the one played when the losers bracket's player wins it
+const (
+	grandFinal      = "GF1"
+	grandFinalReset = "GF2"
+)
+
+// standings points
+const (
+	pointsWin  = 3
+	pointsDraw = 1
+)
+
+// builds the matches of t's format between its players, in seeding order
+func buildBracket(t *store.Tournament) {
+	ids := make([]string, len(t.Players))
+	for i, p := range t.Players {
+		ids[i] = p.ID
+	}
+	switch t.Format {
+	case FormatSingleElimination:
+		t.Matches = winnersBracket(ids)
+	case FormatDoubleElimination:
+		t.Matches = doubleElimination(ids)
+	default:
+		t.Matches = roundRobin(ids)
+	}
+	// a slot waits for every match that sends somebody to it
+	for _, m := range t.Matches {
+		if m.WinnerTo != "" {
+			match(t, m.WinnerTo).Waiting++
+		}
+		if m.LoserTo != "" {
+			match(t, m.LoserTo).Waiting++
+		}
+	}
+}
+
+func matchID(prefix string, round int, i int) string {
+	return fmt.Sprintf("%s%d-%d", prefix, round, i+1)
+}
+
+// the first round pairs seeds so the best ones meet as late as possible, the seeds missing to
+// fill a power of two are byes. Winners of match i play in match i/2 of the next round
+func winnersBracket(players []string) []store.TournamentMatch {
+	size, rounds := 2, 1
+	for size < len(players) {
+		size, rounds = size*2, rounds+1
+	}
+	seeds := seedOrder(size)
+	var matches []store.TournamentMatch
+	for round := 1; round <= rounds; round++ {
+		count := size >> round
+		for i := range count {
+			m := store.TournamentMatch{
+				ID:      matchID("W", round, i),
+				Bracket: bracketWinners,
+				Round:   round,
+				Status:  StatusWaiting,
+			}
+			if round == 1 {
+				for slot, seed := range seeds[2*i : 2*i+2] {
+					if seed <= len(players) {
+						m.Players[slot] = players[seed-1]
+					}
+				}
+			}
+			if round < rounds {
+				m.WinnerTo, m.WinnerSlot = matchID("W", round+1, i/2), i%2
+			}
+			matches = append(matches, m)
+		}
+	}
+	return matches
+}
+
+// seeds by bracket position for size players, i.e. 1 8 4 5 2 7 3 6 for 8
+func seedOrder(size int) []int {
+	seeds := []int{1}
+	for n := 2; n <= size; n *= 2 {
+		next := make([]int, 0, n)
+		for _, seed := range seeds {
+			next = append(next, seed, n+1-seed)
+		}
+		seeds = next
+	}
+	return seeds
+}
+
+// the winners bracket, a losers bracket every winners bracket loser drops into and a grand
+// final between the winners of both. The grand final is played again if the losers bracket's
+// player wins it, so everybody has to lose twice
+func doubleElimination(players []string) []store.TournamentMatch {
+	matches := winnersBracket(players)
+	rounds := matches[len(matches)-1].Round
+	size := 1 << rounds
+	final := &matches[len(matches)-1]
+	final.WinnerTo, final.WinnerSlot = grandFinal, 0
+	if rounds == 1 {
+		// two players, the loser goes straight to the grand final
+		final.LoserTo, final.LoserSlot = grandFinal, 1
+	}
+	winners := func(round int, i int) *store.TournamentMatch {
+		return &matches[size-size>>(round-1)+i]
+	}
+
+	// odd rounds play the survivors against each other, even rounds against the players
+	// dropping from the next winners round
+	last := 2 * (rounds - 1)
+	for round := 1; round <= last; round++ {
+		count := size >> ((round+1)/2 + 1)
+		for i := range count {
+			m := store.TournamentMatch{
+				ID:      matchID("L", round, i),
+				Bracket: bracketLosers,
+				Round:   round,
+				Status:  StatusWaiting,
+			}
+			switch {
+			case round == last:
+				m.WinnerTo, m.WinnerSlot = grandFinal, 1
+			case round%2 == 1:
+				m.WinnerTo, m.WinnerSlot = matchID("L", round+1, i), 0
+			default:
+				m.WinnerTo, m.WinnerSlot = matchID("L", round+1, i/2), i%2
+			}
+			matches = append(matches, m)
+		}
+		switch {
+		case round == 1:
+			for i := range size / 2 {
+				w := winners(1, i)
+				w.LoserTo, w.LoserSlot = matchID("L", 1, i/2), i%2
+			}
+		case round%2 == 0:
+			// in reverse, so players from the same half of the bracket don't meet again
+			// right away
+			for i := range count {
+				w := winners(round/2+1, count-1-i)
+				w.LoserTo, w.LoserSlot = matchID("L", round, i), 1
+			}
+		}
+	}
+
+	return append(matches,
+		store.TournamentMatch{ID: grandFinal, Bracket: bracketFinal, Round: 1, Status: StatusWaiting},
+		// only played if the first grand final says so, see advance
+		store.TournamentMatch{ID: grandFinalReset, Bracket: bracketFinal, Round: 2, Status: StatusWaiting, Waiting: 1},
+	)
+}
+
+// everybody plays everybody once, paired by the circle method so nobody plays twice in a
+// round. With an odd number of players somebody sits every round out
+func roundRobin(players []string) []store.TournamentMatch {
+	circle := slices.Clone(players)
+	if len(circle)%2 == 1 {
+		circle = append(circle, "")
+	}
+	n := len(circle)
+	var matches []store.TournamentMatch
+	for round := 1; round < n; round++ {
+		played := 0
+		for i := range n / 2 {
+			a, b := circle[i], circle[n-1-i]
+			if a == "" || b == "" {
+				continue
+			}
+			// take turns hosting
+			if (round+i)%2 == 0 {
+				a, b = b, a
+			}
+			played++
+			matches = append(matches, store.TournamentMatch{
+				ID:      matchID("R", round, played-1),
+				Bracket: bracketRoundRobin,
+				Round:   round,
+				Players: [2]string{a, b},
+				Status:  StatusWaiting,
+			})
+		}
+		// keep the first player, rotate the others
+		circle = append([]string{circle[0], circle[n-1]}, circle[1:n-1]...)
+	}
+	return matches
+}
+
+func match(t *store.Tournament, id string) *store.TournamentMatch {
+	for i := range t.Matches {
+		if t.Matches[i].ID == id {
+			return &t.Matches[i]
+		}
+	}
+	return nil
+}
+
+// finishes m with winner, empty for a draw or for nobody when neither player showed up, and
+// moves its players on. Returns whether that decided the tournament
+func advance(t *store.Tournament, m *store.TournamentMatch, winner string) bool {
+	m.Status, m.Winner = StatusFinished, winner
+	loser := ""
+	switch winner {
+	case m.Players[0]:
+		loser = m.Players[1]
+	case m.Players[1]:
+		loser = m.Players[0]
+	}
+	if m.ID == grandFinal {
+		reset := match(t, grandFinalReset)
+		if winner == m.Players[0] || m.Players[1] == "" {
+			// the winners bracket's player lost nothing yet
+			reset.Status = StatusSkipped
+			t.Winner = winner
+			return true
+		}
+		reset.Players, reset.Waiting = m.Players, 0
+		return false
+	}
+	send(t, m.WinnerTo, m.WinnerSlot, winner)
+	send(t, m.LoserTo, m.LoserSlot, loser)
+	if m.Bracket == bracketRoundRobin {
+		for _, other := range t.Matches {
+			if other.Status != StatusFinished && other.Status != StatusSkipped {
+				return false
+			}
+		}
+		t.Winner = standings(t)[0].PlayerID
+		return true
+	}
+	if m.WinnerTo == "" {
+		t.Winner = winner
+		return true
+	}
+	return false
+}
+
+// fills a slot of match id with player, nobody if it's empty
+func send(t *store.Tournament, id string, slot int, player string) {
+	if id == "" {
+		return
+	}
+	m := match(t, id)
+	m.Players[slot] = player
+	m.Waiting--
+}
+
+// moves matches on whose players are all decided: ready with two players, won by the player
+// with one and skipped with none. Returns whether that decided the tournament
+func settle(t *store.Tournament) bool {
+	for settled := true; settled; {
+		settled = false
+		for i := range t.Matches {
+			m := &t.Matches[i]
+			if m.Status != StatusWaiting || m.Waiting > 0 {
+				continue
+			}
+			settled = true
+			switch {
+			case m.Players[0] != "" && m.Players[1] != "":
+				m.Status = StatusReady
+			case m.Players[0] == "" && m.Players[1] == "":
+				done := advance(t, m, "")
+				m.Status = StatusSkipped
+				if done {
+					return true
+				}
+			default:
+				m.Walkover = true
+				if advance(t, m, m.Players[0]+m.Players[1]) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Standing is a player's record in a tournament
+type Standing struct {
+	PlayerID string `json:"playerId"`
+	Name     string `json:"name"`
+	Seed     int    `json:"seed"`
+	Played   int    `json:"played"`
+	Wins     int    `json:"wins"`
+	Losses   int    `json:"losses"`
+	Draws    int    `json:"draws"`
+	Points   int    `json:"points"`
+}
+
+// the players' records, most points first, then most wins, then best seed
+func standings(t *store.Tournament) []Standing {
+	table := make([]Standing, len(t.Players))
+	index := make(map[string]int)
+	for i, p := range t.Players {
+		table[i] = Standing{PlayerID: p.ID, Name: p.Name, Seed: p.Seed}
+		index[p.ID] = i
+	}
+	for _, m := range t.Matches {
+		if m.Status != StatusFinished || m.Players[0] == "" || m.Players[1] == "" {
+			continue
+		}
+		for _, id := range m.Players {
+			s := &table[index[id]]
+			s.Played++
+			switch m.Winner {
+			case "":
+				s.Draws++
+				s.Points += pointsDraw
+			case id:
+				s.Wins++
+				s.Points += pointsWin
+			default:
+				s.Losses++
+			}
+		}
+	}
+	slices.SortStableFunc(table, func(a Standing, b Standing) int {
+		if c := cmp.Compare(b.Points, a.Points); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(b.Wins, a.Wins); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Seed, b.Seed)
+	})
+	return table
+}
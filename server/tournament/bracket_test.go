@@ -0,0 +1,286 @@
+package tournament
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/isaackoz/tronline/store"
+)
+
+// a running tournament of format between players p1 to pn, seeded in that order, with the
+// matches it starts with settled
+func newBracket(t *testing.T, format string, n int) *store.Tournament {
+	t.Helper()
+	tour := &store.Tournament{ID: "t1", Format: format, Status: StatusRunning}
+	for i := range n {
+		id := fmt.Sprintf("p%d", i+1)
+		tour.Players = append(tour.Players, store.TournamentPlayer{ID: id, Name: id, Seed: i + 1})
+	}
+	buildBracket(tour)
+	if settle(tour) {
+		t.Fatalf("%s with %d players decided before a match was played", format, n)
+	}
+	return tour
+}
+
+// plays the ready matches in bracket order, winner picks who wins each. Returns whether that
+// decided the tournament, false once nothing is ready or match until is
+func play(t *testing.T, tour *store.Tournament, until string, winner func(m *store.TournamentMatch) string) bool {
+	t.Helper()
+	for range 2 * len(tour.Matches) {
+		i := -1
+		for j := range tour.Matches {
+			if tour.Matches[j].Status == StatusReady {
+				i = j
+				break
+			}
+		}
+		if i < 0 || tour.Matches[i].ID == until {
+			return false
+		}
+		if advance(tour, &tour.Matches[i], winner(&tour.Matches[i])) || settle(tour) {
+			return true
+		}
+	}
+	t.Fatal("tournament never stopped moving on")
+	return false
+}
+
+// the better seed wins every match
+func bestSeed(tour *store.Tournament) func(m *store.TournamentMatch) string {
+	seeds := make(map[string]int)
+	for _, p := range tour.Players {
+		seeds[p.ID] = p.Seed
+	}
+	return func(m *store.TournamentMatch) string {
+		if seeds[m.Players[0]] < seeds[m.Players[1]] {
+			return m.Players[0]
+		}
+		return m.Players[1]
+	}
+}
+
+// losses of every player in the matches that were played
+func losses(tour *store.Tournament) map[string]int {
+	lost := make(map[string]int)
+	for _, m := range tour.Matches {
+		if m.Status != StatusFinished || m.Players[0] == "" || m.Players[1] == "" || m.Winner == "" {
+			continue
+		}
+		if m.Winner == m.Players[0] {
+			lost[m.Players[1]]++
+		} else {
+			lost[m.Players[0]]++
+		}
+	}
+	return lost
+}
+
+func TestSingleEliminationByes(t *testing.T) {
+	tests := []struct {
+		players int
+		// seeds that go through the first round without playing
+		byes []string
+	}{
+		{2, nil},
+		{3, []string{"p1"}},
+		{5, []string{"p1", "p2", "p3"}},
+		{6, []string{"p1", "p2"}},
+		{8, nil},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d players", tt.players), func(t *testing.T) {
+			tour := newBracket(t, FormatSingleElimination, tt.players)
+			var byes []string
+			for _, m := range tour.Matches {
+				if m.Round == 1 && m.Walkover {
+					if m.Status != StatusFinished {
+						t.Fatalf("bye %s: got status %s, want %s", m.ID, m.Status, StatusFinished)
+					}
+					byes = append(byes, m.Winner)
+				}
+			}
+			if fmt.Sprint(byes) != fmt.Sprint(tt.byes) {
+				t.Fatalf("byes: got %v, want %v", byes, tt.byes)
+			}
+
+			if !play(t, tour, "", bestSeed(tour)) {
+				t.Fatal("tournament wasn't decided")
+			}
+			if tour.Winner != "p1" {
+				t.Fatalf("winner: got %s, want p1", tour.Winner)
+			}
+			played := 0
+			for _, m := range tour.Matches {
+				if m.Status == StatusFinished && !m.Walkover {
+					played++
+				}
+			}
+			// everybody but the winner is knocked out once
+			if played != tt.players-1 {
+				t.Fatalf("matches played: got %d, want %d", played, tt.players-1)
+			}
+		})
+	}
+}
+
+func TestDoubleEliminationWalkovers(t *testing.T) {
+	for _, n := range []int{2, 3, 4, 5, 6, 7, 8, 11} {
+		t.Run(fmt.Sprintf("%d players", n), func(t *testing.T) {
+			tour := newBracket(t, FormatDoubleElimination, n)
+			if !play(t, tour, "", bestSeed(tour)) {
+				t.Fatal("tournament wasn't decided")
+			}
+			if tour.Winner != "p1" {
+				t.Fatalf("winner: got %s, want p1", tour.Winner)
+			}
+			for _, m := range tour.Matches {
+				if m.Status != StatusFinished && m.Status != StatusSkipped {
+					t.Fatalf("match %s left %s", m.ID, m.Status)
+				}
+				// a losers bracket match nobody dropped into isn't won by anybody
+				if m.Status == StatusSkipped && m.Winner != "" {
+					t.Fatalf("skipped match %s: got winner %s", m.ID, m.Winner)
+				}
+			}
+			// nobody is out before losing twice, the winner never lost
+			lost := losses(tour)
+			for _, p := range tour.Players {
+				want := 2
+				if p.ID == tour.Winner {
+					want = 0
+				}
+				if lost[p.ID] != want {
+					t.Fatalf("losses of %s: got %d, want %d", p.ID, lost[p.ID], want)
+				}
+			}
+		})
+	}
+}
+
+func TestSettledWalkover(t *testing.T) {
+	tour := newBracket(t, FormatSingleElimination, 4)
+	// p4 never showed up against p1, the organizer gives it to p1
+	m := match(tour, "W1-1")
+	if m.Players != [2]string{"p1", "p4"} {
+		t.Fatalf("W1-1 players: got %v", m.Players)
+	}
+	m.Walkover = true
+	if advance(tour, m, "p1") || settle(tour) {
+		t.Fatal("tournament decided after its first match")
+	}
+	final := match(tour, "W2-1")
+	if final.Players[0] != "p1" || final.Waiting != 1 || final.Status != StatusWaiting {
+		t.Fatalf("final: got %+v, want p1 waiting for one more player", final)
+	}
+}
+
+func TestGrandFinalReset(t *testing.T) {
+	tests := []struct {
+		name string
+		// slot of the grand final's winner, 0 came through the winners bracket
+		winnerSlot int
+		// status of the reset after the grand final
+		reset string
+	}{
+		{"winners bracket player wins", 0, StatusSkipped},
+		{"losers bracket player wins", 1, StatusReady},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tour := newBracket(t, FormatDoubleElimination, 4)
+			if play(t, tour, grandFinal, bestSeed(tour)) {
+				t.Fatal("tournament decided before the grand final")
+			}
+			gf := match(tour, grandFinal)
+			if gf.Status != StatusReady || gf.Players != [2]string{"p1", "p2"} {
+				t.Fatalf("grand final: got %s %v, want ready p1 against p2", gf.Status, gf.Players)
+			}
+
+			winner := gf.Players[tt.winnerSlot]
+			done := advance(tour, gf, winner) || settle(tour)
+			reset := match(tour, grandFinalReset)
+			if reset.Status != tt.reset {
+				t.Fatalf("reset: got status %s, want %s", reset.Status, tt.reset)
+			}
+			if tt.reset == StatusSkipped {
+				if !done || tour.Winner != winner {
+					t.Fatalf("after the grand final: got done %v winner %s, want %s", done, tour.Winner, winner)
+				}
+				return
+			}
+			if done || reset.Players != gf.Players {
+				t.Fatalf("reset: got done %v players %v, want the grand final's %v", done, reset.Players, gf.Players)
+			}
+			// the winners bracket's player lost once too now, the reset decides it
+			if !advance(tour, reset, "p1") || tour.Winner != "p1" {
+				t.Fatalf("after the reset: got winner %s, want p1", tour.Winner)
+			}
+		})
+	}
+}
+
+func TestOddRoundRobin(t *testing.T) {
+	for _, n := range []int{3, 5, 7} {
+		t.Run(fmt.Sprintf("%d players", n), func(t *testing.T) {
+			tour := newBracket(t, FormatRoundRobin, n)
+			if len(tour.Matches) != n*(n-1)/2 {
+				t.Fatalf("matches: got %d, want %d", len(tour.Matches), n*(n-1)/2)
+			}
+			pairs := make(map[[2]string]bool)
+			rounds := make(map[int]map[string]bool)
+			for _, m := range tour.Matches {
+				if m.Status != StatusReady {
+					t.Fatalf("match %s: got status %s, want %s", m.ID, m.Status, StatusReady)
+				}
+				pair := m.Players
+				if pair[0] > pair[1] {
+					pair[0], pair[1] = pair[1], pair[0]
+				}
+				if pairs[pair] {
+					t.Fatalf("%v play each other twice", pair)
+				}
+				pairs[pair] = true
+				if rounds[m.Round] == nil {
+					rounds[m.Round] = make(map[string]bool)
+				}
+				for _, p := range m.Players {
+					if rounds[m.Round][p] {
+						t.Fatalf("%s plays twice in round %d", p, m.Round)
+					}
+					rounds[m.Round][p] = true
+				}
+			}
+			// everybody sits out exactly one round
+			if len(rounds) != n {
+				t.Fatalf("rounds: got %d, want %d", len(rounds), n)
+			}
+			for round, players := range rounds {
+				if len(players) != n-1 {
+					t.Fatalf("round %d: got %d players, want %d", round, len(players), n-1)
+				}
+			}
+
+			// p1 draws everybody, the others go by seed
+			best := bestSeed(tour)
+			if !play(t, tour, "", func(m *store.TournamentMatch) string {
+				if m.Players[0] == "p1" || m.Players[1] == "p1" {
+					return ""
+				}
+				return best(m)
+			}) {
+				t.Fatal("tournament wasn't decided")
+			}
+			table := standings(tour)
+			// p2 wins all but the draw with p1
+			if tour.Winner != "p2" || table[0].PlayerID != "p2" || table[0].Points != (n-2)*pointsWin+pointsDraw {
+				t.Fatalf("standings: got winner %s, first %+v", tour.Winner, table[0])
+			}
+			for _, s := range table {
+				if s.Played != n-1 {
+					t.Fatalf("%s played %d, want %d", s.PlayerID, s.Played, n-1)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package tournament
+
+import (
+	"sync"
+
+	"github.com/isaackoz/tronline/store"
+)
+
+type EventType string
+
+const (
+	EventPlayerJoined EventType = "player-joined"
+	EventPlayerLeft   EventType = "player-left"
+	EventStarted      EventType = "started"
+	// a match's room is open, its players join it as clients
+	EventMatchReady    EventType = "match-ready"
+	EventMatchFinished EventType = "match-finished"
+	// the organizer has to settle the match
+	EventMatchStalled EventType = "match-stalled"
+	EventFinished     EventType = "finished"
+)
+
+// Event is something that happened in a tournament. Participants watch for match-ready
+// events with their id to know which room to join
+type Event struct {
+	Type         EventType `json:"type"`
+	TournamentID string    `json:"tournamentId"`
+	// player-joined and player-left only
+	PlayerID string `json:"playerId,omitempty"`
+	// match events only
+	Match *store.TournamentMatch `json:"match,omitempty"`
+	// finished only
+	Winner string `json:"winner,omitempty"`
+}
+
+// events a subscriber can fall behind on before it misses some
+const subscriberBuffer = 32
+
+// events fans a tournament's events out to its subscribers
+type events struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan Event]struct{}
+}
+
+func newEvents() *events {
+	return &events{subscribers: make(map[string]map[chan Event]struct{})}
+}
+
+// Subscribe returns the events of the tournament from now on and a func to stop them
+func (s *Service) Subscribe(tournamentID string) (<-chan Event, func()) {
+	return s.events.subscribe(tournamentID)
+}
+
+func (e *events) subscribe(tournamentID string) (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.subscribers[tournamentID] == nil {
+		e.subscribers[tournamentID] = make(map[chan Event]struct{})
+	}
+	e.subscribers[tournamentID][ch] = struct{}{}
+	return ch, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.subscribers[tournamentID], ch)
+		if len(e.subscribers[tournamentID]) == 0 {
+			delete(e.subscribers, tournamentID)
+		}
+	}
+}
+
+// sends ev to the tournament's subscribers, skipping the ones that fell behind. They catch up
+// by loading the tournament
+func (e *events) publish(ev Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for ch := range e.subscribers[ev.TournamentID] {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package tournament
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/isaackoz/tronline/identity"
+	"github.com/isaackoz/tronline/internal/httpx"
+)
+
+const (
+	// largest tournament request accepted
+	maxRequestBody = 4 * 1024
+	// how often an idle event stream gets a comment so proxies keep it open
+	keepAliveInterval = 30 * time.Second
+)
+
+// SettleRequest decides a match by hand
+type SettleRequest struct {
+	// player id of the winner, empty for a draw in a round robin
+	Winner string `json:"winner"`
+}
+
+// HandleTournaments registers the tournament endpoints. Changes need the player's identity
+// token as a bearer token:
+//
+//	POST   /tournaments                                  create one, the caller organizes it
+//	GET    /tournaments?offset=&limit=                   newest first
+//	GET    /tournaments/{id}                             the tournament with its bracket
+//	POST   /tournaments/{id}/players                     sign up
+//	DELETE /tournaments/{id}/players                     withdraw before it starts
+//	POST   /tournaments/{id}/start                       organizer only
+//	POST   /tournaments/{id}/matches/{matchId}/result    organizer only, see SettleRequest
+//	GET    /tournaments/{id}/events                      server-sent events, see Event
+//
+// When a match is ready its players join the room of the match-ready event over the
+// websocket with role=client&roomId=<room id>&token=<identity token>
+func HandleTournaments(mux *http.ServeMux, service *Service, ids *identity.Service) {
+	mux.HandleFunc("POST /tournaments", func(w http.ResponseWriter, r *http.Request) {
+		organizer, ok := ids.Require(w, r)
+		if !ok {
+			return
+		}
+		var settings Settings
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&settings); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		t, err := service.Create(r.Context(), organizer, settings)
+		if err != nil {
+			writeError(w, err, "create tournament")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		httpx.WriteJSON(w, view(t))
+	})
+
+	mux.HandleFunc("GET /tournaments", func(w http.ResponseWriter, r *http.Request) {
+		offset, limit := httpx.Pagination(r)
+		tournaments, err := service.List(r.Context(), offset, limit)
+		if err != nil {
+			writeError(w, err, "list tournaments")
+			return
+		}
+		httpx.WriteJSON(w, map[string]any{
+			"tournaments": tournaments,
+			"offset":      offset,
+			"limit":       limit,
+		})
+	})
+
+	mux.HandleFunc("GET /tournaments/{id}", func(w http.ResponseWriter, r *http.Request) {
+		v, err := service.Get(r.Context(), r.PathValue("id"))
+		if err != nil {
+			writeError(w, err, "load tournament")
+			return
+		}
+		httpx.WriteJSON(w, v)
+	})
+
+	mux.HandleFunc("POST /tournaments/{id}/players", func(w http.ResponseWriter, r *http.Request) {
+		player, ok := ids.Require(w, r)
+		if !ok {
+			return
+		}
+		v, err := service.Join(r.Context(), r.PathValue("id"), player)
+		if err != nil {
+			writeError(w, err, "join tournament")
+			return
+		}
+		httpx.WriteJSON(w, v)
+	})
+
+	mux.HandleFunc("DELETE /tournaments/{id}/players", func(w http.ResponseWriter, r *http.Request) {
+		player, ok := ids.Require(w, r)
+		if !ok {
+			return
+		}
+		v, err := service.Leave(r.Context(), r.PathValue("id"), player.ID)
+		if err != nil {
+			writeError(w, err, "leave tournament")
+			return
+		}
+		httpx.WriteJSON(w, v)
+	})
+
+	mux.HandleFunc("POST /tournaments/{id}/start", func(w http.ResponseWriter, r *http.Request) {
+		player, ok := ids.Require(w, r)
+		if !ok {
+			return
+		}
+		v, err := service.Start(r.Context(), r.PathValue("id"), player.ID)
+		if err != nil {
+			writeError(w, err, "start tournament")
+			return
+		}
+		httpx.WriteJSON(w, v)
+	})
+
+	mux.HandleFunc("POST /tournaments/{id}/matches/{matchId}/result", func(w http.ResponseWriter, r *http.Request) {
+		player, ok := ids.Require(w, r)
+		if !ok {
+			return
+		}
+		var req SettleRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&req); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		v, err := service.Settle(r.Context(), r.PathValue("id"), r.PathValue("matchId"), player.ID, req.Winner)
+		if err != nil {
+			writeError(w, err, "settle tournament match")
+			return
+		}
+		httpx.WriteJSON(w, v)
+	})
+
+	mux.HandleFunc("GET /tournaments/{id}/events", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if _, err := service.Get(r.Context(), id); err != nil {
+			writeError(w, err, "load tournament")
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		events, stop := service.Subscribe(id)
+		defer stop()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(keepAliveInterval)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			case e := <-events:
+				data, err := json.Marshal(e)
+				if err != nil {
+					slog.Debug("encode tournament event", "error", err)
+					continue
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+func writeError(w http.ResponseWriter, err error, action string) {
+	switch {
+	case errors.Is(err, ErrUnknownTournament), errors.Is(err, ErrUnknownMatch):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrInvalidSettings), errors.Is(err, ErrInvalidWinner):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrNotOrganizer):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrNotOpen), errors.Is(err, ErrNotRunning), errors.Is(err, ErrFull),
+		errors.Is(err, ErrAlreadyJoined), errors.Is(err, ErrNotJoined), errors.Is(err, ErrTooFewPlayers),
+		errors.Is(err, ErrMatchDecided):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrTooManyCreated):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	default:
+		slog.Error(action, "error", err)
+		http.Error(w, "could not "+action, http.StatusInternalServerError)
+	}
+}
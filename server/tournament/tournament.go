@@ -0,0 +1,798 @@
+// Package tournament runs single elimination, double elimination and round robin tournaments.
+// Players sign up, the organizer starts it, and every pairing gets a hosted room on the hub
+// reserved for its two players. Results of those rooms move the bracket on until there's a
+// champion
+package tournament
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/isaackoz/tronline/arena"
+	"github.com/isaackoz/tronline/bot"
+	"github.com/isaackoz/tronline/identity"
+	"github.com/isaackoz/tronline/leaderboard"
+	"github.com/isaackoz/tronline/mode"
+	"github.com/isaackoz/tronline/ratelimit"
+	"github.com/isaackoz/tronline/result"
+	"github.com/isaackoz/tronline/signaling"
+	"github.com/isaackoz/tronline/store"
+	"github.com/lithammer/shortuuid/v4"
+)
+
+// formats
+const (
+	FormatSingleElimination = "single-elimination"
+	FormatDoubleElimination = "double-elimination"
+	FormatRoundRobin        = "round-robin"
+)
+
+// statuses of a tournament
+const (
+	// players can sign up
+	StatusOpen    = "open"
+	StatusRunning = "running"
+	// also a match that's decided
+	StatusFinished = "finished"
+)
+
+// statuses of a match
+const (
+	// an earlier match still has to decide a player
+	StatusWaiting = "waiting"
+	// both players are known, the room opens once neither plays another match
+	StatusReady = "ready"
+	// the room is open
+	StatusPlaying = "playing"
+	// no result after maxRooms rooms, the organizer has to settle it
+	StatusStalled = "stalled"
+	// nobody to play it, or the grand final wasn't played again
+	StatusSkipped = "skipped"
+)
+
+var (
+	ErrUnknownTournament = errors.New("unknown tournament")
+	ErrUnknownMatch      = errors.New("unknown match")
+	ErrInvalidSettings   = errors.New("invalid tournament settings")
+	ErrNotOrganizer      = errors.New("only the organizer can do that")
+	ErrNotOpen           = errors.New("tournament already started")
+	ErrNotRunning        = errors.New("tournament isn't running")
+	ErrFull              = errors.New("tournament is full")
+	ErrAlreadyJoined     = errors.New("player already signed up")
+	ErrNotJoined         = errors.New("player didn't sign up")
+	ErrTooFewPlayers     = errors.New("tournament needs at least 2 players")
+	ErrMatchDecided      = errors.New("match is decided or its players aren't known yet")
+	ErrInvalidWinner     = errors.New("winner must be a player of the match, draws are only allowed in round robins")
+	ErrTooManyCreated    = errors.New("too many tournaments created, try again later")
+)
+
+const (
+	defaultMaxPlayers = 16
+	maxPlayers        = 64
+	maxNameLength     = 48
+	// rooms a match gets before it's stalled. Another one opens when a room closes without a
+	// result, or after a draw in elimination
+	maxRooms = 3
+	// how often closed rooms are noticed and waiting matches are scheduled
+	sweepInterval = 15 * time.Second
+	// tournaments loaded per page when restoring the running ones
+	restorePage = 100
+	// tournaments a player can create per day
+	createdPerDay = 5
+	// tournaments nobody changed for this long and without a room are dropped from memory,
+	// they're loaded again on their next change
+	idleTimeout = 30 * time.Minute
+)
+
+// Settings are what the organizer picks when creating a tournament
+type Settings struct {
+	Name   string `json:"name"`
+	Format string `json:"format"`
+	// duel or teams. Defaults to a single round duel
+	Game     mode.Mode `json:"game"`
+	Arena    string    `json:"arena,omitempty"`
+	PowerUps bool      `json:"powerUps,omitempty"`
+	Ranked   bool      `json:"ranked,omitempty"`
+	// defaults to 16
+	MaxPlayers int `json:"maxPlayers,omitempty"`
+}
+
+// View is a tournament as the web app shows it
+type View struct {
+	*store.Tournament
+	// round robin only, best first
+	Standings []Standing `json:"standings,omitempty"`
+}
+
+// Service runs the tournaments. Open and running ones are kept in memory while they're in
+// use and saved after every change, they're picked up again on restart
+type Service struct {
+	rootCtx     context.Context
+	hub         *signaling.Hub
+	tournaments store.TournamentStore
+	ratings     store.RatingStore
+	events      *events
+	created     *ratelimit.Keyed
+
+	// guards the maps only, changes to a tournament are serialized by its own lock so saving
+	// it and opening rooms don't hold up the others
+	mu     sync.Mutex
+	active map[string]*activeTournament
+	// every room opened for a match that isn't decided yet
+	rooms map[string]roomMatch
+	// players of rooms opened by changes that aren't saved yet, by tournament
+	reserved map[string]string
+	// events of the changes being made by tournament, sent once they're saved
+	pending map[string][]Event
+}
+
+// a tournament in memory
+type activeTournament struct {
+	// held while a change is made and saved
+	mu sync.Mutex
+	// the saved tournament, replaced by every change. Guarded by Service.mu
+	t *store.Tournament
+	// when it last changed. Guarded by Service.mu
+	changed time.Time
+}
+
+type roomMatch struct {
+	tournament string
+	match      string
+}
+
+// New creates the service. Rooms of matches run until rootCtx is done
+func New(rootCtx context.Context, hub *signaling.Hub, tournaments store.TournamentStore, ratings store.RatingStore) *Service {
+	return &Service{
+		rootCtx:     rootCtx,
+		hub:         hub,
+		tournaments: tournaments,
+		ratings:     ratings,
+		events:      newEvents(),
+		created:     ratelimit.NewKeyed(createdPerDay, 24*time.Hour),
+		active:      make(map[string]*activeTournament),
+		rooms:       make(map[string]roomMatch),
+		reserved:    make(map[string]string),
+		pending:     make(map[string][]Event),
+	}
+}
+
+// Run restores the tournaments that were open or running and reopens rooms that closed
+// without a result until ctx is done
+func (s *Service) Run(ctx context.Context) {
+	if err := s.restore(ctx); err != nil {
+		slog.Error("restore tournaments", "error", err)
+	}
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sweep(ctx)
+		}
+	}
+}
+
+func (s *Service) restore(ctx context.Context) error {
+	for offset := 0; ; offset += restorePage {
+		page, err := s.tournaments.List(ctx, offset, restorePage)
+		if err != nil {
+			return fmt.Errorf("list tournaments: %w", err)
+		}
+		s.mu.Lock()
+		for _, t := range page {
+			if _, ok := s.active[t.ID]; !ok && t.Status != StatusFinished {
+				s.active[t.ID] = &activeTournament{t: t, changed: time.Now()}
+				slog.Debug("restored tournament", "tournament_id", t.ID, "status", t.Status)
+			}
+		}
+		s.mu.Unlock()
+		if len(page) < restorePage {
+			return nil
+		}
+	}
+}
+
+// the rooms of matches in memory are gone after a restart, and rooms expire when nobody
+// finishes the match. Either way the match gets a new room
+func (s *Service) sweep(ctx context.Context) {
+	s.evict(time.Now())
+	s.mu.Lock()
+	var ids []string
+	for id, a := range s.active {
+		if a.t.Status == StatusRunning {
+			ids = append(ids, id)
+		}
+	}
+	s.mu.Unlock()
+	for _, id := range ids {
+		_, err := s.update(ctx, id, func(t *store.Tournament) error {
+			changed := false
+			for i := range t.Matches {
+				m := &t.Matches[i]
+				if m.Status != StatusPlaying {
+					continue
+				}
+				if _, open := s.hub.GetRoom(m.RoomID); !open {
+					slog.Debug("tournament room closed without a result", "tournament_id", t.ID, "match_id", m.ID, "room_id", m.RoomID)
+					s.reopen(t, m)
+					changed = true
+				}
+			}
+			if s.schedule(t) {
+				changed = true
+			}
+			if !changed {
+				return errUnchanged
+			}
+			return nil
+		})
+		if err != nil {
+			slog.Error("sweep tournament", "error", err, "tournament_id", id)
+		}
+	}
+}
+
+// drops the tournaments from memory that nobody changed for idleTimeout and whose players
+// have no room to play in
+func (s *Service) evict(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inRoom := make(map[string]bool)
+	for roomID, ref := range s.rooms {
+		// a closed room can't send a result anymore
+		if _, open := s.hub.GetRoom(roomID); !open {
+			delete(s.rooms, roomID)
+			continue
+		}
+		inRoom[ref.tournament] = true
+	}
+	for id, a := range s.active {
+		if inRoom[id] || now.Sub(a.changed) < idleTimeout || slices.ContainsFunc(a.t.Matches, func(m store.TournamentMatch) bool {
+			return m.Status == StatusReady || m.Status == StatusPlaying
+		}) {
+			continue
+		}
+		// being changed right now
+		if !a.mu.TryLock() {
+			continue
+		}
+		delete(s.active, id)
+		a.mu.Unlock()
+		slog.Debug("evicted idle tournament", "tournament_id", id, "status", a.t.Status)
+	}
+}
+
+// errUnchanged tells update there's nothing to save
+var errUnchanged = errors.New("unchanged")
+
+// update applies change to a copy of an open or running tournament and saves it, one change
+// per tournament at a time. The events change published are sent once it's saved
+func (s *Service) update(ctx context.Context, id string, change func(t *store.Tournament) error) (*store.Tournament, error) {
+	for {
+		a, err := s.load(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		a.mu.Lock()
+		s.mu.Lock()
+		evicted := s.active[id] != a
+		s.mu.Unlock()
+		if evicted {
+			// evicted before the lock was ours, load it again
+			a.mu.Unlock()
+			continue
+		}
+		t, err := s.apply(ctx, a, change)
+		a.mu.Unlock()
+		return t, err
+	}
+}
+
+// the open or running tournament in memory, loaded from the store if it isn't
+func (s *Service) load(ctx context.Context, id string) (*activeTournament, error) {
+	s.mu.Lock()
+	a, ok := s.active[id]
+	s.mu.Unlock()
+	if ok {
+		return a, nil
+	}
+	t, err := s.tournaments.Load(ctx, id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrUnknownTournament
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load tournament: %w", err)
+	}
+	if t.Status == StatusFinished {
+		return nil, ErrNotRunning
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.active[id]; ok {
+		// somebody else loaded it meanwhile
+		return a, nil
+	}
+	a = &activeTournament{t: t, changed: time.Now()}
+	s.active[id] = a
+	return a, nil
+}
+
+// makes a change to a. must hold a.mu
+func (s *Service) apply(ctx context.Context, a *activeTournament, change func(t *store.Tournament) error) (*store.Tournament, error) {
+	s.mu.Lock()
+	current := a.t
+	s.mu.Unlock()
+	t := current.Clone()
+	err := change(t)
+	if err == nil {
+		err = s.tournaments.Save(ctx, t)
+		if err != nil {
+			err = fmt.Errorf("save tournament: %w", err)
+		}
+	}
+
+	s.mu.Lock()
+	events := s.pending[t.ID]
+	delete(s.pending, t.ID)
+	for player, id := range s.reserved {
+		if id == t.ID {
+			delete(s.reserved, player)
+		}
+	}
+	if err != nil {
+		s.mu.Unlock()
+		if errors.Is(err, errUnchanged) {
+			return current.Clone(), nil
+		}
+		return nil, err
+	}
+	if t.Status == StatusFinished {
+		delete(s.active, t.ID)
+		for roomID, ref := range s.rooms {
+			if ref.tournament == t.ID {
+				delete(s.rooms, roomID)
+			}
+		}
+	} else {
+		a.t, a.changed = t, time.Now()
+	}
+	s.mu.Unlock()
+	for _, e := range events {
+		s.events.publish(e)
+	}
+	return t.Clone(), nil
+}
+
+// must hold t's lock
+func (s *Service) publish(t *store.Tournament, e Event) {
+	e.TournamentID = t.ID
+	s.mu.Lock()
+	s.pending[t.ID] = append(s.pending[t.ID], e)
+	s.mu.Unlock()
+}
+
+// Create opens a tournament for players to sign up to
+func (s *Service) Create(ctx context.Context, organizer *identity.Identity, settings Settings) (*store.Tournament, error) {
+	t, err := newTournament(settings)
+	if err != nil {
+		return nil, err
+	}
+	if !s.created.Allow(organizer.ID) {
+		return nil, ErrTooManyCreated
+	}
+	t.OrganizerID = organizer.ID
+	if err := s.tournaments.Save(ctx, t); err != nil {
+		return nil, fmt.Errorf("save tournament: %w", err)
+	}
+	s.mu.Lock()
+	s.active[t.ID] = &activeTournament{t: t.Clone(), changed: time.Now()}
+	s.mu.Unlock()
+	slog.Info("tournament created", "tournament_id", t.ID, "name", t.Name, "format", t.Format, "organizer_id", t.OrganizerID)
+	return t, nil
+}
+
+func newTournament(settings Settings) (*store.Tournament, error) {
+	name := strings.TrimSpace(settings.Name)
+	if name == "" || utf8.RuneCountInString(name) > maxNameLength || strings.IndexFunc(name, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+		return nil, fmt.Errorf("%w: name must be 1 to %d printable characters", ErrInvalidSettings, maxNameLength)
+	}
+	switch settings.Format {
+	case FormatSingleElimination, FormatDoubleElimination, FormatRoundRobin:
+	default:
+		return nil, fmt.Errorf("%w: format must be %s, %s or %s", ErrInvalidSettings, FormatSingleElimination, FormatDoubleElimination, FormatRoundRobin)
+	}
+	game := settings.Game
+	if game.Kind == "" {
+		game = mode.Default
+	}
+	if err := game.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSettings, err)
+	}
+	// the two players have to be on different sides, and a bot can't win it for them
+	if game.Kind != mode.KindDuel && game.Kind != mode.KindTeams {
+		return nil, fmt.Errorf("%w: tournaments are played in %s or %s", ErrInvalidSettings, mode.KindDuel, mode.KindTeams)
+	}
+	if settings.Arena == "" {
+		settings.Arena = arena.Default
+	}
+	a, err := arena.Resolve(settings.Arena, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSettings, err)
+	}
+	if _, err := a.Settings(game.Players()); err != nil {
+		return nil, fmt.Errorf("%w: arena %s can't be played in %s: %w", ErrInvalidSettings, a.Name, game.Kind, err)
+	}
+	if settings.MaxPlayers == 0 {
+		settings.MaxPlayers = defaultMaxPlayers
+	}
+	if settings.MaxPlayers < 2 || settings.MaxPlayers > maxPlayers {
+		return nil, fmt.Errorf("%w: max players must be between 2 and %d", ErrInvalidSettings, maxPlayers)
+	}
+	return &store.Tournament{
+		ID:         shortuuid.New(),
+		Name:       name,
+		Format:     settings.Format,
+		Status:     StatusOpen,
+		Game:       game,
+		Arena:      settings.Arena,
+		PowerUps:   settings.PowerUps,
+		Ranked:     settings.Ranked,
+		MaxPlayers: settings.MaxPlayers,
+		Players:    []store.TournamentPlayer{},
+		Matches:    []store.TournamentMatch{},
+		CreatedAt:  time.Now(),
+	}, nil
+}
+
+// Get returns a tournament with its bracket
+func (s *Service) Get(ctx context.Context, id string) (*View, error) {
+	var t *store.Tournament
+	s.mu.Lock()
+	a, ok := s.active[id]
+	if ok {
+		t = a.t.Clone()
+	}
+	s.mu.Unlock()
+	if !ok {
+		var err error
+		t, err = s.tournaments.Load(ctx, id)
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, ErrUnknownTournament
+		}
+		if err != nil {
+			return nil, fmt.Errorf("load tournament: %w", err)
+		}
+	}
+	return view(t), nil
+}
+
+func view(t *store.Tournament) *View {
+	v := &View{Tournament: t}
+	if t.Format == FormatRoundRobin && t.Status != StatusOpen {
+		v.Standings = standings(t)
+	}
+	return v
+}
+
+// List returns tournaments, newest first
+func (s *Service) List(ctx context.Context, offset int, limit int) ([]*store.Tournament, error) {
+	tournaments, err := s.tournaments.List(ctx, offset, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list tournaments: %w", err)
+	}
+	return tournaments, nil
+}
+
+// Join signs the player up to an open tournament
+func (s *Service) Join(ctx context.Context, id string, player *identity.Identity) (*View, error) {
+	t, err := s.update(ctx, id, func(t *store.Tournament) error {
+		if t.Status != StatusOpen {
+			return ErrNotOpen
+		}
+		if slices.ContainsFunc(t.Players, func(p store.TournamentPlayer) bool { return p.ID == player.ID }) {
+			return ErrAlreadyJoined
+		}
+		if len(t.Players) >= t.MaxPlayers {
+			return ErrFull
+		}
+		t.Players = append(t.Players, store.TournamentPlayer{ID: player.ID, Name: player.Name, JoinedAt: time.Now()})
+		s.publish(t, Event{Type: EventPlayerJoined, PlayerID: player.ID})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return view(t), nil
+}
+
+// Leave takes the player off an open tournament
+func (s *Service) Leave(ctx context.Context, id string, playerID string) (*View, error) {
+	t, err := s.update(ctx, id, func(t *store.Tournament) error {
+		if t.Status != StatusOpen {
+			return ErrNotOpen
+		}
+		i := slices.IndexFunc(t.Players, func(p store.TournamentPlayer) bool { return p.ID == playerID })
+		if i < 0 {
+			return ErrNotJoined
+		}
+		t.Players = slices.Delete(t.Players, i, i+1)
+		s.publish(t, Event{Type: EventPlayerLeft, PlayerID: playerID})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return view(t), nil
+}
+
+// Start seeds the players, builds the bracket and opens the rooms of the first matches
+func (s *Service) Start(ctx context.Context, id string, playerID string) (*View, error) {
+	t, err := s.update(ctx, id, func(t *store.Tournament) error {
+		if t.OrganizerID != playerID {
+			return ErrNotOrganizer
+		}
+		if t.Status != StatusOpen {
+			return ErrNotOpen
+		}
+		if len(t.Players) < 2 {
+			return ErrTooFewPlayers
+		}
+		s.seed(ctx, t)
+		buildBracket(t)
+		t.Status, t.StartedAt = StatusRunning, time.Now()
+		s.publish(t, Event{Type: EventStarted})
+		s.progress(t)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("tournament started", "tournament_id", t.ID, "players", len(t.Players), "matches", len(t.Matches))
+	return view(t), nil
+}
+
+// orders the players by their all-time rating, the unrated ones after the rated ones in
+// sign up order
+func (s *Service) seed(ctx context.Context, t *store.Tournament) {
+	ratings := make(map[string]int)
+	for _, p := range t.Players {
+		r, err := s.ratings.Load(ctx, string(leaderboard.WindowAllTime), p.ID)
+		if err == nil {
+			ratings[p.ID] = r.Rating
+		} else if !errors.Is(err, store.ErrNotFound) {
+			slog.Error("load rating for seeding", "error", err, "tournament_id", t.ID, "player_id", p.ID)
+		}
+	}
+	slices.SortStableFunc(t.Players, func(a store.TournamentPlayer, b store.TournamentPlayer) int {
+		ra, rated := ratings[a.ID]
+		rb, ratedB := ratings[b.ID]
+		if rated != ratedB {
+			if rated {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(rb, ra)
+	})
+	for i := range t.Players {
+		t.Players[i].Seed = i + 1
+	}
+}
+
+// Settle decides a match that isn't decided yet, i.e. when a player never showed up. winner
+// is a player of the match, empty for a draw in a round robin
+func (s *Service) Settle(ctx context.Context, id string, matchID string, playerID string, winner string) (*View, error) {
+	t, err := s.update(ctx, id, func(t *store.Tournament) error {
+		if t.OrganizerID != playerID {
+			return ErrNotOrganizer
+		}
+		if t.Status != StatusRunning {
+			return ErrNotRunning
+		}
+		m := match(t, matchID)
+		if m == nil {
+			return ErrUnknownMatch
+		}
+		if !undecided(m) {
+			return ErrMatchDecided
+		}
+		if winner != m.Players[0] && winner != m.Players[1] && (winner != "" || t.Format != FormatRoundRobin) {
+			return ErrInvalidWinner
+		}
+		m.Walkover = true
+		s.finish(t, m, winner)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("tournament match settled", "tournament_id", id, "match_id", matchID, "winner", winner)
+	return view(t), nil
+}
+
+// Record moves the bracket on with the result of a tournament room's match. Other results
+// are ignored. Meant for result.Config.Recorded
+func (s *Service) Record(ctx context.Context, r *result.Result) {
+	s.mu.Lock()
+	ref, ok := s.rooms[r.RoomID]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	_, err := s.update(ctx, ref.tournament, func(t *store.Tournament) error {
+		m := match(t, ref.match)
+		if m == nil || !undecided(m) {
+			return errUnchanged
+		}
+		if r.Status != result.StatusConfirmed || len(r.Players) < 2 || r.Players[0] != m.Players[0] || r.Players[1] != m.Players[1] {
+			slog.Warn("tournament room result doesn't fit its match", "tournament_id", t.ID, "match_id", m.ID, "result_id", r.ID, "status", r.Status, "players", r.Players)
+			return errUnchanged
+		}
+		winner := ""
+		sides := mode.Mode{Kind: r.Mode}
+		for i, id := range m.Players {
+			if sides.Side(i) == r.Winner {
+				winner = id
+			}
+		}
+		if winner == "" && t.Format != FormatRoundRobin {
+			// somebody has to go through, play it again
+			s.reopen(t, m)
+			s.schedule(t)
+			return nil
+		}
+		m.ResultID, m.Scores = r.ID, slices.Clone(r.Scores)
+		s.finish(t, m, winner)
+		return nil
+	})
+	if err != nil {
+		slog.Error("record tournament match", "error", err, "tournament_id", ref.tournament, "match_id", ref.match, "result_id", r.ID)
+	}
+}
+
+// whether m's players are known and it isn't decided yet
+func undecided(m *store.TournamentMatch) bool {
+	return m.Status == StatusReady || m.Status == StatusPlaying || m.Status == StatusStalled
+}
+
+// decides m and moves the tournament on. must hold t's lock
+func (s *Service) finish(t *store.Tournament, m *store.TournamentMatch, winner string) {
+	m.RoomID, m.FinishedAt = "", time.Now()
+	s.mu.Lock()
+	for roomID, ref := range s.rooms {
+		if ref.tournament == t.ID && ref.match == m.ID {
+			delete(s.rooms, roomID)
+		}
+	}
+	s.mu.Unlock()
+	done := advance(t, m, winner)
+	s.publish(t, Event{Type: EventMatchFinished, Match: matchCopy(m)})
+	slog.Debug("tournament match finished", "tournament_id", t.ID, "match_id", m.ID, "winner", winner)
+	if done {
+		s.complete(t)
+		return
+	}
+	s.progress(t)
+}
+
+// settles the matches that can be and opens rooms for the ready ones. must hold t's lock
+func (s *Service) progress(t *store.Tournament) {
+	if settle(t) {
+		s.complete(t)
+		return
+	}
+	s.schedule(t)
+}
+
+// must hold t's lock
+func (s *Service) complete(t *store.Tournament) {
+	t.Status, t.FinishedAt = StatusFinished, time.Now()
+	for i := range t.Matches {
+		// matches nobody will play anymore
+		if m := &t.Matches[i]; m.Status != StatusFinished {
+			m.Status = StatusSkipped
+		}
+	}
+	s.publish(t, Event{Type: EventFinished, Winner: t.Winner})
+	slog.Info("tournament finished", "tournament_id", t.ID, "winner", t.Winner)
+}
+
+// opens rooms for the ready matches whose players aren't playing another match, in bracket
+// order. Returns whether it opened any. must hold t's lock
+func (s *Service) schedule(t *store.Tournament) bool {
+	// the players are reserved until the change is saved, so other tournaments don't pair
+	// them meanwhile
+	var ready []*store.TournamentMatch
+	s.mu.Lock()
+	busy := make(map[string]bool)
+	for id, other := range s.active {
+		if id != t.ID {
+			playing(other.t, busy)
+		}
+	}
+	for player, id := range s.reserved {
+		if id != t.ID {
+			busy[player] = true
+		}
+	}
+	playing(t, busy)
+	for i := range t.Matches {
+		m := &t.Matches[i]
+		if m.Status != StatusReady || busy[m.Players[0]] || busy[m.Players[1]] {
+			continue
+		}
+		ready = append(ready, m)
+		busy[m.Players[0]], busy[m.Players[1]] = true, true
+		s.reserved[m.Players[0]], s.reserved[m.Players[1]] = t.ID, t.ID
+	}
+	s.mu.Unlock()
+	for _, m := range ready {
+		s.open(t, m)
+	}
+	return len(ready) > 0
+}
+
+// adds the players of t's matches being played to busy
+func playing(t *store.Tournament, busy map[string]bool) {
+	for _, m := range t.Matches {
+		if m.Status == StatusPlaying {
+			busy[m.Players[0]], busy[m.Players[1]] = true, true
+		}
+	}
+}
+
+// opens a hosted room only m's players can join. must hold t's lock
+func (s *Service) open(t *store.Tournament, m *store.TournamentMatch) {
+	room := s.hub.OpenRoom(s.rootCtx, signaling.RoomSettings{
+		Mode:          signaling.RoomModeHosted,
+		Arena:         t.Arena,
+		Seed:          rand.Uint32(),
+		Game:          t.Game,
+		BotDifficulty: bot.DifficultyMedium,
+		PowerUps:      t.PowerUps,
+		Ranked:        t.Ranked,
+		Players:       slices.Clone(m.Players[:]),
+	})
+	m.Status, m.RoomID = StatusPlaying, room.ID
+	m.Rooms++
+	if m.StartedAt.IsZero() {
+		m.StartedAt = time.Now()
+	}
+	s.mu.Lock()
+	s.rooms[room.ID] = roomMatch{tournament: t.ID, match: m.ID}
+	s.mu.Unlock()
+	s.publish(t, Event{Type: EventMatchReady, Match: matchCopy(m)})
+	slog.Debug("tournament room opened", "tournament_id", t.ID, "match_id", m.ID, "room_id", room.ID, "players", m.Players)
+}
+
+// gives m another room on the next schedule, or stalls it once it had maxRooms. Rooms it
+// had keep counting until it's decided, a late result still settles it. must hold t's lock
+func (s *Service) reopen(t *store.Tournament, m *store.TournamentMatch) {
+	m.RoomID = ""
+	if m.Rooms >= maxRooms {
+		m.Status = StatusStalled
+		s.publish(t, Event{Type: EventMatchStalled, Match: matchCopy(m)})
+		slog.Info("tournament match stalled", "tournament_id", t.ID, "match_id", m.ID, "rooms", m.Rooms)
+		return
+	}
+	m.Status = StatusReady
+}
+
+func matchCopy(m *store.TournamentMatch) *store.TournamentMatch {
+	c := *m
+	c.Scores = slices.Clone(m.Scores)
+	return &c
+}
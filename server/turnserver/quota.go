@@ -0,0 +1,160 @@
+package turnserver
+
+import (
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/isaackoz/tronline/ratelimit"
+	"github.com/pion/turn/v4"
+)
+
+// how long a slot allow reserved waits for its allocation. The allocation is created right
+// after allow, so a reservation still there after this failed
+const reservationTimeout = 5 * time.Second
+
+// quotas tracks allocations and bandwidth per user
+type quotas struct {
+	bandwidth      int
+	maxAllocations int
+
+	mu          sync.Mutex
+	allocations map[string]int
+	// slots allow handed out whose allocation isn't created yet, by when they were
+	reserved map[string][]time.Time
+	buckets  map[string]*ratelimit.Bucket
+	// relay conns by local address, so OnAllocationCreated can attach the user's bucket
+	relays map[string]*limitedPacketConn
+}
+
+func newQuotas(bandwidth int, maxAllocations int) *quotas {
+	return &quotas{
+		bandwidth:      bandwidth,
+		maxAllocations: maxAllocations,
+		allocations:    make(map[string]int),
+		reserved:       make(map[string][]time.Time),
+		buckets:        make(map[string]*ratelimit.Bucket),
+		relays:         make(map[string]*limitedPacketConn),
+	}
+}
+
+// rejects new allocations once the user hit their allocation quota, otherwise reserves a
+// slot for the allocation so concurrent ones can't go over it. The slot is taken by
+// OnAllocationCreated, or given back after reservationTimeout if creating it failed
+func (q *quotas) allow(username string, realm string, srcAddr net.Addr) bool {
+	if q.maxAllocations <= 0 {
+		return true
+	}
+	user := userFromUsername(username)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	reserved := q.release(user, time.Now())
+	if q.allocations[user]+len(reserved) >= q.maxAllocations {
+		slog.Warn("turn allocation quota exceeded", "user", user, "remote_addr", srcAddr.String())
+		return false
+	}
+	q.reserved[user] = append(reserved, time.Now())
+	return true
+}
+
+// drops the user's reservations older than reservationTimeout and returns the others.
+// must hold q.mu
+func (q *quotas) release(user string, now time.Time) []time.Time {
+	reserved := q.reserved[user]
+	for len(reserved) > 0 && now.Sub(reserved[0]) > reservationTimeout {
+		reserved = reserved[1:]
+	}
+	if len(reserved) == 0 {
+		delete(q.reserved, user)
+		return nil
+	}
+	q.reserved[user] = reserved
+	return reserved
+}
+
+func (q *quotas) eventHandler() turn.EventHandler {
+	return turn.EventHandler{
+		OnAllocationCreated: func(srcAddr, dstAddr net.Addr, protocol, username, realm string, relayAddr net.Addr, requestedPort int) {
+			user := userFromUsername(username)
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			// the allocation takes the slot allow reserved for it
+			if reserved := q.release(user, time.Now()); len(reserved) > 0 {
+				q.reserved[user] = reserved[1:]
+			}
+			q.allocations[user]++
+			bucket, ok := q.buckets[user]
+			if !ok {
+				// one second worth of burst
+				bucket = ratelimit.NewBucket(q.bandwidth, q.bandwidth)
+				q.buckets[user] = bucket
+			}
+			if conn, ok := q.relays[relayKey(relayAddr)]; ok {
+				conn.bucket.Store(bucket)
+			}
+			slog.Debug("turn allocation created", "user", user, "protocol", protocol, "relay_addr", relayAddr.String())
+		},
+		OnAllocationDeleted: func(srcAddr, dstAddr net.Addr, protocol, username, realm string) {
+			user := userFromUsername(username)
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.allocations[user]--
+			if q.allocations[user] <= 0 {
+				delete(q.allocations, user)
+				delete(q.buckets, user)
+			}
+			slog.Debug("turn allocation deleted", "user", user, "protocol", protocol)
+		},
+	}
+}
+
+func (q *quotas) wrap(conn net.PacketConn) net.PacketConn {
+	limited := &limitedPacketConn{PacketConn: conn, quotas: q}
+	q.mu.Lock()
+	q.relays[relayKey(conn.LocalAddr())] = limited
+	q.mu.Unlock()
+	return limited
+}
+
+// relay conns listen on 0.0.0.0 but are advertised on the public ip, so match on the port only
+func relayKey(addr net.Addr) string {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return strconv.Itoa(udpAddr.Port)
+	}
+	return addr.String()
+}
+
+// limitedPacketConn drops relayed packets once its user ran out of bandwidth
+type limitedPacketConn struct {
+	net.PacketConn
+	quotas *quotas
+	bucket atomic.Pointer[ratelimit.Bucket]
+}
+
+func (c *limitedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.bucket.Load().Allow(n) {
+			return n, addr, err
+		}
+		// over quota, drop the packet from the peer
+	}
+}
+
+func (c *limitedPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.bucket.Load().Allow(len(p)) {
+		// over quota, pretend it was sent. udp is lossy anyway
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *limitedPacketConn) Close() error {
+	c.quotas.mu.Lock()
+	delete(c.quotas.relays, relayKey(c.PacketConn.LocalAddr()))
+	c.quotas.mu.Unlock()
+	return c.PacketConn.Close()
+}
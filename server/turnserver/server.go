@@ -0,0 +1,185 @@
+// Package turnserver runs an embedded TURN relay (pion/turn) for players behind symmetric NAT.
+// Credentials use the TURN REST API scheme (same as coturn's use-auth-secret), so the ICE
+// provider hands out time limited credentials without the server keeping any state.
+// Clients reach the server over udp or tcp, the relayed traffic to the peer is always udp:
+// pion doesn't do TCP allocations (RFC 6062), and browsers only ask for udp ones anyway
+package turnserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/pion/turn/v4"
+)
+
+type Config struct {
+	// udp address to listen on, i.e. ":3478". Empty disables the udp listener
+	UDPAddr string
+	// tcp address to listen on, i.e. ":3478", for clients that can't use udp. Their
+	// allocations still relay over udp. Empty disables the tcp listener
+	TCPAddr string
+	// realm used for the long-term credentials
+	Realm string
+	// shared secret for the TURN REST API credentials
+	Secret string
+	// public ip handed out as the relay address
+	PublicIP net.IP
+	// relay ports are allocated in [RelayPortMin, RelayPortMax]
+	RelayPortMin uint16
+	RelayPortMax uint16
+	// relayed bytes per second per user, in both directions. 0 means unlimited
+	UserBandwidth int
+	// concurrent allocations per user. 0 means unlimited
+	UserAllocations int
+}
+
+type Server struct {
+	config Config
+	turn   *turn.Server
+	quotas *quotas
+	// the addresses the listeners got, set by Start
+	udpAddr net.Addr
+	tcpAddr net.Addr
+}
+
+func NewServer(config Config) (*Server, error) {
+	if config.UDPAddr == "" && config.TCPAddr == "" {
+		return nil, errors.New("turn server needs a udp or tcp address")
+	}
+	if config.Secret == "" {
+		return nil, errors.New("turn server secret is empty")
+	}
+	if config.PublicIP == nil {
+		return nil, errors.New("turn server public ip is empty")
+	}
+	return &Server{
+		config: config,
+		quotas: newQuotas(config.UserBandwidth, config.UserAllocations),
+	}, nil
+}
+
+// Start opens the listeners and starts relaying. The server is closed once ctx is done
+func (s *Server) Start(ctx context.Context) error {
+	var packetConfigs []turn.PacketConnConfig
+	var listenerConfigs []turn.ListenerConfig
+
+	if s.config.UDPAddr != "" {
+		conn, err := net.ListenPacket("udp4", s.config.UDPAddr)
+		if err != nil {
+			return fmt.Errorf("listen udp: %w", err)
+		}
+		s.udpAddr = conn.LocalAddr()
+		packetConfigs = append(packetConfigs, turn.PacketConnConfig{
+			PacketConn:            conn,
+			RelayAddressGenerator: s.relayGenerator(),
+		})
+	}
+	if s.config.TCPAddr != "" {
+		listener, err := net.Listen("tcp4", s.config.TCPAddr)
+		if err != nil {
+			for _, c := range packetConfigs {
+				c.PacketConn.Close()
+			}
+			return fmt.Errorf("listen tcp: %w", err)
+		}
+		s.tcpAddr = listener.Addr()
+		listenerConfigs = append(listenerConfigs, turn.ListenerConfig{
+			Listener:              listener,
+			RelayAddressGenerator: s.relayGenerator(),
+		})
+	}
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:             s.config.Realm,
+		AuthHandler:       turn.LongTermTURNRESTAuthHandler(s.config.Secret, nil),
+		QuotaHandler:      s.quotas.allow,
+		EventHandler:      s.quotas.eventHandler(),
+		PacketConnConfigs: packetConfigs,
+		ListenerConfigs:   listenerConfigs,
+	})
+	if err != nil {
+		for _, c := range packetConfigs {
+			c.PacketConn.Close()
+		}
+		for _, c := range listenerConfigs {
+			c.Listener.Close()
+		}
+		return fmt.Errorf("create turn server: %w", err)
+	}
+	s.turn = server
+	udpPort, tcpPort := s.Ports()
+	slog.Info("turn server listening",
+		"udp_port", udpPort,
+		"tcp_port", tcpPort,
+		"public_ip", s.config.PublicIP.String(),
+		"relay_ports", fmt.Sprintf("%d-%d", s.config.RelayPortMin, s.config.RelayPortMax),
+	)
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Close(); err != nil {
+			slog.Error("close turn server", "error", err)
+		}
+		slog.Info("turn server stopped")
+	}()
+	return nil
+}
+
+// Ports returns the ports the listeners are bound to, empty if the transport is disabled.
+// Only set once Start succeeded
+func (s *Server) Ports() (udp string, tcp string) {
+	if s.udpAddr != nil {
+		_, udp, _ = net.SplitHostPort(s.udpAddr.String())
+	}
+	if s.tcpAddr != nil {
+		_, tcp, _ = net.SplitHostPort(s.tcpAddr.String())
+	}
+	return udp, tcp
+}
+
+// AllocationCount returns the number of active allocations
+func (s *Server) AllocationCount() int {
+	if s.turn == nil {
+		return 0
+	}
+	return s.turn.AllocationCount()
+}
+
+func (s *Server) relayGenerator() turn.RelayAddressGenerator {
+	return &limitedRelayGenerator{
+		RelayAddressGenerator: &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: s.config.PublicIP,
+			Address:      "0.0.0.0",
+			MinPort:      s.config.RelayPortMin,
+			MaxPort:      s.config.RelayPortMax,
+		},
+		quotas: s.quotas,
+	}
+}
+
+// TURN REST usernames are "<expiry>:<user>", the quotas are per user
+func userFromUsername(username string) string {
+	if _, user, ok := strings.Cut(username, ":"); ok {
+		return user
+	}
+	return username
+}
+
+// limitedRelayGenerator wraps the relay connections so the bandwidth quota of the
+// allocation's user can be applied once the allocation is created
+type limitedRelayGenerator struct {
+	turn.RelayAddressGenerator
+	quotas *quotas
+}
+
+func (g *limitedRelayGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, addr, err := g.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	return g.quotas.wrap(conn), addr, nil
+}
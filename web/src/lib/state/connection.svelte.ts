@@ -5,6 +5,8 @@ import {
 	type ICECandidateMessage,
 	type Message,
 	type OfferMessage,
+	type RelayRequestMessage,
+	type RelayStartMessage,
 	type WebRTCConnectedMessage
 } from '$lib/types/message';
 import { getContext, setContext } from 'svelte';
@@ -24,10 +26,14 @@ interface ConnectionStateConfig {
 	onOpen?: () => void;
 	onError?: (error: unknown) => void;
 	onClose?: () => void;
+	// called once game messages can be sent, over WebRTC or the server relay
 	onWebRTCReady?: () => void;
 	onGameMessage?: (data: unknown) => void;
 }
 
+// how long WebRTC gets to open the data channel before falling back to the server relay
+const WEBRTC_TIMEOUT = 10000;
+
 export class ConnectionState {
 	// private state
 	#ws: WebSocket | null = $state(null);
@@ -39,6 +45,8 @@ export class ConnectionState {
 	#role: 'host' | 'client' | null = null;
 	#pc: RTCPeerConnection | null = null;
 	#dataChannel: RTCDataChannel | null = null;
+	#webrtcTimeout: number | null = null;
+	#relayStart: RelayStartMessage | null = null;
 
 	// All of the following are public reactive (runes) state
 	roomId = $state<string | null>(null);
@@ -51,6 +59,8 @@ export class ConnectionState {
 	isGuestConnected = $state(false);
 	isWebRTCConnected = $state(false);
 	isP2PConnecting = $state(false);
+	// game messages go through the signaling websocket because WebRTC could not connect
+	isRelaying = $state(false);
 
 	// private event callbacks
 	#onOpenCallback?: () => void;
@@ -80,6 +90,8 @@ export class ConnectionState {
 		this.connectionError = null;
 		this.isGuestConnected = false;
 		this.isWebRTCConnected = false;
+		this.isRelaying = false;
+		this.#relayStart = null;
 		this.roomError = null;
 		this.isConnecting = true;
 		this.roomId = roomId ?? null;
@@ -95,6 +107,8 @@ export class ConnectionState {
 				url += `?role=host`;
 			}
 			this.#ws = new WebSocket(url);
+			// relayed game frames
+			this.#ws.binaryType = 'arraybuffer';
 			this.#setupEventListeners();
 		} catch (err) {
 			console.error('Failed to create WebSocket', err);
@@ -110,6 +124,9 @@ export class ConnectionState {
 		this.isGuestConnected = false;
 		this.isWebRTCConnected = false;
 		this.isP2PConnecting = false;
+		this.isRelaying = false;
+		this.#relayStart = null;
+		this.#clearWebRTCTimeout();
 
 		if (this.#reconnectTimeout) {
 			clearTimeout(this.#reconnectTimeout);
@@ -141,6 +158,10 @@ export class ConnectionState {
 		};
 
 		this.#ws.onmessage = async (event: MessageEvent) => {
+			if (event.data instanceof ArrayBuffer) {
+				this.#handleRelayFrame(event.data);
+				return;
+			}
 			try {
 				// assert Message type
 				const data = JSON.parse(event.data) as Message;
@@ -164,6 +185,9 @@ export class ConnectionState {
 					case MessageType.WebRTCConnected:
 						console.log('WebRTC connection established');
 						break;
+					case MessageType.RelayStart:
+						this.#handleRelayStart(data);
+						break;
 					case MessageType.RoomMeta:
 						this.roomId = data.roomId;
 						break;
@@ -242,7 +266,12 @@ export class ConnectionState {
 	}
 
 	#onWebRTCConnectionReady() {
+		if (this.isRelaying) {
+			// too late, the room already switched to the relay
+			return;
+		}
 		console.log('WebRTC connection is ready');
+		this.#clearWebRTCTimeout();
 		this.isWebRTCConnected = true;
 
 		// notify server that webrtc is connected
@@ -309,6 +338,7 @@ export class ConnectionState {
 			};
 
 			this.#setupConnectionStateHandlers();
+			this.#startWebRTCTimeout();
 
 			// create and send an offer (this message gets proxied through the ws server)
 			try {
@@ -376,6 +406,7 @@ export class ConnectionState {
 		};
 
 		this.#setupConnectionStateHandlers();
+		this.#startWebRTCTimeout();
 
 		try {
 			await this.#pc.setRemoteDescription(
@@ -495,6 +526,7 @@ export class ConnectionState {
 				case 'failed':
 					console.error('Peer connection failed');
 					this.isWebRTCConnected = false;
+					this.#requestRelay();
 					break;
 				case 'closed':
 					console.log('Peer connection closed');
@@ -509,6 +541,9 @@ export class ConnectionState {
 	}
 
 	sendGameMessage(data: unknown): boolean {
+		if (this.isRelaying) {
+			return this.#sendRelayFrame(data);
+		}
 		if (!this.#dataChannel || this.#dataChannel.readyState !== 'open') {
 			console.warn('Data channel is not open; cant send message');
 			return false;
@@ -523,6 +558,77 @@ export class ConnectionState {
 		}
 	}
 
+	#startWebRTCTimeout() {
+		this.#clearWebRTCTimeout();
+		this.#webrtcTimeout = window.setTimeout(() => {
+			this.#webrtcTimeout = null;
+			if (!this.isWebRTCConnected) {
+				console.warn('WebRTC did not connect in time');
+				this.#requestRelay();
+			}
+		}, WEBRTC_TIMEOUT);
+	}
+
+	#clearWebRTCTimeout() {
+		if (this.#webrtcTimeout) {
+			clearTimeout(this.#webrtcTimeout);
+			this.#webrtcTimeout = null;
+		}
+	}
+
+	// asks the room to relay game frames. The websocket is still open because it only closes
+	// once WebRTC connects
+	#requestRelay() {
+		this.#clearWebRTCTimeout();
+		if (this.isRelaying || !this.#ws || this.#ws.readyState !== WebSocket.OPEN) return;
+		console.log('Falling back to the server relay');
+		const msg: RelayRequestMessage = { type: MessageType.RelayRequest };
+		this.#ws.send(JSON.stringify(msg));
+	}
+
+	#handleRelayStart(data: RelayStartMessage) {
+		if (this.isRelaying) return;
+		this.#clearWebRTCTimeout();
+		this.#relayStart = data;
+		this.isRelaying = true;
+		// the peer connection is of no use anymore
+		if (this.#dataChannel) {
+			this.#dataChannel.onclose = null;
+			this.#dataChannel.close();
+			this.#dataChannel = null;
+		}
+		if (this.#pc) {
+			this.#pc.onconnectionstatechange = null;
+			this.#pc.close();
+			this.#pc = null;
+		}
+		console.log('Game messages are relayed by the server');
+		this.#onWebRTCReadyCallback?.();
+	}
+
+	#handleRelayFrame(frame: ArrayBuffer) {
+		try {
+			const data = JSON.parse(new TextDecoder().decode(frame));
+			this.#onGameMessageCallback?.(data);
+		} catch (err) {
+			console.error('Failed to parse relayed game message', err);
+		}
+	}
+
+	#sendRelayFrame(data: unknown): boolean {
+		if (!this.#ws || this.#ws.readyState !== WebSocket.OPEN) {
+			console.warn('WebSocket is not open; cant relay message');
+			return false;
+		}
+		const frame = new TextEncoder().encode(JSON.stringify(data));
+		if (this.#relayStart && frame.byteLength > this.#relayStart.maxFrameSize) {
+			console.error('Game message is too large to relay');
+			return false;
+		}
+		this.#ws.send(frame);
+		return true;
+	}
+
 	cleanup() {
 		if (this.#dataChannel) {
 			this.#dataChannel.close();
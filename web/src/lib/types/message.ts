@@ -9,6 +9,17 @@ export enum MessageType {
 	Error = 'error',
 	WebRTCConnected = 'webrtc-connected',
 	RoomMeta = 'room-meta',
+	RelayRequest = 'relay-request',
+	RelayStart = 'relay-start',
+	Input = 'input',
+	MatchStart = 'match-start',
+	State = 'state',
+	MatchResult = 'match-result',
+	RoundResult = 'round-result',
+	Rollback = 'rollback',
+	BotRequest = 'bot-request',
+	ResultKey = 'result-key',
+	LogRequest = 'log-request',
 	HostLeft = 'host-left',
 	GuestLeft = 'guest-left',
 	GuestJoined = 'guest-joined',
@@ -36,6 +47,16 @@ export interface EventMessage {
 export interface RoomMetaMessage {
 	type: MessageType.RoomMeta;
 	roomId: string;
+	mode: 'p2p' | 'hosted';
+	arena: string;
+	// generated arenas are created from it, see GET /arenas/generated/{seed}
+	seed: number;
+	game: GameMode;
+	powerUps?: boolean;
+	suddenDeath?: SuddenDeath;
+	// P2P results of ranked rooms are randomly verified from the input logs
+	ranked?: boolean;
+	iceServers?: RTCIceServer[];
 }
 
 // WebRTC Offer message
@@ -75,6 +96,208 @@ export interface WebRTCConnectedMessage {
 	type: MessageType.WebRTCConnected;
 }
 
+// Relay request message (client -> server) after WebRTC failed or timed out
+export interface RelayRequestMessage {
+	type: MessageType.RelayRequest;
+}
+
+// Relay start message, game frames are sent as binary websocket frames from now on
+export interface RelayStartMessage {
+	type: MessageType.RelayStart;
+	maxBytesPerSecond: number;
+	maxFrameSize: number;
+}
+
+export interface GameMode {
+	kind: 'duel' | 'ffa' | 'teams' | 'survival';
+	bestOf: number;
+	friendlyPass?: boolean;
+	// survival only, seconds to survive
+	timeLimit?: number;
+}
+
+export type Direction = 'up' | 'right' | 'down' | 'left';
+export type Turn = 'none' | 'left' | 'right';
+
+export interface Cycle {
+	pos: { x: number; y: number };
+	dir: Direction;
+	alive: boolean;
+	diedAt?: number;
+	// power-ups only
+	energy?: number;
+	jumps?: number;
+	shield?: number;
+	// cells moved into on the tick, ending at pos, when the cycle moved more than one.
+	// They're all trail
+	path?: { x: number; y: number }[];
+}
+
+export type PowerUpKind = 'boost' | 'jump' | 'eraser' | 'shield';
+
+export interface PowerUp {
+	pos: { x: number; y: number };
+	kind: PowerUpKind;
+}
+
+export interface PowerUpSettings {
+	interval: number;
+	max: number;
+	maxEnergy: number;
+	energyRegen: number;
+	shieldTicks: number;
+	eraseRadius: number;
+}
+
+// sudden death settings, all in ticks. Parts are off while their tick is 0
+export interface SuddenDeath {
+	// a ring of walls closes in every shrinkEvery ticks from shrinkAfter on
+	shrinkAfter?: number;
+	shrinkEvery?: number;
+	// cycles move 2 cells per tick from speedAfter on, 1 more every speedEvery ticks. The
+	// cells they pass through come in their cycle's path
+	speedAfter?: number;
+	speedEvery?: number;
+	maxSpeed?: number;
+	// the round is over after maxTicks, decided by tieBreak
+	maxTicks?: number;
+	tieBreak?: 'draw' | 'length';
+}
+
+// a cycle died (cause is set) or picked up a power-up (pickup is set)
+export interface GameEvent {
+	tick: number;
+	player: number;
+	cause?: 'wall' | 'trail' | 'head-on' | 'closed-in';
+	pickup?: PowerUpKind;
+	at: { x: number; y: number };
+	other: number;
+	// trail cells an eraser cleared
+	erased?: { x: number; y: number }[];
+}
+
+// Input message (client -> server) in a server hosted match
+export interface InputMessage {
+	type: MessageType.Input;
+	tick: number;
+	turn: Turn;
+	// power-ups only
+	boost?: boolean;
+	jump?: boolean;
+}
+
+// Match start message of a server hosted match
+export interface MatchStartMessage {
+	type: MessageType.MatchStart;
+	player: number;
+	game: GameMode;
+	round: number;
+	width: number;
+	height: number;
+	walls?: { x: number; y: number }[];
+	wrap?: boolean;
+	teams?: number[];
+	friendlyPass?: boolean;
+	powerUps?: PowerUpSettings;
+	suddenDeath?: SuddenDeath;
+	tickRate: number;
+	rollbackWindow: number;
+	cycles: Cycle[];
+	startsIn: number;
+}
+
+// State delta of a tick of a server hosted match
+export interface StateMessage {
+	type: MessageType.State;
+	tick: number;
+	cycles: Cycle[];
+	powerUps?: PowerUp[];
+	// sudden death rings of walls closed in so far, ring 0 being the outermost cells
+	rings?: number;
+	deaths?: GameEvent[];
+	pickups?: GameEvent[];
+}
+
+// Rollback message after a late input: rewind to `from` and apply the ticks in order
+export interface RollbackMessage {
+	type: MessageType.Rollback;
+	from: number;
+	ticks: {
+		tick: number;
+		cycles: Cycle[];
+		powerUps?: PowerUp[];
+		deaths?: GameEvent[];
+		pickups?: GameEvent[];
+	}[];
+}
+
+// Bot request message (host -> server), a bot joins a hosted room as the guest
+export interface BotRequestMessage {
+	type: MessageType.BotRequest;
+	difficulty?: 'easy' | 'medium' | 'hard';
+}
+
+// Round result message. winner is the winning side: the player, the team in teams,
+// survivors (0) or bots (1) in survival. -1 for a draw
+export interface RoundResultMessage {
+	type: MessageType.RoundResult;
+	round: number;
+	winner: number;
+	tick: number;
+	reason: 'crash' | 'time';
+	scores: number[];
+}
+
+// Match result message, winner is the winning side like in RoundResultMessage
+export interface MatchResultMessage {
+	type: MessageType.MatchResult;
+	winner: number;
+	tick: number;
+	reason: 'crash' | 'time' | 'forfeit';
+	mode: GameMode['kind'];
+	rounds: number;
+	scores: number[];
+}
+
+// Result key message of a P2P room once both members are in. Sign the match-result
+// report with key: hex HMAC-SHA256 of matchId|player|winner|ticks|reason|checksum|scores
+// (scores comma separated)
+export interface ResultKeyMessage {
+	type: MessageType.ResultKey;
+	matchId: string;
+	player: number;
+	key: string;
+	// seconds left to report the outcome
+	reportWithin: number;
+}
+
+// Match report message (client -> server) of a P2P match. Can also be POSTed to /results
+// without the type once the websocket is closed
+export interface MatchReportMessage {
+	type: MessageType.MatchResult;
+	matchId: string;
+	player: number;
+	signature: string;
+	winner: number;
+	ticks: number;
+	reason: 'crash' | 'time' | 'forfeit';
+	scores?: number[];
+	// checksum of the final game state
+	checksum: number;
+}
+
+// Log request message after the match-result reports disagreed or the match was picked for a
+// check. POST { player, signature, log } to /results/{matchId}/logs where log is the lockstep
+// input log and signature the hex HMAC-SHA256 of matchId|player|<log json> with the report key.
+// The log's settings must be the ones the room's arena and game mode set up. Players caught
+// cheating are banned
+export interface LogRequestMessage {
+	type: MessageType.LogRequest;
+	matchId: string;
+	// seconds left to upload
+	within: number;
+}
+
 // Discriminated union of all message types
 export type Message =
 	| EventMessage
@@ -83,4 +306,16 @@ export type Message =
 	| AnswerMessage
 	| ICECandidateMessage
 	| ErrorMessage
-	| WebRTCConnectedMessage;
+	| WebRTCConnectedMessage
+	| RelayRequestMessage
+	| RelayStartMessage
+	| InputMessage
+	| MatchStartMessage
+	| StateMessage
+	| MatchResultMessage
+	| RoundResultMessage
+	| RollbackMessage
+	| BotRequestMessage
+	| ResultKeyMessage
+	| MatchReportMessage
+	| LogRequestMessage;